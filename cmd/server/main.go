@@ -1,16 +1,28 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/nostr-pay/nostr-pay/internal/api"
 	"github.com/nostr-pay/nostr-pay/internal/config"
 	"github.com/nostr-pay/nostr-pay/internal/lnbits"
+	"github.com/nostr-pay/nostr-pay/internal/lnurl"
+	"github.com/nostr-pay/nostr-pay/internal/merchant"
+	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
 	"github.com/nostr-pay/nostr-pay/internal/payment"
+	"github.com/nostr-pay/nostr-pay/internal/rates"
+	"github.com/nostr-pay/nostr-pay/internal/secretbox"
 	"github.com/nostr-pay/nostr-pay/internal/store"
+	"github.com/nostr-pay/nostr-pay/internal/webhook"
 )
 
 func main() {
@@ -37,13 +49,127 @@ func main() {
 	defer db.Close()
 
 	lnbitsClient := lnbits.NewClient(cfg.LNbitsURL, cfg.LNbitsAdminKey, cfg.LNbitsInvoiceKey)
-	paymentSvc := payment.NewService(db, lnbitsClient, "http://localhost"+cfg.ServerAddr)
+	paymentSvc := payment.NewService(db, lnbitsClient, cfg.WebhookBaseURL)
+	paymentSvc.SetFeeLimit(payment.FeeLimit{BaseSats: cfg.PayFeeLimitBaseSats, PPM: cfg.PayFeeLimitPPM})
+	paymentSvc.SetWithdrawalLimits(payment.WithdrawalLimits{
+		ReserveSats: cfg.WithdrawReserveSats,
+		MaxFeeSats:  cfg.WithdrawMaxFeeSats,
+		DailySats:   cfg.WithdrawDailySats,
+	})
+	paymentSvc.SetAddressResolver(lnurl.NewClient(&http.Client{Timeout: 10 * time.Second}))
+	if cfg.PublicBaseURL != "" {
+		paymentSvc.SetLightningAddresses(payment.AddressConfig{
+			BaseURL:      cfg.PublicBaseURL,
+			MinSats:      cfg.LNURLMinSats,
+			MaxSats:      cfg.LNURLMaxSats,
+			CommentChars: int(cfg.LNURLCommentChars),
+		})
+	}
+	if cfg.WalletMode == "merchant" {
+		box, err := secretbox.New(cfg.WalletEncryptionKey)
+		if err != nil {
+			slog.Error("failed to set up wallet encryption", "error", err)
+			os.Exit(1)
+		}
+		paymentSvc.SetWallets(payment.WalletConfig{
+			Users:   lnbitsClient,
+			AdminID: cfg.LNbitsUserID,
+			Keys:    box,
+			Client: func(adminKey, invoiceKey string) payment.LNbitsClient {
+				return lnbitsClient.WithKeys(adminKey, invoiceKey)
+			},
+		})
+	}
+	webhooks := webhook.NewService(db, webhook.NewClient(10*time.Second))
+	paymentSvc.SetStatusListener(webhooks)
+
+	var rateProvider rates.Provider
+	switch cfg.RateProvider {
+	case "static":
+		rateProvider, _ = rates.ParseStatic(cfg.StaticRates) // validated by config.Load
+	case "file":
+		rateProvider = rates.NewFileProvider(cfg.RatesFile)
+	}
+	if rateProvider != nil {
+		paymentSvc.SetRateProvider(rates.NewCachedProvider(rateProvider, cfg.RateCacheTTL, cfg.RateMaxAge))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// "nostr-pay reconcile" settles missed payments once and exits
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		n, err := paymentSvc.Reconcile(ctx, true)
+		if err != nil {
+			slog.Error("reconciliation failed", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("reconciliation finished", "settled", n)
+		return
+	}
+
+	var replayCache nostrauth.ReplayCache = nostrauth.NewMemoryReplayCache()
+	if cfg.ReplayCache == "store" {
+		replayCache = db
+	}
 
-	srv := api.NewServer(db, paymentSvc)
+	sessions := nostrauth.NewSessionManager(db, cfg.SessionTTL)
+	apiKeys := nostrauth.NewAPIKeyManager(db)
+
+	auth, err := nostrauth.NewAuthenticator(nostrauth.Options{
+		PublicBaseURL:  cfg.PublicBaseURL,
+		TrustedProxies: cfg.TrustedProxies,
+		RequirePayload: cfg.RequirePayload,
+		ReplayCache:    replayCache,
+		Sessions:       sessions,
+		APIKeys:        apiKeys,
+		Users:          db,
+		Operators:      cfg.OperatorPubkeys,
+		Access:         nostrauth.AccessMode(cfg.AccessMode),
+		Allowed:        cfg.AllowedPubkeys,
+		Denylist:       db,
+	})
+	if err != nil {
+		slog.Error("failed to configure auth", "error", err)
+		os.Exit(1)
+	}
+
+	srv := api.NewServer(db, paymentSvc, auth, sessions, apiKeys, merchant.NewService(db), webhooks)
+
+	var workers sync.WaitGroup
+	workers.Go(func() {
+		paymentSvc.RunExpirySweeper(ctx, cfg.ExpirySweepInterval)
+	})
+	workers.Go(func() {
+		paymentSvc.RunReconciler(ctx, cfg.ReconcileInterval)
+	})
+	workers.Go(func() {
+		paymentSvc.RunSplitWorker(ctx, cfg.SplitPayoutInterval)
+	})
+	workers.Go(func() {
+		webhooks.RunWorker(ctx, cfg.WebhookRetryInterval)
+	})
+
+	httpServer := &http.Server{
+		Addr:    cfg.ServerAddr,
+		Handler: srv.Routes(),
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			slog.Error("shutdown error", "error", err)
+		}
+	}()
 
 	slog.Info("starting server", "addr", cfg.ServerAddr)
-	if err := http.ListenAndServe(cfg.ServerAddr, srv.Routes()); err != nil {
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		slog.Error("server error", "error", err)
 		os.Exit(1)
 	}
+
+	stop()
+	workers.Wait()
+	slog.Info("server stopped")
 }
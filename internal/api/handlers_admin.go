@@ -0,0 +1,214 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
+	"github.com/nostr-pay/nostr-pay/internal/payment"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+type setMerchantRequest struct {
+	IsMerchant bool `json:"is_merchant"`
+}
+
+type userResponse struct {
+	Pubkey     string `json:"pubkey"`
+	Npub       string `json:"npub,omitempty"`
+	IsMerchant bool   `json:"is_merchant"`
+	// WalletID is the merchant's own LNbits wallet, when wallets are
+	// provisioned per merchant.
+	WalletID string `json:"wallet_id,omitempty"`
+}
+
+// handleSetMerchant grants or revokes the merchant flag. Unknown pubkeys are
+// provisioned so operators can onboard merchants before their first login.
+// Granting the flag also creates the merchant's LNbits wallet when wallets
+// are per merchant; if that fails the flag is still set, and repeating the
+// request retries it.
+func (s *Server) handleSetMerchant(w http.ResponseWriter, r *http.Request) {
+	pubkey, err := nostrauth.ParsePubkey(r.PathValue("pubkey"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req setMerchantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	_, err = s.store.GetUser(r.Context(), pubkey)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		err = s.store.CreateUser(r.Context(), &store.User{Pubkey: pubkey, IsMerchant: req.IsMerchant})
+	case err == nil:
+		err = s.store.UpdateUserMerchant(r.Context(), pubkey, req.IsMerchant)
+	}
+	if err != nil {
+		slog.Error("failed to update merchant flag", "pubkey", pubkey, "error", err)
+		http.Error(w, "failed to update user", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("merchant flag changed",
+		"pubkey", pubkey,
+		"is_merchant", req.IsMerchant,
+		"operator", nostrauth.PubkeyFromContext(r.Context()),
+	)
+
+	resp := userResponse{
+		Pubkey:     pubkey,
+		IsMerchant: req.IsMerchant,
+	}
+	if req.IsMerchant {
+		u, err := s.paymentSvc.ProvisionWallet(r.Context(), pubkey)
+		switch {
+		case errors.Is(err, payment.ErrWalletsDisabled):
+		case errors.Is(err, payment.ErrSharedBalance):
+			http.Error(w, "merchant flag set, but the merchant still has a balance or payments in flight in the shared wallet; withdraw it and retry the request", http.StatusConflict)
+			return
+		case err != nil:
+			slog.Error("failed to provision merchant wallet", "pubkey", pubkey, "error", err)
+			http.Error(w, "merchant flag set, but creating the merchant's wallet failed; retry the request", http.StatusBadGateway)
+			return
+		default:
+			resp.WalletID = u.LNbitsWalletID
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if wantNpub(r) {
+		resp.Npub = nostrauth.EncodeNpub(pubkey)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleInviteUser creates a user record so the pubkey is admitted in invite
+// access mode. Existing users are left unchanged.
+func (s *Server) handleInviteUser(w http.ResponseWriter, r *http.Request) {
+	pubkey, err := nostrauth.ParsePubkey(r.PathValue("pubkey"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.store.GetUser(r.Context(), pubkey)
+	if errors.Is(err, sql.ErrNoRows) {
+		user = &store.User{Pubkey: pubkey}
+		err = s.store.CreateUser(r.Context(), user)
+	}
+	if err != nil {
+		slog.Error("failed to invite user", "pubkey", pubkey, "error", err)
+		http.Error(w, "failed to invite user", http.StatusInternalServerError)
+		return
+	}
+
+	resp := userResponse{
+		Pubkey:     pubkey,
+		IsMerchant: user.IsMerchant,
+	}
+	if wantNpub(r) {
+		resp.Npub = nostrauth.EncodeNpub(pubkey)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+type denyPubkeyRequest struct {
+	Reason string `json:"reason"`
+}
+
+type deniedPubkeyResponse struct {
+	Pubkey    string    `json:"pubkey"`
+	Npub      string    `json:"npub,omitempty"`
+	Reason    string    `json:"reason"`
+	DeniedBy  string    `json:"denied_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s *Server) handleListDenied(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.store.ListDeniedPubkeys(r.Context())
+	if err != nil {
+		http.Error(w, "failed to list denylist", http.StatusInternalServerError)
+		return
+	}
+
+	npub := wantNpub(r)
+	resp := make([]deniedPubkeyResponse, 0, len(entries))
+	for _, e := range entries {
+		d := deniedPubkeyResponse{
+			Pubkey:    e.Pubkey,
+			Reason:    e.Reason,
+			DeniedBy:  e.DeniedBy,
+			CreatedAt: e.CreatedAt,
+		}
+		if npub {
+			d.Npub = nostrauth.EncodeNpub(e.Pubkey)
+		}
+		resp = append(resp, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleDenyPubkey blocks a pubkey from authenticating. It takes effect on
+// the next request without a restart.
+func (s *Server) handleDenyPubkey(w http.ResponseWriter, r *http.Request) {
+	pubkey, err := nostrauth.ParsePubkey(r.PathValue("pubkey"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req denyPubkeyRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	operator := nostrauth.PubkeyFromContext(r.Context())
+	err = s.store.DenyPubkey(r.Context(), &store.DeniedPubkey{
+		Pubkey:   pubkey,
+		Reason:   req.Reason,
+		DeniedBy: operator,
+	})
+	if err != nil {
+		slog.Error("failed to deny pubkey", "pubkey", pubkey, "error", err)
+		http.Error(w, "failed to update denylist", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("pubkey denied", "pubkey", pubkey, "reason", req.Reason, "operator", operator)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleAllowPubkey(w http.ResponseWriter, r *http.Request) {
+	pubkey, err := nostrauth.ParsePubkey(r.PathValue("pubkey"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.store.AllowPubkey(r.Context(), pubkey)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "pubkey not on denylist", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to update denylist", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("pubkey removed from denylist", "pubkey", pubkey, "operator", nostrauth.PubkeyFromContext(r.Context()))
+	w.WriteHeader(http.StatusNoContent)
+}
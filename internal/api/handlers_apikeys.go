@@ -0,0 +1,110 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+type createAPIKeyRequest struct {
+	Label     string     `json:"label"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type apiKeyResponse struct {
+	ID        string     `json:"id"`
+	Key       string     `json:"key,omitempty"`
+	Label     string     `json:"label"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func newAPIKeyResponse(k *store.APIKey) apiKeyResponse {
+	return apiKeyResponse{
+		ID:        k.ID,
+		Label:     k.Label,
+		Scopes:    k.Scopes,
+		CreatedAt: k.CreatedAt,
+		ExpiresAt: k.ExpiresAt,
+	}
+}
+
+func (s *Server) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	var req createAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	scopes, err := nostrauth.ParseScopes(req.Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Label) > 100 {
+		http.Error(w, "label too long", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		http.Error(w, "expires_at must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	key, apiKey, err := s.apiKeys.Create(r.Context(), pubkey, req.Label, scopes, req.ExpiresAt)
+	if err != nil {
+		slog.Error("failed to create api key", "error", err)
+		http.Error(w, "failed to create api key", http.StatusInternalServerError)
+		return
+	}
+
+	resp := newAPIKeyResponse(apiKey)
+	resp.Key = key
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	keys, err := s.store.ListAPIKeys(r.Context(), pubkey)
+	if err != nil {
+		http.Error(w, "failed to list api keys", http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]apiKeyResponse, 0, len(keys))
+	for _, k := range keys {
+		resp = append(resp, newAPIKeyResponse(k))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	err := s.store.RevokeAPIKey(r.Context(), r.PathValue("id"), pubkey)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "api key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to revoke api key", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	gonostr "github.com/nbd-wtf/go-nostr"
+	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
+)
+
+type challengeResponse struct {
+	Challenge string    `json:"challenge"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (s *Server) handleAuthChallenge(w http.ResponseWriter, r *http.Request) {
+	challenge, expiresAt, err := s.sessions.NewChallenge(r.Context())
+	if err != nil {
+		slog.Error("failed to create challenge", "error", err)
+		http.Error(w, "failed to create challenge", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(challengeResponse{
+		Challenge: challenge,
+		ExpiresAt: expiresAt,
+	})
+}
+
+type loginRequest struct {
+	Event gonostr.Event `json:"event"`
+}
+
+type loginResponse struct {
+	Token     string    `json:"token"`
+	SessionID string    `json:"session_id"`
+	Pubkey    string    `json:"pubkey"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Refuse before a session is minted; the signature is checked by Login.
+	if err := s.auth.CheckAccess(r.Context(), req.Event.PubKey); err != nil {
+		if errors.Is(err, nostrauth.ErrAccessDenied) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		slog.Error("access policy error", "error", err)
+		http.Error(w, "failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	token, sess, err := s.sessions.Login(r.Context(), &req.Event)
+	switch {
+	case errors.Is(err, nostrauth.ErrInvalidKind),
+		errors.Is(err, nostrauth.ErrInvalidEvent),
+		errors.Is(err, nostrauth.ErrInvalidSig),
+		errors.Is(err, nostrauth.ErrEventTooOld),
+		errors.Is(err, nostrauth.ErrInvalidChallenge):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case err != nil:
+		slog.Error("failed to create session", "error", err)
+		http.Error(w, "failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(loginResponse{
+		Token:     token,
+		SessionID: sess.ID,
+		Pubkey:    sess.Pubkey,
+		ExpiresAt: sess.ExpiresAt,
+	})
+}
+
+type sessionResponse struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	sessions, err := s.store.ListSessions(r.Context(), pubkey)
+	if err != nil {
+		http.Error(w, "failed to list sessions", http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]sessionResponse, 0, len(sessions))
+	for _, sess := range sessions {
+		if time.Now().After(sess.ExpiresAt) {
+			continue
+		}
+		resp = append(resp, sessionResponse{
+			ID:        sess.ID,
+			CreatedAt: sess.CreatedAt,
+			ExpiresAt: sess.ExpiresAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	err := s.store.RevokeSession(r.Context(), r.PathValue("id"), pubkey)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
+	"github.com/nostr-pay/nostr-pay/internal/payment"
+)
+
+type lightningAddressResponse struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Address     string    `json:"address"`
+	LNURL       string    `json:"lnurl"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func newLightningAddressResponse(a *payment.LightningAddress) lightningAddressResponse {
+	return lightningAddressResponse{
+		Name:        a.Name,
+		Description: a.Description,
+		Address:     a.Address,
+		LNURL:       a.LNURL,
+		CreatedAt:   a.CreatedAt,
+	}
+}
+
+type claimAddressRequest struct {
+	Description string `json:"description"`
+}
+
+func (s *Server) handleClaimAddress(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	var req claimAddressRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	a, err := s.paymentSvc.ClaimAddress(r.Context(), pubkey, r.PathValue("name"), req.Description)
+	switch {
+	case errors.Is(err, payment.ErrAddressesDisabled):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, payment.ErrInvalidAddressName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, payment.ErrAddressTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to claim lightning address", "pubkey", pubkey, "error", err)
+		http.Error(w, "failed to claim lightning address", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newLightningAddressResponse(a))
+}
+
+func (s *Server) handleListAddresses(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	addresses, err := s.paymentSvc.ListAddresses(r.Context(), pubkey)
+	if errors.Is(err, payment.ErrAddressesDisabled) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to list lightning addresses", http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]lightningAddressResponse, 0, len(addresses))
+	for _, a := range addresses {
+		resp = append(resp, newLightningAddressResponse(a))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) handleReleaseAddress(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	err := s.paymentSvc.ReleaseAddress(r.Context(), pubkey, r.PathValue("name"))
+	if errors.Is(err, payment.ErrAddressNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to release lightning address", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleLNURLPay serves the LNURL-pay offer of a Lightning address
+// (LUD-06, LUD-16).
+func (s *Server) handleLNURLPay(w http.ResponseWriter, r *http.Request) {
+	offer, err := s.paymentSvc.PayOffer(r.Context(), r.PathValue("name"))
+	if err != nil {
+		writeLNURLError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(offer)
+}
+
+// handleLNURLCallback returns an invoice for the amount, in msat, a payer's
+// wallet asks for, with their comment (LUD-12).
+func (s *Server) handleLNURLCallback(w http.ResponseWriter, r *http.Request) {
+	amount, err := strconv.ParseInt(r.URL.Query().Get("amount"), 10, 64)
+	if err != nil {
+		writeLNURLError(w, r, payment.ErrAddressAmount)
+		return
+	}
+
+	result, err := s.paymentSvc.PayAddress(r.Context(), r.PathValue("name"), amount, r.URL.Query().Get("comment"))
+	if err != nil {
+		writeLNURLError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"pr":     result.Bolt11,
+		"routes": []any{},
+	})
+}
+
+// writeLNURLError reports failures the way LNURL wallets expect them, as
+// a JSON status and reason.
+func writeLNURLError(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusBadRequest
+	reason := err.Error()
+	switch {
+	case errors.Is(err, payment.ErrAddressesDisabled), errors.Is(err, payment.ErrAddressNotFound):
+		code = http.StatusNotFound
+		reason = payment.ErrAddressNotFound.Error()
+	case errors.Is(err, payment.ErrAddressAmount), errors.Is(err, payment.ErrAddressComment):
+	default:
+		slog.Error("lnurl request failed", "path", r.URL.Path, "error", err)
+		code = http.StatusInternalServerError
+		reason = "failed to create invoice"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "ERROR",
+		"reason": reason,
+	})
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/merchant"
+	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
+)
+
+type merchantStatsResponse struct {
+	Date string `json:"date"`
+	// TotalSats is net of refunds paid out that day.
+	TotalSats        int64 `json:"total_sats"`
+	TransactionCount int   `json:"transaction_count"`
+	GrossSats        int64 `json:"gross_sats"`
+	RefundedSats     int64 `json:"refunded_sats"`
+	RefundCount      int   `json:"refund_count"`
+	TipSats          int64 `json:"tip_sats"`
+}
+
+func (s *Server) handleMerchantStats(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	date := r.URL.Query().Get("date")
+	if date == "" {
+		date = time.Now().UTC().Format(time.DateOnly)
+	} else if _, err := time.Parse(time.DateOnly, date); err != nil {
+		http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	stats, err := s.paymentSvc.GetMerchantDailyStats(r.Context(), pubkey, date)
+	if err != nil {
+		http.Error(w, "failed to load stats", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(merchantStatsResponse{
+		Date:             stats.Date,
+		TotalSats:        stats.TotalSats,
+		TransactionCount: stats.TransactionCount,
+		GrossSats:        stats.GrossSats,
+		RefundedSats:     stats.RefundedSats,
+		RefundCount:      stats.RefundCount,
+		TipSats:          stats.TipSats,
+	})
+}
+
+type tipSummaryResponse struct {
+	Date         string `json:"date"`
+	StaffPubkey  string `json:"staff_pubkey"`
+	StaffNpub    string `json:"staff_npub,omitempty"`
+	PaymentCount int    `json:"payment_count"`
+	SubtotalSats int64  `json:"subtotal_sats"`
+	TipSats      int64  `json:"tip_sats"`
+}
+
+// staffTransactionResponse is a sale as staff members see it: without the
+// preimage, invoice and payer, which are the merchant's.
+type staffTransactionResponse struct {
+	ID         string     `json:"id"`
+	AmountSats int64      `json:"amount_sats"`
+	TipSats    int64      `json:"tip_sats"`
+	Memo       string     `json:"memo"`
+	Status     string     `json:"status"`
+	SettledAt  *time.Time `json:"settled_at"`
+	// StaffPubkey is who took the payment; empty for the merchant.
+	StaffPubkey string `json:"staff_pubkey,omitempty"`
+	StaffNpub   string `json:"staff_npub,omitempty"`
+}
+
+// maxTipReportDays bounds the range of a tip report.
+const maxTipReportDays = 366
+
+// handleMerchantTips reports settled sales and tips per UTC day and staff
+// member between ?from and ?to (inclusive, default today), so tips can be
+// paid out. With ?format=csv it is served as a download.
+func (s *Server) handleMerchantTips(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+	q := r.URL.Query()
+
+	today := time.Now().UTC().Format(time.DateOnly)
+	from, to := q.Get("from"), q.Get("to")
+	if from == "" {
+		from = today
+	}
+	if to == "" {
+		to = today
+	}
+	fromDay, err1 := time.Parse(time.DateOnly, from)
+	toDay, err2 := time.Parse(time.DateOnly, to)
+	if err1 != nil || err2 != nil {
+		http.Error(w, "from and to must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if toDay.Before(fromDay) || toDay.Sub(fromDay) >= maxTipReportDays*24*time.Hour {
+		http.Error(w, "to must be on or after from and at most a year later", http.StatusBadRequest)
+		return
+	}
+
+	summaries, err := s.paymentSvc.ListTipSummaries(r.Context(), pubkey, from, to)
+	if err != nil {
+		http.Error(w, "failed to load tips", http.StatusInternalServerError)
+		return
+	}
+
+	npub := wantNpub(r)
+	resp := make([]tipSummaryResponse, 0, len(summaries))
+	for _, t := range summaries {
+		row := tipSummaryResponse{
+			Date:         t.Date,
+			StaffPubkey:  t.StaffPubkey,
+			PaymentCount: t.PaymentCount,
+			SubtotalSats: t.SubtotalSats,
+			TipSats:      t.TipSats,
+		}
+		if npub {
+			row.StaffNpub = nostrauth.EncodeNpub(t.StaffPubkey)
+		}
+		resp = append(resp, row)
+	}
+
+	if q.Get("format") == "csv" {
+		writeTipsCSV(w, from, to, resp)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func writeTipsCSV(w http.ResponseWriter, from, to string, rows []tipSummaryResponse) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="tips-%s-%s.csv"`, from, to))
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"date", "staff_pubkey", "staff_npub", "payment_count", "subtotal_sats", "tip_sats"})
+	for _, t := range rows {
+		cw.Write([]string{
+			t.Date, t.StaffPubkey, t.StaffNpub,
+			strconv.Itoa(t.PaymentCount),
+			strconv.FormatInt(t.SubtotalSats, 10),
+			strconv.FormatInt(t.TipSats, 10),
+		})
+	}
+	cw.Flush()
+}
+
+// handleMerchantTransactions lists the caller's settled payments and
+// refunds. With
+// ?merchant=<pubkey>, staff holding the transactions:today permission see
+// that merchant's payments of the current UTC day.
+func (s *Server) handleMerchantTransactions(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	if q := r.URL.Query().Get("merchant"); q != "" {
+		m, err := nostrauth.ParsePubkey(q)
+		if err != nil {
+			http.Error(w, "merchant: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if m != pubkey {
+			s.handleStaffTransactions(w, r, m)
+			return
+		}
+	}
+
+	if !nostrauth.RoleFromContext(r.Context()).Includes(nostrauth.RoleMerchant) {
+		http.Error(w, "merchant role required", http.StatusForbidden)
+		return
+	}
+
+	payments, err := s.paymentSvc.ListMerchantTransactions(r.Context(), pubkey, 50, 0)
+	if err != nil {
+		http.Error(w, "failed to list transactions", http.StatusInternalServerError)
+		return
+	}
+
+	writePayments(w, r, payments)
+}
+
+func (s *Server) handleStaffTransactions(w http.ResponseWriter, r *http.Request, merchantPubkey string) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	err := s.merchants.Authorize(r.Context(), pubkey, merchantPubkey, merchant.PermViewToday)
+	if errors.Is(err, merchant.ErrNotAuthorized) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to list transactions", http.StatusInternalServerError)
+		return
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	payments, err := s.paymentSvc.ListMerchantSalesSince(r.Context(), merchantPubkey, today, 200)
+	if err != nil {
+		http.Error(w, "failed to list transactions", http.StatusInternalServerError)
+		return
+	}
+
+	npub := wantNpub(r)
+	resp := make([]staffTransactionResponse, 0, len(payments))
+	for _, p := range payments {
+		t := staffTransactionResponse{
+			ID:          p.ID,
+			AmountSats:  p.AmountSats,
+			TipSats:     p.TipSats,
+			Memo:        p.Memo,
+			Status:      p.Status,
+			SettledAt:   p.SettledAt,
+			StaffPubkey: p.CreatedByPubkey,
+		}
+		if npub && p.CreatedByPubkey != "" {
+			t.StaffNpub = nostrauth.EncodeNpub(p.CreatedByPubkey)
+		}
+		resp = append(resp, t)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
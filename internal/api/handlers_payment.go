@@ -2,24 +2,60 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/nostr-pay/nostr-pay/internal/bolt11"
+	"github.com/nostr-pay/nostr-pay/internal/lnurl"
+	"github.com/nostr-pay/nostr-pay/internal/merchant"
 	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
 	"github.com/nostr-pay/nostr-pay/internal/payment"
+	"github.com/nostr-pay/nostr-pay/internal/rates"
+	"github.com/nostr-pay/nostr-pay/internal/store"
 )
 
 type createInvoiceRequest struct {
 	AmountSats int64  `json:"amount_sats"`
 	Memo       string `json:"memo"`
+	// MerchantPubkey lets staff create an invoice credited to the merchant
+	// they work for. Defaults to the caller.
+	MerchantPubkey string `json:"merchant_pubkey"`
+	// ExpirySeconds is how long the invoice can be paid. Defaults to
+	// payment.DefaultInvoiceExpiry.
+	ExpirySeconds int64 `json:"expiry_seconds"`
+	// FiatAmount (in minor units, e.g. cents) and Currency price the
+	// invoice in fiat instead of AmountSats.
+	FiatAmount int64  `json:"fiat_amount"`
+	Currency   string `json:"currency"`
+	// TipSats or TipPercent add a tip on top of the amount; the invoice is
+	// for the total.
+	TipSats    int64   `json:"tip_sats"`
+	TipPercent float64 `json:"tip_percent"`
 }
 
 type createInvoiceResponse struct {
-	PaymentID   string `json:"payment_id"`
-	Bolt11      string `json:"bolt11"`
-	PaymentHash string `json:"payment_hash"`
+	PaymentID    string    `json:"payment_id"`
+	Bolt11       string    `json:"bolt11"`
+	PaymentHash  string    `json:"payment_hash"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	AmountSats   int64     `json:"amount_sats"`
+	SubtotalSats int64     `json:"subtotal_sats"`
+	TipSats      int64     `json:"tip_sats"`
+	FiatAmount   int64     `json:"fiat_amount,omitempty"`
+	Currency     string    `json:"currency,omitempty"`
+	ExchangeRate float64   `json:"exchange_rate,omitempty"`
 }
 
+// Bounds for a client-requested invoice expiry.
+const (
+	minInvoiceExpiry = time.Minute
+	maxInvoiceExpiry = 24 * time.Hour
+)
+
 func (s *Server) handleCreateInvoice(w http.ResponseWriter, r *http.Request) {
 	pubkey := nostrauth.PubkeyFromContext(r.Context())
 
@@ -29,16 +65,78 @@ func (s *Server) handleCreateInvoice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.AmountSats <= 0 {
+	if req.Currency != "" {
+		if req.AmountSats != 0 {
+			http.Error(w, "give either amount_sats or fiat_amount and currency", http.StatusBadRequest)
+			return
+		}
+		if req.FiatAmount <= 0 {
+			http.Error(w, "fiat_amount must be positive", http.StatusBadRequest)
+			return
+		}
+	} else if req.AmountSats <= 0 {
 		http.Error(w, "amount must be positive", http.StatusBadRequest)
 		return
 	}
+	expiry := time.Duration(req.ExpirySeconds) * time.Second
+	if req.ExpirySeconds != 0 && (expiry < minInvoiceExpiry || expiry > maxInvoiceExpiry) {
+		http.Error(w, "expiry_seconds must be between 60 and 86400", http.StatusBadRequest)
+		return
+	}
+
+	receiver, createdBy := pubkey, ""
+	if req.MerchantPubkey != "" {
+		m, err := nostrauth.ParsePubkey(req.MerchantPubkey)
+		if err != nil {
+			http.Error(w, "merchant_pubkey: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		receiver = m
+	}
+	if receiver != pubkey {
+		err := s.merchants.Authorize(r.Context(), pubkey, receiver, merchant.PermCreateInvoice)
+		if errors.Is(err, merchant.ErrNotAuthorized) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to authorize staff", "error", err)
+			http.Error(w, "failed to create invoice", http.StatusInternalServerError)
+			return
+		}
+		createdBy = pubkey
+	} else if !nostrauth.RoleFromContext(r.Context()).Includes(nostrauth.RoleMerchant) {
+		http.Error(w, "merchant role required", http.StatusForbidden)
+		return
+	}
 
 	result, err := s.paymentSvc.CreateInvoice(r.Context(), &payment.CreateInvoiceInput{
-		ReceiverPubkey: pubkey,
-		AmountSats:     req.AmountSats,
-		Memo:           req.Memo,
+		ReceiverPubkey:  receiver,
+		AmountSats:      req.AmountSats,
+		Memo:            req.Memo,
+		CreatedByPubkey: createdBy,
+		Expiry:          expiry,
+		FiatAmount:      req.FiatAmount,
+		FiatCurrency:    req.Currency,
+		TipSats:         req.TipSats,
+		TipPercent:      req.TipPercent,
 	})
+	switch {
+	case errors.Is(err, payment.ErrInvalidTip),
+		errors.Is(err, payment.ErrFiatUnavailable),
+		errors.Is(err, rates.ErrUnknownCurrency),
+		errors.Is(err, rates.ErrInvalidAmount):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, payment.ErrRateUnavailable):
+		slog.Warn("exchange rate unavailable", "currency", req.Currency, "error", err)
+		http.Error(w, payment.ErrRateUnavailable.Error(), http.StatusServiceUnavailable)
+		return
+	case errors.Is(err, payment.ErrUnexpectedInvoice):
+		slog.Error("lnbits returned a bad invoice", "error", err)
+		http.Error(w, payment.ErrUnexpectedInvoice.Error(), http.StatusBadGateway)
+		return
+	}
 	if err != nil {
 		slog.Error("failed to create invoice", "error", err)
 		http.Error(w, "failed to create invoice", http.StatusInternalServerError)
@@ -48,10 +146,227 @@ func (s *Server) handleCreateInvoice(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(createInvoiceResponse{
+		PaymentID:    result.PaymentID,
+		Bolt11:       result.Bolt11,
+		PaymentHash:  result.PaymentHash,
+		ExpiresAt:    result.ExpiresAt,
+		AmountSats:   result.AmountSats,
+		SubtotalSats: result.SubtotalSats,
+		TipSats:      result.TipSats,
+		FiatAmount:   result.FiatAmount,
+		Currency:     result.FiatCurrency,
+		ExchangeRate: result.ExchangeRate,
+	})
+}
+
+type payInvoiceRequest struct {
+	Bolt11 string `json:"bolt11"`
+	// AmountSats is the amount the client expects to pay; the invoice is
+	// refused if it asks for anything else.
+	AmountSats int64 `json:"amount_sats"`
+}
+
+type payInvoiceResponse struct {
+	PaymentID   string `json:"payment_id"`
+	PaymentHash string `json:"payment_hash"`
+	Status      string `json:"status"`
+	AmountSats  int64  `json:"amount_sats"`
+	FeeSats     int64  `json:"fee_sats"`
+	Preimage    string `json:"preimage,omitempty"`
+}
+
+func (s *Server) handlePayInvoice(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	var req payInvoiceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Bolt11 == "" {
+		http.Error(w, "bolt11 is required", http.StatusBadRequest)
+		return
+	}
+	if req.AmountSats < 0 {
+		http.Error(w, "amount must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.paymentSvc.PayInvoice(r.Context(), &payment.PayInvoiceInput{
+		PayerPubkey: pubkey,
+		Bolt11:      req.Bolt11,
+		AmountSats:  req.AmountSats,
+	})
+	if err != nil {
+		s.writePayError(w, pubkey, result, err)
+		return
+	}
+
+	writePayResult(w, result)
+}
+
+// writePayError maps the errors of paying an invoice to responses. A
+// result alongside the error means the payment was recorded, so the
+// response is kept for retries with the same Idempotency-Key rather than
+// paying again.
+func (s *Server) writePayError(w http.ResponseWriter, pubkey string, result *payment.PayInvoiceResult, err error) {
+	if result != nil {
+		keepIdempotentResponse(w)
+	}
+	switch {
+	case errors.Is(err, payment.ErrInvalidInvoice),
+		errors.Is(err, payment.ErrAmountlessInvoice),
+		errors.Is(err, payment.ErrAmountMismatch),
+		errors.Is(err, payment.ErrInvoiceExpired):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, payment.ErrDuplicateInvoice),
+		errors.Is(err, payment.ErrWithdrawalLimit),
+		errors.Is(err, payment.ErrFeeLimit):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, payment.ErrInsufficientBalance):
+		http.Error(w, err.Error(), http.StatusPaymentRequired)
+	case errors.Is(err, payment.ErrPaymentFailed):
+		slog.Warn("outgoing payment failed", "pubkey", pubkey, "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		slog.Error("failed to pay invoice", "error", err)
+		http.Error(w, "failed to pay invoice", http.StatusInternalServerError)
+	}
+}
+
+// writePayResult reports a payment still in flight as accepted; its final
+// status shows up in the history.
+func writePayResult(w http.ResponseWriter, result *payment.PayInvoiceResult) {
+	code := http.StatusOK
+	if result.Status != "paid" {
+		code = http.StatusAccepted
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(payInvoiceResponse{
 		PaymentID:   result.PaymentID,
-		Bolt11:      result.Bolt11,
 		PaymentHash: result.PaymentHash,
+		Status:      result.Status,
+		AmountSats:  result.AmountSats,
+		FeeSats:     result.FeeSats,
+		Preimage:    result.Preimage,
+	})
+}
+
+type refundRequest struct {
+	// AmountSats defaults to the amount left to refund.
+	AmountSats       int64  `json:"amount_sats"`
+	Bolt11           string `json:"bolt11"`
+	LightningAddress string `json:"lightning_address"`
+}
+
+func (s *Server) handleRefund(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	var req refundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.AmountSats < 0 {
+		http.Error(w, "amount must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.paymentSvc.Refund(r.Context(), &payment.RefundInput{
+		MerchantPubkey:   pubkey,
+		PaymentID:        r.PathValue("id"),
+		AmountSats:       req.AmountSats,
+		Bolt11:           req.Bolt11,
+		LightningAddress: req.LightningAddress,
 	})
+	switch {
+	case errors.Is(err, payment.ErrPaymentNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, payment.ErrNotRefundable),
+		errors.Is(err, payment.ErrRefundExceedsPayment):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, payment.ErrRefundDestination),
+		errors.Is(err, lnurl.ErrInvalidAddress),
+		errors.Is(err, lnurl.ErrAmountOutOfRange):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, payment.ErrAddressUnavailable):
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if err != nil {
+		s.writePayError(w, pubkey, result, err)
+		return
+	}
+
+	writePayResult(w, result)
+}
+
+type hopHintResponse struct {
+	NodeID                    string `json:"node_id"`
+	ShortChannelID            string `json:"short_channel_id"`
+	FeeBaseMsat               uint32 `json:"fee_base_msat"`
+	FeeProportionalMillionths uint32 `json:"fee_proportional_millionths"`
+	CLTVExpiryDelta           uint16 `json:"cltv_expiry_delta"`
+}
+
+type decodeResponse struct {
+	Network            string              `json:"network"`
+	AmountMsat         int64               `json:"amount_msat"`
+	PaymentHash        string              `json:"payment_hash"`
+	PaymentSecret      string              `json:"payment_secret,omitempty"`
+	Description        string              `json:"description,omitempty"`
+	DescriptionHash    string              `json:"description_hash,omitempty"`
+	Timestamp          time.Time           `json:"timestamp"`
+	ExpiresAt          time.Time           `json:"expires_at"`
+	Expired            bool                `json:"expired"`
+	MinFinalCLTVExpiry int64               `json:"min_final_cltv_expiry"`
+	Payee              string              `json:"payee"`
+	RouteHints         [][]hopHintResponse `json:"route_hints"`
+}
+
+// handleDecode decodes and verifies a bolt11 invoice without paying it.
+func (s *Server) handleDecode(w http.ResponseWriter, r *http.Request) {
+	inv, err := bolt11.Decode(r.URL.Query().Get("bolt11"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := decodeResponse{
+		Network:            inv.Network,
+		AmountMsat:         inv.AmountMsat,
+		PaymentHash:        inv.PaymentHash,
+		PaymentSecret:      inv.PaymentSecret,
+		Description:        inv.Description,
+		DescriptionHash:    inv.DescriptionHash,
+		Timestamp:          inv.Timestamp,
+		ExpiresAt:          inv.ExpiresAt(),
+		Expired:            inv.Expired(time.Now()),
+		MinFinalCLTVExpiry: inv.MinFinalCLTVExpiry,
+		Payee:              inv.Payee,
+		RouteHints:         [][]hopHintResponse{},
+	}
+	for _, route := range inv.RouteHints {
+		hops := make([]hopHintResponse, len(route))
+		for i, h := range route {
+			// Short channel ids read as block x transaction x output
+			hops[i] = hopHintResponse{
+				NodeID:                    h.NodeID,
+				ShortChannelID:            fmt.Sprintf("%dx%dx%d", h.ShortChannelID>>40, h.ShortChannelID>>16&0xffffff, h.ShortChannelID&0xffff),
+				FeeBaseMsat:               h.FeeBaseMsat,
+				FeeProportionalMillionths: h.FeeProportionalMillionths,
+				CLTVExpiryDelta:           h.CLTVExpiryDelta,
+			}
+		}
+		resp.RouteHints = append(resp.RouteHints, hops)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
 
 func (s *Server) handleGetPayment(w http.ResponseWriter, r *http.Request) {
@@ -62,13 +377,36 @@ func (s *Server) handleGetPayment(w http.ResponseWriter, r *http.Request) {
 	}
 
 	p, err := s.paymentSvc.GetPayment(r.Context(), id)
-	if err != nil {
+	if err != nil || !canViewPayment(r, p) {
+		// Same response for foreign payments so IDs cannot be probed
+		http.Error(w, "payment not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newPaymentResponse(p, wantNpub(r)))
+}
+
+// handlePaymentEvents returns the status history of a payment, oldest
+// first.
+func (s *Server) handlePaymentEvents(w http.ResponseWriter, r *http.Request) {
+	p, err := s.paymentSvc.GetPayment(r.Context(), r.PathValue("id"))
+	if err != nil || !canViewPayment(r, p) {
 		http.Error(w, "payment not found", http.StatusNotFound)
 		return
 	}
 
+	events, err := s.paymentSvc.ListPaymentEvents(r.Context(), p.ID)
+	if err != nil {
+		http.Error(w, "failed to list payment events", http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []*store.PaymentEvent{}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(p)
+	json.NewEncoder(w).Encode(events)
 }
 
 func (s *Server) handlePaymentHistory(w http.ResponseWriter, r *http.Request) {
@@ -80,8 +418,54 @@ func (s *Server) handlePaymentHistory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	writePayments(w, r, payments)
+}
+
+// paymentResponse is a payment as returned by the API. With ?npub=true the
+// NIP-19 forms of its pubkeys are added next to the hex ones.
+type paymentResponse struct {
+	*store.Payment
+	SenderNpub    string `json:",omitempty"`
+	ReceiverNpub  string `json:",omitempty"`
+	CreatedByNpub string `json:",omitempty"`
+}
+
+func newPaymentResponse(p *store.Payment, npub bool) paymentResponse {
+	resp := paymentResponse{Payment: p}
+	if npub {
+		resp.SenderNpub = nostrauth.EncodeNpub(p.SenderPubkey)
+		resp.ReceiverNpub = nostrauth.EncodeNpub(p.ReceiverPubkey)
+		resp.CreatedByNpub = nostrauth.EncodeNpub(p.CreatedByPubkey)
+	}
+	return resp
+}
+
+func writePayments(w http.ResponseWriter, r *http.Request, payments []*store.Payment) {
+	npub := wantNpub(r)
+	resp := make([]paymentResponse, 0, len(payments))
+	for _, p := range payments {
+		resp = append(resp, newPaymentResponse(p, npub))
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(payments)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// wantNpub reports whether the client asked for npub forms of pubkeys in
+// the response.
+func wantNpub(r *http.Request) bool {
+	v, _ := strconv.ParseBool(r.URL.Query().Get("npub"))
+	return v
+}
+
+// canViewPayment allows the receiver, the sender, the staff member who
+// created it and operators to read a payment.
+func canViewPayment(r *http.Request, p *store.Payment) bool {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+	if pubkey != "" && (p.ReceiverPubkey == pubkey || p.SenderPubkey == pubkey || p.CreatedByPubkey == pubkey) {
+		return true
+	}
+	return nostrauth.RoleFromContext(r.Context()).Includes(nostrauth.RoleOperator)
 }
 
 type webhookPayload struct {
@@ -95,12 +479,18 @@ func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.paymentSvc.HandleWebhook(r.Context(), payload.PaymentHash); err != nil {
+	// The service notifies WebSocket subscribers only when this call
+	// settles the payment
+	err := s.paymentSvc.HandleWebhook(r.Context(), payload.PaymentHash, r.URL.Query().Get("token"))
+	if errors.Is(err, payment.ErrInvalidWebhook) {
+		slog.Warn("rejected webhook", "payment_hash", payload.PaymentHash, "remote_addr", r.RemoteAddr)
+		http.Error(w, "invalid webhook", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
 		http.Error(w, "webhook processing failed", http.StatusInternalServerError)
 		return
 	}
 
-	s.wsHub.NotifyPayment(payload.PaymentHash, "paid")
-
 	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
+	"github.com/nostr-pay/nostr-pay/internal/payment"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+type createSplitRuleRequest struct {
+	// Destination is a Lightning address or the pubkey of a user on this
+	// instance.
+	Destination string  `json:"destination"`
+	Percent     float64 `json:"percent"`
+	AmountSats  int64   `json:"amount_sats"`
+	Label       string  `json:"label"`
+}
+
+type splitRuleResponse struct {
+	ID          string    `json:"id"`
+	Destination string    `json:"destination"`
+	Percent     float64   `json:"percent,omitempty"`
+	AmountSats  int64     `json:"amount_sats,omitempty"`
+	Label       string    `json:"label"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func newSplitRuleResponse(r *store.SplitRule) splitRuleResponse {
+	return splitRuleResponse{
+		ID:          r.ID,
+		Destination: r.Destination,
+		Percent:     r.Percent,
+		AmountSats:  r.AmountSats,
+		Label:       r.Label,
+		CreatedAt:   r.CreatedAt,
+	}
+}
+
+type splitPayoutResponse struct {
+	ID              string    `json:"id"`
+	RuleID          string    `json:"rule_id"`
+	Destination     string    `json:"destination"`
+	AmountSats      int64     `json:"amount_sats"`
+	Status          string    `json:"status"`
+	Attempts        int       `json:"attempts"`
+	LastError       string    `json:"last_error,omitempty"`
+	NextAttemptAt   time.Time `json:"next_attempt_at"`
+	PayoutPaymentID string    `json:"payout_payment_id,omitempty"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+func (s *Server) handleCreateSplitRule(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	var req createSplitRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	dest := strings.TrimSpace(req.Destination)
+	if !strings.Contains(dest, "@") {
+		p, err := nostrauth.ParsePubkey(dest)
+		if err != nil {
+			http.Error(w, "destination: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		dest = p
+	}
+
+	rule, err := s.paymentSvc.CreateSplitRule(r.Context(), &payment.SplitRuleInput{
+		MerchantPubkey: pubkey,
+		Destination:    dest,
+		Percent:        req.Percent,
+		AmountSats:     req.AmountSats,
+		Label:          req.Label,
+	})
+	if errors.Is(err, payment.ErrInvalidSplitRule) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to create split rule", "error", err)
+		http.Error(w, "failed to create split rule", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newSplitRuleResponse(rule))
+}
+
+func (s *Server) handleListSplitRules(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	rules, err := s.paymentSvc.ListSplitRules(r.Context(), pubkey)
+	if err != nil {
+		http.Error(w, "failed to list split rules", http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]splitRuleResponse, 0, len(rules))
+	for _, rule := range rules {
+		resp = append(resp, newSplitRuleResponse(rule))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) handleDeleteSplitRule(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	err := s.paymentSvc.DeleteSplitRule(r.Context(), r.PathValue("id"), pubkey)
+	if errors.Is(err, payment.ErrSplitRuleNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to delete split rule", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListSplitPayouts shows the receiver of a payment what became of
+// its splits.
+func (s *Server) handleListSplitPayouts(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	p, err := s.paymentSvc.GetPayment(r.Context(), r.PathValue("id"))
+	if err != nil || p.ReceiverPubkey != pubkey {
+		http.Error(w, "payment not found", http.StatusNotFound)
+		return
+	}
+
+	payouts, err := s.paymentSvc.ListSplitPayouts(r.Context(), p.ID)
+	if err != nil {
+		http.Error(w, "failed to list split payouts", http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]splitPayoutResponse, 0, len(payouts))
+	for _, sp := range payouts {
+		resp = append(resp, splitPayoutResponse{
+			ID:              sp.ID,
+			RuleID:          sp.RuleID,
+			Destination:     sp.Destination,
+			AmountSats:      sp.AmountSats,
+			Status:          sp.Status,
+			Attempts:        sp.Attempts,
+			LastError:       sp.LastError,
+			NextAttemptAt:   sp.NextAttemptAt,
+			PayoutPaymentID: sp.PayoutPaymentID,
+			UpdatedAt:       sp.UpdatedAt,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/merchant"
+	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+type grantStaffRequest struct {
+	StaffPubkey string   `json:"staff_pubkey"`
+	Permissions []string `json:"permissions"`
+}
+
+type staffGrantResponse struct {
+	MerchantPubkey string    `json:"merchant_pubkey"`
+	MerchantNpub   string    `json:"merchant_npub,omitempty"`
+	StaffPubkey    string    `json:"staff_pubkey"`
+	StaffNpub      string    `json:"staff_npub,omitempty"`
+	Permissions    []string  `json:"permissions"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func newStaffGrantResponse(g *store.StaffGrant, npub bool) staffGrantResponse {
+	resp := staffGrantResponse{
+		MerchantPubkey: g.MerchantPubkey,
+		StaffPubkey:    g.StaffPubkey,
+		Permissions:    g.Permissions,
+		CreatedAt:      g.CreatedAt,
+	}
+	if npub {
+		resp.MerchantNpub = nostrauth.EncodeNpub(g.MerchantPubkey)
+		resp.StaffNpub = nostrauth.EncodeNpub(g.StaffPubkey)
+	}
+	return resp
+}
+
+func (s *Server) handleGrantStaff(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	var req grantStaffRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	staffPubkey, err := nostrauth.ParsePubkey(req.StaffPubkey)
+	if err != nil {
+		http.Error(w, "staff_pubkey: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	perms, err := merchant.ParsePermissions(req.Permissions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	grant, err := s.merchants.GrantStaff(r.Context(), pubkey, staffPubkey, perms)
+	if errors.Is(err, merchant.ErrSelfGrant) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to grant staff", "error", err)
+		http.Error(w, "failed to grant staff", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newStaffGrantResponse(grant, wantNpub(r)))
+}
+
+func (s *Server) handleListStaff(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	grants, err := s.merchants.ListStaff(r.Context(), pubkey)
+	if err != nil {
+		http.Error(w, "failed to list staff", http.StatusInternalServerError)
+		return
+	}
+	writeStaffGrants(w, r, grants)
+}
+
+// handleListEmployers lets a staff member discover the merchants it may act
+// for.
+func (s *Server) handleListEmployers(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	grants, err := s.merchants.ListEmployers(r.Context(), pubkey)
+	if err != nil {
+		http.Error(w, "failed to list merchants", http.StatusInternalServerError)
+		return
+	}
+	writeStaffGrants(w, r, grants)
+}
+
+func (s *Server) handleRevokeStaff(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	staffPubkey, err := nostrauth.ParsePubkey(r.PathValue("pubkey"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.merchants.RevokeStaff(r.Context(), pubkey, staffPubkey)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "staff member not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to revoke staff", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeStaffGrants(w http.ResponseWriter, r *http.Request, grants []*store.StaffGrant) {
+	npub := wantNpub(r)
+	resp := make([]staffGrantResponse, 0, len(grants))
+	for _, g := range grants {
+		resp = append(resp, newStaffGrantResponse(g, npub))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
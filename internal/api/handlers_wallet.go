@@ -0,0 +1,89 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/nostr-pay/nostr-pay/internal/lnurl"
+	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
+	"github.com/nostr-pay/nostr-pay/internal/payment"
+)
+
+type walletResponse struct {
+	// WalletID is the merchant's own LNbits wallet; without one the
+	// balance is the merchant's share of the shared wallet.
+	WalletID           string `json:"wallet_id,omitempty"`
+	BalanceSats        int64  `json:"balance_sats"`
+	ReserveSats        int64  `json:"reserve_sats"`
+	DailyLimitSats     int64  `json:"daily_limit_sats"`
+	WithdrawnTodaySats int64  `json:"withdrawn_today_sats"`
+	AvailableSats      int64  `json:"available_sats"`
+}
+
+func (s *Server) handleGetWallet(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	b, err := s.paymentSvc.Balance(r.Context(), pubkey)
+	if err != nil {
+		slog.Error("failed to get balance", "pubkey", pubkey, "error", err)
+		http.Error(w, "failed to get balance", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(walletResponse{
+		WalletID:           b.WalletID,
+		BalanceSats:        b.BalanceSats,
+		ReserveSats:        b.ReserveSats,
+		DailyLimitSats:     b.DailyLimitSats,
+		WithdrawnTodaySats: b.WithdrawnTodaySats,
+		AvailableSats:      b.AvailableSats,
+	})
+}
+
+type withdrawRequest struct {
+	// AmountSats is required for Lightning addresses.
+	AmountSats       int64  `json:"amount_sats"`
+	Bolt11           string `json:"bolt11"`
+	LightningAddress string `json:"lightning_address"`
+}
+
+func (s *Server) handleWithdraw(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	var req withdrawRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.AmountSats < 0 {
+		http.Error(w, "amount must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	result, err := s.paymentSvc.Withdraw(r.Context(), &payment.WithdrawInput{
+		MerchantPubkey:   pubkey,
+		AmountSats:       req.AmountSats,
+		Bolt11:           req.Bolt11,
+		LightningAddress: req.LightningAddress,
+	})
+	switch {
+	case errors.Is(err, payment.ErrWithdrawalDestination),
+		errors.Is(err, payment.ErrWithdrawalAmount),
+		errors.Is(err, lnurl.ErrInvalidAddress),
+		errors.Is(err, lnurl.ErrAmountOutOfRange):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, payment.ErrAddressUnavailable):
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if err != nil {
+		s.writePayError(w, pubkey, result, err)
+		return
+	}
+
+	writePayResult(w, result)
+}
@@ -0,0 +1,224 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+	"github.com/nostr-pay/nostr-pay/internal/webhook"
+)
+
+const (
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 200
+)
+
+type createWebhookRequest struct {
+	URL string `json:"url"`
+	// Events to send; all of them if empty.
+	Events []string `json:"events"`
+}
+
+type webhookEndpointResponse struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Secret is only returned when the endpoint is created.
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newWebhookEndpointResponse(e *store.WebhookEndpoint) webhookEndpointResponse {
+	events := e.Events
+	if events == nil {
+		events = []string{}
+	}
+	return webhookEndpointResponse{
+		ID:        e.ID,
+		URL:       e.URL,
+		Events:    events,
+		CreatedAt: e.CreatedAt,
+	}
+}
+
+type webhookDeliveryResponse struct {
+	ID             string          `json:"id"`
+	EndpointID     string          `json:"endpoint_id"`
+	EventID        string          `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	PaymentID      string          `json:"payment_id"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastError      string          `json:"last_error,omitempty"`
+	ResponseStatus int             `json:"response_status,omitempty"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+	Payload        json.RawMessage `json:"payload,omitempty"`
+}
+
+func newWebhookDeliveryResponse(d *store.WebhookDelivery, withPayload bool) webhookDeliveryResponse {
+	resp := webhookDeliveryResponse{
+		ID:             d.ID,
+		EndpointID:     d.EndpointID,
+		EventID:        d.EventID,
+		EventType:      d.EventType,
+		PaymentID:      d.PaymentID,
+		Status:         d.Status,
+		Attempts:       d.Attempts,
+		LastError:      d.LastError,
+		ResponseStatus: d.ResponseStatus,
+		NextAttemptAt:  d.NextAttemptAt,
+		CreatedAt:      d.CreatedAt,
+		UpdatedAt:      d.UpdatedAt,
+	}
+	if withPayload {
+		resp.Payload = d.Payload
+	}
+	return resp
+}
+
+func (s *Server) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	var req createWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	endpoint, err := s.webhooks.CreateEndpoint(r.Context(), pubkey, req.URL, req.Events)
+	if errors.Is(err, webhook.ErrInvalidEndpoint) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to create webhook endpoint", "error", err)
+		http.Error(w, "failed to create webhook endpoint", http.StatusInternalServerError)
+		return
+	}
+
+	resp := newWebhookEndpointResponse(endpoint)
+	resp.Secret = endpoint.Secret
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	endpoints, err := s.webhooks.ListEndpoints(r.Context(), pubkey)
+	if err != nil {
+		http.Error(w, "failed to list webhook endpoints", http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]webhookEndpointResponse, 0, len(endpoints))
+	for _, e := range endpoints {
+		resp = append(resp, newWebhookEndpointResponse(e))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	err := s.webhooks.DeleteEndpoint(r.Context(), r.PathValue("id"), pubkey)
+	if errors.Is(err, webhook.ErrEndpointNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to delete webhook endpoint", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListWebhookDeliveries returns the delivery log, newest first,
+// filtered by ?endpoint_id=, ?payment_id= and ?status=.
+func (s *Server) handleListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+	q := r.URL.Query()
+
+	filter := store.WebhookDeliveryFilter{
+		EndpointID: q.Get("endpoint_id"),
+		PaymentID:  q.Get("payment_id"),
+		Status:     q.Get("status"),
+		Limit:      defaultDeliveryLimit,
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxDeliveryLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxDeliveryLimit), http.StatusBadRequest)
+			return
+		}
+		filter.Limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+		filter.Offset = n
+	}
+
+	deliveries, err := s.webhooks.ListDeliveries(r.Context(), pubkey, filter)
+	if err != nil {
+		http.Error(w, "failed to list webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]webhookDeliveryResponse, 0, len(deliveries))
+	for _, d := range deliveries {
+		resp = append(resp, newWebhookDeliveryResponse(d, false))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) handleGetWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	d, err := s.webhooks.GetDelivery(r.Context(), r.PathValue("id"), pubkey)
+	if errors.Is(err, webhook.ErrDeliveryNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to get webhook delivery", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newWebhookDeliveryResponse(d, true))
+}
+
+func (s *Server) handleRedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	pubkey := nostrauth.PubkeyFromContext(r.Context())
+
+	d, err := s.webhooks.Redeliver(r.Context(), r.PathValue("id"), pubkey)
+	switch {
+	case errors.Is(err, webhook.ErrDeliveryNotFound), errors.Is(err, webhook.ErrEndpointNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		slog.Error("failed to redeliver webhook", "delivery_id", r.PathValue("id"), "error", err)
+		http.Error(w, "failed to redeliver webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(newWebhookDeliveryResponse(d, false))
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+const (
+	// idempotencyTTL is how long a response is kept for replay.
+	idempotencyTTL = 24 * time.Hour
+	// maxIdempotencyKeyLen bounds the client-chosen key.
+	maxIdempotencyKeyLen = 255
+	// maxIdempotentBody bounds how much of a request body is buffered for
+	// hashing.
+	maxIdempotentBody = 1 << 20
+)
+
+// idempotent makes a handler safe to retry. Requests carrying an
+// Idempotency-Key header are remembered per pubkey: a retry with the same
+// key and body gets the original response, while the same key with a
+// different body is rejected with 409. Only successful responses, and those
+// a handler marks with keepIdempotentResponse, are kept, so other failed
+// requests can be retried with the same key. It must run inside
+// Authenticator.Middleware.
+func (s *Server) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			http.Error(w, "Idempotency-Key too long", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		pubkey := nostrauth.PubkeyFromContext(r.Context())
+		hash := requestHash(r, body)
+		existing, created, err := s.store.ReserveIdempotencyKey(r.Context(), &store.IdempotencyRecord{
+			Pubkey:      pubkey,
+			Key:         key,
+			RequestHash: hash,
+			ExpiresAt:   time.Now().Add(idempotencyTTL),
+		})
+		if err != nil {
+			slog.Error("failed to reserve idempotency key", "error", err)
+			http.Error(w, "idempotency check failed", http.StatusInternalServerError)
+			return
+		}
+
+		if !created {
+			switch {
+			case existing.RequestHash != hash:
+				http.Error(w, "Idempotency-Key was already used for a different request", http.StatusConflict)
+			case existing.StatusCode == 0:
+				http.Error(w, "a request with this Idempotency-Key is still in progress", http.StatusConflict)
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(existing.StatusCode)
+				w.Write(existing.Response)
+			}
+			return
+		}
+
+		rec := &responseRecorder{header: make(http.Header), status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		// Use a fresh context so a client hanging up does not leave the key
+		// reserved forever.
+		ctx := context.WithoutCancel(r.Context())
+		if rec.status >= 200 && rec.status < 300 || rec.keep {
+			if err := s.store.CompleteIdempotencyKey(ctx, pubkey, key, rec.status, rec.body.Bytes()); err != nil {
+				slog.Error("failed to store idempotent response", "error", err)
+			}
+		} else if err := s.store.ReleaseIdempotencyKey(ctx, pubkey, key); err != nil {
+			slog.Error("failed to release idempotency key", "error", err)
+		}
+
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+	})
+}
+
+// keepIdempotentResponse makes idempotent store an error response for
+// replay instead of releasing the key, for requests that failed after
+// changing something, such as a payment that was recorded.
+func keepIdempotentResponse(w http.ResponseWriter) {
+	if rec, ok := w.(*responseRecorder); ok {
+		rec.keep = true
+	}
+}
+
+// requestHash fingerprints the method, path and body of a request.
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder buffers a handler's response so it can be stored before
+// being sent.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	wrote  bool
+	keep   bool
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.wrote {
+		return
+	}
+	r.status = status
+	r.wrote = true
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wrote = true
+	return r.body.Write(b)
+}
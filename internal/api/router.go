@@ -13,16 +13,159 @@ func (s *Server) Routes() http.Handler {
 	mux.HandleFunc("GET /api/health", s.handleHealth)
 	mux.HandleFunc("POST /api/payments/webhook", s.handleWebhook)
 	mux.HandleFunc("GET /api/ws", s.handleWS)
+	mux.HandleFunc("POST /api/auth/challenge", s.handleAuthChallenge)
+	mux.HandleFunc("POST /api/auth/session", s.handleLogin)
+	mux.HandleFunc("GET /.well-known/lnurlp/{name}", s.handleLNURLPay)
+	mux.HandleFunc("GET /api/lnurlp/{name}/callback", s.handleLNURLCallback)
 
 	// Authenticated endpoints
-	mux.Handle("POST /api/payments/invoice", nostrauth.AuthMiddleware(
-		http.HandlerFunc(s.handleCreateInvoice),
+	// Merchants or their staff; the handler checks which
+	mux.Handle("POST /api/payments/invoice", s.auth.Middleware(
+		nostrauth.RequireScope(nostrauth.ScopeCreateInvoice,
+			s.idempotent(http.HandlerFunc(s.handleCreateInvoice))),
 	))
-	mux.Handle("GET /api/payments/{id}", nostrauth.AuthMiddleware(
-		http.HandlerFunc(s.handleGetPayment),
+	mux.Handle("POST /api/payments/pay", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RejectAPIKeys(s.idempotent(http.HandlerFunc(s.handlePayInvoice)))),
 	))
-	mux.Handle("GET /api/payments/history", nostrauth.AuthMiddleware(
-		http.HandlerFunc(s.handlePaymentHistory),
+	mux.Handle("GET /api/wallet", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RequireScope(nostrauth.ScopeReadPayments, http.HandlerFunc(s.handleGetWallet))),
+	))
+	mux.Handle("POST /api/wallet/withdraw", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RejectAPIKeys(s.idempotent(http.HandlerFunc(s.handleWithdraw)))),
+	))
+	mux.Handle("POST /api/payments/{id}/refund", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RejectAPIKeys(s.idempotent(http.HandlerFunc(s.handleRefund)))),
+	))
+	mux.Handle("GET /api/payments/{id}/splits", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RequireScope(nostrauth.ScopeReadPayments, http.HandlerFunc(s.handleListSplitPayouts))),
+	))
+	mux.Handle("GET /api/payments/{id}/events", s.auth.Middleware(
+		nostrauth.RequireScope(nostrauth.ScopeReadPayments, http.HandlerFunc(s.handlePaymentEvents)),
+	))
+	mux.Handle("GET /api/payments/{id}", s.auth.Middleware(
+		nostrauth.RequireScope(nostrauth.ScopeReadPayments, http.HandlerFunc(s.handleGetPayment)),
+	))
+	mux.Handle("GET /api/payments/history", s.auth.Middleware(
+		nostrauth.RequireScope(nostrauth.ScopeReadPayments, http.HandlerFunc(s.handlePaymentHistory)),
+	))
+	mux.Handle("GET /api/decode", s.auth.Middleware(http.HandlerFunc(s.handleDecode)))
+	mux.Handle("GET /api/auth/sessions", s.auth.Middleware(
+		nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleListSessions)),
+	))
+	mux.Handle("DELETE /api/auth/sessions/{id}", s.auth.Middleware(
+		nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleRevokeSession)),
+	))
+
+	// Merchant endpoints
+	mux.Handle("GET /api/merchant/stats", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RequireScope(nostrauth.ScopeReadStats, http.HandlerFunc(s.handleMerchantStats))),
+	))
+	mux.Handle("GET /api/merchant/tips", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RequireScope(nostrauth.ScopeReadStats, http.HandlerFunc(s.handleMerchantTips))),
+	))
+	mux.Handle("GET /api/merchant/transactions", s.auth.Middleware(
+		nostrauth.RequireScope(nostrauth.ScopeReadPayments, http.HandlerFunc(s.handleMerchantTransactions)),
+	))
+	mux.Handle("POST /api/splits", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleCreateSplitRule))),
+	))
+	mux.Handle("GET /api/splits", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleListSplitRules))),
+	))
+	mux.Handle("DELETE /api/splits/{id}", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleDeleteSplitRule))),
+	))
+	mux.Handle("POST /api/webhooks", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleCreateWebhook))),
+	))
+	mux.Handle("GET /api/webhooks", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleListWebhooks))),
+	))
+	mux.Handle("DELETE /api/webhooks/{id}", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleDeleteWebhook))),
+	))
+	mux.Handle("GET /api/webhooks/deliveries", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RequireScope(nostrauth.ScopeReadPayments, http.HandlerFunc(s.handleListWebhookDeliveries))),
+	))
+	mux.Handle("GET /api/webhooks/deliveries/{id}", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RequireScope(nostrauth.ScopeReadPayments, http.HandlerFunc(s.handleGetWebhookDelivery))),
+	))
+	mux.Handle("POST /api/webhooks/deliveries/{id}/redeliver", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleRedeliverWebhook))),
+	))
+	mux.Handle("PUT /api/addresses/{name}", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleClaimAddress))),
+	))
+	mux.Handle("GET /api/addresses", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleListAddresses))),
+	))
+	mux.Handle("DELETE /api/addresses/{name}", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleReleaseAddress))),
+	))
+	mux.Handle("POST /api/keys", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleCreateAPIKey))),
+	))
+	mux.Handle("GET /api/keys", s.auth.Middleware(
+		nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleListAPIKeys)),
+	))
+	mux.Handle("DELETE /api/keys/{id}", s.auth.Middleware(
+		nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleRevokeAPIKey)),
+	))
+
+	mux.Handle("POST /api/staff", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleMerchant,
+			nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleGrantStaff))),
+	))
+	mux.Handle("GET /api/staff", s.auth.Middleware(
+		nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleListStaff)),
+	))
+	mux.Handle("DELETE /api/staff/{pubkey}", s.auth.Middleware(
+		nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleRevokeStaff)),
+	))
+	mux.Handle("GET /api/staff/merchants", s.auth.Middleware(
+		nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleListEmployers)),
+	))
+
+	// Operator endpoints
+	mux.Handle("PUT /api/admin/users/{pubkey}/merchant", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleOperator,
+			nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleSetMerchant))),
+	))
+	mux.Handle("PUT /api/admin/users/{pubkey}", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleOperator,
+			nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleInviteUser))),
+	))
+	mux.Handle("GET /api/admin/denylist", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleOperator,
+			nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleListDenied))),
+	))
+	mux.Handle("PUT /api/admin/denylist/{pubkey}", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleOperator,
+			nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleDenyPubkey))),
+	))
+	mux.Handle("DELETE /api/admin/denylist/{pubkey}", s.auth.Middleware(
+		nostrauth.RequireRole(nostrauth.RoleOperator,
+			nostrauth.RejectAPIKeys(http.HandlerFunc(s.handleAllowPubkey))),
 	))
 
 	// Apply global middleware
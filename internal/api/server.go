@@ -1,20 +1,38 @@
 package api
 
 import (
+	"github.com/nostr-pay/nostr-pay/internal/merchant"
+	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
 	"github.com/nostr-pay/nostr-pay/internal/payment"
 	"github.com/nostr-pay/nostr-pay/internal/store"
+	"github.com/nostr-pay/nostr-pay/internal/webhook"
 )
 
 type Server struct {
 	store      store.Store
 	paymentSvc *payment.Service
+	auth       *nostrauth.Authenticator
+	sessions   *nostrauth.SessionManager
+	apiKeys    *nostrauth.APIKeyManager
+	merchants  *merchant.Service
+	webhooks   *webhook.Service
 	wsHub      *WSHub
 }
 
-func NewServer(store store.Store, paymentSvc *payment.Service) *Server {
-	return &Server{
+// NewServer wires the HTTP API. It registers its WebSocket hub as the
+// payment service's notifier so status changes made in the background reach
+// subscribers.
+func NewServer(store store.Store, paymentSvc *payment.Service, auth *nostrauth.Authenticator, sessions *nostrauth.SessionManager, apiKeys *nostrauth.APIKeyManager, merchants *merchant.Service, webhooks *webhook.Service) *Server {
+	s := &Server{
 		store:      store,
 		paymentSvc: paymentSvc,
+		auth:       auth,
+		sessions:   sessions,
+		apiKeys:    apiKeys,
+		merchants:  merchants,
+		webhooks:   webhooks,
 		wsHub:      NewWSHub(),
 	}
+	paymentSvc.SetNotifier(s.wsHub)
+	return s
 }
@@ -0,0 +1,354 @@
+// Package bolt11 decodes and verifies Lightning invoices (BOLT 11).
+package bolt11
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcutil/bech32"
+)
+
+var (
+	ErrInvalidInvoice = errors.New("invalid invoice")
+	ErrBadSignature   = errors.New("invalid invoice signature")
+)
+
+// Defaults for fields an invoice may omit.
+const (
+	DefaultExpiry             = time.Hour
+	DefaultMinFinalCLTVExpiry = 18
+)
+
+// Invoice is a decoded payment request.
+type Invoice struct {
+	Network string // mainnet, testnet, signet or regtest
+	// AmountMsat is 0 when the invoice leaves the amount to the payer.
+	AmountMsat      int64
+	Timestamp       time.Time
+	PaymentHash     string // hex
+	PaymentSecret   string // hex
+	Description     string
+	DescriptionHash string // hex
+	Expiry          time.Duration
+	// MinFinalCLTVExpiry is the CLTV delta required for the last hop.
+	MinFinalCLTVExpiry int64
+	// Payee is the compressed node key that signed the invoice, in hex.
+	Payee      string
+	RouteHints [][]HopHint
+}
+
+// HopHint is one hop of a private route to the payee.
+type HopHint struct {
+	NodeID                    string // hex
+	ShortChannelID            uint64
+	FeeBaseMsat               uint32
+	FeeProportionalMillionths uint32
+	CLTVExpiryDelta           uint16
+}
+
+// ExpiresAt is when the invoice can no longer be paid.
+func (inv *Invoice) ExpiresAt() time.Time {
+	return inv.Timestamp.Add(inv.Expiry)
+}
+
+func (inv *Invoice) Expired(now time.Time) bool {
+	return !now.Before(inv.ExpiresAt())
+}
+
+// networks maps the currency prefix of the human-readable part to a network
+// name. Longer prefixes come first so "bcrt" is not read as "bc".
+var networks = []struct {
+	prefix, name string
+}{
+	{"bcrt", "regtest"},
+	{"bc", "mainnet"},
+	{"tbs", "signet"},
+	{"tb", "testnet"},
+}
+
+// Tagged field types, named by their bech32 character.
+const (
+	fieldPaymentHash     = 1  // p
+	fieldRouteHint       = 3  // r
+	fieldExpiry          = 6  // x
+	fieldDescription     = 13 // d
+	fieldPaymentSecret   = 16 // s
+	fieldPayee           = 19 // n
+	fieldDescriptionHash = 23 // h
+	fieldMinFinalCLTV    = 24 // c
+)
+
+const (
+	timestampWords = 7
+	signatureWords = 104 // 64-byte signature plus recovery id
+	hashWords      = 52  // 32 bytes
+	pubkeyWords    = 53  // 33 bytes
+	hopHintLen     = 51
+	msatPerBTC     = 100_000_000_000
+	maxMsat        = 21_000_000 * msatPerBTC
+)
+
+// Decode parses a bolt11 invoice, with or without a "lightning:" prefix,
+// and verifies its signature. The payee is taken from the n field when
+// present and recovered from the signature otherwise.
+func Decode(s string) (*Invoice, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.TrimPrefix(s, "lightning:")
+
+	hrp, data, err := bech32.DecodeNoLimit(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidInvoice, err)
+	}
+	if len(data) < timestampWords+signatureWords {
+		return nil, fmt.Errorf("%w: too short", ErrInvalidInvoice)
+	}
+
+	inv := &Invoice{
+		Expiry:             DefaultExpiry,
+		MinFinalCLTVExpiry: DefaultMinFinalCLTVExpiry,
+	}
+	if err := parseHRP(hrp, inv); err != nil {
+		return nil, err
+	}
+
+	body, sig := data[:len(data)-signatureWords], data[len(data)-signatureWords:]
+	ts, _ := wordsToUint(body[:timestampWords])
+	inv.Timestamp = time.Unix(int64(ts), 0).UTC()
+
+	payee, err := parseFields(body[timestampWords:], inv)
+	if err != nil {
+		return nil, err
+	}
+	if inv.PaymentHash == "" {
+		return nil, fmt.Errorf("%w: missing payment hash", ErrInvalidInvoice)
+	}
+
+	recovered, err := recoverPayee(hrp, body, sig)
+	if err != nil {
+		return nil, err
+	}
+	if payee != nil && !payee.IsEqual(recovered) {
+		return nil, fmt.Errorf("%w: not signed by the payee", ErrBadSignature)
+	}
+	inv.Payee = hex.EncodeToString(recovered.SerializeCompressed())
+	return inv, nil
+}
+
+func parseHRP(hrp string, inv *Invoice) error {
+	rest, ok := strings.CutPrefix(hrp, "ln")
+	if !ok {
+		return fmt.Errorf("%w: prefix %q is not a lightning invoice", ErrInvalidInvoice, hrp)
+	}
+	for _, n := range networks {
+		if amount, ok := strings.CutPrefix(rest, n.prefix); ok {
+			msat, err := parseAmount(amount)
+			if err != nil {
+				return err
+			}
+			inv.Network = n.name
+			inv.AmountMsat = msat
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: unknown network in %q", ErrInvalidInvoice, hrp)
+}
+
+// multipliers divide a bitcoin amount; p (pico) must be a multiple of 10
+// since it is finer than a millisatoshi.
+var multipliers = map[byte]int64{
+	'm': 1_000,
+	'u': 1_000_000,
+	'n': 1_000_000_000,
+	'p': 1_000_000_000_000,
+}
+
+func parseAmount(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	div := int64(1)
+	if d, ok := multipliers[s[len(s)-1]]; ok {
+		div, s = d, s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 || s[0] == '0' {
+		return 0, fmt.Errorf("%w: bad amount %q", ErrInvalidInvoice, s)
+	}
+
+	var msat int64
+	if div > msatPerBTC {
+		step := div / msatPerBTC
+		if n%step != 0 {
+			return 0, fmt.Errorf("%w: amount is not a whole millisatoshi", ErrInvalidInvoice)
+		}
+		msat = n / step
+	} else {
+		step := msatPerBTC / div
+		if n > maxMsat/step {
+			return 0, fmt.Errorf("%w: amount too large", ErrInvalidInvoice)
+		}
+		msat = n * step
+	}
+	return msat, nil
+}
+
+// parseFields reads the tagged fields into inv and returns the n field, if
+// any. Fields of unknown type, and known fields with the wrong length, are
+// skipped as the spec requires.
+func parseFields(words []byte, inv *Invoice) (*btcec.PublicKey, error) {
+	var payee *btcec.PublicKey
+	for len(words) > 0 {
+		if len(words) < 3 {
+			return nil, fmt.Errorf("%w: truncated field", ErrInvalidInvoice)
+		}
+		typ, n := words[0], int(words[1])<<5|int(words[2])
+		if len(words) < 3+n {
+			return nil, fmt.Errorf("%w: truncated field", ErrInvalidInvoice)
+		}
+		val := words[3 : 3+n]
+		words = words[3+n:]
+
+		switch typ {
+		case fieldPaymentHash, fieldPaymentSecret, fieldDescriptionHash:
+			if n != hashWords {
+				continue
+			}
+			b, err := wordsToBytes(val)
+			if err != nil {
+				return nil, err
+			}
+			switch typ {
+			case fieldPaymentHash:
+				inv.PaymentHash = hex.EncodeToString(b)
+			case fieldPaymentSecret:
+				inv.PaymentSecret = hex.EncodeToString(b)
+			default:
+				inv.DescriptionHash = hex.EncodeToString(b)
+			}
+		case fieldDescription:
+			b, err := wordsToBytes(val)
+			if err != nil {
+				return nil, err
+			}
+			if !utf8.Valid(b) {
+				return nil, fmt.Errorf("%w: description is not UTF-8", ErrInvalidInvoice)
+			}
+			inv.Description = string(b)
+		case fieldExpiry:
+			secs, ok := wordsToUint(val)
+			if !ok || secs > uint64(time.Duration(1<<63-1)/time.Second) {
+				return nil, fmt.Errorf("%w: expiry too large", ErrInvalidInvoice)
+			}
+			inv.Expiry = time.Duration(secs) * time.Second
+		case fieldMinFinalCLTV:
+			v, ok := wordsToUint(val)
+			if !ok || v > 1<<32 {
+				return nil, fmt.Errorf("%w: min_final_cltv_expiry too large", ErrInvalidInvoice)
+			}
+			inv.MinFinalCLTVExpiry = int64(v)
+		case fieldPayee:
+			if n != pubkeyWords {
+				continue
+			}
+			b, err := wordsToBytes(val)
+			if err != nil {
+				return nil, err
+			}
+			if payee, err = btcec.ParsePubKey(b); err != nil {
+				return nil, fmt.Errorf("%w: bad payee key: %v", ErrInvalidInvoice, err)
+			}
+		case fieldRouteHint:
+			b, err := wordsToBytes(val)
+			if err != nil {
+				return nil, err
+			}
+			route, err := parseRoute(b)
+			if err != nil {
+				return nil, err
+			}
+			inv.RouteHints = append(inv.RouteHints, route)
+		}
+	}
+	return payee, nil
+}
+
+func parseRoute(b []byte) ([]HopHint, error) {
+	if len(b) == 0 || len(b)%hopHintLen != 0 {
+		return nil, fmt.Errorf("%w: bad route hint length %d", ErrInvalidInvoice, len(b))
+	}
+	var route []HopHint
+	for ; len(b) > 0; b = b[hopHintLen:] {
+		route = append(route, HopHint{
+			NodeID:                    hex.EncodeToString(b[:33]),
+			ShortChannelID:            beUint(b[33:41]),
+			FeeBaseMsat:               uint32(beUint(b[41:45])),
+			FeeProportionalMillionths: uint32(beUint(b[45:49])),
+			CLTVExpiryDelta:           uint16(beUint(b[49:51])),
+		})
+	}
+	return route, nil
+}
+
+// recoverPayee checks the signature over the human-readable part and the
+// data words and returns the key that made it.
+func recoverPayee(hrp string, body, sigWords []byte) (*btcec.PublicKey, error) {
+	sig, err := wordsToBytes(sigWords)
+	if err != nil || len(sig) != 65 || sig[64] > 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrBadSignature)
+	}
+	hash := signingHash(hrp, body)
+
+	// RecoverCompact expects the recovery flag first, offset by 27 and
+	// marked as belonging to a compressed key.
+	compact := make([]byte, 65)
+	compact[0] = 27 + 4 + sig[64]
+	copy(compact[1:], sig[:64])
+	pub, _, err := ecdsa.RecoverCompact(compact, hash)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	return pub, nil
+}
+
+func signingHash(hrp string, body []byte) []byte {
+	b, _ := bech32.ConvertBits(body, 5, 8, true)
+	h := sha256.New()
+	h.Write([]byte(hrp))
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+func wordsToBytes(words []byte) ([]byte, error) {
+	b, err := bech32.ConvertBits(words, 5, 8, false)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidInvoice, err)
+	}
+	return b, nil
+}
+
+// wordsToUint reads big-endian 5-bit words; ok is false past 64 bits.
+func wordsToUint(words []byte) (v uint64, ok bool) {
+	if len(words) > 12 {
+		return 0, false
+	}
+	for _, w := range words {
+		v = v<<5 | uint64(w)
+	}
+	return v, true
+}
+
+func beUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
@@ -0,0 +1,211 @@
+package bolt11_test
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil/bech32"
+
+	"github.com/nostr-pay/nostr-pay/internal/bolt11"
+	"github.com/nostr-pay/nostr-pay/internal/bolt11/bolt11test"
+)
+
+func testKey(t *testing.T) *btcec.PrivateKey {
+	t.Helper()
+	b, _ := hex.DecodeString("e126f68f7eafcc8b74f54d269fe206be715000f94dac067d1c04a8ca3b2db734")
+	key, _ := btcec.PrivKeyFromBytes(b)
+	return key
+}
+
+// Examples from the BOLT 11 specification, signed by the key in testKey.
+func TestDecode_Spec(t *testing.T) {
+	tests := []struct {
+		name        string
+		invoice     string
+		amountMsat  int64
+		description string
+		expiry      time.Duration
+	}{
+		{
+			name:        "donation",
+			invoice:     "lnbc1pvjluezsp5zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zygspp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdpl2pkx2ctnv5sxxmmwwd5kgetjypeh2ursdae8g6twvus8g6rfwvs8qun0dfjkxaq9qrsgq357wnc5r2ueh7ck6q93dj32dlqnls087fxdwk8qakdyafkq3yap9us6v52vjjsrvywa6rt52cm9r9zqt8r2t7mlcwspyetp5h2tztugp9lfyql",
+			description: "Please consider supporting this project",
+			expiry:      time.Hour,
+		},
+		{
+			name:        "coffee",
+			invoice:     "lnbc2500u1pvjluezsp5zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zygspp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdq5xysxxatsyp3k7enxv4jsxqzpu9qrsgquk0rl77nj30yxdy8j9vdx85fkpmdla2087ne0xh8nhedh8w27kyke0lp53ut353s06fv3qfegext0eh0ymjpf39tuven09sam30g4vgpfna3rh",
+			amountMsat:  250_000_000,
+			description: "1 cup coffee",
+			expiry:      time.Minute,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv, err := bolt11.Decode(tt.invoice)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if inv.Network != "mainnet" || inv.AmountMsat != tt.amountMsat {
+				t.Errorf("network %q amount %d, want mainnet %d", inv.Network, inv.AmountMsat, tt.amountMsat)
+			}
+			if inv.PaymentHash != "0001020304050607080900010203040506070809000102030405060708090102" {
+				t.Errorf("PaymentHash = %s", inv.PaymentHash)
+			}
+			if inv.Description != tt.description || inv.Expiry != tt.expiry {
+				t.Errorf("description %q expiry %v, want %q %v", inv.Description, inv.Expiry, tt.description, tt.expiry)
+			}
+			if !inv.Timestamp.Equal(time.Unix(1496314658, 0)) {
+				t.Errorf("Timestamp = %v", inv.Timestamp)
+			}
+			if inv.Payee != "03e7156ae33b0a208d0744199163177e909e80176e55d97a2f221ede0f934dd9ad" {
+				t.Errorf("Payee = %s", inv.Payee)
+			}
+		})
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	key := testKey(t)
+	payee := hex.EncodeToString(key.PubKey().SerializeCompressed())
+
+	tests := []struct {
+		name string
+		inv  bolt11.Invoice
+		hrp  string
+	}{
+		{
+			name: "description",
+			inv: bolt11.Invoice{
+				Network:     "mainnet",
+				AmountMsat:  250_000_000,
+				Description: "coffee ☕",
+				Expiry:      10 * time.Minute,
+			},
+			hrp: "lnbc2500u1",
+		},
+		{
+			name: "description hash and payee",
+			inv: bolt11.Invoice{
+				Network:         "testnet",
+				AmountMsat:      1_500,
+				DescriptionHash: strings.Repeat("ab", 32),
+				PaymentSecret:   strings.Repeat("11", 32),
+				Payee:           payee,
+			},
+			hrp: "lntb15n1",
+		},
+		{
+			name: "any amount with route hints",
+			inv: bolt11.Invoice{
+				Network:            "regtest",
+				MinFinalCLTVExpiry: 40,
+				RouteHints: [][]bolt11.HopHint{{{
+					NodeID:                    payee,
+					ShortChannelID:            0x0102030405060708,
+					FeeBaseMsat:               1000,
+					FeeProportionalMillionths: 100,
+					CLTVExpiryDelta:           144,
+				}}},
+			},
+			hrp: "lnbcrt1",
+		},
+		{
+			name: "sub-satoshi amount",
+			inv:  bolt11.Invoice{Network: "signet", AmountMsat: 1},
+			hrp:  "lntbs10p1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.inv.Timestamp = time.Unix(1_700_000_000, 0).UTC()
+			tt.inv.PaymentHash = strings.Repeat("01", 32)
+
+			s, err := bolt11test.Encode(&tt.inv, key)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if !strings.HasPrefix(s, tt.hrp) {
+				t.Errorf("invoice %q, want prefix %q", s, tt.hrp)
+			}
+
+			got, err := bolt11.Decode("lightning:" + strings.ToUpper(s))
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			want := tt.inv
+			want.Payee = payee
+			if want.Expiry == 0 {
+				want.Expiry = bolt11.DefaultExpiry
+			}
+			if want.MinFinalCLTVExpiry == 0 {
+				want.MinFinalCLTVExpiry = bolt11.DefaultMinFinalCLTVExpiry
+			}
+			if got.Network != want.Network || got.AmountMsat != want.AmountMsat ||
+				!got.Timestamp.Equal(want.Timestamp) || got.PaymentHash != want.PaymentHash ||
+				got.PaymentSecret != want.PaymentSecret || got.Description != want.Description ||
+				got.DescriptionHash != want.DescriptionHash || got.Expiry != want.Expiry ||
+				got.MinFinalCLTVExpiry != want.MinFinalCLTVExpiry || got.Payee != want.Payee {
+				t.Errorf("decoded %+v, want %+v", got, want)
+			}
+			if len(got.RouteHints) != len(want.RouteHints) ||
+				(len(want.RouteHints) > 0 && got.RouteHints[0][0] != want.RouteHints[0][0]) {
+				t.Errorf("RouteHints = %+v, want %+v", got.RouteHints, want.RouteHints)
+			}
+		})
+	}
+}
+
+func TestDecode_Invalid(t *testing.T) {
+	key := testKey(t)
+	valid, err := bolt11test.Encode(&bolt11.Invoice{
+		Network:     "mainnet",
+		AmountMsat:  100_000,
+		Timestamp:   time.Unix(1_700_000_000, 0),
+		PaymentHash: strings.Repeat("01", 32),
+		Payee:       hex.EncodeToString(key.PubKey().SerializeCompressed()),
+	}, key)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	// Re-encode the signed data under another amount: the checksum is
+	// valid but the signature no longer matches the n field
+	_, data, _ := bech32.DecodeNoLimit(valid)
+	tampered, _ := bech32.Encode("lnbc2u", data)
+	otherNetwork, _ := bech32.Encode("lnxx1u", data)
+
+	tests := []struct {
+		name    string
+		invoice string
+		wantErr error
+	}{
+		{"tampered amount", tampered, bolt11.ErrBadSignature},
+		{"bad checksum", valid[:len(valid)-1] + "q", bolt11.ErrInvalidInvoice},
+		{"not an invoice", "npub1xyz", bolt11.ErrInvalidInvoice},
+		{"unknown network", otherNetwork, bolt11.ErrInvalidInvoice},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := bolt11.Decode(tt.invoice); !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInvoice_Expired(t *testing.T) {
+	inv := &bolt11.Invoice{Timestamp: time.Unix(1_700_000_000, 0), Expiry: time.Minute}
+	if inv.Expired(inv.Timestamp.Add(59 * time.Second)) {
+		t.Error("expired before its expiry")
+	}
+	if !inv.Expired(inv.Timestamp.Add(time.Minute)) {
+		t.Error("not expired at its expiry")
+	}
+}
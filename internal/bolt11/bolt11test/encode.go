@@ -0,0 +1,177 @@
+// Package bolt11test creates signed bolt11 invoices for tests, which
+// bolt11.Decode accepts like real ones.
+package bolt11test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcutil/bech32"
+
+	"github.com/nostr-pay/nostr-pay/internal/bolt11"
+)
+
+// prefixes maps network names to the currency prefix of the
+// human-readable part.
+var prefixes = map[string]string{
+	"mainnet": "bc",
+	"testnet": "tb",
+	"signet":  "tbs",
+	"regtest": "bcrt",
+}
+
+// Tagged field types, named by their bech32 character.
+const (
+	fieldPaymentHash     = 1  // p
+	fieldRouteHint       = 3  // r
+	fieldExpiry          = 6  // x
+	fieldDescription     = 13 // d
+	fieldPaymentSecret   = 16 // s
+	fieldPayee           = 19 // n
+	fieldDescriptionHash = 23 // h
+	fieldMinFinalCLTV    = 24 // c
+)
+
+const (
+	timestampWords = 7
+	msatPerBTC     = 100_000_000_000
+)
+
+// multipliers divide a bitcoin amount.
+var multipliers = map[byte]int64{
+	'm': 1_000,
+	'u': 1_000_000,
+	'n': 1_000_000_000,
+}
+
+// Encode signs inv with key and returns the bolt11 string. Payee, when set,
+// must be the key's public key and is written as the n field.
+func Encode(inv *bolt11.Invoice, key *btcec.PrivateKey) (string, error) {
+	prefix := prefixes[inv.Network]
+	if prefix == "" {
+		return "", fmt.Errorf("%w: unknown network %q", bolt11.ErrInvalidInvoice, inv.Network)
+	}
+	hrp := "ln" + prefix + formatAmount(inv.AmountMsat)
+
+	words := uintToWords(uint64(inv.Timestamp.Unix()), timestampWords)
+
+	hash, err := hex.DecodeString(inv.PaymentHash)
+	if err != nil || len(hash) != 32 {
+		return "", fmt.Errorf("%w: payment hash must be 32 bytes of hex", bolt11.ErrInvalidInvoice)
+	}
+	words = appendField(words, fieldPaymentHash, hash)
+
+	if inv.PaymentSecret != "" {
+		secret, err := hex.DecodeString(inv.PaymentSecret)
+		if err != nil || len(secret) != 32 {
+			return "", fmt.Errorf("%w: payment secret must be 32 bytes of hex", bolt11.ErrInvalidInvoice)
+		}
+		words = appendField(words, fieldPaymentSecret, secret)
+	}
+	if inv.DescriptionHash != "" {
+		dh, err := hex.DecodeString(inv.DescriptionHash)
+		if err != nil || len(dh) != 32 {
+			return "", fmt.Errorf("%w: description hash must be 32 bytes of hex", bolt11.ErrInvalidInvoice)
+		}
+		words = appendField(words, fieldDescriptionHash, dh)
+	} else {
+		words = appendField(words, fieldDescription, []byte(inv.Description))
+	}
+	if inv.Expiry != 0 && inv.Expiry != bolt11.DefaultExpiry {
+		words = appendWords(words, fieldExpiry, uintToWords(uint64(inv.Expiry.Seconds()), 0))
+	}
+	if inv.MinFinalCLTVExpiry != 0 && inv.MinFinalCLTVExpiry != bolt11.DefaultMinFinalCLTVExpiry {
+		words = appendWords(words, fieldMinFinalCLTV, uintToWords(uint64(inv.MinFinalCLTVExpiry), 0))
+	}
+	if inv.Payee != "" {
+		pub := key.PubKey().SerializeCompressed()
+		if inv.Payee != hex.EncodeToString(pub) {
+			return "", fmt.Errorf("%w: payee does not match the signing key", bolt11.ErrInvalidInvoice)
+		}
+		words = appendField(words, fieldPayee, pub)
+	}
+	for _, route := range inv.RouteHints {
+		var buf bytes.Buffer
+		for _, h := range route {
+			node, err := hex.DecodeString(h.NodeID)
+			if err != nil || len(node) != 33 {
+				return "", fmt.Errorf("%w: route hint node id must be 33 bytes of hex", bolt11.ErrInvalidInvoice)
+			}
+			buf.Write(node)
+			binary.Write(&buf, binary.BigEndian, h.ShortChannelID)
+			binary.Write(&buf, binary.BigEndian, h.FeeBaseMsat)
+			binary.Write(&buf, binary.BigEndian, h.FeeProportionalMillionths)
+			binary.Write(&buf, binary.BigEndian, h.CLTVExpiryDelta)
+		}
+		words = appendField(words, fieldRouteHint, buf.Bytes())
+	}
+
+	// The signature is 64 bytes followed by the recovery id, where
+	// SignCompact puts a flag byte first.
+	compact := ecdsa.SignCompact(key, signingHash(hrp, words), true)
+	sig := append(compact[1:], compact[0]-27-4)
+	sigWords, err := bech32.ConvertBits(sig, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	return bech32.Encode(hrp, append(words, sigWords...))
+}
+
+// formatAmount picks the largest multiplier that expresses msat exactly.
+func formatAmount(msat int64) string {
+	if msat == 0 {
+		return ""
+	}
+	for _, m := range []byte{0, 'm', 'u', 'n'} {
+		step := int64(msatPerBTC)
+		if m != 0 {
+			step = msatPerBTC / multipliers[m]
+		}
+		if msat%step == 0 {
+			s := strconv.FormatInt(msat/step, 10)
+			if m != 0 {
+				s += string(m)
+			}
+			return s
+		}
+	}
+	return strconv.FormatInt(msat*10, 10) + "p"
+}
+
+func appendField(words []byte, typ byte, data []byte) []byte {
+	w, _ := bech32.ConvertBits(data, 8, 5, true)
+	return appendWords(words, typ, w)
+}
+
+func appendWords(words []byte, typ byte, data []byte) []byte {
+	words = append(words, typ, byte(len(data)>>5), byte(len(data)&31))
+	return append(words, data...)
+}
+
+// uintToWords writes v as big-endian 5-bit words, padded to at least n
+// words. With n = 0 it uses as few words as possible.
+func uintToWords(v uint64, n int) []byte {
+	var words []byte
+	for v > 0 {
+		words = append([]byte{byte(v & 31)}, words...)
+		v >>= 5
+	}
+	for len(words) < n {
+		words = append([]byte{0}, words...)
+	}
+	return words
+}
+
+func signingHash(hrp string, words []byte) []byte {
+	b, _ := bech32.ConvertBits(words, 5, 8, true)
+	h := sha256.New()
+	h.Write([]byte(hrp))
+	h.Write(b)
+	return h.Sum(nil)
+}
@@ -2,18 +2,55 @@ package config
 
 import (
 	"fmt"
+	"net/netip"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/nostr"
+	"github.com/nostr-pay/nostr-pay/internal/rates"
+	"github.com/nostr-pay/nostr-pay/internal/secretbox"
 )
 
 type Config struct {
-	LNbitsURL        string
-	LNbitsAdminKey   string
-	LNbitsInvoiceKey string
-	ServerAddr       string
-	DBPath           string
-	NostrRelays      []string
-	CORSOrigins      []string
+	LNbitsURL            string
+	LNbitsAdminKey       string
+	LNbitsInvoiceKey     string
+	ServerAddr           string
+	DBPath               string
+	NostrRelays          []string
+	CORSOrigins          []string
+	PublicBaseURL        string
+	TrustedProxies       []netip.Prefix
+	RequirePayload       bool
+	ReplayCache          string
+	SessionTTL           time.Duration
+	OperatorPubkeys      []string
+	AccessMode           string
+	AllowedPubkeys       []string
+	ExpirySweepInterval  time.Duration
+	WebhookBaseURL       string
+	ReconcileInterval    time.Duration
+	SplitPayoutInterval  time.Duration
+	WebhookRetryInterval time.Duration
+	RateProvider         string
+	StaticRates          string
+	RatesFile            string
+	RateCacheTTL         time.Duration
+	RateMaxAge           time.Duration
+	PayFeeLimitBaseSats  int64
+	PayFeeLimitPPM       int64
+	WithdrawReserveSats  int64
+	WithdrawMaxFeeSats   int64
+	WithdrawDailySats    int64
+	LNURLMinSats         int64
+	LNURLMaxSats         int64
+	LNURLCommentChars    int64
+	WalletMode           string
+	LNbitsUserID         string
+	WalletEncryptionKey  []byte
 }
 
 func Load() (*Config, error) {
@@ -23,6 +60,14 @@ func Load() (*Config, error) {
 		LNbitsInvoiceKey: os.Getenv("LNBITS_INVOICE_KEY"),
 		ServerAddr:       getEnvDefault("SERVER_ADDR", ":8080"),
 		DBPath:           getEnvDefault("DB_PATH", "./data/nostr-pay.db"),
+		PublicBaseURL:    strings.TrimSuffix(os.Getenv("PUBLIC_BASE_URL"), "/"),
+		ReplayCache:      getEnvDefault("REPLAY_CACHE", "memory"),
+		AccessMode:       getEnvDefault("ACCESS_MODE", "open"),
+		RateProvider:     os.Getenv("RATE_PROVIDER"),
+		StaticRates:      os.Getenv("RATES_STATIC"),
+		RatesFile:        os.Getenv("RATES_FILE"),
+		WalletMode:       getEnvDefault("WALLET_MODE", "shared"),
+		LNbitsUserID:     os.Getenv("LNBITS_USER_ID"),
 	}
 
 	if relays := os.Getenv("NOSTR_RELAYS"); relays != "" {
@@ -33,6 +78,189 @@ func Load() (*Config, error) {
 		cfg.CORSOrigins = strings.Split(origins, ",")
 	}
 
+	if err := validateBaseURL("PUBLIC_BASE_URL", cfg.PublicBaseURL); err != nil {
+		return nil, err
+	}
+
+	// LNbits calls the webhook from wherever it runs, so under Docker this
+	// must be an address reachable from the LNbits container.
+	cfg.WebhookBaseURL = strings.TrimSuffix(os.Getenv("WEBHOOK_BASE_URL"), "/")
+	if err := validateBaseURL("WEBHOOK_BASE_URL", cfg.WebhookBaseURL); err != nil {
+		return nil, err
+	}
+	if cfg.WebhookBaseURL == "" {
+		cfg.WebhookBaseURL = cfg.PublicBaseURL
+	}
+	if cfg.WebhookBaseURL == "" {
+		cfg.WebhookBaseURL = "http://localhost" + cfg.ServerAddr
+	}
+
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		for _, p := range strings.Split(proxies, ",") {
+			prefix, err := parsePrefix(strings.TrimSpace(p))
+			if err != nil {
+				return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q: %w", p, err)
+			}
+			cfg.TrustedProxies = append(cfg.TrustedProxies, prefix)
+		}
+	}
+
+	requirePayload, err := getEnvBool("NIP98_REQUIRE_PAYLOAD", false)
+	if err != nil {
+		return nil, err
+	}
+	cfg.RequirePayload = requirePayload
+
+	sessionTTL, err := getEnvDuration("SESSION_TTL", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SessionTTL = sessionTTL
+
+	sweepInterval, err := getEnvDuration("EXPIRY_SWEEP_INTERVAL", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ExpirySweepInterval = sweepInterval
+
+	reconcileInterval, err := getEnvDuration("RECONCILE_INTERVAL", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ReconcileInterval = reconcileInterval
+
+	splitInterval, err := getEnvDuration("SPLIT_PAYOUT_INTERVAL", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SplitPayoutInterval = splitInterval
+
+	webhookInterval, err := getEnvDuration("WEBHOOK_RETRY_INTERVAL", 15*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	cfg.WebhookRetryInterval = webhookInterval
+
+	switch cfg.RateProvider {
+	case "":
+	case "static":
+		if _, err := rates.ParseStatic(cfg.StaticRates); err != nil {
+			return nil, fmt.Errorf("invalid RATES_STATIC: %w", err)
+		}
+	case "file":
+		if cfg.RatesFile == "" {
+			return nil, fmt.Errorf("RATES_FILE is required when RATE_PROVIDER is file")
+		}
+	default:
+		return nil, fmt.Errorf("invalid RATE_PROVIDER %q: must be static or file", cfg.RateProvider)
+	}
+
+	rateCacheTTL, err := getEnvDuration("RATE_CACHE_TTL", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	cfg.RateCacheTTL = rateCacheTTL
+
+	rateMaxAge, err := getEnvDuration("RATE_MAX_AGE", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	cfg.RateMaxAge = rateMaxAge
+
+	feeBase, err := getEnvInt("PAY_FEE_LIMIT_BASE_SATS", 10)
+	if err != nil {
+		return nil, err
+	}
+	cfg.PayFeeLimitBaseSats = feeBase
+
+	feePPM, err := getEnvInt("PAY_FEE_LIMIT_PPM", 10_000)
+	if err != nil {
+		return nil, err
+	}
+	cfg.PayFeeLimitPPM = feePPM
+
+	withdrawReserve, err := getEnvInt("WITHDRAW_RESERVE_SATS", 1000)
+	if err != nil {
+		return nil, err
+	}
+	cfg.WithdrawReserveSats = withdrawReserve
+
+	withdrawMaxFee, err := getEnvInt("WITHDRAW_MAX_FEE_SATS", 1000)
+	if err != nil {
+		return nil, err
+	}
+	cfg.WithdrawMaxFeeSats = withdrawMaxFee
+
+	withdrawDaily, err := getEnvInt("WITHDRAW_DAILY_LIMIT_SATS", 1_000_000)
+	if err != nil {
+		return nil, err
+	}
+	cfg.WithdrawDailySats = withdrawDaily
+
+	// Lightning addresses are served at PUBLIC_BASE_URL when it is set
+	lnurlMin, err := getEnvInt("LNURL_MIN_SENDABLE_SATS", 1)
+	if err != nil {
+		return nil, err
+	}
+	lnurlMax, err := getEnvInt("LNURL_MAX_SENDABLE_SATS", 1_000_000)
+	if err != nil {
+		return nil, err
+	}
+	if lnurlMin < 1 || lnurlMax < lnurlMin {
+		return nil, fmt.Errorf("invalid LNURL_MIN_SENDABLE_SATS %d and LNURL_MAX_SENDABLE_SATS %d: need 1 <= min <= max", lnurlMin, lnurlMax)
+	}
+	cfg.LNURLMinSats = lnurlMin
+	cfg.LNURLMaxSats = lnurlMax
+
+	lnurlComment, err := getEnvInt("LNURL_COMMENT_ALLOWED", 144)
+	if err != nil {
+		return nil, err
+	}
+	if lnurlComment < 0 {
+		return nil, fmt.Errorf("invalid LNURL_COMMENT_ALLOWED %d: must not be negative", lnurlComment)
+	}
+	cfg.LNURLCommentChars = lnurlComment
+
+	// In merchant mode each merchant gets a wallet of its own, created
+	// through the LNbits user manager extension of LNBITS_USER_ID, whose
+	// wallet the admin and invoice keys belong to.
+	switch cfg.WalletMode {
+	case "shared":
+	case "merchant":
+		if cfg.LNbitsUserID == "" {
+			return nil, fmt.Errorf("LNBITS_USER_ID is required when WALLET_MODE is merchant")
+		}
+		key, err := secretbox.ParseKey(os.Getenv("WALLET_ENCRYPTION_KEY"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid WALLET_ENCRYPTION_KEY: %w", err)
+		}
+		cfg.WalletEncryptionKey = key
+	default:
+		return nil, fmt.Errorf("invalid WALLET_MODE %q: must be shared or merchant", cfg.WalletMode)
+	}
+
+	if cfg.ReplayCache != "memory" && cfg.ReplayCache != "store" {
+		return nil, fmt.Errorf("invalid REPLAY_CACHE %q: must be memory or store", cfg.ReplayCache)
+	}
+
+	operators, err := getEnvPubkeys("OPERATOR_PUBKEYS")
+	if err != nil {
+		return nil, err
+	}
+	cfg.OperatorPubkeys = operators
+
+	switch cfg.AccessMode {
+	case "open", "allowlist", "invite":
+	default:
+		return nil, fmt.Errorf("invalid ACCESS_MODE %q: must be open, allowlist or invite", cfg.AccessMode)
+	}
+
+	allowed, err := getEnvPubkeys("ALLOWED_PUBKEYS")
+	if err != nil {
+		return nil, err
+	}
+	cfg.AllowedPubkeys = allowed
+
 	if cfg.LNbitsURL == "" || cfg.LNbitsAdminKey == "" || cfg.LNbitsInvoiceKey == "" {
 		return nil, fmt.Errorf("required config missing: LNBITS_URL, LNBITS_ADMIN_KEY, and LNBITS_INVOICE_KEY must be set")
 	}
@@ -40,9 +268,88 @@ func Load() (*Config, error) {
 	return cfg, nil
 }
 
+// validateBaseURL checks that an optional base URL setting is an absolute
+// http(s) URL.
+func validateBaseURL(key, v string) error {
+	if v == "" {
+		return nil
+	}
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid %s %q: must be an absolute http(s) URL", key, v)
+	}
+	return nil
+}
+
+// getEnvPubkeys parses a comma-separated list of hex, npub or nprofile
+// pubkeys and returns them as hex.
+func getEnvPubkeys(key string) ([]string, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return nil, nil
+	}
+	var pubkeys []string
+	for _, entry := range strings.Split(v, ",") {
+		pk, err := nostr.ParsePubkey(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %w", key, strings.TrimSpace(entry), err)
+		}
+		pubkeys = append(pubkeys, pk)
+	}
+	return pubkeys, nil
+}
+
 func getEnvDefault(key, fallback string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
 	}
 	return fallback
 }
+
+// parsePrefix accepts either a CIDR range or a single IP address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func getEnvBool(key string, fallback bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: must be a boolean", key, v)
+	}
+	return b, nil
+}
+
+func getEnvInt(key string, fallback int64) (int64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a non-negative integer", key, v)
+	}
+	return n, nil
+}
+
+func getEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive duration such as 24h", key, v)
+	}
+	return d, nil
+}
@@ -62,3 +62,260 @@ func TestLoadMissingRequired(t *testing.T) {
 		t.Fatal("expected error for missing required config")
 	}
 }
+
+func TestLoadPublicURLAndProxies(t *testing.T) {
+	t.Setenv("LNBITS_URL", "https://lnbits.test.com")
+	t.Setenv("LNBITS_ADMIN_KEY", "key")
+	t.Setenv("LNBITS_INVOICE_KEY", "key")
+	t.Setenv("PUBLIC_BASE_URL", "https://pay.example.com/")
+	t.Setenv("TRUSTED_PROXIES", "172.16.0.0/12, 127.0.0.1")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.PublicBaseURL != "https://pay.example.com" {
+		t.Errorf("PublicBaseURL = %q, want %q", cfg.PublicBaseURL, "https://pay.example.com")
+	}
+	if len(cfg.TrustedProxies) != 2 {
+		t.Fatalf("TrustedProxies len = %d, want 2", len(cfg.TrustedProxies))
+	}
+	if cfg.TrustedProxies[1].String() != "127.0.0.1/32" {
+		t.Errorf("TrustedProxies[1] = %q, want %q", cfg.TrustedProxies[1], "127.0.0.1/32")
+	}
+}
+
+func TestLoadInvalidTrustedProxy(t *testing.T) {
+	t.Setenv("LNBITS_URL", "https://lnbits.test.com")
+	t.Setenv("LNBITS_ADMIN_KEY", "key")
+	t.Setenv("LNBITS_INVOICE_KEY", "key")
+	t.Setenv("TRUSTED_PROXIES", "not-an-ip")
+
+	if _, err := config.Load(); err == nil {
+		t.Fatal("expected error for invalid TRUSTED_PROXIES")
+	}
+}
+
+func TestLoadInvalidBool(t *testing.T) {
+	t.Setenv("LNBITS_URL", "https://lnbits.test.com")
+	t.Setenv("LNBITS_ADMIN_KEY", "key")
+	t.Setenv("LNBITS_INVOICE_KEY", "key")
+	t.Setenv("NIP98_REQUIRE_PAYLOAD", "sometimes")
+
+	if _, err := config.Load(); err == nil {
+		t.Fatal("expected error for invalid NIP98_REQUIRE_PAYLOAD")
+	}
+}
+
+func TestLoadOperatorPubkeys(t *testing.T) {
+	t.Setenv("LNBITS_URL", "https://lnbits.test.com")
+	t.Setenv("LNBITS_ADMIN_KEY", "key")
+	t.Setenv("LNBITS_INVOICE_KEY", "key")
+	t.Setenv("OPERATOR_PUBKEYS", "npub-is-not-hex")
+
+	if _, err := config.Load(); err == nil {
+		t.Fatal("expected error for invalid OPERATOR_PUBKEYS")
+	}
+
+	pk := "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+	t.Setenv("OPERATOR_PUBKEYS", pk)
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.OperatorPubkeys) != 1 || cfg.OperatorPubkeys[0] != pk {
+		t.Errorf("OperatorPubkeys = %v, want [%s]", cfg.OperatorPubkeys, pk)
+	}
+
+	// npub entries are normalized to hex
+	t.Setenv("OPERATOR_PUBKEYS", "npub180cvv07tjdrrgpa0j7j7tmnyl2yr6yr7l8j4s3evf6u64th6gkwsyjh6w6")
+	cfg, err = config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.OperatorPubkeys) != 1 || cfg.OperatorPubkeys[0] != pk {
+		t.Errorf("OperatorPubkeys = %v, want [%s]", cfg.OperatorPubkeys, pk)
+	}
+}
+
+func TestLoadAccessMode(t *testing.T) {
+	t.Setenv("LNBITS_URL", "https://lnbits.test.com")
+	t.Setenv("LNBITS_ADMIN_KEY", "key")
+	t.Setenv("LNBITS_INVOICE_KEY", "key")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.AccessMode != "open" {
+		t.Errorf("AccessMode = %q, want open", cfg.AccessMode)
+	}
+
+	t.Setenv("ACCESS_MODE", "closed")
+	if _, err := config.Load(); err == nil {
+		t.Fatal("expected error for invalid ACCESS_MODE")
+	}
+
+	t.Setenv("ACCESS_MODE", "allowlist")
+	t.Setenv("ALLOWED_PUBKEYS", "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d, npub1invalid")
+	if _, err := config.Load(); err == nil {
+		t.Fatal("expected error for invalid ALLOWED_PUBKEYS entry")
+	}
+}
+
+func TestLoadWebhookBaseURL(t *testing.T) {
+	t.Setenv("LNBITS_URL", "https://lnbits.test.com")
+	t.Setenv("LNBITS_ADMIN_KEY", "key")
+	t.Setenv("LNBITS_INVOICE_KEY", "key")
+	t.Setenv("SERVER_ADDR", ":9090")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.WebhookBaseURL != "http://localhost:9090" {
+		t.Errorf("WebhookBaseURL = %q, want listen address fallback", cfg.WebhookBaseURL)
+	}
+
+	t.Setenv("PUBLIC_BASE_URL", "https://pay.example.com")
+	cfg, _ = config.Load()
+	if cfg.WebhookBaseURL != "https://pay.example.com" {
+		t.Errorf("WebhookBaseURL = %q, want public base URL", cfg.WebhookBaseURL)
+	}
+
+	t.Setenv("WEBHOOK_BASE_URL", "http://api:8080/")
+	cfg, _ = config.Load()
+	if cfg.WebhookBaseURL != "http://api:8080" {
+		t.Errorf("WebhookBaseURL = %q, want %q", cfg.WebhookBaseURL, "http://api:8080")
+	}
+
+	t.Setenv("WEBHOOK_BASE_URL", "api:8080")
+	if _, err := config.Load(); err == nil {
+		t.Fatal("expected error for relative WEBHOOK_BASE_URL")
+	}
+}
+
+func TestLoadRateProvider(t *testing.T) {
+	t.Setenv("LNBITS_URL", "https://lnbits.test.com")
+	t.Setenv("LNBITS_ADMIN_KEY", "key")
+	t.Setenv("LNBITS_INVOICE_KEY", "key")
+
+	t.Setenv("RATE_PROVIDER", "static")
+	t.Setenv("RATES_STATIC", "EUR=sixty")
+	if _, err := config.Load(); err == nil {
+		t.Fatal("expected error for invalid RATES_STATIC")
+	}
+
+	t.Setenv("RATES_STATIC", "EUR=60000")
+	if _, err := config.Load(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	t.Setenv("RATE_PROVIDER", "file")
+	if _, err := config.Load(); err == nil {
+		t.Fatal("expected error for file provider without RATES_FILE")
+	}
+}
+
+func TestLoadPayFeeLimit(t *testing.T) {
+	t.Setenv("LNBITS_URL", "https://lnbits.test.com")
+	t.Setenv("LNBITS_ADMIN_KEY", "key")
+	t.Setenv("LNBITS_INVOICE_KEY", "key")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.PayFeeLimitBaseSats != 10 || cfg.PayFeeLimitPPM != 10000 {
+		t.Errorf("fee limit = %d + %d ppm, want 10 + 10000 ppm", cfg.PayFeeLimitBaseSats, cfg.PayFeeLimitPPM)
+	}
+
+	t.Setenv("PAY_FEE_LIMIT_PPM", "-1")
+	if _, err := config.Load(); err == nil {
+		t.Fatal("expected error for negative PAY_FEE_LIMIT_PPM")
+	}
+}
+
+func TestLoadWalletMode(t *testing.T) {
+	t.Setenv("LNBITS_URL", "https://lnbits.test.com")
+	t.Setenv("LNBITS_ADMIN_KEY", "key")
+	t.Setenv("LNBITS_INVOICE_KEY", "key")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.WalletMode != "shared" || cfg.WalletEncryptionKey != nil {
+		t.Errorf("WalletMode = %q, want shared without a key", cfg.WalletMode)
+	}
+
+	t.Setenv("WALLET_MODE", "merchant")
+	if _, err := config.Load(); err == nil {
+		t.Fatal("expected error for merchant mode without LNBITS_USER_ID")
+	}
+
+	t.Setenv("LNBITS_USER_ID", "lnbits-user")
+	t.Setenv("WALLET_ENCRYPTION_KEY", "too-short")
+	if _, err := config.Load(); err == nil {
+		t.Fatal("expected error for invalid WALLET_ENCRYPTION_KEY")
+	}
+
+	t.Setenv("WALLET_ENCRYPTION_KEY", "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	cfg, err = config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.WalletEncryptionKey) != 32 || cfg.LNbitsUserID != "lnbits-user" {
+		t.Errorf("key of %d bytes for %q", len(cfg.WalletEncryptionKey), cfg.LNbitsUserID)
+	}
+
+	t.Setenv("WALLET_MODE", "custodial")
+	if _, err := config.Load(); err == nil {
+		t.Fatal("expected error for invalid WALLET_MODE")
+	}
+}
+
+func TestLoadWithdrawalLimits(t *testing.T) {
+	t.Setenv("LNBITS_URL", "https://lnbits.test.com")
+	t.Setenv("LNBITS_ADMIN_KEY", "key")
+	t.Setenv("LNBITS_INVOICE_KEY", "key")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.WithdrawReserveSats != 1000 || cfg.WithdrawMaxFeeSats != 1000 || cfg.WithdrawDailySats != 1_000_000 {
+		t.Errorf("withdrawal limits = %d reserve, %d fee, %d a day", cfg.WithdrawReserveSats, cfg.WithdrawMaxFeeSats, cfg.WithdrawDailySats)
+	}
+
+	t.Setenv("WITHDRAW_DAILY_LIMIT_SATS", "0")
+	if cfg, _ := config.Load(); cfg.WithdrawDailySats != 0 {
+		t.Errorf("WithdrawDailySats = %d, want 0", cfg.WithdrawDailySats)
+	}
+
+	t.Setenv("WITHDRAW_RESERVE_SATS", "lots")
+	if _, err := config.Load(); err == nil {
+		t.Fatal("expected error for invalid WITHDRAW_RESERVE_SATS")
+	}
+}
+
+func TestLoadLNURLLimits(t *testing.T) {
+	t.Setenv("LNBITS_URL", "https://lnbits.test.com")
+	t.Setenv("LNBITS_ADMIN_KEY", "key")
+	t.Setenv("LNBITS_INVOICE_KEY", "key")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.LNURLMinSats != 1 || cfg.LNURLMaxSats != 1_000_000 || cfg.LNURLCommentChars != 144 {
+		t.Errorf("lnurl limits = %d-%d sats, %d comment chars", cfg.LNURLMinSats, cfg.LNURLMaxSats, cfg.LNURLCommentChars)
+	}
+
+	t.Setenv("LNURL_MIN_SENDABLE_SATS", "5000")
+	t.Setenv("LNURL_MAX_SENDABLE_SATS", "1000")
+	if _, err := config.Load(); err == nil {
+		t.Fatal("expected error for a minimum above the maximum")
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 )
 
 type Client struct {
@@ -25,12 +27,26 @@ func NewClient(baseURL, adminKey, invoiceKey string) *Client {
 	}
 }
 
+// WithKeys returns a client for another wallet on the same LNbits instance.
+func (c *Client) WithKeys(adminKey, invoiceKey string) *Client {
+	return &Client{
+		baseURL:    c.baseURL,
+		adminKey:   adminKey,
+		invoiceKey: invoiceKey,
+		httpClient: c.httpClient,
+	}
+}
+
 // Request/Response types
 
 type CreateInvoiceRequest struct {
 	Amount  int64  `json:"amount"`
 	Memo    string `json:"memo,omitempty"`
 	Webhook string `json:"webhook,omitempty"`
+	Expiry  int64  `json:"expiry,omitempty"` // seconds; LNbits default when zero
+	// DescriptionHash is the hex SHA-256 of a description the invoice
+	// commits to in place of Memo, such as LNURL-pay metadata.
+	DescriptionHash string `json:"description_hash,omitempty"`
 }
 
 type CreateInvoiceResponse struct {
@@ -40,18 +56,53 @@ type CreateInvoiceResponse struct {
 }
 
 type PaymentStatus struct {
-	Paid        bool   `json:"paid"`
-	Preimage    string `json:"preimage"`
+	Paid bool `json:"paid"`
+	// Status is "pending", "success" or "failed"; LNbits versions before
+	// 0.12 leave it out.
+	Status      string         `json:"status"`
+	Preimage    string         `json:"preimage"`
+	PaymentHash string         `json:"payment_hash"`
+	Amount      int64          `json:"amount"`
+	Details     PaymentDetails `json:"details"`
+}
+
+type PaymentDetails struct {
+	Amount int64 `json:"amount"` // millisats, negative for outgoing
+	Fee    int64 `json:"fee"`    // millisats, negative for outgoing
+}
+
+type PayInvoiceResponse struct {
 	PaymentHash string `json:"payment_hash"`
-	Amount      int64  `json:"amount"`
+	CheckingID  string `json:"checking_id"`
 }
 
+// ErrPaymentFailed is returned when LNbits reports that an outgoing payment
+// did not go through, as opposed to a transport error where the outcome is
+// unknown.
+var ErrPaymentFailed = errors.New("lnbits: payment failed")
+
+// statusPaymentError is the status LNbits answers a failed payment with.
+const statusPaymentError = 520
+
+// ErrPaymentNotFound is returned by CheckPayment when the wallet has no
+// payment with the hash.
+var ErrPaymentNotFound = errors.New("lnbits: payment not found")
+
 type Wallet struct {
 	ID      string `json:"id"`
 	Name    string `json:"name"`
 	Balance int64  `json:"balance"`
 }
 
+// UserWallet is an LNbits user created through the user manager extension,
+// with its wallet and that wallet's keys.
+type UserWallet struct {
+	UserID     string
+	WalletID   string
+	AdminKey   string
+	InvoiceKey string
+}
+
 // Methods
 
 func (c *Client) CreateInvoice(ctx context.Context, req *CreateInvoiceRequest) (*CreateInvoiceResponse, error) {
@@ -64,6 +115,12 @@ func (c *Client) CreateInvoice(ctx context.Context, req *CreateInvoiceRequest) (
 	if req.Webhook != "" {
 		body["webhook"] = req.Webhook
 	}
+	if req.Expiry > 0 {
+		body["expiry"] = req.Expiry
+	}
+	if req.DescriptionHash != "" {
+		body["description_hash"] = req.DescriptionHash
+	}
 
 	resp, err := c.doRequest(ctx, http.MethodPost, "/api/v1/payments", c.invoiceKey, body)
 	if err != nil {
@@ -89,6 +146,9 @@ func (c *Client) CheckPayment(ctx context.Context, paymentHash string) (*Payment
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrPaymentNotFound
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("lnbits: check payment returned status %d", resp.StatusCode)
 	}
@@ -100,6 +160,66 @@ func (c *Client) CheckPayment(ctx context.Context, paymentHash string) (*Payment
 	return &result, nil
 }
 
+// PayInvoice pays a bolt11 invoice from the wallet using the admin key.
+// LNbits blocks until the payment succeeds or fails. ErrPaymentFailed is
+// only returned when the payment was refused: a 4xx response, or LNbits'
+// own 520 with the reason in its JSON detail. Any other status, such as a
+// proxy's 502 or 504, leaves the outcome unknown, since the payment may
+// still go through.
+func (c *Client) PayInvoice(ctx context.Context, bolt11 string) (*PayInvoiceResponse, error) {
+	body := map[string]any{
+		"out":    true,
+		"bolt11": bolt11,
+	}
+
+	resp, err := c.doRequest(ctx, http.MethodPost, "/api/v1/payments", c.adminKey, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		var e struct {
+			Detail string `json:"detail"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 ||
+			resp.StatusCode == statusPaymentError && e.Detail != "" {
+			return nil, fmt.Errorf("%w: status %d: %s", ErrPaymentFailed, resp.StatusCode, e.Detail)
+		}
+		return nil, fmt.Errorf("lnbits: pay invoice returned status %d, outcome unknown", resp.StatusCode)
+	}
+
+	var result PayInvoiceResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("lnbits: decode response: %w", err)
+	}
+	return &result, nil
+}
+
+// FeeReserve returns, in millisats, the most LNbits will let the routing
+// of bolt11 cost: its fee reserve (LNBITS_RESERVE_FEE_MIN/PERCENT) for the
+// amount, which it passes to its funding source as the fee limit.
+func (c *Client) FeeReserve(ctx context.Context, bolt11 string) (int64, error) {
+	resp, err := c.doRequest(ctx, http.MethodGet, "/api/v1/payments/fee-reserve?invoice="+url.QueryEscape(bolt11), c.invoiceKey, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("lnbits: fee reserve returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		FeeReserve int64 `json:"fee_reserve"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("lnbits: decode response: %w", err)
+	}
+	return result.FeeReserve, nil
+}
+
 func (c *Client) GetWallet(ctx context.Context) (*Wallet, error) {
 	resp, err := c.doRequest(ctx, http.MethodGet, "/api/v1/wallet", c.invoiceKey, nil)
 	if err != nil {
@@ -118,6 +238,52 @@ func (c *Client) GetWallet(ctx context.Context) (*Wallet, error) {
 	return &result, nil
 }
 
+// CreateUserWallet creates an LNbits user with one wallet through the user
+// manager extension, which must be enabled for the LNbits user adminID. The
+// request is made with the admin key of a wallet of that user.
+func (c *Client) CreateUserWallet(ctx context.Context, adminID, userName, walletName string) (*UserWallet, error) {
+	body := map[string]any{
+		"admin_id":    adminID,
+		"user_name":   userName,
+		"wallet_name": walletName,
+	}
+
+	resp, err := c.doRequest(ctx, http.MethodPost, "/usermanager/api/v1/users", c.adminKey, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("lnbits: create user returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		ID      string `json:"id"`
+		Wallets []struct {
+			ID       string `json:"id"`
+			AdminKey string `json:"adminkey"`
+			InKey    string `json:"inkey"`
+		} `json:"wallets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("lnbits: decode response: %w", err)
+	}
+	if result.ID == "" || len(result.Wallets) == 0 {
+		return nil, errors.New("lnbits: create user returned no wallet")
+	}
+	w := result.Wallets[0]
+	if w.ID == "" || w.AdminKey == "" || w.InKey == "" {
+		return nil, errors.New("lnbits: create user returned a wallet without keys")
+	}
+	return &UserWallet{
+		UserID:     result.ID,
+		WalletID:   w.ID,
+		AdminKey:   w.AdminKey,
+		InvoiceKey: w.InKey,
+	}, nil
+}
+
 func (c *Client) doRequest(ctx context.Context, method, path, apiKey string, body any) (*http.Response, error) {
 	var bodyReader io.Reader
 	if body != nil {
@@ -3,6 +3,7 @@ package lnbits_test
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -31,6 +32,9 @@ func TestCreateInvoice(t *testing.T) {
 		if body["amount"] != float64(1000) {
 			t.Errorf("amount = %v, want 1000", body["amount"])
 		}
+		if body["expiry"] != float64(600) {
+			t.Errorf("expiry = %v, want 600", body["expiry"])
+		}
 
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -46,6 +50,7 @@ func TestCreateInvoice(t *testing.T) {
 	invoice, err := client.CreateInvoice(context.Background(), &lnbits.CreateInvoiceRequest{
 		Amount: 1000,
 		Memo:   "Test payment",
+		Expiry: 600,
 	})
 	if err != nil {
 		t.Fatalf("CreateInvoice: %v", err)
@@ -59,6 +64,25 @@ func TestCreateInvoice(t *testing.T) {
 	}
 }
 
+func TestCreateInvoice_DescriptionHash(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["description_hash"] != "ab12" {
+			t.Errorf("description_hash = %v, want ab12", body["description_hash"])
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"payment_hash": "hash_123"})
+	}))
+	defer server.Close()
+
+	client := lnbits.NewClient(server.URL, "test-admin-key", "test-invoice-key")
+	if _, err := client.CreateInvoice(context.Background(), &lnbits.CreateInvoiceRequest{Amount: 1000, DescriptionHash: "ab12"}); err != nil {
+		t.Fatalf("CreateInvoice: %v", err)
+	}
+}
+
 func TestCheckPayment(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/api/v1/payments/hash_123" {
@@ -67,6 +91,7 @@ func TestCheckPayment(t *testing.T) {
 
 		json.NewEncoder(w).Encode(map[string]any{
 			"paid":         true,
+			"status":       "success",
 			"preimage":     "preimage_abc",
 			"payment_hash": "hash_123",
 			"amount":       1000000, // millisats
@@ -84,8 +109,20 @@ func TestCheckPayment(t *testing.T) {
 	if !status.Paid {
 		t.Error("expected Paid = true")
 	}
-	if status.Preimage != "preimage_abc" {
-		t.Errorf("Preimage = %q, want %q", status.Preimage, "preimage_abc")
+	if status.Preimage != "preimage_abc" || status.Status != "success" {
+		t.Errorf("status = %+v, want success with preimage_abc", status)
+	}
+}
+
+func TestCheckPayment_NotFound(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"detail":"Payment does not exist."}`, http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	client := lnbits.NewClient(server.URL, "test-admin-key", "test-invoice-key")
+	if _, err := client.CheckPayment(context.Background(), "hash_123"); !errors.Is(err, lnbits.ErrPaymentNotFound) {
+		t.Errorf("err = %v, want ErrPaymentNotFound", err)
 	}
 }
 
@@ -117,3 +154,128 @@ func TestGetWallet(t *testing.T) {
 		t.Errorf("Balance = %d, want 500000", wallet.Balance)
 	}
 }
+
+func TestPayInvoice(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "test-admin-key" {
+			t.Errorf("pay must use the admin key")
+		}
+
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["out"] != true {
+			t.Errorf("out = %v, want true", body["out"])
+		}
+
+		if body["bolt11"] == "lnbc_unroutable" {
+			w.WriteHeader(520)
+			json.NewEncoder(w).Encode(map[string]string{"detail": "no route"})
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"payment_hash": "hash_out"})
+	}))
+	defer server.Close()
+
+	client := lnbits.NewClient(server.URL, "test-admin-key", "test-invoice-key")
+
+	resp, err := client.PayInvoice(context.Background(), "lnbc_ok")
+	if err != nil {
+		t.Fatalf("PayInvoice: %v", err)
+	}
+	if resp.PaymentHash != "hash_out" {
+		t.Errorf("PaymentHash = %q, want %q", resp.PaymentHash, "hash_out")
+	}
+
+	if _, err := client.PayInvoice(context.Background(), "lnbc_unroutable"); !errors.Is(err, lnbits.ErrPaymentFailed) {
+		t.Errorf("err = %v, want ErrPaymentFailed", err)
+	}
+}
+
+func TestPayInvoice_UnknownOutcome(t *testing.T) {
+	for _, code := range []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout, 520} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// A proxy's error page, which says nothing about the payment
+			w.WriteHeader(code)
+			w.Write([]byte("<html>upstream timed out</html>"))
+		}))
+		client := lnbits.NewClient(server.URL, "test-admin-key", "test-invoice-key")
+		_, err := client.PayInvoice(context.Background(), "lnbc_slow")
+		if err == nil || errors.Is(err, lnbits.ErrPaymentFailed) {
+			t.Errorf("status %d: err = %v, want an error other than ErrPaymentFailed", code, err)
+		}
+		server.Close()
+	}
+}
+
+func TestFeeReserve(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/payments/fee-reserve" || r.URL.Query().Get("invoice") != "lnbc_ok" {
+			t.Errorf("unexpected request: %s", r.URL)
+		}
+		json.NewEncoder(w).Encode(map[string]any{"fee_reserve": 12000})
+	}))
+	defer server.Close()
+
+	client := lnbits.NewClient(server.URL, "test-admin-key", "test-invoice-key")
+	reserve, err := client.FeeReserve(context.Background(), "lnbc_ok")
+	if err != nil {
+		t.Fatalf("FeeReserve: %v", err)
+	}
+	if reserve != 12000 {
+		t.Errorf("FeeReserve = %d, want 12000", reserve)
+	}
+}
+
+func TestCreateUserWallet(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/usermanager/api/v1/users" || r.Method != http.MethodPost {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("X-Api-Key") != "test-admin-key" {
+			t.Errorf("create user must use the admin key")
+		}
+
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["admin_id"] != "admin_user" || body["wallet_name"] != "Shop" {
+			t.Errorf("body = %v", body)
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{
+			"id":   "user_1",
+			"name": body["user_name"],
+			"wallets": []map[string]string{
+				{"id": "wallet_1", "user": "user_1", "adminkey": "admin_1", "inkey": "invoice_1"},
+			},
+		})
+	}))
+	defer server.Close()
+
+	client := lnbits.NewClient(server.URL, "test-admin-key", "test-invoice-key")
+
+	wallet, err := client.CreateUserWallet(context.Background(), "admin_user", "merchant", "Shop")
+	if err != nil {
+		t.Fatalf("CreateUserWallet: %v", err)
+	}
+	want := lnbits.UserWallet{UserID: "user_1", WalletID: "wallet_1", AdminKey: "admin_1", InvoiceKey: "invoice_1"}
+	if *wallet != want {
+		t.Errorf("wallet = %+v, want %+v", *wallet, want)
+	}
+}
+
+func TestWithKeys(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "invoice_1" {
+			t.Errorf("X-Api-Key = %q, want the other wallet's invoice key", r.Header.Get("X-Api-Key"))
+		}
+		json.NewEncoder(w).Encode(map[string]any{"id": "wallet_1", "balance": 0})
+	}))
+	defer server.Close()
+
+	client := lnbits.NewClient(server.URL, "test-admin-key", "test-invoice-key").WithKeys("admin_1", "invoice_1")
+	if _, err := client.GetWallet(context.Background()); err != nil {
+		t.Fatalf("GetWallet: %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+// Package lnurl fetches invoices from Lightning addresses (LUD-16) using
+// LNURL-pay (LUD-06), and encodes the LNURLs of the ones served here.
+package lnurl
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nostr-pay/nostr-pay/internal/bolt11"
+)
+
+var (
+	ErrInvalidAddress   = errors.New("invalid lightning address")
+	ErrAmountOutOfRange = errors.New("amount outside the range the recipient accepts")
+	ErrBadInvoice       = errors.New("recipient returned a bad invoice")
+)
+
+// PayParams is a recipient's LNURL-pay offer.
+type PayParams struct {
+	Callback       string `json:"callback"`
+	MinSendable    int64  `json:"minSendable"` // msat
+	MaxSendable    int64  `json:"maxSendable"` // msat
+	Metadata       string `json:"metadata"`
+	CommentAllowed int    `json:"commentAllowed"`
+	Tag            string `json:"tag"`
+}
+
+// errorResponse is how LNURL services report failures, with HTTP 200.
+type errorResponse struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// maxResponseSize bounds what is read from a recipient's server.
+const maxResponseSize = 64 << 10
+
+type Client struct {
+	httpClient *http.Client
+}
+
+func NewClient(httpClient *http.Client) *Client {
+	return &Client{httpClient: httpClient}
+}
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9\-_.+]+$`)
+
+// ParseAddress splits user@domain and returns the LNURL-pay endpoint for
+// it. Onion domains are reached over http, everything else over https.
+func ParseAddress(address string) (string, error) {
+	user, domain, ok := strings.Cut(strings.ToLower(strings.TrimSpace(address)), "@")
+	if !ok || !usernamePattern.MatchString(user) || domain == "" || strings.ContainsAny(domain, "/?#@") {
+		return "", fmt.Errorf("%w %q", ErrInvalidAddress, address)
+	}
+	scheme := "https"
+	if strings.HasSuffix(strings.Split(domain, ":")[0], ".onion") {
+		scheme = "http"
+	}
+	return scheme + "://" + domain + "/.well-known/lnurlp/" + user, nil
+}
+
+// Resolve fetches the pay parameters of a Lightning address.
+func (c *Client) Resolve(ctx context.Context, address string) (*PayParams, error) {
+	endpoint, err := ParseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	var params PayParams
+	if err := c.get(ctx, endpoint, &params); err != nil {
+		return nil, err
+	}
+	if params.Tag != "payRequest" {
+		return nil, fmt.Errorf("lnurl: %s is not a pay request", address)
+	}
+	if _, err := url.Parse(params.Callback); err != nil || !strings.HasPrefix(params.Callback, "http") {
+		return nil, fmt.Errorf("lnurl: invalid callback %q", params.Callback)
+	}
+	return &params, nil
+}
+
+// FetchInvoice asks a Lightning address for an invoice of amountMsat. The
+// invoice is checked to be for that amount and to commit to the offer's
+// metadata. The comment is sent only if the recipient accepts comments,
+// truncated to the length it allows.
+func (c *Client) FetchInvoice(ctx context.Context, address string, amountMsat int64, comment string) (string, error) {
+	params, err := c.Resolve(ctx, address)
+	if err != nil {
+		return "", err
+	}
+	if amountMsat < params.MinSendable || amountMsat > params.MaxSendable {
+		return "", fmt.Errorf("%w: %d-%d msat", ErrAmountOutOfRange, params.MinSendable, params.MaxSendable)
+	}
+
+	callback, _ := url.Parse(params.Callback)
+	q := callback.Query()
+	q.Set("amount", strconv.FormatInt(amountMsat, 10))
+	if comment != "" && params.CommentAllowed > 0 {
+		if r := []rune(comment); len(r) > params.CommentAllowed {
+			comment = string(r[:params.CommentAllowed])
+		}
+		q.Set("comment", comment)
+	}
+	callback.RawQuery = q.Encode()
+
+	var resp struct {
+		PR string `json:"pr"`
+	}
+	if err := c.get(ctx, callback.String(), &resp); err != nil {
+		return "", err
+	}
+
+	inv, err := bolt11.Decode(resp.PR)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrBadInvoice, err)
+	}
+	if inv.AmountMsat != amountMsat {
+		return "", fmt.Errorf("%w: amount %d msat, requested %d", ErrBadInvoice, inv.AmountMsat, amountMsat)
+	}
+	metadataHash := sha256.Sum256([]byte(params.Metadata))
+	if inv.DescriptionHash != hex.EncodeToString(metadataHash[:]) {
+		return "", fmt.Errorf("%w: description hash does not match the metadata", ErrBadInvoice)
+	}
+	return resp.PR, nil
+}
+
+func (c *Client) get(ctx context.Context, endpoint string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("lnurl: create request: %w", err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("lnurl: request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("lnurl: %s returned status %d", req.URL.Host, resp.StatusCode)
+	}
+
+	var body json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&body); err != nil {
+		return fmt.Errorf("lnurl: decode response: %w", err)
+	}
+	var e errorResponse
+	if json.Unmarshal(body, &e) == nil && strings.EqualFold(e.Status, "ERROR") {
+		return fmt.Errorf("lnurl: %s", e.Reason)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("lnurl: decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package lnurl_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+
+	"github.com/nostr-pay/nostr-pay/internal/bolt11"
+	"github.com/nostr-pay/nostr-pay/internal/bolt11/bolt11test"
+	"github.com/nostr-pay/nostr-pay/internal/lnurl"
+)
+
+const metadata = `[["text/plain","Pay alice"]]`
+
+// newServer serves alice's LNURL-pay offer. invoiceMsat, if set, replaces
+// the amount of the returned invoices.
+func newServer(t *testing.T, invoiceMsat int64) (*httptest.Server, *[]string) {
+	t.Helper()
+	key, _ := btcec.NewPrivateKey()
+	var comments []string
+
+	mux := http.NewServeMux()
+	var server *httptest.Server
+	mux.HandleFunc("GET /.well-known/lnurlp/alice", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(lnurl.PayParams{
+			Callback:       server.URL + "/callback?id=alice",
+			MinSendable:    1000,
+			MaxSendable:    1_000_000_000,
+			Metadata:       metadata,
+			CommentAllowed: 5,
+			Tag:            "payRequest",
+		})
+	})
+	mux.HandleFunc("GET /callback", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("id") != "alice" {
+			t.Errorf("callback query lost: %s", r.URL.RawQuery)
+		}
+		comments = append(comments, r.URL.Query().Get("comment"))
+		amount, _ := strconv.ParseInt(r.URL.Query().Get("amount"), 10, 64)
+		if invoiceMsat != 0 {
+			amount = invoiceMsat
+		}
+		h := sha256.Sum256([]byte(metadata))
+		pr, err := bolt11test.Encode(&bolt11.Invoice{
+			Network:         "mainnet",
+			AmountMsat:      amount,
+			Timestamp:       time.Now(),
+			PaymentHash:     strings.Repeat("ab", 32),
+			DescriptionHash: hex.EncodeToString(h[:]),
+		}, key)
+		if err != nil {
+			t.Errorf("Encode: %v", err)
+		}
+		json.NewEncoder(w).Encode(map[string]any{"pr": pr, "routes": []any{}})
+	})
+	mux.HandleFunc("GET /.well-known/lnurlp/bob", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"ERROR","reason":"unknown user"}`))
+	})
+
+	server = httptest.NewTLSServer(mux)
+	t.Cleanup(server.Close)
+	return server, &comments
+}
+
+func TestFetchInvoice(t *testing.T) {
+	server, comments := newServer(t, 0)
+	client := lnurl.NewClient(server.Client())
+	address := "alice@" + strings.TrimPrefix(server.URL, "https://")
+
+	pr, err := client.FetchInvoice(context.Background(), address, 21_000, "thanks!")
+	if err != nil {
+		t.Fatalf("FetchInvoice: %v", err)
+	}
+	inv, _ := bolt11.Decode(pr)
+	if inv.AmountMsat != 21_000 {
+		t.Errorf("AmountMsat = %d, want 21000", inv.AmountMsat)
+	}
+	if len(*comments) != 1 || (*comments)[0] != "thank" {
+		t.Errorf("comments = %q, want the comment cut to 5 characters", *comments)
+	}
+
+	if _, err := client.FetchInvoice(context.Background(), address, 999, ""); !errors.Is(err, lnurl.ErrAmountOutOfRange) {
+		t.Errorf("below minimum: err = %v, want ErrAmountOutOfRange", err)
+	}
+
+	bob := "bob@" + strings.TrimPrefix(server.URL, "https://")
+	if _, err := client.FetchInvoice(context.Background(), bob, 21_000, ""); err == nil || !strings.Contains(err.Error(), "unknown user") {
+		t.Errorf("error response: err = %v, want the reason", err)
+	}
+}
+
+func TestFetchInvoice_WrongAmount(t *testing.T) {
+	server, _ := newServer(t, 50_000)
+	client := lnurl.NewClient(server.Client())
+	address := "alice@" + strings.TrimPrefix(server.URL, "https://")
+
+	if _, err := client.FetchInvoice(context.Background(), address, 21_000, ""); !errors.Is(err, lnurl.ErrBadInvoice) {
+		t.Errorf("err = %v, want ErrBadInvoice", err)
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"Alice@Example.com", "https://example.com/.well-known/lnurlp/alice"},
+		{"tips+pos@abc.onion", "http://abc.onion/.well-known/lnurlp/tips+pos"},
+		{"alice", ""},
+		{"al ice@example.com", ""},
+		{"alice@example.com/evil", ""},
+	}
+	for _, tt := range tests {
+		got, err := lnurl.ParseAddress(tt.address)
+		if tt.want == "" {
+			if !errors.Is(err, lnurl.ErrInvalidAddress) {
+				t.Errorf("ParseAddress(%q): err = %v, want ErrInvalidAddress", tt.address, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseAddress(%q) = %q, %v; want %q", tt.address, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package lnurl
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+)
+
+// Encode returns the bech32 form of an LNURL endpoint (LUD-01), upper case
+// so that QR codes of it can use the denser alphanumeric mode.
+func Encode(endpoint string) (string, error) {
+	s, err := bech32.EncodeFromBase256("lnurl", []byte(endpoint))
+	if err != nil {
+		return "", fmt.Errorf("lnurl: encode: %w", err)
+	}
+	return strings.ToUpper(s), nil
+}
+
+// ValidUsername reports whether name can be the user part of a Lightning
+// address (LUD-16).
+func ValidUsername(name string) bool {
+	return usernamePattern.MatchString(name)
+}
@@ -0,0 +1,48 @@
+package lnurl_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+
+	"github.com/nostr-pay/nostr-pay/internal/lnurl"
+)
+
+func TestEncode(t *testing.T) {
+	// The example from LUD-01
+	endpoint := "https://service.com/api?q=3fc3645b439ce8e7f2553a69e5267081d96dcd340693afabe04be7b0ccd178df"
+	want := "LNURL1DP68GURN8GHJ7UM9WFMXJCM99E3K7MF0V9CXJ0M385EKVCENXC6R2C35XVUKXEFCV5MKVV34X5EKZD3EV56NYD3HXQURZEPEXEJXXEPNXSCRVWFNV9NXZCN9XQ6XYEFHVGCXXCMYXYMNSERXFQ5FNS"
+
+	got, err := lnurl.Encode(endpoint)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if got != want {
+		t.Errorf("Encode = %s, want %s", got, want)
+	}
+
+	hrp, data, err := bech32.DecodeNoLimit(strings.ToLower(got))
+	if err != nil {
+		t.Fatalf("DecodeNoLimit: %v", err)
+	}
+	decoded, _ := bech32.ConvertBits(data, 5, 8, false)
+	if hrp != "lnurl" || string(decoded) != endpoint {
+		t.Errorf("decoded %s %q, want lnurl %q", hrp, decoded, endpoint)
+	}
+}
+
+func TestValidUsername(t *testing.T) {
+	for name, want := range map[string]bool{
+		"shop":       true,
+		"tips.bar-1": true,
+		"Shop":       false,
+		"":           false,
+		"a b":        false,
+		"shop@host":  false,
+	} {
+		if got := lnurl.ValidUsername(name); got != want {
+			t.Errorf("ValidUsername(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
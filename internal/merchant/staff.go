@@ -0,0 +1,121 @@
+package merchant
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+// Permission is something a merchant lets a staff member do on its behalf.
+type Permission string
+
+const (
+	// PermCreateInvoice allows creating invoices credited to the merchant.
+	PermCreateInvoice Permission = "invoices:create"
+	// PermViewToday allows listing the merchant's settled payments of the
+	// current UTC day.
+	PermViewToday Permission = "transactions:today"
+)
+
+// Permissions lists every permission a staff member can be granted.
+var Permissions = []Permission{PermCreateInvoice, PermViewToday}
+
+var (
+	ErrNotAuthorized     = errors.New("not authorized for this merchant")
+	ErrInvalidPermission = errors.New("unknown permission")
+	ErrSelfGrant         = errors.New("a merchant cannot be its own staff")
+)
+
+// Service manages staff delegation: merchants authorize other pubkeys (e.g.
+// cashiers on a shared POS) to act for them with limited permissions.
+type Service struct {
+	store store.Store
+}
+
+func NewService(store store.Store) *Service {
+	return &Service{store: store}
+}
+
+// ParsePermissions validates permission names.
+func ParsePermissions(names []string) ([]Permission, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("%w: at least one permission is required", ErrInvalidPermission)
+	}
+	perms := make([]Permission, 0, len(names))
+	for _, name := range names {
+		perm := Permission(name)
+		if !slices.Contains(Permissions, perm) {
+			return nil, fmt.Errorf("%w %q", ErrInvalidPermission, name)
+		}
+		if !slices.Contains(perms, perm) {
+			perms = append(perms, perm)
+		}
+	}
+	return perms, nil
+}
+
+// GrantStaff creates or replaces a staff member's permissions.
+func (s *Service) GrantStaff(ctx context.Context, merchantPubkey, staffPubkey string, perms []Permission) (*store.StaffGrant, error) {
+	if merchantPubkey == staffPubkey {
+		return nil, ErrSelfGrant
+	}
+
+	names := make([]string, len(perms))
+	for i, p := range perms {
+		names[i] = string(p)
+	}
+	grant := &store.StaffGrant{
+		MerchantPubkey: merchantPubkey,
+		StaffPubkey:    staffPubkey,
+		Permissions:    names,
+	}
+	if err := s.store.UpsertStaffGrant(ctx, grant); err != nil {
+		return nil, fmt.Errorf("store staff grant: %w", err)
+	}
+	return s.store.GetStaffGrant(ctx, merchantPubkey, staffPubkey)
+}
+
+func (s *Service) RevokeStaff(ctx context.Context, merchantPubkey, staffPubkey string) error {
+	return s.store.DeleteStaffGrant(ctx, merchantPubkey, staffPubkey)
+}
+
+func (s *Service) ListStaff(ctx context.Context, merchantPubkey string) ([]*store.StaffGrant, error) {
+	return s.store.ListStaffGrantsByMerchant(ctx, merchantPubkey)
+}
+
+// ListEmployers returns the grants a staff member holds, one per merchant.
+func (s *Service) ListEmployers(ctx context.Context, staffPubkey string) ([]*store.StaffGrant, error) {
+	return s.store.ListStaffGrantsByStaff(ctx, staffPubkey)
+}
+
+// Authorize checks that actor holds perm for merchantPubkey and that the
+// merchant still has the merchant role. It returns ErrNotAuthorized
+// otherwise.
+func (s *Service) Authorize(ctx context.Context, actor, merchantPubkey string, perm Permission) error {
+	grant, err := s.store.GetStaffGrant(ctx, merchantPubkey, actor)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotAuthorized
+	}
+	if err != nil {
+		return fmt.Errorf("get staff grant: %w", err)
+	}
+	if !slices.Contains(grant.Permissions, string(perm)) {
+		return ErrNotAuthorized
+	}
+
+	user, err := s.store.GetUser(ctx, merchantPubkey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotAuthorized
+	}
+	if err != nil {
+		return fmt.Errorf("get merchant: %w", err)
+	}
+	if !user.IsMerchant {
+		return ErrNotAuthorized
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package merchant_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nostr-pay/nostr-pay/internal/merchant"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+func setupService(t *testing.T) (store.Store, *merchant.Service) {
+	t.Helper()
+	db, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, merchant.NewService(db)
+}
+
+func TestAuthorize(t *testing.T) {
+	db, svc := setupService(t)
+	ctx := context.Background()
+
+	db.CreateUser(ctx, &store.User{Pubkey: "owner", IsMerchant: true})
+
+	if _, err := svc.GrantStaff(ctx, "owner", "cashier", []merchant.Permission{merchant.PermCreateInvoice}); err != nil {
+		t.Fatalf("GrantStaff: %v", err)
+	}
+
+	if err := svc.Authorize(ctx, "cashier", "owner", merchant.PermCreateInvoice); err != nil {
+		t.Errorf("granted permission: %v", err)
+	}
+	if err := svc.Authorize(ctx, "cashier", "owner", merchant.PermViewToday); !errors.Is(err, merchant.ErrNotAuthorized) {
+		t.Errorf("missing permission: err = %v, want ErrNotAuthorized", err)
+	}
+	if err := svc.Authorize(ctx, "stranger", "owner", merchant.PermCreateInvoice); !errors.Is(err, merchant.ErrNotAuthorized) {
+		t.Errorf("no grant: err = %v, want ErrNotAuthorized", err)
+	}
+
+	// Grants stop working once the owner loses the merchant role
+	db.UpdateUserMerchant(ctx, "owner", false)
+	if err := svc.Authorize(ctx, "cashier", "owner", merchant.PermCreateInvoice); !errors.Is(err, merchant.ErrNotAuthorized) {
+		t.Errorf("demoted merchant: err = %v, want ErrNotAuthorized", err)
+	}
+}
+
+func TestGrantStaff_Replace(t *testing.T) {
+	_, svc := setupService(t)
+	ctx := context.Background()
+
+	svc.GrantStaff(ctx, "owner", "cashier", []merchant.Permission{merchant.PermCreateInvoice})
+	grant, err := svc.GrantStaff(ctx, "owner", "cashier", []merchant.Permission{merchant.PermViewToday})
+	if err != nil {
+		t.Fatalf("GrantStaff: %v", err)
+	}
+	if len(grant.Permissions) != 1 || grant.Permissions[0] != string(merchant.PermViewToday) {
+		t.Errorf("Permissions = %v, want [%s]", grant.Permissions, merchant.PermViewToday)
+	}
+
+	if _, err := svc.GrantStaff(ctx, "owner", "owner", []merchant.Permission{merchant.PermViewToday}); !errors.Is(err, merchant.ErrSelfGrant) {
+		t.Errorf("self grant: err = %v, want ErrSelfGrant", err)
+	}
+
+	if err := svc.RevokeStaff(ctx, "owner", "cashier"); err != nil {
+		t.Fatalf("RevokeStaff: %v", err)
+	}
+	staff, _ := svc.ListStaff(ctx, "owner")
+	if len(staff) != 0 {
+		t.Errorf("got %d staff after revoke, want 0", len(staff))
+	}
+}
+
+func TestParsePermissions(t *testing.T) {
+	if _, err := merchant.ParsePermissions([]string{"invoices:create", "refunds:issue"}); !errors.Is(err, merchant.ErrInvalidPermission) {
+		t.Errorf("err = %v, want ErrInvalidPermission", err)
+	}
+}
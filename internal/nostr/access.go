@@ -0,0 +1,71 @@
+package nostr
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// AccessMode decides which pubkeys may use the instance.
+type AccessMode string
+
+const (
+	// AccessOpen admits any pubkey not on the denylist.
+	AccessOpen AccessMode = "open"
+	// AccessAllowlist admits only the configured pubkeys.
+	AccessAllowlist AccessMode = "allowlist"
+	// AccessInvite admits only pubkeys that already have a user record,
+	// e.g. created by an operator. Users are not provisioned on first
+	// authentication.
+	AccessInvite AccessMode = "invite"
+)
+
+var ErrAccessDenied = errors.New("access denied")
+
+// Denylist reports pubkeys blocked by an operator.
+type Denylist interface {
+	IsPubkeyDenied(ctx context.Context, pubkey string) (bool, error)
+}
+
+func (m AccessMode) valid() bool {
+	switch m {
+	case AccessOpen, AccessAllowlist, AccessInvite:
+		return true
+	}
+	return false
+}
+
+// CheckAccess applies the instance access policy to an authenticated
+// pubkey. Operators are always admitted so they cannot lock themselves out.
+func (a *Authenticator) CheckAccess(ctx context.Context, pubkey string) error {
+	if a.operators[pubkey] {
+		return nil
+	}
+
+	if a.denylist != nil {
+		denied, err := a.denylist.IsPubkeyDenied(ctx, pubkey)
+		if err != nil {
+			return fmt.Errorf("check denylist: %w", err)
+		}
+		if denied {
+			return ErrAccessDenied
+		}
+	}
+
+	switch a.access {
+	case AccessAllowlist:
+		if !a.allowed[pubkey] {
+			return ErrAccessDenied
+		}
+	case AccessInvite:
+		_, err := a.users.GetUser(ctx, pubkey)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrAccessDenied
+		}
+		if err != nil {
+			return fmt.Errorf("check invite: %w", err)
+		}
+	}
+	return nil
+}
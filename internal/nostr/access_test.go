@@ -0,0 +1,106 @@
+package nostr_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+func TestAccessPolicy(t *testing.T) {
+	db, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test db: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	const url = "http://example.com/api/test"
+	allowedToken, allowedPK := createSignedAuthEvent(t, url, "GET")
+	strangerToken, _ := createSignedAuthEvent(t, url, "GET")
+	deniedToken, deniedPK := createSignedAuthEvent(t, url, "GET")
+	operatorToken, operatorPK := createSignedAuthEvent(t, url, "GET")
+	db.DenyPubkey(ctx, &store.DeniedPubkey{Pubkey: deniedPK})
+	db.DenyPubkey(ctx, &store.DeniedPubkey{Pubkey: operatorPK})
+
+	tests := []struct {
+		name  string
+		mode  nostrauth.AccessMode
+		token string
+		want  int
+	}{
+		{"open", nostrauth.AccessOpen, strangerToken, http.StatusOK},
+		{"denied", nostrauth.AccessOpen, deniedToken, http.StatusForbidden},
+		{"allowlisted", nostrauth.AccessAllowlist, allowedToken, http.StatusOK},
+		{"not allowlisted", nostrauth.AccessAllowlist, strangerToken, http.StatusForbidden},
+		{"operator", nostrauth.AccessAllowlist, operatorToken, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := nostrauth.NewAuthenticator(nostrauth.Options{
+				Users:     db,
+				Operators: []string{operatorPK},
+				Access:    tt.mode,
+				Allowed:   []string{allowedPK},
+				Denylist:  db,
+				// Tokens are reused across cases
+				ReplayCache: nostrauth.NewMemoryReplayCache(),
+			})
+			if err != nil {
+				t.Fatalf("NewAuthenticator: %v", err)
+			}
+			mw := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			req := httptest.NewRequest(http.MethodGet, url, nil)
+			req.Header.Set("Authorization", tt.token)
+			rr := httptest.NewRecorder()
+			mw.ServeHTTP(rr, req)
+
+			if rr.Code != tt.want {
+				t.Errorf("status = %d, want %d", rr.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessPolicy_Invite(t *testing.T) {
+	db, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test db: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	auth, err := nostrauth.NewAuthenticator(nostrauth.Options{Users: db, Access: nostrauth.AccessInvite})
+	if err != nil {
+		t.Fatalf("NewAuthenticator: %v", err)
+	}
+
+	invitedToken, invitedPK := createSignedAuthEvent(t, "http://example.com/api/test", "GET")
+	db.CreateUser(ctx, &store.User{Pubkey: invitedPK})
+	strangerToken, strangerPK := createSignedAuthEvent(t, "http://example.com/api/test", "GET")
+
+	mw := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for token, want := range map[string]int{invitedToken: http.StatusOK, strangerToken: http.StatusForbidden} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/api/test", nil)
+		req.Header.Set("Authorization", token)
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, req)
+		if rr.Code != want {
+			t.Errorf("status = %d, want %d", rr.Code, want)
+		}
+	}
+
+	// Rejected pubkeys must not be provisioned
+	if _, err := db.GetUser(ctx, strangerPK); err == nil {
+		t.Error("uninvited pubkey was provisioned")
+	}
+
+	if _, err := nostrauth.NewAuthenticator(nostrauth.Options{Access: nostrauth.AccessInvite}); err == nil {
+		t.Error("expected error for invite mode without a user store")
+	}
+}
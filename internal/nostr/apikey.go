@@ -0,0 +1,157 @@
+package nostr
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+// Scope limits what an API key may do. NIP-98 and session authentication
+// are not scoped.
+type Scope string
+
+const (
+	ScopeCreateInvoice Scope = "invoices:create"
+	ScopeReadPayments  Scope = "payments:read"
+	ScopeReadStats     Scope = "stats:read"
+)
+
+// Scopes lists every scope an API key can be granted.
+var Scopes = []Scope{ScopeCreateInvoice, ScopeReadPayments, ScopeReadStats}
+
+const (
+	apiKeyPrefix = "key_"
+	scopesKey    = contextKey("scopes")
+)
+
+var (
+	ErrInvalidAPIKey = errors.New("invalid or expired api key")
+	ErrInvalidScope  = errors.New("unknown scope")
+)
+
+// HasScope reports whether the request may use scope. Requests not
+// authenticated by an API key have every scope.
+func HasScope(ctx context.Context, scope Scope) bool {
+	scopes, ok := ctx.Value(scopesKey).([]Scope)
+	if !ok {
+		return true
+	}
+	return slices.Contains(scopes, scope)
+}
+
+// IsAPIKeyRequest reports whether the request was authenticated by an API
+// key.
+func IsAPIKeyRequest(ctx context.Context) bool {
+	_, ok := ctx.Value(scopesKey).([]Scope)
+	return ok
+}
+
+// RequireScope rejects API-key requests whose key lacks scope.
+func RequireScope(scope Scope, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !HasScope(r.Context(), scope) {
+			http.Error(w, "api key lacks scope "+string(scope), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RejectAPIKeys restricts an endpoint to signed or session requests, e.g.
+// for managing credentials.
+func RejectAPIKeys(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if IsAPIKeyRequest(r.Context()) {
+			http.Error(w, "not available to api keys", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ParseScopes validates scope names.
+func ParseScopes(names []string) ([]Scope, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("%w: at least one scope is required", ErrInvalidScope)
+	}
+	scopes := make([]Scope, 0, len(names))
+	for _, name := range names {
+		scope := Scope(name)
+		if !slices.Contains(Scopes, scope) {
+			return nil, fmt.Errorf("%w %q", ErrInvalidScope, name)
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+// APIKeyManager issues and resolves API keys for server-to-server
+// integrations. Keys are stored hashed.
+type APIKeyManager struct {
+	store store.Store
+}
+
+func NewAPIKeyManager(store store.Store) *APIKeyManager {
+	return &APIKeyManager{store: store}
+}
+
+// Create issues a key for owner. The plaintext key is returned once and
+// cannot be recovered later.
+func (m *APIKeyManager) Create(ctx context.Context, owner, label string, scopes []Scope, expiresAt *time.Time) (string, *store.APIKey, error) {
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return "", nil, err
+	}
+	key := apiKeyPrefix + secret
+
+	names := make([]string, len(scopes))
+	for i, s := range scopes {
+		names[i] = string(s)
+	}
+
+	apiKey := &store.APIKey{
+		ID:          "apk_" + id,
+		OwnerPubkey: owner,
+		Label:       label,
+		Scopes:      names,
+		KeyHash:     hashToken(key),
+		CreatedAt:   time.Now(),
+		ExpiresAt:   expiresAt,
+	}
+	if err := m.store.CreateAPIKey(ctx, apiKey); err != nil {
+		return "", nil, fmt.Errorf("store api key: %w", err)
+	}
+	return key, apiKey, nil
+}
+
+// Resolve returns the active key record for a bearer key.
+func (m *APIKeyManager) Resolve(ctx context.Context, key string) (*store.APIKey, error) {
+	apiKey, err := m.store.GetAPIKeyByHash(ctx, hashToken(key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if apiKey.RevokedAt != nil || (apiKey.ExpiresAt != nil && time.Now().After(*apiKey.ExpiresAt)) {
+		return nil, ErrInvalidAPIKey
+	}
+	return apiKey, nil
+}
+
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
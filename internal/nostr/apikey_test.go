@@ -0,0 +1,90 @@
+package nostr_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := nostrauth.ParseScopes([]string{"invoices:create", "invoices:create", "stats:read"})
+	if err != nil {
+		t.Fatalf("ParseScopes: %v", err)
+	}
+	if len(scopes) != 2 {
+		t.Errorf("got %d scopes, want 2 after dedup", len(scopes))
+	}
+
+	if _, err := nostrauth.ParseScopes([]string{"wallet:drain"}); err == nil {
+		t.Error("expected error for unknown scope")
+	}
+	if _, err := nostrauth.ParseScopes(nil); err == nil {
+		t.Error("expected error for empty scopes")
+	}
+}
+
+func TestAuthMiddleware_APIKey(t *testing.T) {
+	db, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test db: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	owner := "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+	db.CreateUser(ctx, &store.User{Pubkey: owner, IsMerchant: true})
+
+	keys := nostrauth.NewAPIKeyManager(db)
+	key, apiKey, err := keys.Create(ctx, owner, "webshop", []nostrauth.Scope{nostrauth.ScopeCreateInvoice}, nil)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	past := time.Now().Add(-time.Minute)
+	expiredKey, _, _ := keys.Create(ctx, owner, "old", []nostrauth.Scope{nostrauth.ScopeCreateInvoice}, &past)
+
+	auth, _ := nostrauth.NewAuthenticator(nostrauth.Options{APIKeys: keys, Users: db})
+
+	var gotPubkey string
+	var gotRole nostrauth.Role
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPubkey = nostrauth.PubkeyFromContext(r.Context())
+		gotRole = nostrauth.RoleFromContext(r.Context())
+	})
+
+	do := func(h http.Handler, key string) int {
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/api/payments/invoice", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		rr := httptest.NewRecorder()
+		auth.Middleware(h).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := do(nostrauth.RequireScope(nostrauth.ScopeCreateInvoice, ok), key); code != http.StatusOK {
+		t.Fatalf("scoped request: status = %d, want 200", code)
+	}
+	if gotPubkey != owner || gotRole != nostrauth.RoleMerchant {
+		t.Errorf("context = (%q, %q), want (%q, merchant)", gotPubkey, gotRole, owner)
+	}
+
+	if code := do(nostrauth.RequireScope(nostrauth.ScopeReadStats, ok), key); code != http.StatusForbidden {
+		t.Errorf("missing scope: status = %d, want 403", code)
+	}
+	if code := do(nostrauth.RejectAPIKeys(ok), key); code != http.StatusForbidden {
+		t.Errorf("RejectAPIKeys: status = %d, want 403", code)
+	}
+	if code := do(ok, expiredKey); code != http.StatusUnauthorized {
+		t.Errorf("expired key: status = %d, want 401", code)
+	}
+
+	if err := db.RevokeAPIKey(ctx, apiKey.ID, owner); err != nil {
+		t.Fatalf("RevokeAPIKey: %v", err)
+	}
+	if code := do(ok, key); code != http.StatusUnauthorized {
+		t.Errorf("revoked key: status = %d, want 401", code)
+	}
+}
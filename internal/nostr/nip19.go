@@ -0,0 +1,63 @@
+package nostr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	gonostr "github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+var ErrInvalidPubkey = errors.New("invalid pubkey")
+
+// ParsePubkey accepts a pubkey as 64-character hex, npub or nprofile (NIP-19)
+// and returns it as lowercase hex, the form used in storage and in the
+// request context.
+func ParsePubkey(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", fmt.Errorf("%w: empty", ErrInvalidPubkey)
+	}
+
+	lower := strings.ToLower(s)
+	if !strings.HasPrefix(lower, "npub1") && !strings.HasPrefix(lower, "nprofile1") {
+		if !IsHexPubkey(lower) {
+			return "", fmt.Errorf("%w: expected 64 hex characters, npub or nprofile", ErrInvalidPubkey)
+		}
+		return lower, nil
+	}
+
+	prefix, value, err := nip19.Decode(s)
+	if err != nil {
+		return "", fmt.Errorf("%w: bad bech32 encoding: %v", ErrInvalidPubkey, err)
+	}
+
+	var pubkey string
+	switch prefix {
+	case "npub":
+		pubkey, _ = value.(string)
+	case "nprofile":
+		pp, _ := value.(gonostr.ProfilePointer)
+		pubkey = pp.PublicKey
+	default:
+		return "", fmt.Errorf("%w: unexpected %s identifier", ErrInvalidPubkey, prefix)
+	}
+	if !IsHexPubkey(pubkey) {
+		return "", fmt.Errorf("%w: %s does not contain a 32-byte key", ErrInvalidPubkey, prefix)
+	}
+	return pubkey, nil
+}
+
+// EncodeNpub returns the npub form of a hex pubkey, or "" if it is not a
+// valid pubkey.
+func EncodeNpub(pubkey string) string {
+	if !IsHexPubkey(pubkey) {
+		return ""
+	}
+	npub, err := nip19.EncodePublicKey(pubkey)
+	if err != nil {
+		return ""
+	}
+	return npub
+}
@@ -0,0 +1,56 @@
+package nostr_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/nostr-pay/nostr-pay/internal/nostr"
+)
+
+const testPubkey = "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+
+func TestParsePubkey(t *testing.T) {
+	npub := nostr.EncodeNpub(testPubkey)
+	if npub != "npub180cvv07tjdrrgpa0j7j7tmnyl2yr6yr7l8j4s3evf6u64th6gkwsyjh6w6" {
+		t.Fatalf("EncodeNpub = %q", npub)
+	}
+	nprofile, _ := nip19.EncodeProfile(testPubkey, []string{"wss://relay.example.com"})
+
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"hex", testPubkey},
+		{"uppercase hex", "3BF0C63FCB93463407AF97A5E5EE64FA883D107EF9E558472C4EB9AAAEFA459D"},
+		{"npub", npub},
+		{"nprofile", nprofile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := nostr.ParsePubkey(tt.input)
+			if err != nil {
+				t.Fatalf("ParsePubkey: %v", err)
+			}
+			if got != testPubkey {
+				t.Errorf("got %q, want %q", got, testPubkey)
+			}
+		})
+	}
+}
+
+func TestParsePubkey_Invalid(t *testing.T) {
+	note, _ := nip19.EncodeNote(testPubkey)
+	npub := nostr.EncodeNpub(testPubkey)
+
+	for _, input := range []string{
+		"",
+		"abc",
+		npub[:len(npub)-1] + "q", // checksum mismatch
+		note,
+	} {
+		if _, err := nostr.ParsePubkey(input); !errors.Is(err, nostr.ErrInvalidPubkey) {
+			t.Errorf("ParsePubkey(%q): err = %v, want ErrInvalidPubkey", input, err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package nostr
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ReplayCache remembers NIP-98 event IDs so that a signed event is accepted
+// only once. store.Store satisfies it for deployments where several API
+// replicas must share replay state.
+type ReplayCache interface {
+	// MarkAuthEventSeen records id until expiresAt and reports whether the
+	// id was new. A false result means the event is a replay.
+	MarkAuthEventSeen(ctx context.Context, id string, expiresAt time.Time) (bool, error)
+}
+
+// MemoryReplayCache is a process-local ReplayCache. Entries are dropped once
+// their expiry has passed, which bounds the map to the events seen within
+// one validity window.
+type MemoryReplayCache struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+func NewMemoryReplayCache() *MemoryReplayCache {
+	return &MemoryReplayCache{
+		seen: make(map[string]time.Time),
+	}
+}
+
+func (c *MemoryReplayCache) MarkAuthEventSeen(ctx context.Context, id string, expiresAt time.Time) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastPrune) > eventWindow {
+		for k, exp := range c.seen {
+			if now.After(exp) {
+				delete(c.seen, k)
+			}
+		}
+		c.lastPrune = now
+	}
+
+	if exp, ok := c.seen[id]; ok && now.Before(exp) {
+		return false, nil
+	}
+	c.seen[id] = expiresAt
+	return true, nil
+}
@@ -0,0 +1,41 @@
+package nostr_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
+)
+
+func TestMemoryReplayCache(t *testing.T) {
+	cache := nostrauth.NewMemoryReplayCache()
+	ctx := context.Background()
+
+	fresh, err := cache.MarkAuthEventSeen(ctx, "event_1", time.Now().Add(time.Minute))
+	if err != nil || !fresh {
+		t.Fatalf("first use: fresh = %v, err = %v; want true, nil", fresh, err)
+	}
+
+	fresh, _ = cache.MarkAuthEventSeen(ctx, "event_1", time.Now().Add(time.Minute))
+	if fresh {
+		t.Error("second use should be reported as a replay")
+	}
+
+	fresh, _ = cache.MarkAuthEventSeen(ctx, "event_2", time.Now().Add(time.Minute))
+	if !fresh {
+		t.Error("different event should be fresh")
+	}
+}
+
+func TestMemoryReplayCache_Expired(t *testing.T) {
+	cache := nostrauth.NewMemoryReplayCache()
+	ctx := context.Background()
+
+	cache.MarkAuthEventSeen(ctx, "event_1", time.Now().Add(-time.Second))
+
+	fresh, _ := cache.MarkAuthEventSeen(ctx, "event_1", time.Now().Add(time.Minute))
+	if !fresh {
+		t.Error("expired entry should not block the id")
+	}
+}
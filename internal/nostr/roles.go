@@ -0,0 +1,113 @@
+package nostr
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+// Role is the caller's privilege level. Higher roles include the
+// permissions of lower ones.
+type Role string
+
+const (
+	RoleUser     Role = "user"
+	RoleMerchant Role = "merchant"
+	RoleOperator Role = "operator"
+)
+
+const roleKey contextKey = "role"
+
+var roleRank = map[Role]int{
+	RoleUser:     1,
+	RoleMerchant: 2,
+	RoleOperator: 3,
+}
+
+// Includes reports whether r grants at least the permissions of other.
+func (r Role) Includes(other Role) bool {
+	return roleRank[r] >= roleRank[other]
+}
+
+func RoleFromContext(ctx context.Context) Role {
+	v, _ := ctx.Value(roleKey).(Role)
+	return v
+}
+
+// IsHexPubkey reports whether s is a 32-byte lowercase hex public key.
+func IsHexPubkey(s string) bool {
+	if len(s) != 64 || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// UserStore is the subset of store.Store used to provision users on first
+// authentication.
+type UserStore interface {
+	GetUser(ctx context.Context, pubkey string) (*store.User, error)
+	CreateUser(ctx context.Context, user *store.User) error
+}
+
+// RequireRole rejects requests whose authenticated role does not include
+// role. It must run inside Authenticator.Middleware.
+func RequireRole(role Role, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !RoleFromContext(r.Context()).Includes(role) {
+			http.Error(w, string(role)+" role required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// resolveRole loads the user for pubkey, creating it on first sight, and
+// derives its role.
+func (a *Authenticator) resolveRole(ctx context.Context, pubkey string) (Role, error) {
+	if a.operators[pubkey] {
+		// Operators are still provisioned so they show up as users.
+		if a.users != nil {
+			if _, err := a.provisionUser(ctx, pubkey); err != nil {
+				return "", err
+			}
+		}
+		return RoleOperator, nil
+	}
+	if a.users == nil {
+		return RoleUser, nil
+	}
+
+	user, err := a.provisionUser(ctx, pubkey)
+	if err != nil {
+		return "", err
+	}
+	if user.IsMerchant {
+		return RoleMerchant, nil
+	}
+	return RoleUser, nil
+}
+
+func (a *Authenticator) provisionUser(ctx context.Context, pubkey string) (*store.User, error) {
+	user, err := a.users.GetUser(ctx, pubkey)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if err := a.users.CreateUser(ctx, &store.User{Pubkey: pubkey}); err != nil {
+		// A concurrent request may have created the user first.
+		if user, getErr := a.users.GetUser(ctx, pubkey); getErr == nil {
+			return user, nil
+		}
+		return nil, err
+	}
+	return a.users.GetUser(ctx, pubkey)
+}
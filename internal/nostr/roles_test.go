@@ -0,0 +1,87 @@
+package nostr_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+func TestAuthMiddleware_ProvisionsUser(t *testing.T) {
+	db, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test db: %v", err)
+	}
+	defer db.Close()
+
+	auth, _ := nostrauth.NewAuthenticator(nostrauth.Options{Users: db})
+
+	var gotRole nostrauth.Role
+	mw := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotRole = nostrauth.RoleFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api/test", nil)
+	token, pk := createSignedAuthEvent(t, "http://example.com/api/test", "GET")
+	req.Header.Set("Authorization", token)
+	mw.ServeHTTP(httptest.NewRecorder(), req)
+
+	if gotRole != nostrauth.RoleUser {
+		t.Errorf("role = %q, want %q", gotRole, nostrauth.RoleUser)
+	}
+	user, err := db.GetUser(context.Background(), pk)
+	if err != nil {
+		t.Fatalf("user was not provisioned: %v", err)
+	}
+	if user.IsMerchant {
+		t.Error("new users should not be merchants")
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	db, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test db: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	merchantToken, merchantPK := createSignedAuthEvent(t, "http://example.com/api/merchant/stats", "GET")
+	db.CreateUser(ctx, &store.User{Pubkey: merchantPK, IsMerchant: true})
+	userToken, _ := createSignedAuthEvent(t, "http://example.com/api/merchant/stats", "GET")
+	operatorToken, operatorPK := createSignedAuthEvent(t, "http://example.com/api/merchant/stats", "GET")
+
+	auth, _ := nostrauth.NewAuthenticator(nostrauth.Options{
+		Users:     db,
+		Operators: []string{operatorPK},
+	})
+	mw := auth.Middleware(nostrauth.RequireRole(nostrauth.RoleMerchant,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	))
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"merchant", merchantToken, http.StatusOK},
+		{"plain user", userToken, http.StatusForbidden},
+		{"operator", operatorToken, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/api/merchant/stats", nil)
+			req.Header.Set("Authorization", tt.token)
+			rr := httptest.NewRecorder()
+			mw.ServeHTTP(rr, req)
+
+			if rr.Code != tt.want {
+				t.Errorf("status = %d, want %d", rr.Code, tt.want)
+			}
+		})
+	}
+}
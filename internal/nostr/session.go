@@ -0,0 +1,143 @@
+package nostr
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	gonostr "github.com/nbd-wtf/go-nostr"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+// KindClientAuth is the NIP-42 client authentication kind used to answer a
+// login challenge.
+const KindClientAuth = 22242
+
+const (
+	challengeTTL       = 5 * time.Minute
+	sessionTokenPrefix = "sess_"
+)
+
+var (
+	ErrInvalidChallenge = errors.New("invalid or expired challenge")
+	ErrInvalidSession   = errors.New("invalid or expired session")
+)
+
+// SessionManager exchanges a signed challenge for a short-lived bearer
+// token, so clients with slow signers (e.g. NIP-46 remote signers) need one
+// signature per login instead of one per request.
+type SessionManager struct {
+	store store.Store
+	ttl   time.Duration
+}
+
+func NewSessionManager(store store.Store, ttl time.Duration) *SessionManager {
+	return &SessionManager{
+		store: store,
+		ttl:   ttl,
+	}
+}
+
+// NewChallenge issues a single-use nonce the client must sign.
+func (m *SessionManager) NewChallenge(ctx context.Context) (string, time.Time, error) {
+	challenge, err := randomHex(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(challengeTTL)
+	if err := m.store.CreateAuthChallenge(ctx, challenge, expiresAt); err != nil {
+		return "", time.Time{}, fmt.Errorf("store challenge: %w", err)
+	}
+	return challenge, expiresAt, nil
+}
+
+// Login verifies a kind-22242 event carrying a previously issued challenge
+// and opens a session for its author. The returned token is only ever held
+// by the client; the store keeps its hash.
+func (m *SessionManager) Login(ctx context.Context, event *gonostr.Event) (string, *store.Session, error) {
+	if event.Kind != KindClientAuth {
+		return "", nil, ErrInvalidKind
+	}
+	if !event.CheckID() {
+		return "", nil, ErrInvalidEvent
+	}
+	ok, err := event.CheckSignature()
+	if err != nil || !ok {
+		return "", nil, ErrInvalidSig
+	}
+	if time.Since(time.Unix(int64(event.CreatedAt), 0)).Abs() > challengeTTL {
+		return "", nil, ErrEventTooOld
+	}
+
+	challengeTag := event.Tags.GetFirst([]string{"challenge"})
+	if challengeTag == nil || len(*challengeTag) < 2 {
+		return "", nil, ErrInvalidChallenge
+	}
+	consumed, err := m.store.ConsumeAuthChallenge(ctx, (*challengeTag)[1])
+	if err != nil {
+		return "", nil, fmt.Errorf("consume challenge: %w", err)
+	}
+	if !consumed {
+		return "", nil, ErrInvalidChallenge
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return "", nil, err
+	}
+	token := sessionTokenPrefix + secret
+
+	now := time.Now()
+	sess := &store.Session{
+		ID:        "ses_" + id,
+		Pubkey:    event.PubKey,
+		TokenHash: hashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(m.ttl),
+	}
+	if err := m.store.CreateSession(ctx, sess); err != nil {
+		return "", nil, fmt.Errorf("store session: %w", err)
+	}
+	return token, sess, nil
+}
+
+// Resolve returns the active session for a bearer token.
+func (m *SessionManager) Resolve(ctx context.Context, token string) (*store.Session, error) {
+	if !strings.HasPrefix(token, sessionTokenPrefix) {
+		return nil, ErrInvalidSession
+	}
+	sess, err := m.store.GetSessionByTokenHash(ctx, hashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidSession
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sess.RevokedAt != nil || time.Now().After(sess.ExpiresAt) {
+		return nil, ErrInvalidSession
+	}
+	return sess, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate random: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,127 @@
+package nostr_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gonostr "github.com/nbd-wtf/go-nostr"
+	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+func setupSessions(t *testing.T) (store.Store, *nostrauth.SessionManager) {
+	t.Helper()
+	db, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, nostrauth.NewSessionManager(db, time.Hour)
+}
+
+func signChallenge(t *testing.T, sk, challenge string) *gonostr.Event {
+	t.Helper()
+	event := &gonostr.Event{
+		Kind:      nostrauth.KindClientAuth,
+		CreatedAt: gonostr.Timestamp(time.Now().Unix()),
+		Tags:      gonostr.Tags{{"challenge", challenge}},
+	}
+	if err := event.Sign(sk); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return event
+}
+
+func TestSessionLogin(t *testing.T) {
+	_, sessions := setupSessions(t)
+	ctx := context.Background()
+
+	challenge, _, err := sessions.NewChallenge(ctx)
+	if err != nil {
+		t.Fatalf("NewChallenge: %v", err)
+	}
+
+	sk := gonostr.GeneratePrivateKey()
+	pk, _ := gonostr.GetPublicKey(sk)
+
+	token, sess, err := sessions.Login(ctx, signChallenge(t, sk, challenge))
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if sess.Pubkey != pk {
+		t.Errorf("Pubkey = %q, want %q", sess.Pubkey, pk)
+	}
+
+	got, err := sessions.Resolve(ctx, token)
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if got.ID != sess.ID {
+		t.Errorf("ID = %q, want %q", got.ID, sess.ID)
+	}
+
+	// The challenge is single-use
+	_, _, err = sessions.Login(ctx, signChallenge(t, sk, challenge))
+	if !errors.Is(err, nostrauth.ErrInvalidChallenge) {
+		t.Errorf("reused challenge: err = %v, want ErrInvalidChallenge", err)
+	}
+}
+
+func TestSessionLogin_UnknownChallenge(t *testing.T) {
+	_, sessions := setupSessions(t)
+
+	sk := gonostr.GeneratePrivateKey()
+	_, _, err := sessions.Login(context.Background(), signChallenge(t, sk, "made-up"))
+	if !errors.Is(err, nostrauth.ErrInvalidChallenge) {
+		t.Errorf("err = %v, want ErrInvalidChallenge", err)
+	}
+}
+
+func TestAuthMiddleware_SessionToken(t *testing.T) {
+	db, sessions := setupSessions(t)
+	ctx := context.Background()
+
+	challenge, _, _ := sessions.NewChallenge(ctx)
+	sk := gonostr.GeneratePrivateKey()
+	pk, _ := gonostr.GetPublicKey(sk)
+	token, sess, err := sessions.Login(ctx, signChallenge(t, sk, challenge))
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+
+	auth, err := nostrauth.NewAuthenticator(nostrauth.Options{Sessions: sessions})
+	if err != nil {
+		t.Fatalf("NewAuthenticator: %v", err)
+	}
+
+	var gotPubkey string
+	mw := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPubkey = nostrauth.PubkeyFromContext(r.Context())
+	}))
+
+	do := func() int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/api/payments/history", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := do(); code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", code)
+	}
+	if gotPubkey != pk {
+		t.Errorf("pubkey = %q, want %q", gotPubkey, pk)
+	}
+
+	if err := db.RevokeSession(ctx, sess.ID, pk); err != nil {
+		t.Fatalf("RevokeSession: %v", err)
+	}
+	if code := do(); code != http.StatusUnauthorized {
+		t.Errorf("after revoke: status = %d, want 401", code)
+	}
+}
@@ -1,10 +1,20 @@
 package nostr
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"strings"
 	"time"
 
@@ -15,71 +25,401 @@ type contextKey string
 
 const pubkeyKey contextKey = "pubkey"
 
+// Verification errors. Each is reported to the client as the response body
+// so that signing problems can be told apart.
+var (
+	ErrMissingHeader  = errors.New("missing authorization header")
+	ErrInvalidToken   = errors.New("invalid authorization token")
+	ErrInvalidEvent   = errors.New("invalid event format")
+	ErrInvalidKind    = errors.New("invalid event kind")
+	ErrInvalidSig     = errors.New("invalid signature")
+	ErrEventTooOld    = errors.New("event too old")
+	ErrMissingURL     = errors.New("missing url tag")
+	ErrURLMismatch    = errors.New("url mismatch")
+	ErrMissingMethod  = errors.New("missing method tag")
+	ErrMethodMismatch = errors.New("method mismatch")
+	ErrMissingPayload = errors.New("missing payload tag")
+	ErrPayloadHash    = errors.New("payload hash mismatch")
+	ErrBodyTooLarge   = errors.New("request body too large")
+	ErrReplayed       = errors.New("event already used")
+	ErrUnavailable    = errors.New("authentication unavailable")
+)
+
+const (
+	// maxBodyBytes bounds how much of a request body is buffered for payload
+	// hashing.
+	maxBodyBytes = 1 << 20
+	// eventWindow is how far an event's created_at may drift from now.
+	eventWindow = 60 * time.Second
+)
+
 func PubkeyFromContext(ctx context.Context) string {
 	v, _ := ctx.Value(pubkeyKey).(string)
 	return v
 }
 
+// Options configures how an Authenticator checks NIP-98 events against the
+// incoming request.
+type Options struct {
+	// PublicBaseURL, when set, supplies the scheme and host (and an optional
+	// path prefix) of the externally visible API, e.g. "https://pay.example.com".
+	PublicBaseURL string
+	// TrustedProxies lists the peers whose X-Forwarded-Proto and
+	// X-Forwarded-Host headers are honoured.
+	TrustedProxies []netip.Prefix
+	// RequirePayload rejects POST, PUT and PATCH requests whose event does
+	// not carry a "payload" tag. When the tag is present it is always checked.
+	RequirePayload bool
+	// ReplayCache records accepted event IDs. Defaults to a
+	// MemoryReplayCache.
+	ReplayCache ReplayCache
+	// Sessions, when set, allows "Authorization: Bearer <token>" as an
+	// alternative to a per-request NIP-98 event.
+	Sessions *SessionManager
+	// APIKeys, when set, allows "Authorization: Bearer key_..." API keys,
+	// which act as their owner with limited scopes.
+	APIKeys *APIKeyManager
+	// Users, when set, provisions a user record on first authentication
+	// and grants RoleMerchant to users flagged as merchants.
+	Users UserStore
+	// Operators are hex pubkeys granted RoleOperator.
+	Operators []string
+	// Access is the instance access policy. Defaults to AccessOpen.
+	// AccessInvite requires Users.
+	Access AccessMode
+	// Allowed lists the hex pubkeys admitted in AccessAllowlist mode.
+	Allowed []string
+	// Denylist, when set, rejects listed pubkeys in every mode.
+	Denylist Denylist
+}
+
+type Authenticator struct {
+	baseURL        *url.URL
+	trustedProxies []netip.Prefix
+	requirePayload bool
+	replay         ReplayCache
+	sessions       *SessionManager
+	apiKeys        *APIKeyManager
+	users          UserStore
+	operators      map[string]bool
+	access         AccessMode
+	allowed        map[string]bool
+	denylist       Denylist
+}
+
+func NewAuthenticator(opts Options) (*Authenticator, error) {
+	a := &Authenticator{
+		trustedProxies: opts.TrustedProxies,
+		requirePayload: opts.RequirePayload,
+		replay:         opts.ReplayCache,
+		sessions:       opts.Sessions,
+		apiKeys:        opts.APIKeys,
+		users:          opts.Users,
+		operators:      make(map[string]bool, len(opts.Operators)),
+		access:         opts.Access,
+		allowed:        make(map[string]bool, len(opts.Allowed)),
+		denylist:       opts.Denylist,
+	}
+	for _, pk := range opts.Operators {
+		a.operators[pk] = true
+	}
+	for _, pk := range opts.Allowed {
+		a.allowed[pk] = true
+	}
+	if a.access == "" {
+		a.access = AccessOpen
+	}
+	if !a.access.valid() {
+		return nil, fmt.Errorf("nostr: invalid access mode %q", a.access)
+	}
+	if a.access == AccessInvite && a.users == nil {
+		return nil, errors.New("nostr: invite access mode requires a user store")
+	}
+	if a.replay == nil {
+		a.replay = NewMemoryReplayCache()
+	}
+	if opts.PublicBaseURL != "" {
+		u, err := url.Parse(opts.PublicBaseURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, errors.New("nostr: invalid public base url")
+		}
+		a.baseURL = u
+	}
+	return a, nil
+}
+
+// AuthMiddleware verifies NIP-98 requests using the Host header of the
+// incoming request and no trusted proxies.
 func AuthMiddleware(next http.Handler) http.Handler {
+	a, _ := NewAuthenticator(Options{})
+	return a.Middleware(next)
+}
+
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" || !strings.HasPrefix(authHeader, "Nostr ") {
-			http.Error(w, "missing authorization header", http.StatusUnauthorized)
+		pubkey, scopes, err := a.authenticate(r)
+		switch {
+		case errors.Is(err, ErrBodyTooLarge):
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		case errors.Is(err, ErrUnavailable):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
 
-		token := strings.TrimPrefix(authHeader, "Nostr ")
-		eventJSON, err := base64.StdEncoding.DecodeString(token)
-		if err != nil {
-			http.Error(w, "invalid authorization token", http.StatusUnauthorized)
+		if err := a.CheckAccess(r.Context(), pubkey); err != nil {
+			if errors.Is(err, ErrAccessDenied) {
+				slog.Warn("security event",
+					"type", "access_denied",
+					"pubkey", pubkey,
+					"path", r.URL.Path,
+					"remote_addr", r.RemoteAddr,
+				)
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			slog.Error("access policy error", "error", err)
+			http.Error(w, ErrUnavailable.Error(), http.StatusServiceUnavailable)
 			return
 		}
 
-		var event gonostr.Event
-		if err := json.Unmarshal(eventJSON, &event); err != nil {
-			http.Error(w, "invalid event format", http.StatusUnauthorized)
+		role, err := a.resolveRole(r.Context(), pubkey)
+		if err != nil {
+			slog.Error("user provisioning error", "error", err)
+			http.Error(w, ErrUnavailable.Error(), http.StatusServiceUnavailable)
 			return
 		}
 
-		// Verify event kind is 27235 (NIP-98)
-		if event.Kind != 27235 {
-			http.Error(w, "invalid event kind", http.StatusUnauthorized)
-			return
+		ctx := context.WithValue(r.Context(), pubkeyKey, pubkey)
+		ctx = context.WithValue(ctx, roleKey, role)
+		if scopes != nil {
+			ctx = context.WithValue(ctx, scopesKey, scopes)
 		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
 
-		// Verify signature
-		ok, err := event.CheckSignature()
-		if err != nil || !ok {
-			http.Error(w, "invalid signature", http.StatusUnauthorized)
-			return
+// authenticate resolves the caller's pubkey from an API key, a session
+// token or a NIP-98 event. Scopes are only returned for API keys.
+func (a *Authenticator) authenticate(r *http.Request) (string, []Scope, error) {
+	authHeader := r.Header.Get("Authorization")
+	if bearer, ok := strings.CutPrefix(authHeader, "Bearer "); ok {
+		switch {
+		case a.apiKeys != nil && isAPIKey(bearer):
+			key, err := a.apiKeys.Resolve(r.Context(), bearer)
+			if errors.Is(err, ErrInvalidAPIKey) {
+				return "", nil, err
+			}
+			if err != nil {
+				slog.Error("api key lookup error", "error", err)
+				return "", nil, ErrUnavailable
+			}
+			scopes := make([]Scope, len(key.Scopes))
+			for i, s := range key.Scopes {
+				scopes[i] = Scope(s)
+			}
+			return key.OwnerPubkey, scopes, nil
+		case a.sessions != nil:
+			sess, err := a.sessions.Resolve(r.Context(), bearer)
+			if errors.Is(err, ErrInvalidSession) {
+				return "", nil, err
+			}
+			if err != nil {
+				slog.Error("session lookup error", "error", err)
+				return "", nil, ErrUnavailable
+			}
+			return sess.Pubkey, nil, nil
 		}
+	}
 
-		// Verify event is recent (within 60 seconds)
-		eventTime := time.Unix(int64(event.CreatedAt), 0)
-		if time.Since(eventTime).Abs() > 60*time.Second {
-			http.Error(w, "event too old", http.StatusUnauthorized)
-			return
+	event, err := a.verify(r)
+	if err != nil {
+		return "", nil, err
+	}
+	return event.PubKey, nil, nil
+}
+
+func (a *Authenticator) verify(r *http.Request) (*gonostr.Event, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" || !strings.HasPrefix(authHeader, "Nostr ") {
+		return nil, ErrMissingHeader
+	}
+
+	token := strings.TrimPrefix(authHeader, "Nostr ")
+	eventJSON, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var event gonostr.Event
+	if err := json.Unmarshal(eventJSON, &event); err != nil || !event.CheckID() {
+		return nil, ErrInvalidEvent
+	}
+
+	// Verify event kind is 27235 (NIP-98)
+	if event.Kind != 27235 {
+		return nil, ErrInvalidKind
+	}
+
+	// Verify signature
+	ok, err := event.CheckSignature()
+	if err != nil || !ok {
+		return nil, ErrInvalidSig
+	}
+
+	// Verify event is recent (within 60 seconds)
+	eventTime := time.Unix(int64(event.CreatedAt), 0)
+	if time.Since(eventTime).Abs() > eventWindow {
+		return nil, ErrEventTooOld
+	}
+
+	// Verify URL tag matches request
+	urlTag := event.Tags.GetFirst([]string{"u"})
+	if urlTag == nil || len(*urlTag) < 2 {
+		return nil, ErrMissingURL
+	}
+	if (*urlTag)[1] != a.requestURL(r) {
+		return nil, ErrURLMismatch
+	}
+
+	// Verify method tag matches request
+	methodTag := event.Tags.GetFirst([]string{"method"})
+	if methodTag == nil || len(*methodTag) < 2 {
+		return nil, ErrMissingMethod
+	}
+	if strings.ToUpper((*methodTag)[1]) != r.Method {
+		return nil, ErrMethodMismatch
+	}
+
+	// Verify payload tag matches the request body
+	if err := a.verifyPayload(r, &event); err != nil {
+		return nil, err
+	}
+
+	// Reject a second use of the same event within its validity window
+	fresh, err := a.replay.MarkAuthEventSeen(r.Context(), event.ID, eventTime.Add(eventWindow))
+	if err != nil {
+		slog.Error("replay cache error", "error", err)
+		return nil, ErrUnavailable
+	}
+	if !fresh {
+		slog.Warn("security event",
+			"type", "nip98_replay",
+			"event_id", event.ID,
+			"pubkey", event.PubKey,
+			"path", r.URL.Path,
+			"remote_addr", r.RemoteAddr,
+		)
+		return nil, ErrReplayed
+	}
+
+	return &event, nil
+}
+
+// verifyPayload compares the SHA-256 of the request body with the event's
+// "payload" tag. The body is buffered and replaced so that handlers can
+// still read it.
+func (a *Authenticator) verifyPayload(r *http.Request, event *gonostr.Event) error {
+	payloadTag := event.Tags.GetFirst([]string{"payload"})
+	if payloadTag == nil || len(*payloadTag) < 2 {
+		if a.requirePayload && isWriteMethod(r.Method) {
+			return ErrMissingPayload
 		}
+		return nil
+	}
 
-		// Verify URL tag matches request
-		urlTag := event.Tags.GetFirst([]string{"u"})
-		if urlTag == nil || len(*urlTag) < 2 {
-			http.Error(w, "missing url tag", http.StatusUnauthorized)
-			return
+	var body []byte
+	if r.Body != nil {
+		b, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+		r.Body.Close()
+		if err != nil {
+			return ErrPayloadHash
 		}
+		if len(b) > maxBodyBytes {
+			return ErrBodyTooLarge
+		}
+		body = b
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
 
-		// Verify method tag matches request
-		methodTag := event.Tags.GetFirst([]string{"method"})
-		if methodTag == nil || len(*methodTag) < 2 {
-			http.Error(w, "missing method tag", http.StatusUnauthorized)
-			return
+	sum := sha256.Sum256(body)
+	if !strings.EqualFold((*payloadTag)[1], hex.EncodeToString(sum[:])) {
+		return ErrPayloadHash
+	}
+	return nil
+}
+
+func isWriteMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		return true
+	}
+	return false
+}
+
+// requestURL rebuilds the absolute URL the client called. The configured
+// public base URL wins; otherwise forwarded headers are used when the peer
+// is a trusted proxy, falling back to the request's own Host and TLS state.
+func (a *Authenticator) requestURL(r *http.Request) string {
+	if a.baseURL != nil {
+		return a.baseURL.Scheme + "://" + a.baseURL.Host +
+			strings.TrimSuffix(a.baseURL.Path, "/") + r.URL.RequestURI()
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+
+	if a.isTrustedProxy(r.RemoteAddr) {
+		if proto := lastHeaderValue(r.Header, "X-Forwarded-Proto"); proto != "" {
+			scheme = strings.ToLower(proto)
 		}
-		if strings.ToUpper((*methodTag)[1]) != r.Method {
-			http.Error(w, "method mismatch", http.StatusUnauthorized)
-			return
+		if fwdHost := lastHeaderValue(r.Header, "X-Forwarded-Host"); fwdHost != "" {
+			host = fwdHost
 		}
+	}
 
-		ctx := context.WithValue(r.Context(), pubkeyKey, event.PubKey)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+	return scheme + "://" + host + r.URL.RequestURI()
+}
+
+func (a *Authenticator) isTrustedProxy(remoteAddr string) bool {
+	if len(a.trustedProxies) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range a.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// lastHeaderValue returns the right-most entry of a forwarding header,
+// across repeated header lines. Proxies that append to the header add
+// theirs at the end, so that entry is the trusted proxy's; entries to its
+// left may come from the client.
+func lastHeaderValue(h http.Header, key string) string {
+	values := h.Values(key)
+	if len(values) == 0 {
+		return ""
+	}
+	v := values[len(values)-1]
+	if i := strings.LastIndexByte(v, ','); i >= 0 {
+		v = v[i+1:]
+	}
+	return strings.TrimSpace(v)
 }
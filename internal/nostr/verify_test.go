@@ -1,10 +1,15 @@
 package nostr_test
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,7 +17,7 @@ import (
 	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
 )
 
-func createSignedAuthEvent(t *testing.T, url, method string) (string, string) {
+func createSignedAuthEvent(t *testing.T, url, method string, extraTags ...gonostr.Tag) (string, string) {
 	t.Helper()
 
 	sk := gonostr.GeneratePrivateKey()
@@ -21,10 +26,10 @@ func createSignedAuthEvent(t *testing.T, url, method string) (string, string) {
 	event := gonostr.Event{
 		Kind:      27235, // NIP-98
 		CreatedAt: gonostr.Timestamp(time.Now().Unix()),
-		Tags: gonostr.Tags{
+		Tags: append(gonostr.Tags{
 			{"u", url},
 			{"method", method},
-		},
+		}, extraTags...),
 		Content: "",
 	}
 	event.Sign(sk)
@@ -103,3 +108,192 @@ func TestAuthMiddleware_InvalidSignature(t *testing.T) {
 		t.Errorf("status = %d, want 401", rr.Code)
 	}
 }
+
+func TestAuthMiddleware_URLMismatch(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler should not be called")
+	})
+
+	mw := nostrauth.AuthMiddleware(handler)
+
+	// Event signed for a different endpoint with the same method
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api/payments/pay_123", nil)
+	token, _ := createSignedAuthEvent(t, "http://example.com/api/payments/history", "GET")
+	req.Header.Set("Authorization", token)
+
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "url mismatch") {
+		t.Errorf("body = %q, want url mismatch error", rr.Body.String())
+	}
+}
+
+func TestAuthMiddleware_QueryMustMatch(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler should not be called")
+	})
+
+	mw := nostrauth.AuthMiddleware(handler)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api/test?limit=500", nil)
+	token, _ := createSignedAuthEvent(t, "http://example.com/api/test?limit=5", "GET")
+	req.Header.Set("Authorization", token)
+
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rr.Code)
+	}
+}
+
+func TestAuthenticator_PublicBaseURL(t *testing.T) {
+	auth, err := nostrauth.NewAuthenticator(nostrauth.Options{
+		PublicBaseURL: "https://pay.example.com",
+	})
+	if err != nil {
+		t.Fatalf("NewAuthenticator: %v", err)
+	}
+
+	called := false
+	mw := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	// The API sees an internal host, the client signed the public URL.
+	req := httptest.NewRequest(http.MethodGet, "http://api:8080/api/test?x=1", nil)
+	token, _ := createSignedAuthEvent(t, "https://pay.example.com/api/test?x=1", "GET")
+	req.Header.Set("Authorization", token)
+
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || !called {
+		t.Errorf("status = %d, want 200 (body %q)", rr.Code, rr.Body.String())
+	}
+}
+
+func TestAuthenticator_TrustedProxyHeaders(t *testing.T) {
+	auth, err := nostrauth.NewAuthenticator(nostrauth.Options{
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	if err != nil {
+		t.Fatalf("NewAuthenticator: %v", err)
+	}
+
+	mw := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		proto      []string
+		host       []string
+		want       int
+	}{
+		{"trusted proxy", "10.1.2.3:40000", []string{"https"}, []string{"pay.example.com"}, http.StatusOK},
+		{"untrusted peer", "203.0.113.7:40000", []string{"https"}, []string{"pay.example.com"}, http.StatusUnauthorized},
+		// Proxies append to the headers, so only the right-most entry is
+		// the trusted proxy's
+		{"appended to client headers", "10.1.2.3:40000", []string{"http, https"}, []string{"evil.example.com, pay.example.com"}, http.StatusOK},
+		{"client entry last", "10.1.2.3:40000", []string{"https"}, []string{"pay.example.com, evil.example.com"}, http.StatusUnauthorized},
+		{"repeated header lines", "10.1.2.3:40000", []string{"http", "https"}, []string{"evil.example.com", "pay.example.com"}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://api:8080/api/test", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.proto {
+				req.Header.Add("X-Forwarded-Proto", v)
+			}
+			for _, v := range tt.host {
+				req.Header.Add("X-Forwarded-Host", v)
+			}
+			token, _ := createSignedAuthEvent(t, "https://pay.example.com/api/test", "GET")
+			req.Header.Set("Authorization", token)
+
+			rr := httptest.NewRecorder()
+			mw.ServeHTTP(rr, req)
+
+			if rr.Code != tt.want {
+				t.Errorf("status = %d, want %d", rr.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthMiddleware_PayloadHash(t *testing.T) {
+	body := `{"amount_sats":1000,"memo":"coffee"}`
+	sum := sha256.Sum256([]byte(body))
+	payload := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		body    string
+		require bool
+		tags    []gonostr.Tag
+		want    int
+	}{
+		{"matching payload", body, false, []gonostr.Tag{{"payload", payload}}, http.StatusOK},
+		{"swapped body", `{"amount_sats":1,"memo":"coffee"}`, false, []gonostr.Tag{{"payload", payload}}, http.StatusUnauthorized},
+		{"optional tag omitted", body, false, nil, http.StatusOK},
+		{"required tag omitted", body, true, nil, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := nostrauth.NewAuthenticator(nostrauth.Options{RequirePayload: tt.require})
+			if err != nil {
+				t.Fatalf("NewAuthenticator: %v", err)
+			}
+
+			mw := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, _ := io.ReadAll(r.Body)
+				if string(got) != tt.body {
+					t.Errorf("handler body = %q, want %q", got, tt.body)
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "http://example.com/api/payments/invoice", strings.NewReader(tt.body))
+			token, _ := createSignedAuthEvent(t, "http://example.com/api/payments/invoice", "POST", tt.tags...)
+			req.Header.Set("Authorization", token)
+
+			rr := httptest.NewRecorder()
+			mw.ServeHTTP(rr, req)
+
+			if rr.Code != tt.want {
+				t.Errorf("status = %d, want %d (body %q)", rr.Code, tt.want, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthMiddleware_Replay(t *testing.T) {
+	calls := 0
+	mw := nostrauth.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+
+	token, _ := createSignedAuthEvent(t, "http://example.com/api/test", "GET")
+
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/api/test", nil)
+		req.Header.Set("Authorization", token)
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, req)
+
+		if rr.Code != want {
+			t.Errorf("request %d: status = %d, want %d", i+1, rr.Code, want)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("handler called %d times, want 1", calls)
+	}
+}
@@ -0,0 +1,46 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// ExpireOverdue marks pending payments past their expiry as expired and
+// notifies subscribers. It returns how many payments were expired.
+func (s *Service) ExpireOverdue(ctx context.Context) (int, error) {
+	expired, err := s.store.ExpirePendingPayments(ctx, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("expire pending payments: %w", err)
+	}
+	for _, p := range expired {
+		s.notify(p.PaymentHash, p.Status)
+		s.changed(ctx, p)
+	}
+	return len(expired), nil
+}
+
+// RunExpirySweeper calls ExpireOverdue every interval until ctx is done.
+func (s *Service) RunExpirySweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.ExpireOverdue(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Error("expiry sweep failed", "error", err)
+				}
+				continue
+			}
+			if n > 0 {
+				slog.Info("expired pending payments", "count", n)
+			}
+		}
+	}
+}
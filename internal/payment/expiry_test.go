@@ -0,0 +1,84 @@
+package payment_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/payment"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+type recordingNotifier struct {
+	mu     sync.Mutex
+	events map[string]string
+}
+
+func (n *recordingNotifier) NotifyPayment(paymentHash string, status string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.events == nil {
+		n.events = make(map[string]string)
+	}
+	n.events[paymentHash] = status
+}
+
+func TestExpireOverdue(t *testing.T) {
+	db, _ := store.NewSQLite(":memory:")
+	defer db.Close()
+
+	svc := payment.NewService(db, &mockLNbits{}, "http://localhost:8080")
+	notifier := &recordingNotifier{}
+	svc.SetNotifier(notifier)
+
+	ctx := context.Background()
+	past := time.Now().Add(-time.Second)
+	db.CreatePayment(ctx, &store.Payment{
+		ID:             "pay_001",
+		Bolt11:         "lnbc...",
+		AmountSats:     500,
+		ReceiverPubkey: "npub_receiver",
+		PaymentHash:    "hash_overdue",
+		Status:         "pending",
+		ExpiresAt:      &past,
+	}, nil)
+
+	n, err := svc.ExpireOverdue(ctx)
+	if err != nil {
+		t.Fatalf("ExpireOverdue: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expired %d payments, want 1", n)
+	}
+
+	p, _ := db.GetPayment(ctx, "pay_001")
+	if p.Status != "expired" {
+		t.Errorf("Status = %q, want %q", p.Status, "expired")
+	}
+	if notifier.events["hash_overdue"] != "expired" {
+		t.Errorf("notifications = %v, want hash_overdue expired", notifier.events)
+	}
+}
+
+func TestRunExpirySweeper_Stops(t *testing.T) {
+	db, _ := store.NewSQLite(":memory:")
+	defer db.Close()
+
+	svc := payment.NewService(db, &mockLNbits{}, "http://localhost:8080")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		svc.RunExpirySweeper(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+
+	time.Sleep(30 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sweeper did not stop after cancel")
+	}
+}
@@ -0,0 +1,249 @@
+package payment
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/lnurl"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+var (
+	// ErrAddressesDisabled is returned when Lightning addresses are not
+	// configured.
+	ErrAddressesDisabled  = errors.New("lightning addresses are not enabled")
+	ErrInvalidAddressName = errors.New("invalid lightning address name")
+	ErrAddressTaken       = errors.New("lightning address is taken")
+	ErrAddressNotFound    = errors.New("lightning address not found")
+	ErrAddressAmount      = errors.New("amount outside the range the address accepts")
+	ErrAddressComment     = errors.New("comment too long")
+)
+
+// MaxLightningAddresses bounds how many names a merchant can claim.
+const MaxLightningAddresses = 10
+
+const (
+	maxAddressName        = 64
+	maxAddressDescription = 200
+)
+
+// AddressConfig enables Lightning addresses (LUD-16) served over LNURL-pay
+// (LUD-06).
+type AddressConfig struct {
+	// BaseURL is the public URL of the service. Addresses are
+	// name@host, and wallets fetch invoices from it.
+	BaseURL string
+	// MinSats and MaxSats bound what payers may send.
+	MinSats int64
+	MaxSats int64
+	// CommentChars is how long a payer's comment may be (LUD-12). Zero
+	// disables comments.
+	CommentChars int
+}
+
+// SetLightningAddresses enables Lightning addresses.
+func (s *Service) SetLightningAddresses(c AddressConfig) {
+	s.lnurlp = c
+}
+
+func (s *Service) addressesEnabled() bool {
+	return s.lnurlp.BaseURL != ""
+}
+
+// LightningAddress is a name a merchant is paid at.
+type LightningAddress struct {
+	Name        string
+	Description string
+	// Address is name@domain.
+	Address string
+	// LNURL encodes the pay endpoint, for static QR codes.
+	LNURL     string
+	CreatedAt time.Time
+}
+
+// ClaimAddress gives the merchant the name, unless another merchant holds
+// it. Claiming a name the merchant holds updates its description.
+func (s *Service) ClaimAddress(ctx context.Context, merchantPubkey, name, description string) (*LightningAddress, error) {
+	if !s.addressesEnabled() {
+		return nil, ErrAddressesDisabled
+	}
+	name = strings.ToLower(strings.TrimSpace(name))
+	description = strings.TrimSpace(description)
+	switch {
+	case len(name) > maxAddressName || !lnurl.ValidUsername(name):
+		return nil, fmt.Errorf("%w: use up to %d of a-z, 0-9, '-', '_', '.' and '+'", ErrInvalidAddressName, maxAddressName)
+	case len([]rune(description)) > maxAddressDescription:
+		return nil, fmt.Errorf("%w: description is longer than %d characters", ErrInvalidAddressName, maxAddressDescription)
+	}
+
+	held, err := s.store.ListLightningAddresses(ctx, merchantPubkey)
+	if err != nil {
+		return nil, fmt.Errorf("list lightning addresses: %w", err)
+	}
+	reclaiming := false
+	for _, a := range held {
+		reclaiming = reclaiming || a.Name == name
+	}
+	if !reclaiming && len(held) >= MaxLightningAddresses {
+		return nil, fmt.Errorf("%w: at most %d names", ErrInvalidAddressName, MaxLightningAddresses)
+	}
+
+	a := &store.LightningAddress{
+		Name:           name,
+		MerchantPubkey: merchantPubkey,
+		Description:    description,
+		CreatedAt:      time.Now().UTC(),
+	}
+	claimed, err := s.store.ClaimLightningAddress(ctx, a)
+	if err != nil {
+		return nil, fmt.Errorf("store lightning address: %w", err)
+	}
+	if !claimed {
+		return nil, ErrAddressTaken
+	}
+	if a, err = s.store.GetLightningAddress(ctx, name); err != nil {
+		return nil, fmt.Errorf("get lightning address: %w", err)
+	}
+	return s.lightningAddress(a)
+}
+
+// ListAddresses returns the names the merchant holds.
+func (s *Service) ListAddresses(ctx context.Context, merchantPubkey string) ([]*LightningAddress, error) {
+	if !s.addressesEnabled() {
+		return nil, ErrAddressesDisabled
+	}
+	held, err := s.store.ListLightningAddresses(ctx, merchantPubkey)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]*LightningAddress, 0, len(held))
+	for _, a := range held {
+		la, err := s.lightningAddress(a)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, la)
+	}
+	return addresses, nil
+}
+
+// ReleaseAddress gives up one of the merchant's names, which anyone may
+// claim again. Invoices already fetched through it stay payable.
+func (s *Service) ReleaseAddress(ctx context.Context, merchantPubkey, name string) error {
+	err := s.store.DeleteLightningAddress(ctx, strings.ToLower(name), merchantPubkey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrAddressNotFound
+	}
+	return err
+}
+
+// PayOffer returns the LNURL-pay response for the name.
+func (s *Service) PayOffer(ctx context.Context, name string) (*lnurl.PayParams, error) {
+	a, err := s.getAddress(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &lnurl.PayParams{
+		Callback:       s.lnurlp.BaseURL + "/api/lnurlp/" + a.Name + "/callback",
+		MinSendable:    s.lnurlp.MinSats * 1000,
+		MaxSendable:    s.lnurlp.MaxSats * 1000,
+		Metadata:       s.addressMetadata(a),
+		CommentAllowed: s.lnurlp.CommentChars,
+		Tag:            "payRequest",
+	}, nil
+}
+
+// PayAddress creates an invoice of amountMsat to the merchant holding the
+// name, for the LNURL-pay callback. The invoice commits to the offer's
+// metadata, and the payer's comment becomes the payment's memo.
+func (s *Service) PayAddress(ctx context.Context, name string, amountMsat int64, comment string) (*CreateInvoiceResult, error) {
+	a, err := s.getAddress(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if amountMsat%1000 != 0 || amountMsat < s.lnurlp.MinSats*1000 || amountMsat > s.lnurlp.MaxSats*1000 {
+		return nil, fmt.Errorf("%w: whole sats from %d to %d", ErrAddressAmount, s.lnurlp.MinSats, s.lnurlp.MaxSats)
+	}
+	if n := len([]rune(comment)); n > s.lnurlp.CommentChars {
+		return nil, fmt.Errorf("%w: %d characters, at most %d allowed", ErrAddressComment, n, s.lnurlp.CommentChars)
+	}
+
+	metadataHash := sha256.Sum256([]byte(s.addressMetadata(a)))
+	return s.createInvoice(ctx, &CreateInvoiceInput{
+		ReceiverPubkey:  a.MerchantPubkey,
+		AmountSats:      amountMsat / 1000,
+		Memo:            comment,
+		DescriptionHash: hex.EncodeToString(metadataHash[:]),
+	}, CauseLNURL, ActorSystem)
+}
+
+// getAddress returns the address to pay. Names held by users who are no
+// longer merchants are not served.
+func (s *Service) getAddress(ctx context.Context, name string) (*store.LightningAddress, error) {
+	if !s.addressesEnabled() {
+		return nil, ErrAddressesDisabled
+	}
+	a, err := s.store.GetLightningAddress(ctx, strings.ToLower(name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAddressNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get lightning address: %w", err)
+	}
+	u, err := s.store.GetUser(ctx, a.MerchantPubkey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAddressNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get merchant: %w", err)
+	}
+	if !u.IsMerchant {
+		return nil, ErrAddressNotFound
+	}
+	return a, nil
+}
+
+func (s *Service) lightningAddress(a *store.LightningAddress) (*LightningAddress, error) {
+	encoded, err := lnurl.Encode(s.lnurlp.BaseURL + "/.well-known/lnurlp/" + a.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &LightningAddress{
+		Name:        a.Name,
+		Description: a.Description,
+		Address:     s.addressOf(a),
+		LNURL:       encoded,
+		CreatedAt:   a.CreatedAt,
+	}, nil
+}
+
+func (s *Service) addressOf(a *store.LightningAddress) string {
+	host := s.lnurlp.BaseURL
+	if u, err := url.Parse(s.lnurlp.BaseURL); err == nil {
+		host = u.Host
+	}
+	return a.Name + "@" + host
+}
+
+// addressMetadata is the LNURL-pay metadata of the address. Invoices commit
+// to its hash, so it must not change between the offer and the callback.
+func (s *Service) addressMetadata(a *store.LightningAddress) string {
+	address := s.addressOf(a)
+	text := a.Description
+	if text == "" {
+		text = "Payment to " + address
+	}
+	metadata, _ := json.Marshal([][]string{
+		{"text/plain", text},
+		{"text/identifier", address},
+	})
+	return string(metadata)
+}
@@ -0,0 +1,124 @@
+package payment_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nostr-pay/nostr-pay/internal/bolt11"
+	"github.com/nostr-pay/nostr-pay/internal/payment"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+func setupAddresses(t *testing.T) (store.Store, *payment.Service) {
+	t.Helper()
+	db, _ := store.NewSQLite(":memory:")
+	t.Cleanup(func() { db.Close() })
+
+	svc := payment.NewService(db, newPayMock(), "http://localhost:8080")
+	svc.SetLightningAddresses(payment.AddressConfig{
+		BaseURL:      "https://pay.example.com",
+		MinSats:      1,
+		MaxSats:      100_000,
+		CommentChars: 10,
+	})
+	return db, svc
+}
+
+func TestClaimAddress(t *testing.T) {
+	_, svc := setupAddresses(t)
+	ctx := context.Background()
+
+	a, err := svc.ClaimAddress(ctx, merchantPubkey, " Shop ", "Corner shop")
+	if err != nil {
+		t.Fatalf("ClaimAddress: %v", err)
+	}
+	if a.Name != "shop" || a.Address != "shop@pay.example.com" || !strings.HasPrefix(a.LNURL, "LNURL1") {
+		t.Errorf("address = %+v", a)
+	}
+
+	if _, err := svc.ClaimAddress(ctx, landlordPubkey, "shop", ""); !errors.Is(err, payment.ErrAddressTaken) {
+		t.Errorf("claiming a held name: err = %v, want ErrAddressTaken", err)
+	}
+	for _, name := range []string{"", "shop@pay.example.com", "two words", strings.Repeat("a", 65)} {
+		if _, err := svc.ClaimAddress(ctx, landlordPubkey, name, ""); !errors.Is(err, payment.ErrInvalidAddressName) {
+			t.Errorf("ClaimAddress(%q): err = %v, want ErrInvalidAddressName", name, err)
+		}
+	}
+
+	if list, _ := svc.ListAddresses(ctx, merchantPubkey); len(list) != 1 || list[0].Description != "Corner shop" {
+		t.Errorf("ListAddresses = %+v", list)
+	}
+	if err := svc.ReleaseAddress(ctx, landlordPubkey, "shop"); !errors.Is(err, payment.ErrAddressNotFound) {
+		t.Errorf("releasing another merchant's name: err = %v, want ErrAddressNotFound", err)
+	}
+	if err := svc.ReleaseAddress(ctx, merchantPubkey, "SHOP"); err != nil {
+		t.Fatalf("ReleaseAddress: %v", err)
+	}
+	if _, err := svc.ClaimAddress(ctx, landlordPubkey, "shop", ""); err != nil {
+		t.Errorf("claiming a released name: %v", err)
+	}
+
+	plain := payment.NewService(nil, newPayMock(), "http://localhost:8080")
+	if _, err := plain.ClaimAddress(ctx, merchantPubkey, "shop", ""); !errors.Is(err, payment.ErrAddressesDisabled) {
+		t.Errorf("without addresses: err = %v, want ErrAddressesDisabled", err)
+	}
+}
+
+func TestPayAddress(t *testing.T) {
+	db, svc := setupAddresses(t)
+	ctx := context.Background()
+	db.CreateUser(ctx, &store.User{Pubkey: merchantPubkey, IsMerchant: true})
+	svc.ClaimAddress(ctx, merchantPubkey, "shop", "")
+
+	offer, err := svc.PayOffer(ctx, "shop")
+	if err != nil {
+		t.Fatalf("PayOffer: %v", err)
+	}
+	if offer.Tag != "payRequest" || offer.Callback != "https://pay.example.com/api/lnurlp/shop/callback" ||
+		offer.MinSendable != 1000 || offer.MaxSendable != 100_000_000 || offer.CommentAllowed != 10 {
+		t.Errorf("offer = %+v", offer)
+	}
+	if !strings.Contains(offer.Metadata, `["text/identifier","shop@pay.example.com"]`) {
+		t.Errorf("metadata = %s, want the address as identifier", offer.Metadata)
+	}
+
+	result, err := svc.PayAddress(ctx, "shop", 21_000, "thanks!")
+	if err != nil {
+		t.Fatalf("PayAddress: %v", err)
+	}
+	inv, _ := bolt11.Decode(result.Bolt11)
+	h := sha256.Sum256([]byte(offer.Metadata))
+	if inv.DescriptionHash != hex.EncodeToString(h[:]) {
+		t.Errorf("description hash = %s, want the metadata's", inv.DescriptionHash)
+	}
+	p, _ := db.GetPayment(ctx, result.PaymentID)
+	if p.AmountSats != 21 || p.ReceiverPubkey != merchantPubkey || p.Memo != "thanks!" || p.Status != "pending" {
+		t.Errorf("payment = %+v", p)
+	}
+	events, _ := svc.ListPaymentEvents(ctx, p.ID)
+	if len(events) == 0 || events[0].Cause != payment.CauseLNURL {
+		t.Errorf("events = %+v, want created by lnurl", events)
+	}
+
+	for _, amount := range []int64{0, 1500, 100_001_000} {
+		if _, err := svc.PayAddress(ctx, "shop", amount, ""); !errors.Is(err, payment.ErrAddressAmount) {
+			t.Errorf("PayAddress(%d msat): err = %v, want ErrAddressAmount", amount, err)
+		}
+	}
+	if _, err := svc.PayAddress(ctx, "shop", 1000, "far too long"); !errors.Is(err, payment.ErrAddressComment) {
+		t.Errorf("long comment: err = %v, want ErrAddressComment", err)
+	}
+	if _, err := svc.PayOffer(ctx, "nobody"); !errors.Is(err, payment.ErrAddressNotFound) {
+		t.Errorf("unknown name: err = %v, want ErrAddressNotFound", err)
+	}
+
+	// Names of former merchants are not served
+	db.UpdateUserMerchant(ctx, merchantPubkey, false)
+	if _, err := svc.PayAddress(ctx, "shop", 1000, ""); !errors.Is(err, payment.ErrAddressNotFound) {
+		t.Errorf("former merchant: err = %v, want ErrAddressNotFound", err)
+	}
+}
@@ -0,0 +1,342 @@
+package payment
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/bolt11"
+	"github.com/nostr-pay/nostr-pay/internal/lnbits"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+var (
+	ErrInvalidInvoice      = errors.New("invalid invoice")
+	ErrAmountlessInvoice   = errors.New("invoice has no amount")
+	ErrAmountMismatch      = errors.New("invoice amount does not match")
+	ErrInvoiceExpired      = errors.New("invoice expired")
+	ErrDuplicateInvoice    = errors.New("invoice already known")
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrPaymentFailed       = errors.New("payment failed")
+	ErrFeeLimit            = errors.New("routing fee could exceed the fee limit")
+)
+
+// FeeLimit caps the routing fee of outgoing payments at BaseSats plus PPM
+// parts per million of the amount.
+type FeeLimit struct {
+	BaseSats int64
+	PPM      int64
+}
+
+// DefaultFeeLimit is 10 sats plus 1%.
+var DefaultFeeLimit = FeeLimit{BaseSats: 10, PPM: 10_000}
+
+func (l FeeLimit) For(amountSats int64) int64 {
+	return l.BaseSats + amountSats*l.PPM/1_000_000
+}
+
+type PayInvoiceInput struct {
+	PayerPubkey string
+	Bolt11      string
+	// AmountSats, when set, must equal the invoice amount. Clients pass
+	// the amount they showed the user so a swapped invoice is refused.
+	AmountSats int64
+}
+
+type PayInvoiceResult struct {
+	PaymentID   string
+	PaymentHash string
+	Status      string
+	AmountSats  int64
+	FeeSats     int64
+	Preimage    string
+}
+
+// SetFeeLimit replaces DefaultFeeLimit for outgoing payments.
+func (s *Service) SetFeeLimit(l FeeLimit) {
+	s.feeLimit = l
+}
+
+// PayInvoice pays a bolt11 invoice from the payer's LNbits wallet, or the
+// shared one, and records it as a sent payment of the payer. Like a
+// withdrawal, it must leave the reserve and stays within the daily limit.
+//
+// LNbits does not take a per-payment fee cap; it caps the fee at its own
+// fee reserve (LNBITS_RESERVE_FEE_MIN/PERCENT). The limit is enforced by
+// asking LNbits for that reserve first and refusing the payment with
+// ErrFeeLimit if it is higher than the limit. The wallet must also cover
+// the amount plus the limit.
+func (s *Service) PayInvoice(ctx context.Context, input *PayInvoiceInput) (*PayInvoiceResult, error) {
+	limits := s.withdrawals
+	return s.pay(ctx, input, payPurpose{limits: &limits})
+}
+
+// payPurpose says what an outgoing payment is for. The zero value is a
+// payment the service makes on the payer's behalf, such as a split payout.
+type payPurpose struct {
+	// refundOf is the payment refunded; the refund must stay within what
+	// is left to refund.
+	refundOf *store.Payment
+	// limits, when set, makes the payment one the merchant makes out of
+	// their balance: its fee is capped, it must leave the reserve, counts
+	// toward the daily limit and is marked as a withdrawal.
+	limits *WithdrawalLimits
+	// cause is logged with the payment's creation; CauseCreated, or
+	// CauseRefund for refunds, when empty.
+	cause string
+}
+
+// pay implements PayInvoice, refunds, withdrawals and split payouts. From
+// the shared wallet, the payer's share of it must cover the payment, so
+// that merchants cannot spend each other's earnings. When LNbits fails or
+// cannot be reached after the payment was recorded, the result is returned
+// along with the error so callers can follow the payment up.
+func (s *Service) pay(ctx context.Context, input *PayInvoiceInput, purpose payPurpose) (*PayInvoiceResult, error) {
+	inv, err := bolt11.Decode(input.Bolt11)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidInvoice, err)
+	}
+	if inv.AmountMsat <= 0 {
+		return nil, ErrAmountlessInvoice
+	}
+	amountSats := (inv.AmountMsat + 999) / 1000
+	if input.AmountSats > 0 && input.AmountSats != amountSats {
+		return nil, fmt.Errorf("%w: invoice is for %d sats, expected %d", ErrAmountMismatch, amountSats, input.AmountSats)
+	}
+	if inv.Expired(time.Now()) {
+		return nil, ErrInvoiceExpired
+	}
+
+	// Refuse our own invoices and repeats; the hash identifies the payment
+	if _, err := s.store.GetPaymentByHash(ctx, inv.PaymentHash); err == nil {
+		return nil, ErrDuplicateInvoice
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("get payment by hash: %w", err)
+	}
+
+	feeLimit := s.feeLimit.For(amountSats)
+	if purpose.limits != nil && purpose.limits.MaxFeeSats > 0 {
+		feeLimit = min(feeLimit, purpose.limits.MaxFeeSats)
+	}
+
+	wallet, walletID, err := s.walletFor(ctx, input.PayerPubkey)
+	if err != nil {
+		return nil, err
+	}
+	reserve, err := wallet.FeeReserve(ctx, input.Bolt11)
+	if err != nil {
+		return nil, fmt.Errorf("get fee reserve: %w", err)
+	}
+	if reserve > feeLimit*1000 {
+		return nil, fmt.Errorf("%w: LNbits allows up to %d sats, the limit is %d", ErrFeeLimit, (reserve+999)/1000, feeLimit)
+	}
+	balance, err := wallet.GetWallet(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get wallet: %w", err)
+	}
+	required := amountSats + feeLimit
+	if purpose.limits != nil {
+		required += purpose.limits.ReserveSats
+	}
+	if balance.Balance < required*1000 {
+		return nil, ErrInsufficientBalance
+	}
+
+	paymentID, err := newID("pay_")
+	if err != nil {
+		return nil, err
+	}
+	payment := &store.Payment{
+		ID:           paymentID,
+		Bolt11:       input.Bolt11,
+		AmountSats:   amountSats,
+		Memo:         inv.Description,
+		SenderPubkey: input.PayerPubkey,
+		PaymentHash:  inv.PaymentHash,
+		Status:       StatusPending,
+		Direction:    "sent",
+		WalletID:     walletID,
+		Withdrawal:   purpose.limits != nil,
+	}
+	if err := s.createSent(ctx, payment, purpose, required); err != nil {
+		return nil, err
+	}
+
+	result := &PayInvoiceResult{
+		PaymentID:   paymentID,
+		PaymentHash: inv.PaymentHash,
+		Status:      StatusPending,
+		AmountSats:  amountSats,
+	}
+
+	if _, err := wallet.PayInvoice(ctx, input.Bolt11); err != nil {
+		if errors.Is(err, lnbits.ErrPaymentFailed) {
+			if _, err := s.completeOutgoing(ctx, payment, StatusFailed, CausePayment, input.PayerPubkey, "", 0, nil); err != nil {
+				slog.Error("failed to record failed payment", "payment_id", paymentID, "error", err)
+			}
+			result.Status = StatusFailed
+			return result, fmt.Errorf("%w: %w", ErrPaymentFailed, err)
+		}
+		// The outcome is unknown; the payment stays pending until
+		// reconciliation finds it out.
+		return result, fmt.Errorf("pay invoice: %w", err)
+	}
+
+	status, err := wallet.CheckPayment(ctx, inv.PaymentHash)
+	if err != nil {
+		slog.Warn("paid invoice but could not load its status", "payment_id", paymentID, "error", err)
+		return result, nil
+	}
+	if !status.Paid {
+		return result, nil
+	}
+
+	fee := status.Details.Fee
+	if fee < 0 {
+		fee = -fee
+	}
+	result.FeeSats = (fee + 999) / 1000
+	result.Preimage = status.Preimage
+	result.Status = StatusPaid
+	if result.FeeSats > feeLimit {
+		slog.Warn("routing fee above limit",
+			"payment_id", paymentID,
+			"fee_sats", result.FeeSats,
+			"limit_sats", feeLimit,
+		)
+	}
+
+	now := time.Now()
+	completed, err := s.completeOutgoing(ctx, payment, StatusPaid, CausePayment, input.PayerPubkey, status.Preimage, result.FeeSats, &now)
+	if err != nil {
+		// LNbits paid; the payment stays pending until reconciliation
+		// records it
+		return result, err
+	}
+	if completed {
+		s.notify(inv.PaymentHash, StatusPaid)
+		if purpose.refundOf != nil {
+			s.markRefunded(ctx, purpose.refundOf.ID, input.PayerPubkey)
+		}
+	}
+	return result, nil
+}
+
+// createSent stores an outgoing payment. From the shared wallet, the
+// payer's share of it must cover required sats: the amount, fee limit and
+// any reserve. Withdrawals must also stay within the daily limit. The
+// checks are made as the payment is stored, so concurrent payments cannot
+// overshoot them.
+func (s *Service) createSent(ctx context.Context, p *store.Payment, purpose payPurpose, required int64) error {
+	var limit store.SpendLimit
+	if p.WalletID == "" {
+		limit.MinLedgerSats = required
+	}
+	if purpose.limits != nil {
+		limit.Since = startOfDay(time.Now())
+		limit.DailySats = purpose.limits.DailySats
+	}
+
+	cause := purpose.cause
+	switch {
+	case cause != "":
+	case purpose.refundOf != nil:
+		cause = CauseRefund
+	default:
+		cause = CauseCreated
+	}
+	event := createdEvent(cause, p.SenderPubkey)
+	var created bool
+	var err error
+	if purpose.refundOf != nil {
+		p.RefundOf = purpose.refundOf.ID
+		if p.Memo == "" {
+			p.Memo = "Refund for " + purpose.refundOf.ID
+		}
+		created, err = s.store.CreateRefund(ctx, p, purpose.refundOf.AmountSats, limit, event)
+	} else {
+		created, err = s.store.CreateSpend(ctx, p, limit, event)
+	}
+	if err != nil {
+		return fmt.Errorf("store payment: %w", err)
+	}
+	if !created {
+		return s.spendRejected(ctx, p, limit)
+	}
+	return nil
+}
+
+// spendRejected returns why the store refused p under limit.
+func (s *Service) spendRejected(ctx context.Context, p *store.Payment, limit store.SpendLimit) error {
+	if p.Withdrawal && limit.DailySats > 0 {
+		withdrawn, err := s.store.SumWithdrawals(ctx, p.SenderPubkey, limit.Since)
+		if err != nil {
+			return fmt.Errorf("sum withdrawals: %w", err)
+		}
+		if withdrawn+p.AmountSats > limit.DailySats {
+			return fmt.Errorf("%w: %d of %d sats left today", ErrWithdrawalLimit, max(limit.DailySats-withdrawn, 0), limit.DailySats)
+		}
+	}
+	if p.RefundOf != "" && limit.MinLedgerSats > 0 {
+		balance, err := s.store.GetLedgerBalance(ctx, p.SenderPubkey)
+		if err != nil {
+			return fmt.Errorf("get ledger balance: %w", err)
+		}
+		if balance < limit.MinLedgerSats {
+			return ErrInsufficientBalance
+		}
+	}
+	if p.RefundOf != "" {
+		return ErrRefundExceedsPayment
+	}
+	return ErrInsufficientBalance
+}
+
+// unknownPaymentGrace is how long after it was recorded a sent payment
+// LNbits has no trace of is still taken to be on its way there.
+const unknownPaymentGrace = time.Hour
+
+// settleOutgoing checks a pending sent payment, whose outcome pay did not
+// learn, with LNbits and records the outcome once it is known. A payment
+// LNbits never received is marked failed after unknownPaymentGrace. It
+// reports whether the payment was completed.
+func (s *Service) settleOutgoing(ctx context.Context, p *store.Payment, cause string) (bool, error) {
+	wallet, err := s.paymentWallet(ctx, p)
+	if err != nil {
+		return false, err
+	}
+	status, err := wallet.CheckPayment(ctx, p.PaymentHash)
+	switch {
+	case errors.Is(err, lnbits.ErrPaymentNotFound):
+		if time.Since(p.CreatedAt) < unknownPaymentGrace {
+			return false, nil
+		}
+		return s.completeOutgoing(ctx, p, StatusFailed, cause, ActorSystem, "", 0, nil)
+	case err != nil:
+		return false, fmt.Errorf("check payment: %w", err)
+	case status.Status == "failed":
+		return s.completeOutgoing(ctx, p, StatusFailed, cause, ActorSystem, "", 0, nil)
+	case !status.Paid:
+		return false, nil
+	}
+
+	fee := status.Details.Fee
+	if fee < 0 {
+		fee = -fee
+	}
+	now := time.Now()
+	completed, err := s.completeOutgoing(ctx, p, StatusPaid, cause, ActorSystem, status.Preimage, (fee+999)/1000, &now)
+	if err != nil {
+		return false, err
+	}
+	if completed {
+		s.notify(p.PaymentHash, StatusPaid)
+		if p.RefundOf != "" {
+			s.markRefunded(ctx, p.RefundOf, ActorSystem)
+		}
+	}
+	return completed, nil
+}
@@ -0,0 +1,255 @@
+package payment_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/bolt11"
+	"github.com/nostr-pay/nostr-pay/internal/bolt11/bolt11test"
+	"github.com/nostr-pay/nostr-pay/internal/lnbits"
+	"github.com/nostr-pay/nostr-pay/internal/payment"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+func newPayMock() *mockLNbits {
+	return &mockLNbits{
+		paymentResp: &lnbits.PaymentStatus{
+			Paid:     true,
+			Preimage: "preimage_001",
+			Details:  lnbits.PaymentDetails{Amount: -1_000_000, Fee: -2500},
+		},
+		wallet: &lnbits.Wallet{Balance: 10_000_000},
+	}
+}
+
+// fundLedger gives the user sats in the shared wallet, as a settled sale.
+func fundLedger(t *testing.T, db store.Store, pubkey string, sats int64) {
+	t.Helper()
+	id := fmt.Sprintf("pay_funds_%s_%d", pubkey, sats)
+	err := db.CreatePayment(context.Background(), &store.Payment{
+		ID:             id,
+		AmountSats:     sats,
+		ReceiverPubkey: pubkey,
+		PaymentHash:    "hash_" + id,
+		Status:         "paid",
+		Direction:      "received",
+	}, nil)
+	if err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+}
+
+func TestPayInvoice(t *testing.T) {
+	db, _ := store.NewSQLite(":memory:")
+	defer db.Close()
+
+	mock := newPayMock()
+	svc := payment.NewService(db, mock, "http://localhost:8080")
+	notifier := &recordingNotifier{}
+	svc.SetNotifier(notifier)
+	ctx := context.Background()
+	fundLedger(t, db, "npub_payer", 5000)
+
+	invoice, hash := signInvoice(1000, "coffee", 10*time.Minute)
+	result, err := svc.PayInvoice(ctx, &payment.PayInvoiceInput{
+		PayerPubkey: "npub_payer",
+		Bolt11:      invoice,
+		AmountSats:  1000,
+	})
+	if err != nil {
+		t.Fatalf("PayInvoice: %v", err)
+	}
+	if result.Status != "paid" || result.FeeSats != 3 || result.Preimage != "preimage_001" {
+		t.Errorf("result = %+v, want paid with 3 sats fee and the preimage", result)
+	}
+	if result.PaymentHash != hash {
+		t.Errorf("PaymentHash = %q, want %q", result.PaymentHash, hash)
+	}
+
+	p, err := db.GetPayment(ctx, result.PaymentID)
+	if err != nil {
+		t.Fatalf("GetPayment: %v", err)
+	}
+	if p.Direction != "sent" || p.Status != "paid" || p.SenderPubkey != "npub_payer" {
+		t.Errorf("payment = %+v, want a paid payment sent by npub_payer", p)
+	}
+	if p.Preimage != "preimage_001" || p.FeeSats != 3 || p.Memo != "coffee" {
+		t.Errorf("payment = %+v, want preimage, fee and memo recorded", p)
+	}
+	if notifier.events[hash] != "paid" {
+		t.Errorf("notifications = %v, want %s paid", notifier.events, hash)
+	}
+
+	history, _ := db.ListPaymentsByUser(ctx, "npub_payer", 10, 0)
+	if len(history) != 2 {
+		t.Errorf("history has %d payments, want the funds and the sent one", len(history))
+	}
+
+	if _, err := svc.PayInvoice(ctx, &payment.PayInvoiceInput{PayerPubkey: "npub_payer", Bolt11: invoice}); !errors.Is(err, payment.ErrDuplicateInvoice) {
+		t.Errorf("second payment: err = %v, want ErrDuplicateInvoice", err)
+	}
+	if len(mock.paid) != 1 {
+		t.Errorf("paid %d times, want 1", len(mock.paid))
+	}
+}
+
+func TestPayInvoice_Rejected(t *testing.T) {
+	valid, _ := signInvoice(1000, "", time.Hour)
+	amountless, _ := signInvoice(0, "", time.Hour)
+	expired, err := bolt11test.Encode(&bolt11.Invoice{
+		Network:     "mainnet",
+		AmountMsat:  1_000_000,
+		Timestamp:   time.Now().Add(-2 * time.Hour),
+		PaymentHash: strings.Repeat("ee", 32),
+	}, nodeKey)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		input      payment.PayInvoiceInput
+		balance    int64
+		feeReserve int64
+		wantErr    error
+	}{
+		{
+			name:    "not an invoice",
+			input:   payment.PayInvoiceInput{Bolt11: "lnbc10u1p..."},
+			wantErr: payment.ErrInvalidInvoice,
+		},
+		{
+			name:    "amount mismatch",
+			input:   payment.PayInvoiceInput{Bolt11: valid, AmountSats: 999},
+			wantErr: payment.ErrAmountMismatch,
+		},
+		{
+			name:    "amountless",
+			input:   payment.PayInvoiceInput{Bolt11: amountless},
+			wantErr: payment.ErrAmountlessInvoice,
+		},
+		{
+			name:    "expired",
+			input:   payment.PayInvoiceInput{Bolt11: expired},
+			wantErr: payment.ErrInvoiceExpired,
+		},
+		{
+			// 1000 sats plus the default 10 + 1% fee limit
+			name:    "balance below fee limit",
+			input:   payment.PayInvoiceInput{Bolt11: valid},
+			balance: 1_015_000,
+			wantErr: payment.ErrInsufficientBalance,
+		},
+		{
+			// LNbits would let the route cost 21 sats, above the 20 sat limit
+			name:       "fee reserve above fee limit",
+			input:      payment.PayInvoiceInput{Bolt11: valid},
+			feeReserve: 20_001,
+			wantErr:    payment.ErrFeeLimit,
+		},
+		{
+			name:       "fee reserve within fee limit",
+			input:      payment.PayInvoiceInput{Bolt11: valid},
+			feeReserve: 20_000,
+		},
+		{
+			name:    "balance covers the fee limit",
+			input:   payment.PayInvoiceInput{Bolt11: valid},
+			balance: 1_020_000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := store.NewSQLite(":memory:")
+			defer db.Close()
+
+			mock := newPayMock()
+			if tt.balance != 0 {
+				mock.wallet.Balance = tt.balance
+			}
+			mock.feeReserve = tt.feeReserve
+			svc := payment.NewService(db, mock, "http://localhost:8080")
+			svc.SetWithdrawalLimits(payment.WithdrawalLimits{})
+			fundLedger(t, db, "npub_payer", 5000)
+
+			tt.input.PayerPubkey = "npub_payer"
+			_, err := svc.PayInvoice(context.Background(), &tt.input)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("PayInvoice: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if len(mock.paid) != 0 {
+				t.Error("rejected invoice was paid")
+			}
+		})
+	}
+}
+
+func TestPayInvoice_Failed(t *testing.T) {
+	db, _ := store.NewSQLite(":memory:")
+	defer db.Close()
+
+	mock := newPayMock()
+	mock.payErr = fmt.Errorf("%w: no route", lnbits.ErrPaymentFailed)
+	svc := payment.NewService(db, mock, "http://localhost:8080")
+	ctx := context.Background()
+	fundLedger(t, db, "npub_payer", 5000)
+
+	invoice, hash := signInvoice(1000, "", time.Hour)
+	_, err := svc.PayInvoice(ctx, &payment.PayInvoiceInput{PayerPubkey: "npub_payer", Bolt11: invoice})
+	if !errors.Is(err, payment.ErrPaymentFailed) {
+		t.Fatalf("err = %v, want ErrPaymentFailed", err)
+	}
+	p, err := db.GetPaymentByHash(ctx, hash)
+	if err != nil {
+		t.Fatalf("GetPaymentByHash: %v", err)
+	}
+	if p.Status != "failed" {
+		t.Errorf("Status = %q, want %q", p.Status, "failed")
+	}
+}
+
+func TestPayInvoice_Limits(t *testing.T) {
+	db, _ := store.NewSQLite(":memory:")
+	defer db.Close()
+
+	mock := newPayMock()
+	svc := payment.NewService(db, mock, "http://localhost:8080")
+	svc.SetWithdrawalLimits(payment.WithdrawalLimits{ReserveSats: 1000, DailySats: 3000})
+	ctx := context.Background()
+	fundLedger(t, db, "npub_payer", 10_000)
+
+	// The shared wallet holds other merchants' earnings too
+	invoice, _ := signInvoice(1000, "", time.Hour)
+	if _, err := svc.PayInvoice(ctx, &payment.PayInvoiceInput{PayerPubkey: "npub_other", Bolt11: invoice}); !errors.Is(err, payment.ErrInsufficientBalance) {
+		t.Errorf("paying without earnings: err = %v, want ErrInsufficientBalance", err)
+	}
+
+	result, err := svc.PayInvoice(ctx, &payment.PayInvoiceInput{PayerPubkey: "npub_payer", Bolt11: invoice})
+	if err != nil {
+		t.Fatalf("PayInvoice: %v", err)
+	}
+	p, _ := db.GetPayment(ctx, result.PaymentID)
+	if !p.Withdrawal {
+		t.Error("payment not counted toward the daily limit")
+	}
+
+	// Payments and withdrawals share the daily limit
+	invoice, _ = signInvoice(2500, "", time.Hour)
+	if _, err := svc.PayInvoice(ctx, &payment.PayInvoiceInput{PayerPubkey: "npub_payer", Bolt11: invoice}); !errors.Is(err, payment.ErrWithdrawalLimit) {
+		t.Errorf("err = %v, want ErrWithdrawalLimit", err)
+	}
+	if len(mock.paid) != 1 {
+		t.Errorf("paid %d invoices, want 1", len(mock.paid))
+	}
+}
@@ -0,0 +1,85 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+// reconcileBatch is how many payments a reconciliation pass loads at a
+// time.
+const reconcileBatch = 500
+
+// Reconcile checks unsettled payments with LNbits and settles the paid ones,
+// recovering from missed webhooks. With includeExpired, expired payments are
+// checked as well. Sent payments whose outcome is unknown, e.g. after
+// LNbits could not be reached, are completed as paid or failed. It returns
+// how many payments were settled; a failed check is logged and does not
+// stop the pass.
+func (s *Service) Reconcile(ctx context.Context, includeExpired bool) (int, error) {
+	now := time.Now()
+	settled := 0
+	var after *store.Payment
+	for {
+		payments, err := s.store.ListUnsettledPayments(ctx, now, includeExpired, after, reconcileBatch)
+		if err != nil {
+			return settled, fmt.Errorf("list unsettled payments: %w", err)
+		}
+		settled += s.reconcilePage(ctx, payments)
+		if ctx.Err() != nil {
+			return settled, ctx.Err()
+		}
+		if len(payments) < reconcileBatch {
+			return settled, nil
+		}
+		after = payments[len(payments)-1]
+	}
+}
+
+// reconcilePage checks one page of payments and returns how many were
+// settled.
+func (s *Service) reconcilePage(ctx context.Context, payments []*store.Payment) int {
+	settled := 0
+	for _, p := range payments {
+		if ctx.Err() != nil {
+			return settled
+		}
+		var ok bool
+		var err error
+		if p.Direction == "sent" {
+			ok, err = s.settleOutgoing(ctx, p, CauseReconcile)
+		} else {
+			ok, err = s.checkAndSettle(ctx, p, CauseReconcile)
+		}
+		if err != nil {
+			slog.Warn("reconcile payment failed", "payment_id", p.ID, "error", err)
+			continue
+		}
+		if ok {
+			slog.Info("payment settled by reconciliation", "payment_id", p.ID, "status", p.Status)
+			settled++
+		}
+	}
+	return settled
+}
+
+// RunReconciler calls Reconcile for pending, unexpired payments every
+// interval until ctx is done.
+func (s *Service) RunReconciler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.Reconcile(ctx, false); err != nil && ctx.Err() == nil {
+				slog.Error("reconciliation failed", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package payment_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/lnbits"
+	"github.com/nostr-pay/nostr-pay/internal/payment"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+func TestReconcile(t *testing.T) {
+	db, _ := store.NewSQLite(":memory:")
+	defer db.Close()
+
+	mock := &mockLNbits{
+		paymentResp: &lnbits.PaymentStatus{Paid: true},
+	}
+	svc := payment.NewService(db, mock, "http://localhost:8080")
+	notifier := &recordingNotifier{}
+	svc.SetNotifier(notifier)
+
+	ctx := context.Background()
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	db.CreatePayment(ctx, &store.Payment{
+		ID:             "pay_missed",
+		Bolt11:         "lnbc...",
+		AmountSats:     500,
+		ReceiverPubkey: "npub_receiver",
+		PaymentHash:    "hash_missed",
+		Status:         "pending",
+		ExpiresAt:      &future,
+		WebhookToken:   "token_missed",
+	}, nil)
+	db.CreatePayment(ctx, &store.Payment{
+		ID:             "pay_expired",
+		Bolt11:         "lnbc...",
+		AmountSats:     500,
+		ReceiverPubkey: "npub_receiver",
+		PaymentHash:    "hash_expired",
+		Status:         "expired",
+		ExpiresAt:      &past,
+	}, nil)
+
+	n, err := svc.Reconcile(ctx, false)
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("settled %d payments, want 1", n)
+	}
+	p, _ := db.GetPayment(ctx, "pay_missed")
+	if p.Status != "paid" {
+		t.Errorf("Status = %q, want %q", p.Status, "paid")
+	}
+	if notifier.events["hash_missed"] != "paid" {
+		t.Errorf("notifications = %v, want hash_missed paid", notifier.events)
+	}
+
+	// A late webhook for the same payment does not notify twice
+	delete(notifier.events, "hash_missed")
+	if err := svc.HandleWebhook(ctx, "hash_missed", "token_missed"); err != nil {
+		t.Fatalf("HandleWebhook: %v", err)
+	}
+	if _, ok := notifier.events["hash_missed"]; ok {
+		t.Error("already settled payment was notified again")
+	}
+
+	// One-shot mode also recovers expired payments
+	n, _ = svc.Reconcile(ctx, true)
+	if n != 1 {
+		t.Errorf("settled %d payments including expired, want 1", n)
+	}
+}
+
+func TestReconcile_Outgoing(t *testing.T) {
+	db, _ := store.NewSQLite(":memory:")
+	defer db.Close()
+
+	mock := newPayMock()
+	mock.payErr = errors.New("connection reset")
+	svc := payment.NewService(db, mock, "http://localhost:8080")
+	notifier := &recordingNotifier{}
+	svc.SetNotifier(notifier)
+	ctx := context.Background()
+	fundLedger(t, db, "npub_payer", 10_000)
+
+	// LNbits could not be reached, so the outcome is unknown
+	invoice, hash := signInvoice(1000, "", time.Hour)
+	result, err := svc.PayInvoice(ctx, &payment.PayInvoiceInput{PayerPubkey: "npub_payer", Bolt11: invoice})
+	if err == nil || result == nil || result.Status != "pending" {
+		t.Fatalf("PayInvoice = %+v, %v, want pending with an error", result, err)
+	}
+
+	// Unknown to LNbits so far
+	mock.checkErr = lnbits.ErrPaymentNotFound
+	if n, _ := svc.Reconcile(ctx, false); n != 0 {
+		t.Errorf("settled %d payments LNbits does not know of yet, want 0", n)
+	}
+	mock.checkErr = nil
+
+	if n, _ := svc.Reconcile(ctx, false); n != 1 {
+		t.Errorf("settled %d payments, want 1", n)
+	}
+	p, _ := db.GetPayment(ctx, result.PaymentID)
+	if p.Status != "paid" || p.Preimage != "preimage_001" || p.FeeSats != 3 {
+		t.Errorf("payment = %+v, want paid with the preimage and fee", p)
+	}
+	if notifier.events[hash] != "paid" {
+		t.Errorf("notifications = %v, want %s paid", notifier.events, hash)
+	}
+
+	invoice, _ = signInvoice(500, "", time.Hour)
+	result, _ = svc.PayInvoice(ctx, &payment.PayInvoiceInput{PayerPubkey: "npub_payer", Bolt11: invoice})
+	mock.paymentResp = &lnbits.PaymentStatus{Status: "failed"}
+	svc.Reconcile(ctx, false)
+	p, _ = db.GetPayment(ctx, result.PaymentID)
+	if p.Status != "failed" {
+		t.Errorf("Status = %q, want failed", p.Status)
+	}
+	events, _ := svc.ListPaymentEvents(ctx, p.ID)
+	if last := events[len(events)-1]; last.Cause != payment.CauseReconcile {
+		t.Errorf("last event = %+v, want caused by reconciliation", last)
+	}
+}
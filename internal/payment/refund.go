@@ -0,0 +1,106 @@
+package payment
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+var (
+	ErrPaymentNotFound      = errors.New("payment not found")
+	ErrNotRefundable        = errors.New("only settled incoming payments can be refunded")
+	ErrRefundExceedsPayment = errors.New("refund exceeds the amount left to refund")
+	ErrRefundDestination    = errors.New("give either a bolt11 invoice or a lightning address")
+	ErrAddressUnavailable   = errors.New("lightning address did not return an invoice")
+)
+
+// AddressResolver fetches invoices from Lightning addresses.
+type AddressResolver interface {
+	FetchInvoice(ctx context.Context, address string, amountMsat int64, comment string) (string, error)
+}
+
+func (s *Service) SetAddressResolver(r AddressResolver) {
+	s.addresses = r
+}
+
+type RefundInput struct {
+	MerchantPubkey string
+	PaymentID      string
+	// AmountSats defaults to what is left to refund. With a bolt11
+	// invoice that has an amount, it may be left out.
+	AmountSats int64
+	// Exactly one of Bolt11 and LightningAddress is the customer's
+	// destination.
+	Bolt11           string
+	LightningAddress string
+}
+
+// Refund pays sats back to the customer of a settled payment the merchant
+// received. Refunds may be partial; together they never exceed the
+// original amount. The refund is recorded as a sent payment linked to the
+// original.
+func (s *Service) Refund(ctx context.Context, input *RefundInput) (*PayInvoiceResult, error) {
+	if (input.Bolt11 == "") == (input.LightningAddress == "") {
+		return nil, ErrRefundDestination
+	}
+
+	orig, err := s.store.GetPayment(ctx, input.PaymentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrPaymentNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get payment: %w", err)
+	}
+	if orig.ReceiverPubkey != input.MerchantPubkey {
+		return nil, ErrPaymentNotFound
+	}
+	if orig.Direction != "received" || (orig.Status != StatusPaid && orig.Status != StatusRefunded) {
+		return nil, ErrNotRefundable
+	}
+
+	remaining := orig.AmountSats - orig.RefundedSats
+	amount := input.AmountSats
+	if amount == 0 && input.LightningAddress != "" {
+		amount = remaining
+	}
+	if remaining <= 0 || amount > remaining {
+		return nil, fmt.Errorf("%w: %d sats left", ErrRefundExceedsPayment, max(remaining, 0))
+	}
+
+	bolt11 := input.Bolt11
+	if input.LightningAddress != "" {
+		if s.addresses == nil {
+			return nil, ErrAddressUnavailable
+		}
+		bolt11, err = s.addresses.FetchInvoice(ctx, input.LightningAddress, amount*1000, "Refund for "+orig.ID)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrAddressUnavailable, err)
+		}
+	}
+
+	return s.pay(ctx, &PayInvoiceInput{
+		PayerPubkey: input.MerchantPubkey,
+		Bolt11:      bolt11,
+		AmountSats:  amount,
+	}, payPurpose{refundOf: orig})
+}
+
+// markRefunded moves a paid payment to refunded once its refunds cover the
+// amount. It runs after a refund was paid; RefundedSats also counts refunds
+// still in flight, which only exist while a concurrent refund is being
+// sent. settled_at is left as it was, so the sale stays on its day.
+func (s *Service) markRefunded(ctx context.Context, paymentID, actor string) {
+	orig, err := s.store.GetPayment(ctx, paymentID)
+	if err != nil {
+		slog.Error("failed to load refunded payment", "payment_id", paymentID, "error", err)
+		return
+	}
+	if orig.Status != StatusPaid || orig.RefundedSats < orig.AmountSats {
+		return
+	}
+	if _, err := s.transition(ctx, orig, StatusRefunded, CauseRefund, actor, nil); err != nil {
+		slog.Error("failed to mark payment refunded", "payment_id", paymentID, "error", err)
+	}
+}
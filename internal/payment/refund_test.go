@@ -0,0 +1,145 @@
+package payment_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/payment"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+type stubResolver struct {
+	addresses []string
+}
+
+func (r *stubResolver) FetchInvoice(ctx context.Context, address string, amountMsat int64, comment string) (string, error) {
+	r.addresses = append(r.addresses, address)
+	bolt11, _ := signInvoice(amountMsat/1000, "", time.Hour)
+	return bolt11, nil
+}
+
+func TestRefund(t *testing.T) {
+	db, _ := store.NewSQLite(":memory:")
+	defer db.Close()
+
+	mock := newPayMock()
+	svc := payment.NewService(db, mock, "http://localhost:8080")
+	resolver := &stubResolver{}
+	svc.SetAddressResolver(resolver)
+	ctx := context.Background()
+
+	settled := time.Now()
+	db.CreatePayment(ctx, &store.Payment{
+		ID:             "pay_sale",
+		Bolt11:         "lnbc...",
+		AmountSats:     1000,
+		ReceiverPubkey: "merchant",
+		PaymentHash:    "hash_sale",
+		Status:         "pending",
+	}, nil)
+	db.TransitionPaymentStatus(ctx, &store.PaymentEvent{PaymentID: "pay_sale", FromStatus: "pending", ToStatus: "paid"}, &settled)
+	fundLedger(t, db, "merchant", 5000)
+
+	// Partial refund to an invoice the customer presents
+	invoice, _ := signInvoice(400, "returned mug", time.Hour)
+	result, err := svc.Refund(ctx, &payment.RefundInput{
+		MerchantPubkey: "merchant",
+		PaymentID:      "pay_sale",
+		Bolt11:         invoice,
+	})
+	if err != nil {
+		t.Fatalf("Refund: %v", err)
+	}
+	refund, _ := db.GetPayment(ctx, result.PaymentID)
+	if refund.RefundOf != "pay_sale" || refund.SenderPubkey != "merchant" || refund.Status != "paid" {
+		t.Errorf("refund = %+v, want a paid refund of pay_sale sent by the merchant", refund)
+	}
+
+	// More than what is left
+	tooMuch, _ := signInvoice(700, "", time.Hour)
+	_, err = svc.Refund(ctx, &payment.RefundInput{MerchantPubkey: "merchant", PaymentID: "pay_sale", Bolt11: tooMuch})
+	if !errors.Is(err, payment.ErrRefundExceedsPayment) {
+		t.Errorf("over-refund: err = %v, want ErrRefundExceedsPayment", err)
+	}
+
+	// The rest to a Lightning address
+	result, err = svc.Refund(ctx, &payment.RefundInput{
+		MerchantPubkey:   "merchant",
+		PaymentID:        "pay_sale",
+		LightningAddress: "alice@example.com",
+	})
+	if err != nil {
+		t.Fatalf("Refund to address: %v", err)
+	}
+	if result.AmountSats != 600 || len(resolver.addresses) != 1 {
+		t.Errorf("refunded %d sats via %v, want the remaining 600 via alice", result.AmountSats, resolver.addresses)
+	}
+
+	sale, _ := db.GetPayment(ctx, "pay_sale")
+	if sale.RefundedSats != 1000 {
+		t.Errorf("RefundedSats = %d, want 1000", sale.RefundedSats)
+	}
+	if _, err := svc.Refund(ctx, &payment.RefundInput{MerchantPubkey: "merchant", PaymentID: "pay_sale", LightningAddress: "alice@example.com"}); !errors.Is(err, payment.ErrRefundExceedsPayment) {
+		t.Errorf("fully refunded: err = %v, want ErrRefundExceedsPayment", err)
+	}
+}
+
+func TestRefund_Ledger(t *testing.T) {
+	db, _ := store.NewSQLite(":memory:")
+	defer db.Close()
+
+	mock := newPayMock()
+	svc := payment.NewService(db, mock, "http://localhost:8080")
+	ctx := context.Background()
+
+	// The sale's earnings were withdrawn, so the shared wallet's balance
+	// belongs to other merchants
+	db.CreatePayment(ctx, &store.Payment{ID: "pay_sale", AmountSats: 1000, ReceiverPubkey: "merchant", PaymentHash: "hash_sale", Status: "paid", Direction: "received"}, nil)
+	db.CreatePayment(ctx, &store.Payment{ID: "pay_out", AmountSats: 1000, SenderPubkey: "merchant", PaymentHash: "hash_out", Status: "paid", Direction: "sent", Withdrawal: true}, nil)
+	fundLedger(t, db, "other", 5000)
+
+	invoice, _ := signInvoice(500, "", time.Hour)
+	_, err := svc.Refund(ctx, &payment.RefundInput{MerchantPubkey: "merchant", PaymentID: "pay_sale", Bolt11: invoice})
+	if !errors.Is(err, payment.ErrInsufficientBalance) {
+		t.Errorf("err = %v, want ErrInsufficientBalance", err)
+	}
+	if len(mock.paid) != 0 {
+		t.Error("refund paid out of other merchants' earnings")
+	}
+}
+
+func TestRefund_Rejected(t *testing.T) {
+	db, _ := store.NewSQLite(":memory:")
+	defer db.Close()
+
+	svc := payment.NewService(db, newPayMock(), "http://localhost:8080")
+	ctx := context.Background()
+	db.CreatePayment(ctx, &store.Payment{
+		ID:             "pay_pending",
+		Bolt11:         "lnbc...",
+		AmountSats:     1000,
+		ReceiverPubkey: "merchant",
+		PaymentHash:    "hash_pending",
+		Status:         "pending",
+	}, nil)
+	invoice, _ := signInvoice(100, "", time.Hour)
+
+	tests := []struct {
+		name    string
+		input   payment.RefundInput
+		wantErr error
+	}{
+		{"unpaid", payment.RefundInput{MerchantPubkey: "merchant", PaymentID: "pay_pending", Bolt11: invoice}, payment.ErrNotRefundable},
+		{"other merchant", payment.RefundInput{MerchantPubkey: "other", PaymentID: "pay_pending", Bolt11: invoice}, payment.ErrPaymentNotFound},
+		{"no destination", payment.RefundInput{MerchantPubkey: "merchant", PaymentID: "pay_pending"}, payment.ErrRefundDestination},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := svc.Refund(ctx, &tt.input); !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,103 +2,323 @@ package payment
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"log/slog"
 	"time"
 
+	"github.com/nostr-pay/nostr-pay/internal/bolt11"
 	"github.com/nostr-pay/nostr-pay/internal/lnbits"
+	"github.com/nostr-pay/nostr-pay/internal/rates"
 	"github.com/nostr-pay/nostr-pay/internal/store"
 )
 
 type LNbitsClient interface {
 	CreateInvoice(ctx context.Context, req *lnbits.CreateInvoiceRequest) (*lnbits.CreateInvoiceResponse, error)
 	CheckPayment(ctx context.Context, hash string) (*lnbits.PaymentStatus, error)
+	PayInvoice(ctx context.Context, bolt11 string) (*lnbits.PayInvoiceResponse, error)
+	GetWallet(ctx context.Context) (*lnbits.Wallet, error)
+	FeeReserve(ctx context.Context, bolt11 string) (int64, error)
 }
 
+// RateProvider quotes exchange rates for fiat-denominated invoices.
+type RateProvider interface {
+	Rate(ctx context.Context, currency string) (*rates.Rate, error)
+}
+
+var (
+	// ErrFiatUnavailable is returned for fiat-denominated invoices when no
+	// rate provider is configured.
+	ErrFiatUnavailable = errors.New("fiat invoices are not enabled")
+	// ErrRateUnavailable wraps provider failures, including stale rates.
+	ErrRateUnavailable = errors.New("exchange rate unavailable")
+	// ErrUnexpectedInvoice means LNbits returned an invoice that does not
+	// decode or does not match the request.
+	ErrUnexpectedInvoice = errors.New("lnbits returned an unexpected invoice")
+	// ErrInvalidWebhook is returned for webhooks about unknown payments or
+	// without the payment's token.
+	ErrInvalidWebhook = errors.New("invalid webhook")
+)
+
+// Notifier is told when a payment's status changes, e.g. to push it to
+// WebSocket subscribers.
+type Notifier interface {
+	NotifyPayment(paymentHash string, status string)
+}
+
+// DefaultInvoiceExpiry applies when CreateInvoiceInput.Expiry is zero.
+const DefaultInvoiceExpiry = time.Hour
+
 type Service struct {
-	store   store.Store
-	lnbits  LNbitsClient
-	baseURL string
+	store       store.Store
+	lnbits      LNbitsClient
+	baseURL     string
+	notifier    Notifier
+	rates       RateProvider
+	feeLimit    FeeLimit
+	addresses   AddressResolver
+	listener    StatusListener
+	wallets     WalletConfig
+	withdrawals WithdrawalLimits
+	lnurlp      AddressConfig
+	splitWake   chan struct{}
 }
 
 func NewService(store store.Store, lnbits LNbitsClient, baseURL string) *Service {
 	return &Service{
-		store:   store,
-		lnbits:  lnbits,
-		baseURL: baseURL,
+		store:       store,
+		lnbits:      lnbits,
+		baseURL:     baseURL,
+		feeLimit:    DefaultFeeLimit,
+		withdrawals: DefaultWithdrawalLimits,
+		splitWake:   make(chan struct{}, 1),
 	}
 }
 
+// SetRateProvider enables invoices priced in a fiat currency.
+func (s *Service) SetRateProvider(p RateProvider) {
+	s.rates = p
+}
+
+// SetNotifier registers the receiver of status changes made by the service
+// itself, such as expiry.
+func (s *Service) SetNotifier(n Notifier) {
+	s.notifier = n
+}
+
 type CreateInvoiceInput struct {
 	ReceiverPubkey string
 	SenderPubkey   string
 	AmountSats     int64
 	Memo           string
+	// CreatedByPubkey is set when a staff member creates the invoice on
+	// the receiver's behalf.
+	CreatedByPubkey string
+	// Expiry is how long the invoice can be paid. Defaults to
+	// DefaultInvoiceExpiry.
+	Expiry time.Duration
+	// FiatAmount and FiatCurrency price the invoice in fiat instead of
+	// AmountSats. The amount is in the currency's minor unit (e.g. cents)
+	// and is converted at the current rate, which is stored on the payment.
+	FiatAmount   int64
+	FiatCurrency string
+	// TipSats or TipPercent add a tip on top of the amount, which then
+	// becomes the subtotal. At most one may be set.
+	TipSats    int64
+	TipPercent float64
+	// DescriptionHash is the hex SHA-256 of a description the invoice
+	// commits to instead of Memo, such as LNURL-pay metadata. Memo is then
+	// only recorded with the payment.
+	DescriptionHash string
 }
 
 type CreateInvoiceResult struct {
 	PaymentID   string
 	Bolt11      string
 	PaymentHash string
+	ExpiresAt   time.Time
+	// AmountSats is the invoice total: SubtotalSats plus TipSats.
+	AmountSats   int64
+	SubtotalSats int64
+	TipSats      int64
+	// Set for fiat-denominated invoices
+	FiatAmount   int64
+	FiatCurrency string
+	ExchangeRate float64
 }
 
 func (s *Service) CreateInvoice(ctx context.Context, input *CreateInvoiceInput) (*CreateInvoiceResult, error) {
-	webhookURL := s.baseURL + "/api/payments/webhook"
+	actor := input.CreatedByPubkey
+	if actor == "" {
+		actor = input.ReceiverPubkey
+	}
+	return s.createInvoice(ctx, input, CauseCreated, actor)
+}
+
+// createInvoice creates an invoice and records its payment as created by
+// actor for cause.
+func (s *Service) createInvoice(ctx context.Context, input *CreateInvoiceInput, cause, actor string) (*CreateInvoiceResult, error) {
+	webhookToken, err := newWebhookToken()
+	if err != nil {
+		return nil, err
+	}
+	webhookURL := s.baseURL + "/api/payments/webhook?token=" + webhookToken
+
+	amountSats := input.AmountSats
+	var quote *rates.Rate
+	if input.FiatCurrency != "" {
+		quote, amountSats, err = s.quote(ctx, input.FiatAmount, input.FiatCurrency)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	resp, err := s.lnbits.CreateInvoice(ctx, &lnbits.CreateInvoiceRequest{
-		Amount:  input.AmountSats,
-		Memo:    input.Memo,
-		Webhook: webhookURL,
+	subtotalSats := amountSats
+	tipSats, err := tipAmount(subtotalSats, input.TipSats, input.TipPercent)
+	if err != nil {
+		return nil, err
+	}
+	amountSats += tipSats
+
+	expiry := input.Expiry
+	if expiry <= 0 {
+		expiry = DefaultInvoiceExpiry
+	}
+	expiresAt := time.Now().Add(expiry)
+
+	wallet, walletID, err := s.walletFor(ctx, input.ReceiverPubkey)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := wallet.CreateInvoice(ctx, &lnbits.CreateInvoiceRequest{
+		Amount:          amountSats,
+		Memo:            input.Memo,
+		Webhook:         webhookURL,
+		Expiry:          int64(expiry / time.Second),
+		DescriptionHash: input.DescriptionHash,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("create lnbits invoice: %w", err)
 	}
+	if err := checkCreatedInvoice(resp, amountSats, input.DescriptionHash); err != nil {
+		return nil, err
+	}
 
-	paymentID := fmt.Sprintf("pay_%d", time.Now().UnixNano())
+	paymentID, err := newID("pay_")
+	if err != nil {
+		return nil, err
+	}
 
 	payment := &store.Payment{
-		ID:             paymentID,
-		Bolt11:         resp.PaymentRequest,
-		AmountSats:     input.AmountSats,
-		Memo:           input.Memo,
-		SenderPubkey:   input.SenderPubkey,
-		ReceiverPubkey: input.ReceiverPubkey,
-		PaymentHash:    resp.PaymentHash,
-		Status:         "pending",
+		ID:              paymentID,
+		Bolt11:          resp.PaymentRequest,
+		AmountSats:      amountSats,
+		Memo:            input.Memo,
+		SenderPubkey:    input.SenderPubkey,
+		ReceiverPubkey:  input.ReceiverPubkey,
+		PaymentHash:     resp.PaymentHash,
+		Status:          StatusPending,
+		CreatedByPubkey: input.CreatedByPubkey,
+		ExpiresAt:       &expiresAt,
+		Direction:       "received",
+		SubtotalSats:    subtotalSats,
+		TipSats:         tipSats,
+		WebhookToken:    webhookToken,
+		WalletID:        walletID,
+	}
+	if quote != nil {
+		payment.FiatAmount = input.FiatAmount
+		payment.FiatCurrency = quote.Currency
+		payment.ExchangeRate = quote.BTCPrice
+		payment.RateSource = quote.Source
 	}
 
-	if err := s.store.CreatePayment(ctx, payment); err != nil {
-		return nil, fmt.Errorf("store payment: %w", err)
+	if err := s.createPayment(ctx, payment, cause, actor); err != nil {
+		return nil, err
 	}
 
 	return &CreateInvoiceResult{
-		PaymentID:   paymentID,
-		Bolt11:      resp.PaymentRequest,
-		PaymentHash: resp.PaymentHash,
+		PaymentID:    paymentID,
+		Bolt11:       resp.PaymentRequest,
+		PaymentHash:  resp.PaymentHash,
+		ExpiresAt:    expiresAt,
+		AmountSats:   amountSats,
+		SubtotalSats: subtotalSats,
+		TipSats:      tipSats,
+		FiatAmount:   payment.FiatAmount,
+		FiatCurrency: payment.FiatCurrency,
+		ExchangeRate: payment.ExchangeRate,
 	}, nil
 }
 
-func (s *Service) HandleWebhook(ctx context.Context, paymentHash string) error {
-	// Verify payment with LNbits
-	status, err := s.lnbits.CheckPayment(ctx, paymentHash)
+// quote converts a fiat amount to sats at the provider's current rate.
+func (s *Service) quote(ctx context.Context, fiatAmount int64, currency string) (*rates.Rate, int64, error) {
+	if s.rates == nil {
+		return nil, 0, ErrFiatUnavailable
+	}
+	currency, err := rates.NormalizeCurrency(currency)
 	if err != nil {
-		return fmt.Errorf("check payment: %w", err)
+		return nil, 0, err
 	}
-
-	if !status.Paid {
-		return nil // Not paid yet, ignore
+	rate, err := s.rates.Rate(ctx, currency)
+	if errors.Is(err, rates.ErrUnknownCurrency) {
+		return nil, 0, err
 	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %w", ErrRateUnavailable, err)
+	}
+	sats, err := rates.ToSats(fiatAmount, rate)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rate, sats, nil
+}
 
+// HandleWebhook settles the payment LNbits reports on, after confirming with
+// LNbits that it was actually paid. token must be the one in the webhook
+// URL the invoice was created with; LNbits is not asked about unknown
+// payments or ones without a token, which reconciliation still settles.
+func (s *Service) HandleWebhook(ctx context.Context, paymentHash, token string) error {
 	p, err := s.store.GetPaymentByHash(ctx, paymentHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidWebhook
+	}
 	if err != nil {
 		return fmt.Errorf("get payment by hash: %w", err)
 	}
+	if p.WebhookToken == "" || subtle.ConstantTimeCompare([]byte(p.WebhookToken), []byte(token)) != 1 {
+		return ErrInvalidWebhook
+	}
+
+	_, err = s.checkAndSettle(ctx, p, CauseWebhook)
+	return err
+}
+
+// checkAndSettle asks LNbits whether p was paid and, if so, marks it paid,
+// notifies subscribers and schedules the merchant's split payouts. Both
+// the webhook and reconciliation go through here. It reports whether this
+// call settled the payment; payments whose status does not allow settling
+// by cause are left alone.
+func (s *Service) checkAndSettle(ctx context.Context, p *store.Payment, cause string) (bool, error) {
+	if !CanTransition(p.Status, StatusPaid, cause) {
+		if p.Status == StatusExpired {
+			slog.Info("not settling expired payment; reconciliation will check it", "payment_id", p.ID, "cause", cause)
+		}
+		return false, nil
+	}
+
+	wallet, err := s.paymentWallet(ctx, p)
+	if err != nil {
+		return false, err
+	}
+	status, err := wallet.CheckPayment(ctx, p.PaymentHash)
+	if err != nil {
+		return false, fmt.Errorf("check payment: %w", err)
+	}
+	if !status.Paid {
+		return false, nil
+	}
 
 	now := time.Now()
-	if err := s.store.UpdatePaymentStatus(ctx, p.ID, "paid", &now); err != nil {
-		return fmt.Errorf("update payment status: %w", err)
+	settled, err := s.transition(ctx, p, StatusPaid, cause, ActorSystem, &now)
+	if err != nil {
+		return false, fmt.Errorf("settle payment: %w", err)
+	}
+	if settled {
+		s.notify(p.PaymentHash, StatusPaid)
+		s.scheduleSplits(ctx, p)
 	}
+	return settled, nil
+}
 
-	return nil
+func (s *Service) notify(paymentHash, status string) {
+	if s.notifier != nil {
+		s.notifier.NotifyPayment(paymentHash, status)
+	}
 }
 
 func (s *Service) GetPayment(ctx context.Context, id string) (*store.Payment, error) {
@@ -108,3 +328,62 @@ func (s *Service) GetPayment(ctx context.Context, id string) (*store.Payment, er
 func (s *Service) ListPayments(ctx context.Context, pubkey string, limit, offset int) ([]*store.Payment, error) {
 	return s.store.ListPaymentsByUser(ctx, pubkey, limit, offset)
 }
+
+func (s *Service) GetMerchantDailyStats(ctx context.Context, pubkey string, date string) (*store.MerchantDailyStats, error) {
+	return s.store.GetMerchantDailyStats(ctx, pubkey, date)
+}
+
+// ListTipSummaries returns the merchant's takings and tips per day and
+// staff member for the days from through to (YYYY-MM-DD, inclusive).
+func (s *Service) ListTipSummaries(ctx context.Context, pubkey string, from, to string) ([]*store.TipSummary, error) {
+	return s.store.ListTipSummaries(ctx, pubkey, from, to)
+}
+
+func (s *Service) ListMerchantTransactions(ctx context.Context, pubkey string, limit, offset int) ([]*store.Payment, error) {
+	return s.store.ListMerchantTransactions(ctx, pubkey, limit, offset)
+}
+
+func (s *Service) ListMerchantSalesSince(ctx context.Context, pubkey string, since time.Time, limit int) ([]*store.Payment, error) {
+	return s.store.ListMerchantSalesSince(ctx, pubkey, since, limit)
+}
+
+// newID returns an unguessable public ID with the prefix, such as "pay_"
+// for payments. Older payments use "pay_<unixnano>" and are still looked
+// up by the same column.
+func newID(prefix string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate %sid: %w", prefix, err)
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
+
+// newWebhookToken returns the secret that authenticates an invoice's
+// webhook.
+func newWebhookToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate webhook token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// checkCreatedInvoice verifies that the invoice LNbits returned is validly
+// signed and asks for the amount and hash that are about to be recorded,
+// and that it commits to descriptionHash if one was requested.
+func checkCreatedInvoice(resp *lnbits.CreateInvoiceResponse, amountSats int64, descriptionHash string) error {
+	inv, err := bolt11.Decode(resp.PaymentRequest)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnexpectedInvoice, err)
+	}
+	if inv.PaymentHash != resp.PaymentHash {
+		return fmt.Errorf("%w: payment hash %s, expected %s", ErrUnexpectedInvoice, inv.PaymentHash, resp.PaymentHash)
+	}
+	if inv.AmountMsat != amountSats*1000 {
+		return fmt.Errorf("%w: amount %d msat, expected %d sats", ErrUnexpectedInvoice, inv.AmountMsat, amountSats)
+	}
+	if descriptionHash != "" && inv.DescriptionHash != descriptionHash {
+		return fmt.Errorf("%w: description hash %q, expected %s", ErrUnexpectedInvoice, inv.DescriptionHash, descriptionHash)
+	}
+	return nil
+}
@@ -2,38 +2,121 @@ package payment_test
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/btcsuite/btcd/btcec/v2"
+
+	"github.com/nostr-pay/nostr-pay/internal/bolt11"
+	"github.com/nostr-pay/nostr-pay/internal/bolt11/bolt11test"
 	"github.com/nostr-pay/nostr-pay/internal/lnbits"
 	"github.com/nostr-pay/nostr-pay/internal/payment"
+	"github.com/nostr-pay/nostr-pay/internal/rates"
 	"github.com/nostr-pay/nostr-pay/internal/store"
 )
 
-// Mock LNbits client
+// nodeKey signs the invoices the mock LNbits returns.
+var nodeKey, _ = btcec.NewPrivateKey()
+
+// signInvoice returns a mainnet invoice for amountSats and its payment hash.
+func signInvoice(amountSats int64, memo string, expiry time.Duration) (string, string) {
+	hash := make([]byte, 32)
+	rand.Read(hash)
+	inv := &bolt11.Invoice{
+		Network:     "mainnet",
+		AmountMsat:  amountSats * 1000,
+		Timestamp:   time.Now(),
+		PaymentHash: hex.EncodeToString(hash),
+		Description: memo,
+		Expiry:      expiry,
+	}
+	s, err := bolt11test.Encode(inv, nodeKey)
+	if err != nil {
+		panic(err)
+	}
+	return s, inv.PaymentHash
+}
+
+// signHashedInvoice signs an invoice that commits to a description hash.
+func signHashedInvoice(amountSats int64, descriptionHash string) (string, string) {
+	hash := make([]byte, 32)
+	rand.Read(hash)
+	inv := &bolt11.Invoice{
+		Network:         "mainnet",
+		AmountMsat:      amountSats * 1000,
+		Timestamp:       time.Now(),
+		PaymentHash:     hex.EncodeToString(hash),
+		DescriptionHash: descriptionHash,
+	}
+	s, err := bolt11test.Encode(inv, nodeKey)
+	if err != nil {
+		panic(err)
+	}
+	return s, inv.PaymentHash
+}
+
+// Mock LNbits client. Invoices are signed for the requested amount unless
+// invoiceResp overrides them.
 type mockLNbits struct {
 	invoiceResp *lnbits.CreateInvoiceResponse
 	paymentResp *lnbits.PaymentStatus
+	checkErr    error
+	payErr      error
+	wallet      *lnbits.Wallet
+	feeReserve  int64
+	created     []*lnbits.CreateInvoiceResponse
+	webhooks    []string
+	paid        []string
+	checked     []string
 }
 
 func (m *mockLNbits) CreateInvoice(ctx context.Context, req *lnbits.CreateInvoiceRequest) (*lnbits.CreateInvoiceResponse, error) {
-	return m.invoiceResp, nil
+	resp := m.invoiceResp
+	if resp == nil {
+		bolt11, hash := signInvoice(req.Amount, req.Memo, time.Duration(req.Expiry)*time.Second)
+		if req.DescriptionHash != "" {
+			bolt11, hash = signHashedInvoice(req.Amount, req.DescriptionHash)
+		}
+		resp = &lnbits.CreateInvoiceResponse{PaymentHash: hash, PaymentRequest: bolt11}
+	}
+	m.created = append(m.created, resp)
+	m.webhooks = append(m.webhooks, req.Webhook)
+	return resp, nil
 }
 
 func (m *mockLNbits) CheckPayment(ctx context.Context, hash string) (*lnbits.PaymentStatus, error) {
+	m.checked = append(m.checked, hash)
+	if m.checkErr != nil {
+		return nil, m.checkErr
+	}
 	return m.paymentResp, nil
 }
 
+func (m *mockLNbits) PayInvoice(ctx context.Context, bolt11 string) (*lnbits.PayInvoiceResponse, error) {
+	if m.payErr != nil {
+		return nil, m.payErr
+	}
+	m.paid = append(m.paid, bolt11)
+	return &lnbits.PayInvoiceResponse{}, nil
+}
+
+func (m *mockLNbits) GetWallet(ctx context.Context) (*lnbits.Wallet, error) {
+	return m.wallet, nil
+}
+
+func (m *mockLNbits) FeeReserve(ctx context.Context, bolt11 string) (int64, error) {
+	return m.feeReserve, nil
+}
+
 func TestCreateInvoice(t *testing.T) {
 	db, _ := store.NewSQLite(":memory:")
 	defer db.Close()
 
-	mock := &mockLNbits{
-		invoiceResp: &lnbits.CreateInvoiceResponse{
-			PaymentHash:    "hash_001",
-			PaymentRequest: "lnbc1000n1p...",
-		},
-	}
-
+	mock := &mockLNbits{}
 	svc := payment.NewService(db, mock, "http://localhost:8080")
 
 	result, err := svc.CreateInvoice(context.Background(), &payment.CreateInvoiceInput{
@@ -45,21 +128,148 @@ func TestCreateInvoice(t *testing.T) {
 		t.Fatalf("CreateInvoice: %v", err)
 	}
 
-	if result.Bolt11 != "lnbc1000n1p..." {
-		t.Errorf("Bolt11 = %q, want %q", result.Bolt11, "lnbc1000n1p...")
+	created := mock.created[0]
+	if result.Bolt11 != created.PaymentRequest {
+		t.Errorf("Bolt11 = %q, want %q", result.Bolt11, created.PaymentRequest)
+	}
+	if result.PaymentHash != created.PaymentHash {
+		t.Errorf("PaymentHash = %q, want %q", result.PaymentHash, created.PaymentHash)
+	}
+	if !strings.HasPrefix(result.PaymentID, "pay_") || len(result.PaymentID) != 36 {
+		t.Errorf("PaymentID = %q, want pay_ followed by 32 hex characters", result.PaymentID)
 	}
-	if result.PaymentHash != "hash_001" {
-		t.Errorf("PaymentHash = %q, want %q", result.PaymentHash, "hash_001")
+	if d := time.Until(result.ExpiresAt); d <= 0 || d > payment.DefaultInvoiceExpiry {
+		t.Errorf("ExpiresAt = %v, want within the default expiry", result.ExpiresAt)
 	}
 
 	// Verify payment was persisted
-	p, err := db.GetPaymentByHash(context.Background(), "hash_001")
+	p, err := db.GetPaymentByHash(context.Background(), result.PaymentHash)
 	if err != nil {
 		t.Fatalf("GetPaymentByHash: %v", err)
 	}
 	if p.Status != "pending" {
 		t.Errorf("Status = %q, want %q", p.Status, "pending")
 	}
+	if p.ExpiresAt == nil || !p.ExpiresAt.Equal(result.ExpiresAt) {
+		t.Errorf("stored ExpiresAt = %v, want %v", p.ExpiresAt, result.ExpiresAt)
+	}
+	if len(p.WebhookToken) != 64 || mock.webhooks[0] != "http://localhost:8080/api/payments/webhook?token="+p.WebhookToken {
+		t.Errorf("webhook URL %q, stored token %q", mock.webhooks[0], p.WebhookToken)
+	}
+}
+
+func TestCreateInvoice_Fiat(t *testing.T) {
+	db, _ := store.NewSQLite(":memory:")
+	defer db.Close()
+
+	svc := payment.NewService(db, &mockLNbits{}, "http://localhost:8080")
+
+	input := &payment.CreateInvoiceInput{
+		ReceiverPubkey: "npub_receiver",
+		FiatAmount:     250,
+		FiatCurrency:   "eur",
+	}
+	if _, err := svc.CreateInvoice(context.Background(), input); !errors.Is(err, payment.ErrFiatUnavailable) {
+		t.Fatalf("without provider: err = %v, want ErrFiatUnavailable", err)
+	}
+
+	svc.SetRateProvider(rates.NewStaticProvider(map[string]float64{"EUR": 50_000}))
+	result, err := svc.CreateInvoice(context.Background(), input)
+	if err != nil {
+		t.Fatalf("CreateInvoice: %v", err)
+	}
+	if result.AmountSats != 5000 {
+		t.Errorf("AmountSats = %d, want 5000", result.AmountSats)
+	}
+
+	p, _ := db.GetPaymentByHash(context.Background(), result.PaymentHash)
+	if p.AmountSats != 5000 || p.FiatAmount != 250 || p.FiatCurrency != "EUR" || p.ExchangeRate != 50_000 || p.RateSource != "static" {
+		t.Errorf("stored quote = %d sats, %d %s at %v from %q",
+			p.AmountSats, p.FiatAmount, p.FiatCurrency, p.ExchangeRate, p.RateSource)
+	}
+
+	input.FiatCurrency = "GBP"
+	if _, err := svc.CreateInvoice(context.Background(), input); !errors.Is(err, rates.ErrUnknownCurrency) {
+		t.Errorf("unquoted currency: err = %v, want ErrUnknownCurrency", err)
+	}
+}
+
+func TestCreateInvoice_Tip(t *testing.T) {
+	db, _ := store.NewSQLite(":memory:")
+	defer db.Close()
+
+	svc := payment.NewService(db, &mockLNbits{}, "http://localhost:8080")
+
+	tests := []struct {
+		name       string
+		tipSats    int64
+		tipPercent float64
+		wantTip    int64
+		wantErr    error
+	}{
+		{name: "no tip"},
+		{name: "absolute", tipSats: 150, wantTip: 150},
+		{name: "percent", tipPercent: 12.5, wantTip: 131},
+		{name: "both", tipSats: 100, tipPercent: 10, wantErr: payment.ErrInvalidTip},
+		{name: "negative", tipSats: -1, wantErr: payment.ErrInvalidTip},
+		{name: "percent too high", tipPercent: 101, wantErr: payment.ErrInvalidTip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := svc.CreateInvoice(context.Background(), &payment.CreateInvoiceInput{
+				ReceiverPubkey: "npub_receiver",
+				AmountSats:     1050,
+				TipSats:        tt.tipSats,
+				TipPercent:     tt.tipPercent,
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if result.SubtotalSats != 1050 || result.TipSats != tt.wantTip || result.AmountSats != 1050+tt.wantTip {
+				t.Errorf("result = %d + %d = %d sats, want 1050 + %d",
+					result.SubtotalSats, result.TipSats, result.AmountSats, tt.wantTip)
+			}
+
+			p, _ := db.GetPaymentByHash(context.Background(), result.PaymentHash)
+			inv, _ := bolt11.Decode(p.Bolt11)
+			if p.SubtotalSats != 1050 || p.TipSats != tt.wantTip || inv.AmountMsat != (1050+tt.wantTip)*1000 {
+				t.Errorf("stored %d + %d sats, invoice for %d msat", p.SubtotalSats, p.TipSats, inv.AmountMsat)
+			}
+		})
+	}
+}
+
+func TestCreateInvoice_Unexpected(t *testing.T) {
+	db, _ := store.NewSQLite(":memory:")
+	defer db.Close()
+
+	bolt11, hash := signInvoice(999, "", time.Hour)
+	tests := []struct {
+		name string
+		resp *lnbits.CreateInvoiceResponse
+	}{
+		{"wrong amount", &lnbits.CreateInvoiceResponse{PaymentHash: hash, PaymentRequest: bolt11}},
+		{"wrong hash", &lnbits.CreateInvoiceResponse{PaymentHash: strings.Repeat("00", 32), PaymentRequest: bolt11}},
+		{"garbage", &lnbits.CreateInvoiceResponse{PaymentHash: hash, PaymentRequest: "lnbc1000n1p..."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := payment.NewService(db, &mockLNbits{invoiceResp: tt.resp}, "http://localhost:8080")
+			_, err := svc.CreateInvoice(context.Background(), &payment.CreateInvoiceInput{
+				ReceiverPubkey: "npub_receiver",
+				AmountSats:     1000,
+			})
+			if !errors.Is(err, payment.ErrUnexpectedInvoice) {
+				t.Fatalf("err = %v, want ErrUnexpectedInvoice", err)
+			}
+			if _, err := db.GetPaymentByHash(context.Background(), tt.resp.PaymentHash); err == nil {
+				t.Error("unexpected invoice was stored")
+			}
+		})
+	}
 }
 
 func TestHandleWebhook(t *testing.T) {
@@ -74,24 +284,63 @@ func TestHandleWebhook(t *testing.T) {
 	}
 
 	svc := payment.NewService(db, mock, "http://localhost:8080")
+	notifier := &recordingNotifier{}
+	svc.SetNotifier(notifier)
+	ctx := context.Background()
 
 	// Create a pending payment first
-	db.CreatePayment(context.Background(), &store.Payment{
+	db.CreatePayment(ctx, &store.Payment{
 		ID:             "pay_001",
 		Bolt11:         "lnbc...",
 		AmountSats:     500,
 		ReceiverPubkey: "npub_receiver",
 		PaymentHash:    "hash_webhook",
 		Status:         "pending",
-	})
+		WebhookToken:   "token_abc",
+	}, nil)
+	// Created before webhooks had tokens
+	db.CreatePayment(ctx, &store.Payment{
+		ID:             "pay_legacy",
+		Bolt11:         "lnbc...",
+		AmountSats:     500,
+		ReceiverPubkey: "npub_receiver",
+		PaymentHash:    "hash_legacy",
+		Status:         "pending",
+	}, nil)
+
+	for _, tt := range []struct{ name, hash, token string }{
+		{"unknown hash", "hash_unknown", "token_abc"},
+		{"wrong token", "hash_webhook", "token_xyz"},
+		{"no token", "hash_webhook", ""},
+		{"payment without token", "hash_legacy", ""},
+	} {
+		if err := svc.HandleWebhook(ctx, tt.hash, tt.token); !errors.Is(err, payment.ErrInvalidWebhook) {
+			t.Errorf("%s: err = %v, want ErrInvalidWebhook", tt.name, err)
+		}
+	}
+	if len(mock.checked) != 0 || len(notifier.events) != 0 {
+		t.Fatalf("rejected webhooks checked %v and notified %v", mock.checked, notifier.events)
+	}
 
-	err := svc.HandleWebhook(context.Background(), "hash_webhook")
+	err := svc.HandleWebhook(ctx, "hash_webhook", "token_abc")
 	if err != nil {
 		t.Fatalf("HandleWebhook: %v", err)
 	}
 
-	p, _ := db.GetPayment(context.Background(), "pay_001")
+	p, _ := db.GetPayment(ctx, "pay_001")
 	if p.Status != "paid" {
 		t.Errorf("Status = %q, want %q", p.Status, "paid")
 	}
+	if notifier.events["hash_webhook"] != "paid" {
+		t.Errorf("notifications = %v, want hash_webhook paid", notifier.events)
+	}
+
+	// A repeated delivery changes nothing and notifies no one
+	delete(notifier.events, "hash_webhook")
+	if err := svc.HandleWebhook(ctx, "hash_webhook", "token_abc"); err != nil {
+		t.Fatalf("repeated HandleWebhook: %v", err)
+	}
+	if len(notifier.events) != 0 {
+		t.Errorf("repeated webhook notified %v", notifier.events)
+	}
 }
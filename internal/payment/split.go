@@ -0,0 +1,452 @@
+package payment
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/lnurl"
+	nostrauth "github.com/nostr-pay/nostr-pay/internal/nostr"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+var (
+	ErrInvalidSplitRule  = errors.New("invalid split rule")
+	ErrSplitRuleNotFound = errors.New("split rule not found")
+)
+
+// MaxSplitRules bounds how many split rules a merchant can have.
+const MaxSplitRules = 10
+
+// SplitMaxAttempts is how often a split payout is tried before it is
+// marked failed. Attempts back off exponentially from splitRetryBase.
+const SplitMaxAttempts = 8
+
+const (
+	splitRetryBase = time.Minute
+	// splitClaimLease keeps other workers off a payout while an attempt
+	// runs.
+	splitClaimLease = 5 * time.Minute
+	splitBatch      = 100
+)
+
+type SplitRuleInput struct {
+	MerchantPubkey string
+	// Destination is a Lightning address or the hex pubkey of a user on
+	// this instance.
+	Destination string
+	// Exactly one of Percent and AmountSats is set.
+	Percent    float64
+	AmountSats int64
+	Label      string
+}
+
+// CreateSplitRule adds a rule to the merchant's splits. Percentages of all
+// the merchant's rules add up to at most 100.
+func (s *Service) CreateSplitRule(ctx context.Context, input *SplitRuleInput) (*store.SplitRule, error) {
+	dest := strings.TrimSpace(input.Destination)
+	if strings.Contains(dest, "@") {
+		if _, err := lnurl.ParseAddress(dest); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidSplitRule, err)
+		}
+		dest = strings.ToLower(dest)
+	} else if !nostrauth.IsHexPubkey(dest) {
+		return nil, fmt.Errorf("%w: destination must be a lightning address or a pubkey", ErrInvalidSplitRule)
+	} else if dest == input.MerchantPubkey {
+		return nil, fmt.Errorf("%w: cannot split to yourself", ErrInvalidSplitRule)
+	}
+
+	switch {
+	case (input.Percent != 0) == (input.AmountSats != 0):
+		return nil, fmt.Errorf("%w: give either a percentage or an amount", ErrInvalidSplitRule)
+	case math.IsNaN(input.Percent) || input.Percent < 0 || input.Percent > 100:
+		return nil, fmt.Errorf("%w: percentage must be between 0 and 100", ErrInvalidSplitRule)
+	case input.AmountSats < 0:
+		return nil, fmt.Errorf("%w: amount must be positive", ErrInvalidSplitRule)
+	}
+
+	rules, err := s.store.ListSplitRules(ctx, input.MerchantPubkey)
+	if err != nil {
+		return nil, fmt.Errorf("list split rules: %w", err)
+	}
+	if len(rules) >= MaxSplitRules {
+		return nil, fmt.Errorf("%w: at most %d rules", ErrInvalidSplitRule, MaxSplitRules)
+	}
+	total := input.Percent
+	for _, r := range rules {
+		total += r.Percent
+	}
+	if total > 100 {
+		return nil, fmt.Errorf("%w: percentages add up to more than 100", ErrInvalidSplitRule)
+	}
+
+	id, err := newID("spr_")
+	if err != nil {
+		return nil, err
+	}
+	rule := &store.SplitRule{
+		ID:             id,
+		MerchantPubkey: input.MerchantPubkey,
+		Destination:    dest,
+		Percent:        input.Percent,
+		AmountSats:     input.AmountSats,
+		Label:          input.Label,
+		CreatedAt:      time.Now().UTC(),
+	}
+	if err := s.store.CreateSplitRule(ctx, rule); err != nil {
+		return nil, fmt.Errorf("store split rule: %w", err)
+	}
+	return rule, nil
+}
+
+func (s *Service) ListSplitRules(ctx context.Context, merchantPubkey string) ([]*store.SplitRule, error) {
+	return s.store.ListSplitRules(ctx, merchantPubkey)
+}
+
+func (s *Service) DeleteSplitRule(ctx context.Context, id, merchantPubkey string) error {
+	err := s.store.DeleteSplitRule(ctx, id, merchantPubkey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrSplitRuleNotFound
+	}
+	return err
+}
+
+// ListSplitPayouts returns the payouts made from a payment.
+func (s *Service) ListSplitPayouts(ctx context.Context, paymentID string) ([]*store.SplitPayout, error) {
+	return s.store.ListSplitPayouts(ctx, paymentID)
+}
+
+// scheduleSplits creates the payouts for a payment that was just settled
+// and wakes the split worker. Errors are logged only: the settlement
+// stands whatever happens to its splits.
+func (s *Service) scheduleSplits(ctx context.Context, p *store.Payment) {
+	if p.Direction != "received" || p.RefundOf != "" {
+		return
+	}
+	rules, err := s.store.ListSplitRules(ctx, p.ReceiverPubkey)
+	if err != nil {
+		slog.Error("failed to load split rules", "payment_id", p.ID, "error", err)
+		return
+	}
+	payouts, err := splitPayouts(p, rules, time.Now().UTC())
+	if err != nil || len(payouts) == 0 {
+		return
+	}
+	if err := s.store.CreateSplitPayouts(ctx, payouts); err != nil {
+		slog.Error("failed to schedule split payouts", "payment_id", p.ID, "error", err)
+		return
+	}
+	select {
+	case s.splitWake <- struct{}{}:
+	default:
+	}
+}
+
+// splitPayouts applies rules to p in order. Percentages are of the
+// subtotal, so tips are not shared, and are rounded down. The payouts
+// never add up to more than the subtotal.
+func splitPayouts(p *store.Payment, rules []*store.SplitRule, now time.Time) ([]*store.SplitPayout, error) {
+	base := p.SubtotalSats
+	if base == 0 {
+		base = p.AmountSats - p.TipSats
+	}
+
+	remaining := base
+	var payouts []*store.SplitPayout
+	for _, r := range rules {
+		amount := r.AmountSats
+		if r.Percent > 0 {
+			amount = int64(float64(base) * r.Percent / 100)
+		}
+		amount = min(amount, remaining)
+		if amount <= 0 {
+			continue
+		}
+		remaining -= amount
+
+		id, err := newID("spl_")
+		if err != nil {
+			return nil, err
+		}
+		payouts = append(payouts, &store.SplitPayout{
+			ID:             id,
+			PaymentID:      p.ID,
+			RuleID:         r.ID,
+			MerchantPubkey: p.ReceiverPubkey,
+			Destination:    r.Destination,
+			AmountSats:     amount,
+			Status:         "pending",
+			NextAttemptAt:  now,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		})
+	}
+	return payouts, nil
+}
+
+// ProcessSplitPayouts attempts the split payouts that are due and returns
+// how many were paid. A failed attempt is retried later with backoff until
+// SplitMaxAttempts, after which the payout is marked failed.
+func (s *Service) ProcessSplitPayouts(ctx context.Context) (int, error) {
+	now := time.Now().UTC()
+	due, err := s.store.ListDueSplitPayouts(ctx, now, splitBatch)
+	if err != nil {
+		return 0, fmt.Errorf("list due split payouts: %w", err)
+	}
+
+	paid := 0
+	for _, payout := range due {
+		if ctx.Err() != nil {
+			return paid, ctx.Err()
+		}
+		claimed, err := s.store.ClaimSplitPayout(ctx, payout.ID, now, now.Add(splitClaimLease))
+		if err != nil {
+			slog.Error("failed to claim split payout", "payout_id", payout.ID, "error", err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		err = s.attemptSplitPayout(ctx, payout)
+		payout.Attempts++
+		payout.UpdatedAt = time.Now().UTC()
+		switch {
+		case err == nil:
+			payout.Status = "paid"
+			payout.LastError = ""
+			paid++
+		case payout.Attempts >= SplitMaxAttempts:
+			payout.Status = "failed"
+			payout.LastError = err.Error()
+			slog.Error("split payout failed", "payout_id", payout.ID, "payment_id", payout.PaymentID, "error", err)
+		default:
+			payout.LastError = err.Error()
+			payout.NextAttemptAt = payout.UpdatedAt.Add(splitRetryBase << (payout.Attempts - 1))
+			slog.Warn("split payout attempt failed", "payout_id", payout.ID, "attempt", payout.Attempts, "error", err)
+		}
+		if err := s.store.UpdateSplitPayout(ctx, payout); err != nil {
+			slog.Error("failed to record split payout", "payout_id", payout.ID, "error", err)
+		}
+	}
+	return paid, nil
+}
+
+// attemptSplitPayout makes one attempt at a payout and returns nil once it
+// is paid. An earlier attempt whose outcome was unknown is followed up
+// instead of paying again.
+func (s *Service) attemptSplitPayout(ctx context.Context, payout *store.SplitPayout) error {
+	if payout.PayoutPaymentID != "" {
+		done, err := s.followUpPayout(ctx, payout.PayoutPaymentID)
+		if done || err != nil {
+			return err
+		}
+	}
+
+	if !strings.Contains(payout.Destination, "@") {
+		return s.transferPayout(ctx, payout)
+	}
+
+	if s.addresses == nil {
+		return ErrAddressUnavailable
+	}
+	bolt11, err := s.addresses.FetchInvoice(ctx, payout.Destination, payout.AmountSats*1000, "Split of "+payout.PaymentID)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrAddressUnavailable, err)
+	}
+	result, err := s.pay(ctx, &PayInvoiceInput{
+		PayerPubkey: payout.MerchantPubkey,
+		Bolt11:      bolt11,
+		AmountSats:  payout.AmountSats,
+	}, payPurpose{})
+	if result != nil {
+		payout.PayoutPaymentID = result.PaymentID
+	}
+	if err != nil {
+		return err
+	}
+	if result.Status != StatusPaid {
+		return errors.New("payment sent, status not yet known")
+	}
+	return nil
+}
+
+// followUpPayout checks the payment of an earlier attempt. It reports done
+// once that payment is paid, and an error while it may still be in
+// flight; after a failure a new attempt can be made.
+func (s *Service) followUpPayout(ctx context.Context, paymentID string) (bool, error) {
+	p, err := s.store.GetPayment(ctx, paymentID)
+	if err != nil {
+		return false, fmt.Errorf("get payout payment: %w", err)
+	}
+	switch p.Status {
+	case StatusPaid:
+		return true, nil
+	case StatusFailed:
+		return false, nil
+	}
+	if p.Direction == "received" {
+		// The invoice of a transfer between wallets, which transferPayout
+		// follows up
+		return false, nil
+	}
+
+	if _, err := s.settleOutgoing(ctx, p, CauseSplit); err != nil {
+		return false, fmt.Errorf("check payout payment: %w", err)
+	}
+	switch p.Status {
+	case StatusPaid:
+		return true, nil
+	case StatusFailed:
+		return false, nil
+	}
+	return false, errors.New("payout payment still in flight")
+}
+
+// transferPayout credits a user on this instance. When the merchant and
+// the destination share an LNbits wallet, no Lightning payment is made:
+// the payout is recorded as a settled incoming payment of the destination,
+// keyed by the payout ID so that a repeated attempt finds it instead of
+// crediting twice. From the shared wallet, the merchant's share of it must
+// cover the credit. Otherwise the funds move between the wallets.
+func (s *Service) transferPayout(ctx context.Context, payout *store.SplitPayout) error {
+	if p, err := s.store.GetPaymentByHash(ctx, payout.ID); err == nil {
+		payout.PayoutPaymentID = p.ID
+		return nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("get transfer: %w", err)
+	}
+
+	from, fromID, err := s.walletFor(ctx, payout.MerchantPubkey)
+	if err != nil {
+		return err
+	}
+	_, toID, err := s.walletFor(ctx, payout.Destination)
+	if err != nil {
+		return err
+	}
+	if fromID != toID {
+		return s.walletTransfer(ctx, payout, from, fromID)
+	}
+
+	id, err := newID("pay_")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	credit := &store.Payment{
+		ID:             id,
+		AmountSats:     payout.AmountSats,
+		Memo:           "Split of " + payout.PaymentID,
+		SenderPubkey:   payout.MerchantPubkey,
+		ReceiverPubkey: payout.Destination,
+		PaymentHash:    payout.ID,
+		Status:         StatusPaid,
+		SettledAt:      &now,
+		Direction:      "received",
+	}
+	var limit store.SpendLimit
+	if fromID == "" {
+		limit.MinLedgerSats = payout.AmountSats
+	}
+	created, err := s.store.CreateSpend(ctx, credit, limit, createdEvent(CauseSplit, payout.MerchantPubkey))
+	if err != nil {
+		return fmt.Errorf("store transfer: %w", err)
+	}
+	if !created {
+		return ErrInsufficientBalance
+	}
+	s.changed(ctx, credit)
+	payout.PayoutPaymentID = id
+	return nil
+}
+
+// walletTransfer pays a payout to a user whose wallet is not the
+// merchant's: the destination invoices the amount, recorded as an incoming
+// payment like any other, and the merchant's wallet pays it. A repeated
+// attempt settles or pays the same invoice again rather than a new one,
+// unless it expired unpaid. From the shared wallet, the merchant's share
+// of it must cover the invoice, which counts against it while pending.
+func (s *Service) walletTransfer(ctx context.Context, payout *store.SplitPayout, from LNbitsClient, fromID string) error {
+	var p *store.Payment
+	if payout.PayoutPaymentID != "" {
+		prev, err := s.store.GetPayment(ctx, payout.PayoutPaymentID)
+		if err != nil {
+			return fmt.Errorf("get transfer invoice: %w", err)
+		}
+		cause := CauseSplit
+		if prev.Status == StatusExpired {
+			cause = CauseReconcile
+		}
+		if _, err := s.checkAndSettle(ctx, prev, cause); err != nil {
+			return err
+		}
+		switch prev.Status {
+		case StatusPaid:
+			return nil
+		case StatusPending:
+			p = prev
+		}
+	}
+	if p == nil {
+		inv, err := s.CreateInvoice(ctx, &CreateInvoiceInput{
+			ReceiverPubkey: payout.Destination,
+			SenderPubkey:   payout.MerchantPubkey,
+			AmountSats:     payout.AmountSats,
+			Memo:           "Split of " + payout.PaymentID,
+		})
+		if err != nil {
+			return fmt.Errorf("create transfer invoice: %w", err)
+		}
+		payout.PayoutPaymentID = inv.PaymentID
+		if p, err = s.store.GetPayment(ctx, inv.PaymentID); err != nil {
+			return fmt.Errorf("get transfer invoice: %w", err)
+		}
+	}
+
+	if fromID == "" {
+		balance, err := s.store.GetLedgerBalance(ctx, payout.MerchantPubkey)
+		if err != nil {
+			return fmt.Errorf("get ledger balance: %w", err)
+		}
+		if balance < 0 {
+			return ErrInsufficientBalance
+		}
+	}
+
+	// LNbits settles payments between its own wallets at once
+	if _, err := from.PayInvoice(ctx, p.Bolt11); err != nil {
+		return fmt.Errorf("pay transfer invoice: %w", err)
+	}
+	if _, err := s.checkAndSettle(ctx, p, CauseSplit); err != nil {
+		return err
+	}
+	if p.Status != StatusPaid {
+		return errors.New("transfer invoice paid, status not yet known")
+	}
+	return nil
+}
+
+// RunSplitWorker calls ProcessSplitPayouts every interval, and right after
+// a settlement schedules payouts, until ctx is done.
+func (s *Service) RunSplitWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.splitWake:
+		}
+		if _, err := s.ProcessSplitPayouts(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("split payouts failed", "error", err)
+		}
+	}
+}
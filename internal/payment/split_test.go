@@ -0,0 +1,197 @@
+package payment_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/lnbits"
+	"github.com/nostr-pay/nostr-pay/internal/payment"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+var (
+	merchantPubkey = strings.Repeat("aa", 32)
+	landlordPubkey = strings.Repeat("bb", 32)
+)
+
+func TestCreateSplitRule(t *testing.T) {
+	db, _ := store.NewSQLite(":memory:")
+	defer db.Close()
+
+	svc := payment.NewService(db, &mockLNbits{}, "http://localhost:8080")
+	ctx := context.Background()
+
+	rule, err := svc.CreateSplitRule(ctx, &payment.SplitRuleInput{
+		MerchantPubkey: merchantPubkey,
+		Destination:    "Collective@Example.com",
+		Percent:        60,
+	})
+	if err != nil {
+		t.Fatalf("CreateSplitRule: %v", err)
+	}
+	if !strings.HasPrefix(rule.ID, "spr_") || rule.Destination != "collective@example.com" {
+		t.Errorf("rule = %+v", rule)
+	}
+
+	tests := []struct {
+		name  string
+		input payment.SplitRuleInput
+	}{
+		{"over 100 percent in total", payment.SplitRuleInput{Destination: landlordPubkey, Percent: 41}},
+		{"percent and amount", payment.SplitRuleInput{Destination: landlordPubkey, Percent: 10, AmountSats: 100}},
+		{"neither", payment.SplitRuleInput{Destination: landlordPubkey}},
+		{"negative amount", payment.SplitRuleInput{Destination: landlordPubkey, AmountSats: -5}},
+		{"bad destination", payment.SplitRuleInput{Destination: "landlord", AmountSats: 100}},
+		{"self", payment.SplitRuleInput{Destination: merchantPubkey, AmountSats: 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.input.MerchantPubkey = merchantPubkey
+			if _, err := svc.CreateSplitRule(ctx, &tt.input); !errors.Is(err, payment.ErrInvalidSplitRule) {
+				t.Errorf("err = %v, want ErrInvalidSplitRule", err)
+			}
+		})
+	}
+
+	if err := svc.DeleteSplitRule(ctx, rule.ID, landlordPubkey); !errors.Is(err, payment.ErrSplitRuleNotFound) {
+		t.Errorf("delete another merchant's rule: err = %v, want ErrSplitRuleNotFound", err)
+	}
+	if err := svc.DeleteSplitRule(ctx, rule.ID, merchantPubkey); err != nil {
+		t.Errorf("DeleteSplitRule: %v", err)
+	}
+}
+
+// createSale stores a pending payment of the merchant with a tip.
+func createSale(t *testing.T, db store.Store, id string) {
+	t.Helper()
+	err := db.CreatePayment(context.Background(), &store.Payment{
+		ID:             id,
+		Bolt11:         "lnbc...",
+		AmountSats:     1100,
+		SubtotalSats:   1000,
+		TipSats:        100,
+		ReceiverPubkey: merchantPubkey,
+		PaymentHash:    "hash_" + id,
+		Status:         "pending",
+		WebhookToken:   "token_" + id,
+	}, nil)
+	if err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+}
+
+func TestSplitPayouts(t *testing.T) {
+	db, _ := store.NewSQLite(":memory:")
+	defer db.Close()
+
+	mock := newPayMock()
+	svc := payment.NewService(db, mock, "http://localhost:8080")
+	resolver := &stubResolver{}
+	svc.SetAddressResolver(resolver)
+	ctx := context.Background()
+
+	svc.CreateSplitRule(ctx, &payment.SplitRuleInput{MerchantPubkey: merchantPubkey, Destination: "coop@example.com", Percent: 10})
+	svc.CreateSplitRule(ctx, &payment.SplitRuleInput{MerchantPubkey: merchantPubkey, Destination: landlordPubkey, AmountSats: 200})
+
+	createSale(t, db, "pay_sale")
+	if err := svc.HandleWebhook(ctx, "hash_pay_sale", "token_pay_sale"); err != nil {
+		t.Fatalf("HandleWebhook: %v", err)
+	}
+	// A repeated webhook must not schedule the splits again
+	svc.HandleWebhook(ctx, "hash_pay_sale", "token_pay_sale")
+
+	paid, err := svc.ProcessSplitPayouts(ctx)
+	if err != nil {
+		t.Fatalf("ProcessSplitPayouts: %v", err)
+	}
+	if paid != 2 {
+		t.Fatalf("paid %d payouts, want 2", paid)
+	}
+
+	payouts, _ := svc.ListSplitPayouts(ctx, "pay_sale")
+	if len(payouts) != 2 {
+		t.Fatalf("got %d payouts, want 2", len(payouts))
+	}
+	coop, landlord := payouts[0], payouts[1]
+	if coop.Destination != "coop@example.com" || coop.AmountSats != 100 || coop.Status != "paid" {
+		t.Errorf("coop payout = %+v, want 100 sats (10%% of the subtotal) paid", coop)
+	}
+	sent, _ := db.GetPayment(ctx, coop.PayoutPaymentID)
+	if sent == nil || sent.Direction != "sent" || sent.SenderPubkey != merchantPubkey || sent.AmountSats != 100 {
+		t.Errorf("coop payout payment = %+v", sent)
+	}
+	if landlord.AmountSats != 200 || landlord.Status != "paid" {
+		t.Errorf("landlord payout = %+v, want 200 sats paid", landlord)
+	}
+	credited, _ := db.GetPayment(ctx, landlord.PayoutPaymentID)
+	if credited == nil || credited.ReceiverPubkey != landlordPubkey || credited.Status != "paid" || credited.SettledAt == nil {
+		t.Errorf("landlord credit = %+v", credited)
+	}
+
+	if len(mock.paid) != 1 || len(resolver.addresses) != 1 {
+		t.Errorf("paid %d invoices from %d addresses, want 1 each", len(mock.paid), len(resolver.addresses))
+	}
+}
+
+func TestSplitPayouts_Retry(t *testing.T) {
+	db, _ := store.NewSQLite(":memory:")
+	defer db.Close()
+
+	mock := newPayMock()
+	svc := payment.NewService(db, mock, "http://localhost:8080")
+	svc.SetAddressResolver(&stubResolver{})
+	ctx := context.Background()
+
+	svc.CreateSplitRule(ctx, &payment.SplitRuleInput{MerchantPubkey: merchantPubkey, Destination: "coop@example.com", Percent: 50})
+	createSale(t, db, "pay_sale")
+	svc.HandleWebhook(ctx, "hash_pay_sale", "token_pay_sale")
+
+	mock.payErr = lnbits.ErrPaymentFailed
+	if paid, _ := svc.ProcessSplitPayouts(ctx); paid != 0 {
+		t.Fatalf("paid %d payouts, want 0", paid)
+	}
+
+	sale, _ := db.GetPayment(ctx, "pay_sale")
+	if sale.Status != "paid" {
+		t.Errorf("sale Status = %q after a failed split, want paid", sale.Status)
+	}
+	payouts, _ := svc.ListSplitPayouts(ctx, "pay_sale")
+	payout := payouts[0]
+	if payout.Status != "pending" || payout.Attempts != 1 || payout.LastError == "" || !payout.NextAttemptAt.After(time.Now()) {
+		t.Fatalf("payout after failure = %+v, want pending and retried later", payout)
+	}
+
+	// Not due yet
+	if paid, _ := svc.ProcessSplitPayouts(ctx); paid != 0 {
+		t.Errorf("retried %d payouts before they were due", paid)
+	}
+
+	mock.payErr = nil
+	payout.NextAttemptAt = time.Now().Add(-time.Second)
+	db.UpdateSplitPayout(ctx, payout)
+	if paid, _ := svc.ProcessSplitPayouts(ctx); paid != 1 {
+		t.Fatalf("paid %d payouts on retry, want 1", paid)
+	}
+	payouts, _ = svc.ListSplitPayouts(ctx, "pay_sale")
+	if payouts[0].Status != "paid" || payouts[0].Attempts != 2 || payouts[0].AmountSats != 500 {
+		t.Errorf("payout = %+v, want 500 sats paid on the second attempt", payouts[0])
+	}
+
+	// Out of attempts
+	createSale(t, db, "pay_other")
+	svc.HandleWebhook(ctx, "hash_pay_other", "token_pay_other")
+	mock.payErr = lnbits.ErrPaymentFailed
+	for range payment.SplitMaxAttempts {
+		payouts, _ = svc.ListSplitPayouts(ctx, "pay_other")
+		payouts[0].NextAttemptAt = time.Now().Add(-time.Second)
+		db.UpdateSplitPayout(ctx, payouts[0])
+		svc.ProcessSplitPayouts(ctx)
+	}
+	payouts, _ = svc.ListSplitPayouts(ctx, "pay_other")
+	if payouts[0].Status != "failed" || payouts[0].Attempts != payment.SplitMaxAttempts {
+		t.Errorf("payout = %+v, want failed after %d attempts", payouts[0], payment.SplitMaxAttempts)
+	}
+}
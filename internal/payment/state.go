@@ -0,0 +1,155 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+// Payment statuses. Incoming payments start pending and end up paid or
+// expired, and paid ones are refunded once refunds cover their amount.
+// Outgoing payments end up paid or failed.
+const (
+	StatusPending  = "pending"
+	StatusPaid     = "paid"
+	StatusExpired  = "expired"
+	StatusRefunded = "refunded"
+	StatusFailed   = "failed"
+)
+
+// Causes recorded with status changes.
+const (
+	CauseCreated    = "created"
+	CauseWebhook    = "webhook"
+	CauseReconcile  = "reconcile"
+	CauseExpiry     = "expiry"
+	CausePayment    = "payment"
+	CauseRefund     = "refund"
+	CauseSplit      = "split"
+	CauseWithdrawal = "withdrawal"
+	CauseLNURL      = "lnurl"
+)
+
+// ActorSystem is the actor of changes the service makes on its own.
+const ActorSystem = "system"
+
+var ErrInvalidTransition = errors.New("invalid payment status transition")
+
+// StatusListener is told about a payment once a status change has been
+// stored, e.g. to queue webhooks to the merchant. Unlike Notifier it also
+// hears about payments created in a final status.
+type StatusListener interface {
+	PaymentChanged(ctx context.Context, p *store.Payment)
+}
+
+// SetStatusListener registers l to hear about status changes.
+func (s *Service) SetStatusListener(l StatusListener) {
+	s.listener = l
+}
+
+func (s *Service) changed(ctx context.Context, p *store.Payment) {
+	if s.listener != nil {
+		s.listener.PaymentChanged(ctx, p)
+	}
+}
+
+// transitions lists the statuses each status may move to.
+var transitions = map[string][]string{
+	StatusPending: {StatusPaid, StatusExpired, StatusFailed},
+	StatusExpired: {StatusPaid},
+	StatusPaid:    {StatusRefunded},
+}
+
+// CanTransition reports whether a payment may move from one status to
+// another. An expired invoice only becomes paid through reconciliation,
+// which confirms the late payment with LNbits first; a webhook cannot
+// revive it.
+func CanTransition(from, to, cause string) bool {
+	if from == StatusExpired && to == StatusPaid && cause != CauseReconcile {
+		return false
+	}
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transition moves p to status to, recording the cause and actor. It
+// reports false if p's status changed since it was loaded, in which case
+// nothing is written. On success p.Status is updated.
+func (s *Service) transition(ctx context.Context, p *store.Payment, to, cause, actor string, settledAt *time.Time) (bool, error) {
+	if !CanTransition(p.Status, to, cause) {
+		return false, fmt.Errorf("%w: %s to %s by %s", ErrInvalidTransition, p.Status, to, cause)
+	}
+	ok, err := s.store.TransitionPaymentStatus(ctx, &store.PaymentEvent{
+		PaymentID:  p.ID,
+		FromStatus: p.Status,
+		ToStatus:   to,
+		Cause:      cause,
+		Actor:      actor,
+	}, settledAt)
+	if err != nil {
+		return false, fmt.Errorf("transition payment: %w", err)
+	}
+	if ok {
+		p.Status = to
+		if settledAt != nil {
+			p.SettledAt = settledAt
+		}
+		s.changed(ctx, p)
+	}
+	return ok, nil
+}
+
+// completeOutgoing records the outcome of a sent payment that is pending.
+func (s *Service) completeOutgoing(ctx context.Context, p *store.Payment, to, cause, actor, preimage string, feeSats int64, settledAt *time.Time) (bool, error) {
+	if p.Status != StatusPending || !CanTransition(p.Status, to, cause) {
+		return false, fmt.Errorf("%w: %s to %s", ErrInvalidTransition, p.Status, to)
+	}
+	ok, err := s.store.CompleteOutgoingPayment(ctx, &store.PaymentEvent{
+		PaymentID:  p.ID,
+		FromStatus: p.Status,
+		ToStatus:   to,
+		Cause:      cause,
+		Actor:      actor,
+	}, preimage, feeSats, settledAt)
+	if err != nil {
+		return false, fmt.Errorf("record payment: %w", err)
+	}
+	if ok {
+		p.Status = to
+		p.Preimage = preimage
+		p.FeeSats = feeSats
+		p.SettledAt = settledAt
+		s.changed(ctx, p)
+	}
+	return ok, nil
+}
+
+// createPayment stores a new payment along with the event that records
+// its creation.
+func (s *Service) createPayment(ctx context.Context, p *store.Payment, cause, actor string) error {
+	if err := s.store.CreatePayment(ctx, p, createdEvent(cause, actor)); err != nil {
+		return fmt.Errorf("store payment: %w", err)
+	}
+	if p.Status != StatusPending {
+		s.changed(ctx, p)
+	}
+	return nil
+}
+
+// createdEvent is the event that records a payment's creation; the store
+// fills in the payment and its status.
+func createdEvent(cause, actor string) *store.PaymentEvent {
+	return &store.PaymentEvent{Cause: cause, Actor: actor}
+}
+
+// ListPaymentEvents returns a payment's status history, oldest first.
+func (s *Service) ListPaymentEvents(ctx context.Context, paymentID string) ([]*store.PaymentEvent, error) {
+	return s.store.ListPaymentEvents(ctx, paymentID)
+}
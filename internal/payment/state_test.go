@@ -0,0 +1,144 @@
+package payment_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/payment"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to, cause string
+		want            bool
+	}{
+		{payment.StatusPending, payment.StatusPaid, payment.CauseWebhook, true},
+		{payment.StatusPending, payment.StatusExpired, payment.CauseExpiry, true},
+		{payment.StatusPending, payment.StatusFailed, payment.CausePayment, true},
+		{payment.StatusExpired, payment.StatusPaid, payment.CauseReconcile, true},
+		{payment.StatusExpired, payment.StatusPaid, payment.CauseWebhook, false},
+		{payment.StatusPaid, payment.StatusRefunded, payment.CauseRefund, true},
+		{payment.StatusPaid, payment.StatusPending, payment.CauseWebhook, false},
+		{payment.StatusPaid, payment.StatusExpired, payment.CauseExpiry, false},
+		{payment.StatusFailed, payment.StatusPaid, payment.CausePayment, false},
+		{payment.StatusRefunded, payment.StatusPaid, payment.CauseReconcile, false},
+	}
+	for _, tt := range tests {
+		if got := payment.CanTransition(tt.from, tt.to, tt.cause); got != tt.want {
+			t.Errorf("CanTransition(%s, %s, %s) = %v, want %v", tt.from, tt.to, tt.cause, got, tt.want)
+		}
+	}
+}
+
+// recordingListener records the statuses payments change to.
+type recordingListener struct {
+	changes []string
+}
+
+func (l *recordingListener) PaymentChanged(ctx context.Context, p *store.Payment) {
+	l.changes = append(l.changes, p.Direction+" "+p.Status)
+}
+
+func TestPaymentEvents(t *testing.T) {
+	db, _ := store.NewSQLite(":memory:")
+	defer db.Close()
+
+	mock := newPayMock()
+	svc := payment.NewService(db, mock, "http://localhost:8080")
+	svc.SetAddressResolver(&stubResolver{})
+	listener := &recordingListener{}
+	svc.SetStatusListener(listener)
+	ctx := context.Background()
+	fundLedger(t, db, "merchant", 5000)
+
+	result, err := svc.CreateInvoice(ctx, &payment.CreateInvoiceInput{
+		ReceiverPubkey:  "merchant",
+		CreatedByPubkey: "cashier",
+		AmountSats:      1000,
+	})
+	if err != nil {
+		t.Fatalf("CreateInvoice: %v", err)
+	}
+	created, _ := db.GetPayment(ctx, result.PaymentID)
+	if err := svc.HandleWebhook(ctx, result.PaymentHash, created.WebhookToken); err != nil {
+		t.Fatalf("HandleWebhook: %v", err)
+	}
+	if _, err := svc.Refund(ctx, &payment.RefundInput{
+		MerchantPubkey:   "merchant",
+		PaymentID:        result.PaymentID,
+		LightningAddress: "alice@example.com",
+	}); err != nil {
+		t.Fatalf("Refund: %v", err)
+	}
+
+	p, _ := db.GetPayment(ctx, result.PaymentID)
+	if p.Status != payment.StatusRefunded || p.SettledAt == nil {
+		t.Errorf("Status = %q, SettledAt = %v, want refunded and still settled", p.Status, p.SettledAt)
+	}
+
+	events, err := svc.ListPaymentEvents(ctx, result.PaymentID)
+	if err != nil {
+		t.Fatalf("ListPaymentEvents: %v", err)
+	}
+	want := []store.PaymentEvent{
+		{FromStatus: "", ToStatus: "pending", Cause: payment.CauseCreated, Actor: "cashier"},
+		{FromStatus: "pending", ToStatus: "paid", Cause: payment.CauseWebhook, Actor: payment.ActorSystem},
+		{FromStatus: "paid", ToStatus: "refunded", Cause: payment.CauseRefund, Actor: "merchant"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(events), len(want))
+	}
+	for i, e := range events {
+		w := want[i]
+		if e.FromStatus != w.FromStatus || e.ToStatus != w.ToStatus || e.Cause != w.Cause || e.Actor != w.Actor {
+			t.Errorf("event %d = %+v, want %+v", i, *e, w)
+		}
+	}
+
+	// The refund itself is a sent payment that was paid
+	if got := strings.Join(listener.changes, ", "); got != "received paid, sent paid, received refunded" {
+		t.Errorf("listener heard %q", got)
+	}
+}
+
+func TestExpiredPaymentOnlySettledByReconcile(t *testing.T) {
+	db, _ := store.NewSQLite(":memory:")
+	defer db.Close()
+
+	svc := payment.NewService(db, newPayMock(), "http://localhost:8080")
+	ctx := context.Background()
+
+	past := time.Now().Add(-time.Minute)
+	db.CreatePayment(ctx, &store.Payment{
+		ID:             "pay_late",
+		Bolt11:         "lnbc...",
+		AmountSats:     500,
+		ReceiverPubkey: "merchant",
+		PaymentHash:    "hash_late",
+		Status:         "pending",
+		ExpiresAt:      &past,
+		WebhookToken:   "token_late",
+	}, nil)
+	if _, err := svc.ExpireOverdue(ctx); err != nil {
+		t.Fatalf("ExpireOverdue: %v", err)
+	}
+
+	if err := svc.HandleWebhook(ctx, "hash_late", "token_late"); err != nil {
+		t.Fatalf("HandleWebhook: %v", err)
+	}
+	p, _ := db.GetPayment(ctx, "pay_late")
+	if p.Status != payment.StatusExpired {
+		t.Fatalf("Status = %q after a webhook, want expired", p.Status)
+	}
+
+	if n, _ := svc.Reconcile(ctx, true); n != 1 {
+		t.Fatalf("reconciled %d payments, want 1", n)
+	}
+	events, _ := svc.ListPaymentEvents(ctx, "pay_late")
+	if len(events) != 2 || events[1].FromStatus != "expired" || events[1].ToStatus != "paid" || events[1].Cause != payment.CauseReconcile {
+		t.Errorf("events = %v, want expiry then reconciliation", events)
+	}
+}
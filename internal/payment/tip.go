@@ -0,0 +1,28 @@
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// MaxTipPercent bounds percentage tips.
+const MaxTipPercent = 100
+
+var ErrInvalidTip = errors.New("invalid tip")
+
+// tipAmount returns the tip in sats on subtotal, given either as an
+// absolute amount or as a percentage rounded to the nearest sat.
+func tipAmount(subtotal, tipSats int64, tipPercent float64) (int64, error) {
+	switch {
+	case tipSats != 0 && tipPercent != 0:
+		return 0, fmt.Errorf("%w: give an amount or a percentage, not both", ErrInvalidTip)
+	case tipSats < 0:
+		return 0, fmt.Errorf("%w: amount must not be negative", ErrInvalidTip)
+	case math.IsNaN(tipPercent) || tipPercent < 0 || tipPercent > MaxTipPercent:
+		return 0, fmt.Errorf("%w: percentage must be between 0 and %d", ErrInvalidTip, MaxTipPercent)
+	case tipPercent > 0:
+		return int64(math.Round(float64(subtotal) * tipPercent / 100)), nil
+	}
+	return tipSats, nil
+}
@@ -0,0 +1,188 @@
+package payment
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/nostr-pay/nostr-pay/internal/lnbits"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+// UserManager creates LNbits users with a wallet of their own.
+type UserManager interface {
+	CreateUserWallet(ctx context.Context, adminID, userName, walletName string) (*lnbits.UserWallet, error)
+}
+
+// KeyBox encrypts wallet keys before they are stored. label names where a
+// ciphertext is stored, and opening it under another label fails.
+type KeyBox interface {
+	Seal(plaintext, label string) (string, error)
+	Open(ciphertext, label string) (string, error)
+}
+
+// WalletConfig enables wallets per merchant. Without it, or for users
+// without a wallet of their own, payments go through the shared wallet the
+// service was created with.
+type WalletConfig struct {
+	Users UserManager
+	// AdminID is the LNbits user that owns the merchants' users.
+	AdminID string
+	Keys    KeyBox
+	// Client returns a client for the wallet with the given keys.
+	Client func(adminKey, invoiceKey string) LNbitsClient
+}
+
+var (
+	// ErrWalletsDisabled is returned when provisioning a wallet without
+	// per-merchant wallets configured.
+	ErrWalletsDisabled = errors.New("per-merchant wallets are not enabled")
+	// ErrWalletProvisioning wraps LNbits failures to create a wallet.
+	ErrWalletProvisioning = errors.New("wallet provisioning failed")
+	// ErrSharedBalance is returned when provisioning a wallet for a user
+	// that still has a balance or payments in flight in the shared wallet.
+	ErrSharedBalance = errors.New("user still has a balance in the shared wallet")
+)
+
+// SetWallets enables wallets per merchant.
+func (s *Service) SetWallets(c WalletConfig) {
+	s.wallets = c
+}
+
+func (s *Service) walletsEnabled() bool {
+	return s.wallets.Users != nil
+}
+
+// ProvisionWallet creates an LNbits wallet for the user with pubkey, who
+// must exist, and stores its keys encrypted. Users that already have a
+// wallet keep it. From then on the user's invoices are created in, and its
+// payments made from, that wallet, so the user's share of the shared wallet
+// could no longer be spent: while the user has one, provisioning fails with
+// ErrSharedBalance.
+func (s *Service) ProvisionWallet(ctx context.Context, pubkey string) (*store.User, error) {
+	if !s.walletsEnabled() {
+		return nil, ErrWalletsDisabled
+	}
+	u, err := s.store.GetUser(ctx, pubkey)
+	if err != nil {
+		return nil, err
+	}
+	if hasWallet(u) {
+		return u, nil
+	}
+	balance, err := s.store.GetLedgerBalance(ctx, pubkey)
+	if err != nil {
+		return nil, fmt.Errorf("get ledger balance: %w", err)
+	}
+	if balance != 0 {
+		return nil, ErrSharedBalance
+	}
+
+	w, err := s.wallets.Users.CreateUserWallet(ctx, s.wallets.AdminID, "nostr-pay "+pubkey[:min(len(pubkey), 16)], "nostr-pay")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrWalletProvisioning, err)
+	}
+	adminKey, err := s.wallets.Keys.Seal(w.AdminKey, adminKeyLabel(pubkey))
+	if err != nil {
+		return nil, err
+	}
+	invoiceKey, err := s.wallets.Keys.Seal(w.InvoiceKey, invoiceKeyLabel(pubkey))
+	if err != nil {
+		return nil, err
+	}
+	u.LNbitsWalletID = w.WalletID
+	u.LNbitsUserID = w.UserID
+	u.LNbitsAdminKey = adminKey
+	u.LNbitsInvoiceKey = invoiceKey
+
+	stored, err := s.store.SetUserWallet(ctx, u)
+	if err != nil {
+		return nil, fmt.Errorf("store wallet: %w", err)
+	}
+	if !stored {
+		// Provisioned concurrently, or the user's share of the shared
+		// wallet changed since it was checked; the LNbits user created
+		// here is unused
+		slog.Warn("wallet not stored", "pubkey", pubkey, "unused_lnbits_user", w.UserID)
+		if u, err = s.store.GetUser(ctx, pubkey); err != nil {
+			return nil, err
+		}
+		if !hasWallet(u) {
+			return nil, ErrSharedBalance
+		}
+		return u, nil
+	}
+	slog.Info("wallet provisioned", "pubkey", pubkey, "wallet_id", w.WalletID)
+	return u, nil
+}
+
+// walletFor returns the wallet new payments of the user with pubkey go
+// through, and its ID: the user's own, or the shared wallet with an empty
+// ID.
+func (s *Service) walletFor(ctx context.Context, pubkey string) (LNbitsClient, string, error) {
+	if !s.walletsEnabled() || pubkey == "" {
+		return s.lnbits, "", nil
+	}
+	u, err := s.store.GetUser(ctx, pubkey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.lnbits, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("get user: %w", err)
+	}
+	if !hasWallet(u) {
+		return s.lnbits, "", nil
+	}
+	client, err := s.openWallet(u)
+	if err != nil {
+		return nil, "", err
+	}
+	return client, u.LNbitsWalletID, nil
+}
+
+// paymentWallet returns the wallet p was made in, to check on it.
+func (s *Service) paymentWallet(ctx context.Context, p *store.Payment) (LNbitsClient, error) {
+	if p.WalletID == "" {
+		return s.lnbits, nil
+	}
+	if !s.walletsEnabled() {
+		return nil, fmt.Errorf("payment %s is in wallet %s: %w", p.ID, p.WalletID, ErrWalletsDisabled)
+	}
+	owner := p.ReceiverPubkey
+	if p.Direction == "sent" {
+		owner = p.SenderPubkey
+	}
+	u, err := s.store.GetUser(ctx, owner)
+	if err != nil {
+		return nil, fmt.Errorf("get wallet owner: %w", err)
+	}
+	if u.LNbitsWalletID != p.WalletID {
+		return nil, fmt.Errorf("wallet %s of payment %s no longer belongs to its owner", p.WalletID, p.ID)
+	}
+	return s.openWallet(u)
+}
+
+func (s *Service) openWallet(u *store.User) (LNbitsClient, error) {
+	adminKey, err := s.wallets.Keys.Open(u.LNbitsAdminKey, adminKeyLabel(u.Pubkey))
+	if err != nil {
+		return nil, fmt.Errorf("open admin key of wallet %s: %w", u.LNbitsWalletID, err)
+	}
+	invoiceKey, err := s.wallets.Keys.Open(u.LNbitsInvoiceKey, invoiceKeyLabel(u.Pubkey))
+	if err != nil {
+		return nil, fmt.Errorf("open invoice key of wallet %s: %w", u.LNbitsWalletID, err)
+	}
+	return s.wallets.Client(adminKey, invoiceKey), nil
+}
+
+// hasWallet reports whether u has a wallet of its own. Wallet IDs recorded
+// without keys predate provisioning and are ignored.
+func hasWallet(u *store.User) bool {
+	return u.LNbitsWalletID != "" && u.LNbitsAdminKey != "" && u.LNbitsInvoiceKey != ""
+}
+
+// Keys are sealed under their column and owner, so a key copied to another
+// user or column does not open.
+func adminKeyLabel(pubkey string) string   { return "lnbits_admin_key:" + pubkey }
+func invoiceKeyLabel(pubkey string) string { return "lnbits_invoice_key:" + pubkey }
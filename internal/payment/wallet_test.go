@@ -0,0 +1,201 @@
+package payment_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/lnbits"
+	"github.com/nostr-pay/nostr-pay/internal/payment"
+	"github.com/nostr-pay/nostr-pay/internal/secretbox"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+// walletFarm is a mock LNbits user manager whose wallets are mockLNbits,
+// looked up by their admin key.
+type walletFarm struct {
+	err     error
+	created int
+	wallets map[string]*mockLNbits
+}
+
+func (f *walletFarm) CreateUserWallet(ctx context.Context, adminID, userName, walletName string) (*lnbits.UserWallet, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.created++
+	n := f.created
+	f.wallets[fmt.Sprintf("admin_%d", n)] = newPayMock()
+	return &lnbits.UserWallet{
+		UserID:     fmt.Sprintf("user_%d", n),
+		WalletID:   fmt.Sprintf("wallet_%d", n),
+		AdminKey:   fmt.Sprintf("admin_%d", n),
+		InvoiceKey: fmt.Sprintf("invoice_%d", n),
+	}, nil
+}
+
+// setupWallets returns a service with per-merchant wallets that falls back
+// to the shared wallet.
+func setupWallets(t *testing.T, shared *mockLNbits) (store.Store, *payment.Service, *walletFarm) {
+	t.Helper()
+	db, _ := store.NewSQLite(":memory:")
+	t.Cleanup(func() { db.Close() })
+
+	box, _ := secretbox.New(bytes.Repeat([]byte{7}, secretbox.KeySize))
+	farm := &walletFarm{wallets: map[string]*mockLNbits{}}
+	svc := payment.NewService(db, shared, "http://localhost:8080")
+	svc.SetWallets(payment.WalletConfig{
+		Users:   farm,
+		AdminID: "admin_user",
+		Keys:    box,
+		Client: func(adminKey, invoiceKey string) payment.LNbitsClient {
+			return farm.wallets[adminKey]
+		},
+	})
+	return db, svc, farm
+}
+
+func TestProvisionWallet(t *testing.T) {
+	db, svc, farm := setupWallets(t, newPayMock())
+	ctx := context.Background()
+
+	if _, err := svc.ProvisionWallet(ctx, merchantPubkey); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("unknown user: err = %v, want sql.ErrNoRows", err)
+	}
+
+	db.CreateUser(ctx, &store.User{Pubkey: merchantPubkey, IsMerchant: true})
+	u, err := svc.ProvisionWallet(ctx, merchantPubkey)
+	if err != nil {
+		t.Fatalf("ProvisionWallet: %v", err)
+	}
+	if u.LNbitsWalletID != "wallet_1" || u.LNbitsUserID != "user_1" {
+		t.Errorf("user = %+v", u)
+	}
+	stored, _ := db.GetUser(ctx, merchantPubkey)
+	if stored.LNbitsAdminKey == "" || strings.Contains(stored.LNbitsAdminKey, "admin_1") ||
+		stored.LNbitsInvoiceKey == "" || strings.Contains(stored.LNbitsInvoiceKey, "invoice_1") {
+		t.Errorf("stored keys %q, %q, want them encrypted", stored.LNbitsAdminKey, stored.LNbitsInvoiceKey)
+	}
+
+	// Provisioning again keeps the wallet
+	if u, err := svc.ProvisionWallet(ctx, merchantPubkey); err != nil || u.LNbitsWalletID != "wallet_1" || farm.created != 1 {
+		t.Errorf("ProvisionWallet again = %+v, %v after creating %d wallets", u, err, farm.created)
+	}
+
+	db.CreateUser(ctx, &store.User{Pubkey: landlordPubkey, IsMerchant: true})
+	farm.err = errors.New("usermanager not enabled")
+	if _, err := svc.ProvisionWallet(ctx, landlordPubkey); !errors.Is(err, payment.ErrWalletProvisioning) {
+		t.Errorf("LNbits failure: err = %v, want ErrWalletProvisioning", err)
+	}
+
+	plain := payment.NewService(db, newPayMock(), "http://localhost:8080")
+	if _, err := plain.ProvisionWallet(ctx, landlordPubkey); !errors.Is(err, payment.ErrWalletsDisabled) {
+		t.Errorf("without wallets: err = %v, want ErrWalletsDisabled", err)
+	}
+}
+
+func TestWalletRouting(t *testing.T) {
+	shared := newPayMock()
+	db, svc, farm := setupWallets(t, shared)
+	ctx := context.Background()
+
+	db.CreateUser(ctx, &store.User{Pubkey: merchantPubkey, IsMerchant: true})
+	svc.ProvisionWallet(ctx, merchantPubkey)
+	own := farm.wallets["admin_1"]
+
+	inv, err := svc.CreateInvoice(ctx, &payment.CreateInvoiceInput{ReceiverPubkey: merchantPubkey, AmountSats: 1000})
+	if err != nil {
+		t.Fatalf("CreateInvoice: %v", err)
+	}
+	if len(own.created) != 1 || len(shared.created) != 0 {
+		t.Fatalf("created %d invoices in the merchant's wallet and %d in the shared one, want 1 and 0", len(own.created), len(shared.created))
+	}
+	p, _ := db.GetPayment(ctx, inv.PaymentID)
+	if p.WalletID != "wallet_1" {
+		t.Errorf("WalletID = %q, want wallet_1", p.WalletID)
+	}
+	if err := svc.HandleWebhook(ctx, p.PaymentHash, p.WebhookToken); err != nil {
+		t.Fatalf("HandleWebhook: %v", err)
+	}
+	if len(own.checked) != 1 || len(shared.checked) != 0 {
+		t.Errorf("checked %d times in the merchant's wallet and %d in the shared one, want 1 and 0", len(own.checked), len(shared.checked))
+	}
+
+	bolt11, _ := signInvoice(500, "Supplies", time.Hour)
+	if _, err := svc.PayInvoice(ctx, &payment.PayInvoiceInput{PayerPubkey: merchantPubkey, Bolt11: bolt11}); err != nil {
+		t.Fatalf("PayInvoice: %v", err)
+	}
+	if len(own.paid) != 1 || len(shared.paid) != 0 {
+		t.Errorf("paid %d from the merchant's wallet and %d from the shared one, want 1 and 0", len(own.paid), len(shared.paid))
+	}
+
+	// Users without a wallet of their own fall back to the shared wallet
+	inv, _ = svc.CreateInvoice(ctx, &payment.CreateInvoiceInput{ReceiverPubkey: landlordPubkey, AmountSats: 1000})
+	if p, _ := db.GetPayment(ctx, inv.PaymentID); len(shared.created) != 1 || p.WalletID != "" {
+		t.Errorf("created %d invoices in the shared wallet, WalletID = %q", len(shared.created), p.WalletID)
+	}
+}
+
+func TestSplitPayouts_WalletTransfer(t *testing.T) {
+	shared := newPayMock()
+	db, svc, farm := setupWallets(t, shared)
+	ctx := context.Background()
+
+	db.CreateUser(ctx, &store.User{Pubkey: merchantPubkey, IsMerchant: true})
+	svc.ProvisionWallet(ctx, merchantPubkey)
+	own := farm.wallets["admin_1"]
+
+	svc.CreateSplitRule(ctx, &payment.SplitRuleInput{MerchantPubkey: merchantPubkey, Destination: landlordPubkey, AmountSats: 200})
+	createSale(t, db, "pay_sale")
+	svc.HandleWebhook(ctx, "hash_pay_sale", "token_pay_sale")
+
+	if paid, err := svc.ProcessSplitPayouts(ctx); paid != 1 || err != nil {
+		t.Fatalf("ProcessSplitPayouts = %d, %v, want 1", paid, err)
+	}
+	payouts, _ := svc.ListSplitPayouts(ctx, "pay_sale")
+	credited, _ := db.GetPayment(ctx, payouts[0].PayoutPaymentID)
+	if credited == nil || credited.ReceiverPubkey != landlordPubkey || credited.Status != "paid" || credited.AmountSats != 200 {
+		t.Fatalf("landlord credit = %+v", credited)
+	}
+	// The landlord's shared wallet invoiced the payout and the merchant's
+	// wallet paid it
+	if len(shared.created) != 1 || shared.created[0].PaymentHash != credited.PaymentHash {
+		t.Errorf("shared wallet created %d invoices, want the credit's", len(shared.created))
+	}
+	if len(own.paid) != 1 || own.paid[0] != credited.Bolt11 {
+		t.Errorf("merchant's wallet paid %v, want the credit's invoice", own.paid)
+	}
+}
+
+func TestProvisionWallet_SharedBalance(t *testing.T) {
+	shared := newPayMock()
+	db, svc, farm := setupWallets(t, shared)
+	ctx := context.Background()
+
+	db.CreateUser(ctx, &store.User{Pubkey: merchantPubkey, IsMerchant: true})
+	createSale(t, db, "pay_sale")
+	svc.HandleWebhook(ctx, "hash_pay_sale", "token_pay_sale")
+
+	// The settled sale is the merchant's share of the shared wallet, which
+	// its own wallet could not spend
+	if _, err := svc.ProvisionWallet(ctx, merchantPubkey); !errors.Is(err, payment.ErrSharedBalance) {
+		t.Fatalf("ProvisionWallet = %v, want ErrSharedBalance", err)
+	}
+	if u, _ := db.GetUser(ctx, merchantPubkey); u.LNbitsWalletID != "" || farm.created != 0 {
+		t.Fatalf("wallet %q stored after creating %d wallets", u.LNbitsWalletID, farm.created)
+	}
+	if b, err := svc.Balance(ctx, merchantPubkey); err != nil || b.BalanceSats != 1100 {
+		t.Errorf("Balance = %+v, %v, want the sale in the shared wallet", b, err)
+	}
+
+	// Once the balance is withdrawn the wallet is provisioned
+	db.CreatePayment(ctx, &store.Payment{ID: "pay_out", AmountSats: 1100, SenderPubkey: merchantPubkey, PaymentHash: "hash_out", Status: "paid", Direction: "sent"}, nil)
+	if u, err := svc.ProvisionWallet(ctx, merchantPubkey); err != nil || u.LNbitsWalletID != "wallet_1" {
+		t.Errorf("ProvisionWallet after withdrawing = %+v, %v", u, err)
+	}
+}
@@ -0,0 +1,133 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrWithdrawalDestination = errors.New("give either a bolt11 invoice or a lightning address")
+	ErrWithdrawalAmount      = errors.New("an amount is required to withdraw to a lightning address")
+	ErrWithdrawalLimit       = errors.New("withdrawal exceeds the daily limit")
+)
+
+// WithdrawalLimits apply to merchants moving their balance out.
+type WithdrawalLimits struct {
+	// ReserveSats must stay in the balance, on top of the fee limit, e.g.
+	// to pay refunds from.
+	ReserveSats int64
+	// MaxFeeSats caps the routing fee below the service's fee limit. Zero
+	// leaves the service's limit alone.
+	MaxFeeSats int64
+	// DailySats caps what a merchant withdraws per UTC day, counting
+	// withdrawals in flight. Zero means no cap.
+	DailySats int64
+}
+
+// DefaultWithdrawalLimits keeps 1,000 sats, caps fees at 1,000 sats and
+// allows 1,000,000 sats a day.
+var DefaultWithdrawalLimits = WithdrawalLimits{ReserveSats: 1000, MaxFeeSats: 1000, DailySats: 1_000_000}
+
+// SetWithdrawalLimits replaces DefaultWithdrawalLimits.
+func (s *Service) SetWithdrawalLimits(l WithdrawalLimits) {
+	s.withdrawals = l
+}
+
+// Balance is what a merchant holds and may withdraw.
+type Balance struct {
+	// WalletID is the merchant's own wallet. When it is empty, BalanceSats
+	// is the merchant's share of the shared wallet, as recorded in the
+	// payments.
+	WalletID           string
+	BalanceSats        int64
+	ReserveSats        int64
+	DailyLimitSats     int64
+	WithdrawnTodaySats int64
+	// AvailableSats is what can be withdrawn now, before routing fees.
+	AvailableSats int64
+}
+
+// Balance returns the balance of the merchant with pubkey.
+func (s *Service) Balance(ctx context.Context, pubkey string) (*Balance, error) {
+	wallet, walletID, err := s.walletFor(ctx, pubkey)
+	if err != nil {
+		return nil, err
+	}
+	b := &Balance{
+		WalletID:       walletID,
+		ReserveSats:    s.withdrawals.ReserveSats,
+		DailyLimitSats: s.withdrawals.DailySats,
+	}
+	if walletID == "" {
+		b.BalanceSats, err = s.store.GetLedgerBalance(ctx, pubkey)
+		if err != nil {
+			return nil, fmt.Errorf("get ledger balance: %w", err)
+		}
+	} else {
+		w, err := wallet.GetWallet(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("get wallet: %w", err)
+		}
+		b.BalanceSats = w.Balance / 1000
+	}
+
+	b.WithdrawnTodaySats, err = s.store.SumWithdrawals(ctx, pubkey, startOfDay(time.Now()))
+	if err != nil {
+		return nil, fmt.Errorf("sum withdrawals: %w", err)
+	}
+	b.AvailableSats = max(b.BalanceSats-b.ReserveSats, 0)
+	if b.DailyLimitSats > 0 {
+		b.AvailableSats = min(b.AvailableSats, max(b.DailyLimitSats-b.WithdrawnTodaySats, 0))
+	}
+	return b, nil
+}
+
+type WithdrawInput struct {
+	MerchantPubkey string
+	// AmountSats is required with a Lightning address. With a bolt11
+	// invoice it may be left out, or must match the invoice.
+	AmountSats int64
+	// Exactly one of Bolt11 and LightningAddress is the destination.
+	Bolt11           string
+	LightningAddress string
+}
+
+// Withdraw pays part of the merchant's balance out and records it as a
+// sent payment marked as a withdrawal. The amount plus its fee limit and
+// the reserve must be covered by the balance: the merchant's own wallet,
+// or their share of the shared wallet, so that merchants cannot withdraw
+// each other's earnings.
+func (s *Service) Withdraw(ctx context.Context, input *WithdrawInput) (*PayInvoiceResult, error) {
+	if (input.Bolt11 == "") == (input.LightningAddress == "") {
+		return nil, ErrWithdrawalDestination
+	}
+
+	bolt11 := input.Bolt11
+	if input.LightningAddress != "" {
+		if input.AmountSats <= 0 {
+			return nil, ErrWithdrawalAmount
+		}
+		if s.addresses == nil {
+			return nil, ErrAddressUnavailable
+		}
+		var err error
+		bolt11, err = s.addresses.FetchInvoice(ctx, input.LightningAddress, input.AmountSats*1000, "Withdrawal")
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrAddressUnavailable, err)
+		}
+	}
+
+	limits := s.withdrawals
+	return s.pay(ctx, &PayInvoiceInput{
+		PayerPubkey: input.MerchantPubkey,
+		Bolt11:      bolt11,
+		AmountSats:  input.AmountSats,
+	}, payPurpose{limits: &limits, cause: CauseWithdrawal})
+}
+
+// startOfDay returns the start of t's UTC day.
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
@@ -0,0 +1,119 @@
+package payment_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/payment"
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+func TestWithdraw(t *testing.T) {
+	db, _ := store.NewSQLite(":memory:")
+	defer db.Close()
+
+	mock := newPayMock()
+	svc := payment.NewService(db, mock, "http://localhost:8080")
+	svc.SetWithdrawalLimits(payment.WithdrawalLimits{ReserveSats: 1000, MaxFeeSats: 20, DailySats: 5000})
+	resolver := &stubResolver{}
+	svc.SetAddressResolver(resolver)
+	ctx := context.Background()
+
+	db.CreatePayment(ctx, &store.Payment{ID: "pay_sale", AmountSats: 10_000, ReceiverPubkey: merchantPubkey, PaymentHash: "hash_sale", Status: "paid"}, nil)
+
+	b, err := svc.Balance(ctx, merchantPubkey)
+	if err != nil {
+		t.Fatalf("Balance: %v", err)
+	}
+	if b.WalletID != "" || b.BalanceSats != 10_000 || b.AvailableSats != 5000 {
+		t.Errorf("balance = %+v, want 10000 in the shared wallet, 5000 available today", b)
+	}
+
+	// LNbits would allow 21 sats of fees; the service's limit of 40 would
+	// too, but not the withdrawal cap
+	bolt11, _ := signInvoice(3000, "Payday", time.Hour)
+	mock.feeReserve = 21_000
+	if _, err := svc.Withdraw(ctx, &payment.WithdrawInput{MerchantPubkey: merchantPubkey, Bolt11: bolt11}); !errors.Is(err, payment.ErrFeeLimit) {
+		t.Errorf("err = %v, want ErrFeeLimit", err)
+	}
+	mock.feeReserve = 0
+
+	result, err := svc.Withdraw(ctx, &payment.WithdrawInput{MerchantPubkey: merchantPubkey, Bolt11: bolt11})
+	if err != nil {
+		t.Fatalf("Withdraw: %v", err)
+	}
+	p, _ := db.GetPayment(ctx, result.PaymentID)
+	if result.Status != "paid" || !p.Withdrawal || p.Direction != "sent" || p.SenderPubkey != merchantPubkey {
+		t.Errorf("withdrawal = %+v", p)
+	}
+	events, _ := svc.ListPaymentEvents(ctx, p.ID)
+	if len(events) == 0 || events[0].Cause != payment.CauseWithdrawal {
+		t.Errorf("events = %+v, want created by withdrawal", events)
+	}
+
+	b, _ = svc.Balance(ctx, merchantPubkey)
+	if b.BalanceSats != 10_000-3000-3 || b.WithdrawnTodaySats != 3000 || b.AvailableSats != 2000 {
+		t.Errorf("balance after withdrawal = %+v", b)
+	}
+
+	// Over the daily limit
+	_, err = svc.Withdraw(ctx, &payment.WithdrawInput{MerchantPubkey: merchantPubkey, LightningAddress: "me@wallet.example", AmountSats: 2500})
+	if !errors.Is(err, payment.ErrWithdrawalLimit) {
+		t.Errorf("err = %v, want ErrWithdrawalLimit", err)
+	}
+
+	// The shared wallet's balance belongs to other merchants
+	bolt11, _ = signInvoice(100, "", time.Hour)
+	_, err = svc.Withdraw(ctx, &payment.WithdrawInput{MerchantPubkey: landlordPubkey, Bolt11: bolt11})
+	if !errors.Is(err, payment.ErrInsufficientBalance) {
+		t.Errorf("withdrawing without earnings: err = %v, want ErrInsufficientBalance", err)
+	}
+
+	for _, input := range []payment.WithdrawInput{
+		{MerchantPubkey: merchantPubkey},
+		{MerchantPubkey: merchantPubkey, Bolt11: bolt11, LightningAddress: "me@wallet.example"},
+	} {
+		if _, err := svc.Withdraw(ctx, &input); !errors.Is(err, payment.ErrWithdrawalDestination) {
+			t.Errorf("err = %v, want ErrWithdrawalDestination", err)
+		}
+	}
+	if _, err := svc.Withdraw(ctx, &payment.WithdrawInput{MerchantPubkey: merchantPubkey, LightningAddress: "me@wallet.example"}); !errors.Is(err, payment.ErrWithdrawalAmount) {
+		t.Errorf("err = %v, want ErrWithdrawalAmount", err)
+	}
+	if len(mock.paid) != 1 {
+		t.Errorf("paid %d invoices, want 1", len(mock.paid))
+	}
+}
+
+func TestWithdraw_OwnWallet(t *testing.T) {
+	db, svc, farm := setupWallets(t, newPayMock())
+	svc.SetWithdrawalLimits(payment.WithdrawalLimits{ReserveSats: 1000})
+	ctx := context.Background()
+
+	db.CreateUser(ctx, &store.User{Pubkey: merchantPubkey, IsMerchant: true})
+	svc.ProvisionWallet(ctx, merchantPubkey)
+	own := farm.wallets["admin_1"]
+
+	b, err := svc.Balance(ctx, merchantPubkey)
+	if err != nil {
+		t.Fatalf("Balance: %v", err)
+	}
+	if b.WalletID != "wallet_1" || b.BalanceSats != 10_000 || b.AvailableSats != 9000 {
+		t.Errorf("balance = %+v, want the 10000 sats in the merchant's wallet", b)
+	}
+
+	// The amount, its fee limit and the reserve must fit
+	bolt11, _ := signInvoice(9000, "", time.Hour)
+	if _, err := svc.Withdraw(ctx, &payment.WithdrawInput{MerchantPubkey: merchantPubkey, Bolt11: bolt11}); !errors.Is(err, payment.ErrInsufficientBalance) {
+		t.Errorf("err = %v, want ErrInsufficientBalance", err)
+	}
+	bolt11, _ = signInvoice(8000, "", time.Hour)
+	if _, err := svc.Withdraw(ctx, &payment.WithdrawInput{MerchantPubkey: merchantPubkey, Bolt11: bolt11}); err != nil {
+		t.Fatalf("Withdraw: %v", err)
+	}
+	if len(own.paid) != 1 {
+		t.Errorf("paid %d invoices from the merchant's wallet, want 1", len(own.paid))
+	}
+}
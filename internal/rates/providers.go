@@ -0,0 +1,149 @@
+package rates
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StaticProvider serves fixed rates, e.g. from configuration.
+type StaticProvider struct {
+	prices map[string]float64
+}
+
+// NewStaticProvider returns a provider for the given BTC prices keyed by
+// currency code.
+func NewStaticProvider(prices map[string]float64) *StaticProvider {
+	p := &StaticProvider{prices: make(map[string]float64, len(prices))}
+	for c, price := range prices {
+		p.prices[strings.ToUpper(c)] = price
+	}
+	return p
+}
+
+// ParseStatic parses "EUR=60000,USD=65000" into a StaticProvider.
+func ParseStatic(s string) (*StaticProvider, error) {
+	prices := make(map[string]float64)
+	for _, entry := range strings.Split(s, ",") {
+		code, price, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("rate %q: expected CURRENCY=PRICE", entry)
+		}
+		c, err := NormalizeCurrency(code)
+		if err != nil {
+			return nil, err
+		}
+		v, err := strconv.ParseFloat(price, 64)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("rate %q: price must be a positive number", entry)
+		}
+		prices[c] = v
+	}
+	return NewStaticProvider(prices), nil
+}
+
+// Rate reports static rates as fetched now, so they never go stale.
+func (p *StaticProvider) Rate(ctx context.Context, currency string) (*Rate, error) {
+	price, ok := p.prices[currency]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownCurrency, currency)
+	}
+	return &Rate{Currency: currency, BTCPrice: price, Source: "static", FetchedAt: time.Now()}, nil
+}
+
+// FileProvider reads rates from a JSON file such as
+//
+//	{"EUR": 60000.5, "USD": 65000}
+//
+// written by an external job. The file's modification time is the rate's
+// fetch time, so a job that stops updating it makes rates go stale.
+type FileProvider struct {
+	path string
+}
+
+func NewFileProvider(path string) *FileProvider {
+	return &FileProvider{path: path}
+}
+
+func (p *FileProvider) Rate(ctx context.Context, currency string) (*Rate, error) {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("read rates file: %w", err)
+	}
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("read rates file: %w", err)
+	}
+	var prices map[string]float64
+	if err := json.Unmarshal(data, &prices); err != nil {
+		return nil, fmt.Errorf("parse rates file: %w", err)
+	}
+
+	price, ok := prices[currency]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownCurrency, currency)
+	}
+	return &Rate{Currency: currency, BTCPrice: price, Source: "file", FetchedAt: info.ModTime()}, nil
+}
+
+// CachedProvider keeps rates from another provider for ttl and refuses
+// rates older than maxAge. When a refresh fails, the cached rate is served
+// until it exceeds maxAge.
+type CachedProvider struct {
+	next   Provider
+	ttl    time.Duration
+	maxAge time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedRate
+}
+
+type cachedRate struct {
+	rate     *Rate
+	cachedAt time.Time
+}
+
+func NewCachedProvider(next Provider, ttl, maxAge time.Duration) *CachedProvider {
+	return &CachedProvider{
+		next:   next,
+		ttl:    ttl,
+		maxAge: maxAge,
+		cache:  make(map[string]cachedRate),
+	}
+}
+
+func (p *CachedProvider) Rate(ctx context.Context, currency string) (*Rate, error) {
+	p.mu.Lock()
+	cached, ok := p.cache[currency]
+	p.mu.Unlock()
+
+	now := time.Now()
+	if ok && now.Sub(cached.cachedAt) < p.ttl {
+		return p.checkAge(cached.rate, now)
+	}
+
+	rate, err := p.next.Rate(ctx, currency)
+	if err != nil {
+		if ok && now.Sub(cached.rate.FetchedAt) <= p.maxAge {
+			return cached.rate, nil
+		}
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.cache[currency] = cachedRate{rate: rate, cachedAt: now}
+	p.mu.Unlock()
+	return p.checkAge(rate, now)
+}
+
+func (p *CachedProvider) checkAge(rate *Rate, now time.Time) (*Rate, error) {
+	if age := now.Sub(rate.FetchedAt); age > p.maxAge {
+		return nil, fmt.Errorf("%w: %s rate from %s is %s old", ErrStaleRate, rate.Currency, rate.Source, age.Round(time.Second))
+	}
+	return rate, nil
+}
@@ -0,0 +1,95 @@
+package rates_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/rates"
+)
+
+func TestParseStatic(t *testing.T) {
+	p, err := rates.ParseStatic("EUR=60000, usd=65000.5")
+	if err != nil {
+		t.Fatalf("ParseStatic: %v", err)
+	}
+	rate, err := p.Rate(context.Background(), "USD")
+	if err != nil {
+		t.Fatalf("Rate: %v", err)
+	}
+	if rate.BTCPrice != 65000.5 || rate.Source != "static" {
+		t.Errorf("rate = %+v", rate)
+	}
+	if _, err := p.Rate(context.Background(), "GBP"); !errors.Is(err, rates.ErrUnknownCurrency) {
+		t.Errorf("err = %v, want ErrUnknownCurrency", err)
+	}
+
+	if _, err := rates.ParseStatic("EUR:60000"); err == nil {
+		t.Error("expected error for malformed entry")
+	}
+}
+
+func TestFileProvider_Stale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	if err := os.WriteFile(path, []byte(`{"EUR": 60000}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p := rates.NewCachedProvider(rates.NewFileProvider(path), time.Minute, 10*time.Minute)
+
+	rate, err := p.Rate(context.Background(), "EUR")
+	if err != nil {
+		t.Fatalf("Rate: %v", err)
+	}
+	if rate.BTCPrice != 60000 || rate.Source != "file" {
+		t.Errorf("rate = %+v", rate)
+	}
+
+	// A file the updater stopped touching is refused
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(path, old, old)
+	stale := rates.NewCachedProvider(rates.NewFileProvider(path), time.Minute, 10*time.Minute)
+	if _, err := stale.Rate(context.Background(), "EUR"); !errors.Is(err, rates.ErrStaleRate) {
+		t.Errorf("err = %v, want ErrStaleRate", err)
+	}
+}
+
+type countingProvider struct {
+	calls int
+	err   error
+}
+
+func (p *countingProvider) Rate(ctx context.Context, currency string) (*rates.Rate, error) {
+	p.calls++
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &rates.Rate{Currency: currency, BTCPrice: 60000, Source: "test", FetchedAt: time.Now()}, nil
+}
+
+func TestCachedProvider(t *testing.T) {
+	next := &countingProvider{}
+	p := rates.NewCachedProvider(next, time.Hour, 2*time.Hour)
+	ctx := context.Background()
+
+	p.Rate(ctx, "EUR")
+	p.Rate(ctx, "EUR")
+	if next.calls != 1 {
+		t.Errorf("provider called %d times, want 1", next.calls)
+	}
+
+	// Once the TTL passes, a failing refresh falls back to the cached rate
+	next.err = errors.New("upstream down")
+	expired := rates.NewCachedProvider(next, 0, time.Hour)
+	if _, err := expired.Rate(ctx, "EUR"); err == nil {
+		t.Fatal("expected error without a cached rate")
+	}
+	next.err = nil
+	expired.Rate(ctx, "EUR")
+	next.err = errors.New("upstream down")
+	if _, err := expired.Rate(ctx, "EUR"); err != nil {
+		t.Errorf("fallback to cached rate: %v", err)
+	}
+}
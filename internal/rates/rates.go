@@ -0,0 +1,85 @@
+// Package rates converts fiat amounts to satoshis using exchange rates from
+// a pluggable provider.
+package rates
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnknownCurrency = errors.New("unknown currency")
+	ErrStaleRate       = errors.New("exchange rate too old")
+	ErrInvalidAmount   = errors.New("invalid amount")
+)
+
+// Rate is the price of one bitcoin in a fiat currency.
+type Rate struct {
+	Currency  string // ISO 4217 code, upper case
+	BTCPrice  float64
+	Source    string
+	FetchedAt time.Time
+}
+
+// Provider returns the current rate for a currency. Implementations return
+// ErrUnknownCurrency for currencies they do not quote.
+type Provider interface {
+	Rate(ctx context.Context, currency string) (*Rate, error)
+}
+
+const satsPerBTC = 100_000_000
+
+// minorUnitDigits lists currencies whose minor unit is not a hundredth.
+var minorUnitDigits = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"CLP": 0,
+	"ISK": 0,
+	"BHD": 3,
+	"KWD": 3,
+}
+
+// MinorUnitDigits returns the number of decimal places of a currency's
+// minor unit, e.g. 2 for EUR cents.
+func MinorUnitDigits(currency string) int {
+	if d, ok := minorUnitDigits[currency]; ok {
+		return d
+	}
+	return 2
+}
+
+// NormalizeCurrency upper-cases a currency code and checks that it looks
+// like ISO 4217.
+func NormalizeCurrency(currency string) (string, error) {
+	c := strings.ToUpper(strings.TrimSpace(currency))
+	if len(c) != 3 {
+		return "", fmt.Errorf("%w %q", ErrUnknownCurrency, currency)
+	}
+	for _, r := range c {
+		if r < 'A' || r > 'Z' {
+			return "", fmt.Errorf("%w %q", ErrUnknownCurrency, currency)
+		}
+	}
+	return c, nil
+}
+
+// ToSats converts an amount in the rate's minor currency unit (e.g. cents)
+// to satoshis, rounding to the nearest sat.
+func ToSats(minorAmount int64, rate *Rate) (int64, error) {
+	if minorAmount <= 0 {
+		return 0, fmt.Errorf("%w: must be positive", ErrInvalidAmount)
+	}
+	if rate.BTCPrice <= 0 {
+		return 0, fmt.Errorf("%w: non-positive rate for %s", ErrInvalidAmount, rate.Currency)
+	}
+	fiat := float64(minorAmount) / math.Pow10(MinorUnitDigits(rate.Currency))
+	sats := math.Round(fiat / rate.BTCPrice * satsPerBTC)
+	if sats < 1 {
+		return 0, fmt.Errorf("%w: less than one sat", ErrInvalidAmount)
+	}
+	return int64(sats), nil
+}
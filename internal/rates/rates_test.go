@@ -0,0 +1,46 @@
+package rates_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nostr-pay/nostr-pay/internal/rates"
+)
+
+func TestToSats(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   int64
+		currency string
+		price    float64
+		want     int64
+	}{
+		{"one euro at 50k", 100, "EUR", 50_000, 2000},
+		{"rounds to nearest sat", 1, "EUR", 60_000, 17},
+		{"zero-decimal currency", 1000, "JPY", 10_000_000, 10_000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rates.ToSats(tt.amount, &rates.Rate{Currency: tt.currency, BTCPrice: tt.price})
+			if err != nil {
+				t.Fatalf("ToSats: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d sats, want %d", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := rates.ToSats(0, &rates.Rate{Currency: "EUR", BTCPrice: 50_000}); !errors.Is(err, rates.ErrInvalidAmount) {
+		t.Errorf("zero amount: err = %v, want ErrInvalidAmount", err)
+	}
+}
+
+func TestNormalizeCurrency(t *testing.T) {
+	if c, err := rates.NormalizeCurrency(" eur "); err != nil || c != "EUR" {
+		t.Errorf("NormalizeCurrency = %q, %v; want EUR", c, err)
+	}
+	if _, err := rates.NormalizeCurrency("EURO"); !errors.Is(err, rates.ErrUnknownCurrency) {
+		t.Errorf("err = %v, want ErrUnknownCurrency", err)
+	}
+}
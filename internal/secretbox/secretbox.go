@@ -0,0 +1,75 @@
+// Package secretbox encrypts secrets, such as LNbits wallet keys, before
+// they are stored.
+package secretbox
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// KeySize is the length of keys in bytes; keys are AES-256 keys.
+const KeySize = 32
+
+// ErrDecrypt is returned for ciphertexts that were not sealed with the
+// box's key and label, or were modified since.
+var ErrDecrypt = errors.New("secretbox: decryption failed")
+
+// Box seals and opens secrets with AES-GCM.
+type Box struct {
+	aead cipher.AEAD
+}
+
+func New(key []byte) (*Box, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("secretbox: key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("secretbox: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("secretbox: %w", err)
+	}
+	return &Box{aead: aead}, nil
+}
+
+// ParseKey decodes a key given as 64 hex characters.
+func ParseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil || len(key) != KeySize {
+		return nil, fmt.Errorf("secretbox: key must be %d hex characters", KeySize*2)
+	}
+	return key, nil
+}
+
+// Seal encrypts plaintext and returns it base64-encoded with its nonce.
+// label binds the ciphertext to where it is stored, e.g. the column and
+// row, so that it cannot be opened under another label.
+func (b *Box) Seal(plaintext, label string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("secretbox: generate nonce: %w", err)
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(plaintext), []byte(label))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a ciphertext returned by Seal with the same label.
+func (b *Box) Open(ciphertext, label string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil || len(sealed) < b.aead.NonceSize() {
+		return "", ErrDecrypt
+	}
+	nonce, sealed := sealed[:b.aead.NonceSize()], sealed[b.aead.NonceSize():]
+	plaintext, err := b.aead.Open(nil, nonce, sealed, []byte(label))
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(plaintext), nil
+}
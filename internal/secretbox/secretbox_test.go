@@ -0,0 +1,58 @@
+package secretbox_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nostr-pay/nostr-pay/internal/secretbox"
+)
+
+func TestSealAndOpen(t *testing.T) {
+	box, err := secretbox.New(bytes.Repeat([]byte{1}, secretbox.KeySize))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	sealed, err := box.Seal("admin-key", "admin:merchant")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if strings.Contains(sealed, "admin-key") {
+		t.Errorf("sealed = %q contains the plaintext", sealed)
+	}
+	if again, _ := box.Seal("admin-key", "admin:merchant"); again == sealed {
+		t.Error("sealing twice gave the same ciphertext")
+	}
+	got, err := box.Open(sealed, "admin:merchant")
+	if err != nil || got != "admin-key" {
+		t.Fatalf("Open = %q, %v", got, err)
+	}
+
+	other, _ := secretbox.New(bytes.Repeat([]byte{2}, secretbox.KeySize))
+	tampered := []byte(sealed)
+	tampered[len(tampered)-3] ^= 1
+	for name, open := range map[string]func() (string, error){
+		"other label": func() (string, error) { return box.Open(sealed, "admin:other") },
+		"other key":   func() (string, error) { return other.Open(sealed, "admin:merchant") },
+		"tampered":    func() (string, error) { return box.Open(string(tampered), "admin:merchant") },
+		"not base64":  func() (string, error) { return box.Open("!!", "admin:merchant") },
+		"too short":   func() (string, error) { return box.Open("AAAA", "admin:merchant") },
+	} {
+		if _, err := open(); !errors.Is(err, secretbox.ErrDecrypt) {
+			t.Errorf("%s: err = %v, want ErrDecrypt", name, err)
+		}
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	if _, err := secretbox.ParseKey(strings.Repeat("ab", secretbox.KeySize)); err != nil {
+		t.Errorf("ParseKey: %v", err)
+	}
+	for _, s := range []string{"", "abcd", strings.Repeat("zz", secretbox.KeySize)} {
+		if _, err := secretbox.ParseKey(s); err == nil {
+			t.Errorf("ParseKey(%q) succeeded", s)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
 	_ "github.com/ncruces/go-sqlite3/driver"
@@ -58,22 +59,204 @@ func (s *sqliteStore) migrate() error {
 		settled_at TIMESTAMP
 	);
 
-	CREATE TABLE IF NOT EXISTS merchant_daily_stats (
-		pubkey TEXT,
-		date TEXT,
-		total_sats INTEGER DEFAULT 0,
-		transaction_count INTEGER DEFAULT 0,
-		PRIMARY KEY (pubkey, date)
+	CREATE TABLE IF NOT EXISTS auth_events (
+		event_id TEXT PRIMARY KEY,
+		expires_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS auth_challenges (
+		challenge TEXT PRIMARY KEY,
+		expires_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		pubkey TEXT NOT NULL,
+		key TEXT NOT NULL,
+		request_hash TEXT NOT NULL,
+		status_code INTEGER NOT NULL DEFAULT 0,
+		response BLOB,
+		expires_at INTEGER NOT NULL,
+		PRIMARY KEY (pubkey, key)
+	);
+
+	CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		pubkey TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id TEXT PRIMARY KEY,
+		owner_pubkey TEXT NOT NULL,
+		label TEXT DEFAULT '',
+		scopes TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP,
+		revoked_at TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS staff_grants (
+		merchant_pubkey TEXT NOT NULL,
+		staff_pubkey TEXT NOT NULL,
+		permissions TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (merchant_pubkey, staff_pubkey)
+	);
+
+	CREATE TABLE IF NOT EXISTS denied_pubkeys (
+		pubkey TEXT PRIMARY KEY,
+		reason TEXT DEFAULT '',
+		denied_by TEXT DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS split_rules (
+		id TEXT PRIMARY KEY,
+		merchant_pubkey TEXT NOT NULL,
+		destination TEXT NOT NULL,
+		percent REAL DEFAULT 0,
+		amount_sats INTEGER DEFAULT 0,
+		label TEXT DEFAULT '',
+		created_at TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS split_payouts (
+		id TEXT PRIMARY KEY,
+		payment_id TEXT NOT NULL,
+		rule_id TEXT NOT NULL,
+		merchant_pubkey TEXT NOT NULL,
+		destination TEXT NOT NULL,
+		amount_sats INTEGER NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT DEFAULT '',
+		next_attempt_at TIMESTAMP NOT NULL,
+		payout_payment_id TEXT DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		UNIQUE (payment_id, rule_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS webhook_endpoints (
+		id TEXT PRIMARY KEY,
+		merchant_pubkey TEXT NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT DEFAULT '',
+		created_at TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id TEXT PRIMARY KEY,
+		endpoint_id TEXT NOT NULL,
+		merchant_pubkey TEXT NOT NULL,
+		event_id TEXT NOT NULL,
+		event_type TEXT NOT NULL,
+		payment_id TEXT DEFAULT '',
+		payload BLOB NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT DEFAULT '',
+		response_status INTEGER DEFAULT 0,
+		next_attempt_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS lightning_addresses (
+		name TEXT PRIMARY KEY,
+		merchant_pubkey TEXT NOT NULL,
+		description TEXT DEFAULT '',
+		created_at TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS payment_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		payment_id TEXT NOT NULL,
+		from_status TEXT NOT NULL,
+		to_status TEXT NOT NULL,
+		cause TEXT NOT NULL,
+		actor TEXT DEFAULT '',
+		created_at TIMESTAMP NOT NULL
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_payments_receiver ON payments(receiver_pubkey);
 	CREATE INDEX IF NOT EXISTS idx_payments_sender ON payments(sender_pubkey);
 	CREATE INDEX IF NOT EXISTS idx_payments_hash ON payments(payment_hash);
+	CREATE INDEX IF NOT EXISTS idx_auth_events_expires ON auth_events(expires_at);
+	CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires ON idempotency_keys(expires_at);
+	CREATE INDEX IF NOT EXISTS idx_sessions_pubkey ON sessions(pubkey);
+	CREATE INDEX IF NOT EXISTS idx_api_keys_owner ON api_keys(owner_pubkey);
+	CREATE INDEX IF NOT EXISTS idx_staff_grants_staff ON staff_grants(staff_pubkey);
+	CREATE INDEX IF NOT EXISTS idx_payment_events_payment ON payment_events(payment_id);
+	CREATE INDEX IF NOT EXISTS idx_split_rules_merchant ON split_rules(merchant_pubkey);
+	CREATE INDEX IF NOT EXISTS idx_split_payouts_due ON split_payouts(status, next_attempt_at);
+	CREATE INDEX IF NOT EXISTS idx_webhook_endpoints_merchant ON webhook_endpoints(merchant_pubkey);
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_merchant ON webhook_deliveries(merchant_pubkey, created_at);
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
+	CREATE INDEX IF NOT EXISTS idx_lightning_addresses_merchant ON lightning_addresses(merchant_pubkey);
 	`
-	_, err := s.db.Exec(schema)
+	if _, err := s.db.Exec(schema); err != nil {
+		return err
+	}
+	if err := s.migrateColumns(); err != nil {
+		return err
+	}
+
+	// Indexes on migrated columns
+	_, err := s.db.Exec(`CREATE INDEX IF NOT EXISTS idx_payments_refund_of ON payments(refund_of)`)
 	return err
 }
 
+// columnMigrations lists columns added to existing tables after their first
+// release. They are applied in order and skipped when already present.
+var columnMigrations = []struct {
+	table, column, definition string
+}{
+	{"payments", "created_by_pubkey", "TEXT DEFAULT ''"},
+	{"payments", "expires_at", "TIMESTAMP"},
+	{"payments", "fiat_amount", "INTEGER DEFAULT 0"},
+	{"payments", "fiat_currency", "TEXT DEFAULT ''"},
+	{"payments", "exchange_rate", "REAL DEFAULT 0"},
+	{"payments", "rate_source", "TEXT DEFAULT ''"},
+	{"payments", "direction", "TEXT DEFAULT 'received'"},
+	{"payments", "preimage", "TEXT DEFAULT ''"},
+	{"payments", "fee_sats", "INTEGER DEFAULT 0"},
+	{"payments", "refund_of", "TEXT DEFAULT ''"},
+	{"payments", "subtotal_sats", "INTEGER DEFAULT 0"},
+	{"payments", "tip_sats", "INTEGER DEFAULT 0"},
+	{"payments", "webhook_token", "TEXT DEFAULT ''"},
+	{"users", "lnbits_user_id", "TEXT DEFAULT ''"},
+	{"users", "lnbits_admin_key", "TEXT DEFAULT ''"},
+	{"users", "lnbits_invoice_key", "TEXT DEFAULT ''"},
+	{"payments", "wallet_id", "TEXT DEFAULT ''"},
+	{"payments", "withdrawal", "BOOLEAN DEFAULT FALSE"},
+}
+
+func (s *sqliteStore) migrateColumns() error {
+	for _, m := range columnMigrations {
+		var count int
+		err := s.db.QueryRow(
+			"SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?",
+			m.table, m.column,
+		).Scan(&count)
+		if err != nil {
+			return fmt.Errorf("inspect %s.%s: %w", m.table, m.column, err)
+		}
+		if count > 0 {
+			continue
+		}
+		if _, err := s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition)); err != nil {
+			return fmt.Errorf("add %s.%s: %w", m.table, m.column, err)
+		}
+	}
+	return nil
+}
+
 func (s *sqliteStore) Close() error {
 	return s.db.Close()
 }
@@ -91,9 +274,12 @@ func (s *sqliteStore) CreateUser(ctx context.Context, user *User) error {
 func (s *sqliteStore) GetUser(ctx context.Context, pubkey string) (*User, error) {
 	u := &User{}
 	err := s.db.QueryRowContext(ctx,
-		"SELECT pubkey, is_merchant, lnbits_wallet_id, created_at FROM users WHERE pubkey = ?",
+		`SELECT pubkey, is_merchant, lnbits_wallet_id, lnbits_user_id, lnbits_admin_key,
+		        lnbits_invoice_key, created_at
+		 FROM users WHERE pubkey = ?`,
 		pubkey,
-	).Scan(&u.Pubkey, &u.IsMerchant, &u.LNbitsWalletID, &u.CreatedAt)
+	).Scan(&u.Pubkey, &u.IsMerchant, &u.LNbitsWalletID, &u.LNbitsUserID, &u.LNbitsAdminKey,
+		&u.LNbitsInvoiceKey, &u.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -108,120 +294,1329 @@ func (s *sqliteStore) UpdateUserMerchant(ctx context.Context, pubkey string, isM
 	return err
 }
 
+// SetUserWallet stores the LNbits wallet of user.Pubkey unless the user
+// already has one or still has a share of the shared wallet: a ledger
+// balance, or payments in flight in it. It reports whether the wallet was
+// stored.
+func (s *sqliteStore) SetUserWallet(ctx context.Context, user *User) (bool, error) {
+	pk := user.Pubkey
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE users SET lnbits_wallet_id = ?, lnbits_user_id = ?, lnbits_admin_key = ?, lnbits_invoice_key = ?
+		 WHERE pubkey = ? AND lnbits_wallet_id = ''
+		   AND NOT EXISTS (SELECT 1 FROM payments
+		                   WHERE (receiver_pubkey = ? OR sender_pubkey = ?) AND wallet_id = ''
+		                     AND status = 'pending')
+		   AND (`+ledgerBalanceQuery+`) = 0`,
+		user.LNbitsWalletID, user.LNbitsUserID, user.LNbitsAdminKey, user.LNbitsInvoiceKey, pk,
+		pk, pk, pk, pk, pk, pk,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
 // Payments
 
-func (s *sqliteStore) CreatePayment(ctx context.Context, payment *Payment) error {
-	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO payments (id, bolt11, amount_sats, memo, sender_pubkey, receiver_pubkey, payment_hash, status)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+// paymentColumns ends with the refunded total, which is computed from the
+// payment's refunds rather than stored.
+const paymentColumns = `id, bolt11, amount_sats, memo, sender_pubkey, receiver_pubkey,
+		payment_hash, status, created_at, settled_at, created_by_pubkey, expires_at,
+		fiat_amount, fiat_currency, exchange_rate, rate_source, direction, preimage, fee_sats,
+		refund_of, subtotal_sats, tip_sats, webhook_token, wallet_id, withdrawal, (` + refundedSatsQuery + `)`
+
+// refundedSatsQuery sums the refunds of the payments row that are paid or
+// still in flight.
+const refundedSatsQuery = `SELECT COALESCE(SUM(r.amount_sats), 0) FROM payments r
+		 WHERE r.refund_of = payments.id AND r.status IN ('pending', 'paid')`
+
+func scanPayment(row rowScanner) (*Payment, error) {
+	p := &Payment{}
+	err := row.Scan(&p.ID, &p.Bolt11, &p.AmountSats, &p.Memo, &p.SenderPubkey,
+		&p.ReceiverPubkey, &p.PaymentHash, &p.Status, &p.CreatedAt, &p.SettledAt,
+		&p.CreatedByPubkey, &p.ExpiresAt,
+		&p.FiatAmount, &p.FiatCurrency, &p.ExchangeRate, &p.RateSource,
+		&p.Direction, &p.Preimage, &p.FeeSats, &p.RefundOf, &p.SubtotalSats, &p.TipSats,
+		&p.WebhookToken, &p.WalletID, &p.Withdrawal, &p.RefundedSats)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *sqliteStore) queryPayments(ctx context.Context, query string, args ...any) ([]*Payment, error) {
+	return queryPayments(ctx, s.db, query, args...)
+}
+
+// querier is implemented by *sql.DB and *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func queryPayments(ctx context.Context, q querier, query string, args ...any) ([]*Payment, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []*Payment
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
+
+const insertPayment = `INSERT INTO payments (id, bolt11, amount_sats, memo, sender_pubkey, receiver_pubkey,
+		                       payment_hash, status, created_by_pubkey, expires_at,
+		                       fiat_amount, fiat_currency, exchange_rate, rate_source, direction, refund_of,
+		                       subtotal_sats, tip_sats, settled_at, webhook_token, wallet_id, withdrawal)`
+
+func paymentValues(payment *Payment) []any {
+	direction := payment.Direction
+	if direction == "" {
+		direction = "received"
+	}
+	return []any{
 		payment.ID, payment.Bolt11, payment.AmountSats, payment.Memo,
 		payment.SenderPubkey, payment.ReceiverPubkey, payment.PaymentHash, payment.Status,
+		payment.CreatedByPubkey, payment.ExpiresAt,
+		payment.FiatAmount, payment.FiatCurrency, payment.ExchangeRate, payment.RateSource,
+		direction, payment.RefundOf,
+		payment.SubtotalSats, payment.TipSats, payment.SettledAt, payment.WebhookToken,
+		payment.WalletID, payment.Withdrawal,
+	}
+}
+
+// CreatePayment stores a payment. e, when set, is appended to its event log
+// as the event that records its creation, in the same transaction; its
+// payment ID and status are taken from payment.
+func (s *sqliteStore) CreatePayment(ctx context.Context, payment *Payment, e *PaymentEvent) error {
+	_, err := s.insertPayment(ctx, payment, e,
+		insertPayment+` VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		paymentValues(payment)...,
 	)
 	return err
 }
 
-func (s *sqliteStore) GetPayment(ctx context.Context, id string) (*Payment, error) {
-	p := &Payment{}
-	err := s.db.QueryRowContext(ctx,
-		`SELECT id, bolt11, amount_sats, memo, sender_pubkey, receiver_pubkey,
-		        payment_hash, status, created_at, settled_at
-		 FROM payments WHERE id = ?`,
-		id,
-	).Scan(&p.ID, &p.Bolt11, &p.AmountSats, &p.Memo, &p.SenderPubkey,
-		&p.ReceiverPubkey, &p.PaymentHash, &p.Status, &p.CreatedAt, &p.SettledAt)
+// CreateRefund stores a refund of payment.RefundOf unless the refunds that
+// are paid or in flight would then exceed maxSats, or the refund breaks
+// limit. It reports whether the refund was stored; the checks and insert
+// are a single statement so that concurrent refunds cannot overshoot. e is
+// recorded as for CreatePayment.
+func (s *sqliteStore) CreateRefund(ctx context.Context, payment *Payment, maxSats int64, limit SpendLimit, e *PaymentEvent) (bool, error) {
+	args := append(paymentValues(payment), payment.RefundOf, payment.AmountSats, maxSats)
+	args = append(args, spendLimitArgs(payment, limit)...)
+	return s.insertPaymentIf(ctx, payment, e,
+		`(SELECT COALESCE(SUM(amount_sats), 0) FROM payments
+		  WHERE refund_of = ? AND status IN ('pending', 'paid')) + ? <= ?
+		 AND `+spendLimitCondition,
+		args...,
+	)
+}
+
+// ledgerBalanceQuery is a user's share of the shared wallet: the payments
+// received in it, less those sent from it with their fees and the credits
+// transferred to other users. Payments and transfers in flight count as
+// spent. It takes the pubkey four times.
+const ledgerBalanceQuery = `SELECT
+		(SELECT COALESCE(SUM(amount_sats), 0) FROM payments
+		 WHERE receiver_pubkey = ? AND direction = 'received' AND wallet_id = ''
+		   AND status IN ('paid', 'refunded'))
+		- (SELECT COALESCE(SUM(amount_sats + fee_sats), 0) FROM payments
+		   WHERE sender_pubkey = ? AND direction = 'sent' AND wallet_id = ''
+		     AND status IN ('pending', 'paid'))
+		- (SELECT COALESCE(SUM(amount_sats), 0) FROM payments
+		   WHERE sender_pubkey = ? AND receiver_pubkey != ? AND direction = 'received'
+		     AND status IN ('pending', 'paid', 'refunded'))`
+
+// withdrawnSinceQuery sums a user's paid and in-flight withdrawals created
+// since a time. It takes the pubkey and the time.
+const withdrawnSinceQuery = `SELECT COALESCE(SUM(amount_sats), 0) FROM payments
+		 WHERE sender_pubkey = ? AND withdrawal AND status IN ('pending', 'paid')
+		   AND julianday(created_at) >= julianday(?)`
+
+// spendLimitCondition checks a SpendLimit against the rows already
+// stored. It takes the arguments from spendLimitArgs.
+const spendLimitCondition = `(? = 0 OR (` + withdrawnSinceQuery + `) + ? <= ?)
+		 AND (? <= 0 OR (` + ledgerBalanceQuery + `) >= ?)`
+
+func spendLimitArgs(payment *Payment, limit SpendLimit) []any {
+	pk := payment.SenderPubkey
+	daily := limit.DailySats
+	if !payment.Withdrawal {
+		daily = 0
+	}
+	return []any{
+		daily, pk, limit.Since, payment.AmountSats, daily,
+		limit.MinLedgerSats, pk, pk, pk, pk, limit.MinLedgerSats,
+	}
+}
+
+// CreateSpend stores a payment out of the sender's balance, such as a sent
+// payment or a credit to another user, unless it breaks limit. The daily
+// limit applies to withdrawals only. It reports whether the payment was
+// stored; like CreateRefund, the checks and insert are a single statement
+// so concurrent payments cannot overshoot. e is recorded as for
+// CreatePayment.
+func (s *sqliteStore) CreateSpend(ctx context.Context, payment *Payment, limit SpendLimit, e *PaymentEvent) (bool, error) {
+	args := append(paymentValues(payment), spendLimitArgs(payment, limit)...)
+	return s.insertPaymentIf(ctx, payment, e, spendLimitCondition, args...)
+}
+
+// insertPaymentIf stores a payment if condition holds. args are the
+// payment's values followed by the condition's.
+func (s *sqliteStore) insertPaymentIf(ctx context.Context, payment *Payment, e *PaymentEvent, condition string, args ...any) (bool, error) {
+	return s.insertPayment(ctx, payment, e,
+		insertPayment+`
+		 SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+		 WHERE `+condition,
+		args...,
+	)
+}
+
+// insertPayment runs query, which inserts payment, and records e as its
+// creation event in the same transaction. It reports whether a row was
+// inserted.
+func (s *sqliteStore) insertPayment(ctx context.Context, payment *Payment, e *PaymentEvent, query string, args ...any) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	return p, nil
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	if e != nil {
+		e.PaymentID = payment.ID
+		e.FromStatus = ""
+		e.ToStatus = payment.Status
+		if err := insertPaymentEvent(ctx, tx, e); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// GetLedgerBalance returns the user's share of the shared wallet.
+func (s *sqliteStore) GetLedgerBalance(ctx context.Context, pubkey string) (int64, error) {
+	var balance int64
+	err := s.db.QueryRowContext(ctx, ledgerBalanceQuery, pubkey, pubkey, pubkey, pubkey).Scan(&balance)
+	return balance, err
+}
+
+// SumWithdrawals returns the total of the user's paid and in-flight
+// withdrawals created since since.
+func (s *sqliteStore) SumWithdrawals(ctx context.Context, pubkey string, since time.Time) (int64, error) {
+	var total int64
+	err := s.db.QueryRowContext(ctx, withdrawnSinceQuery, pubkey, since).Scan(&total)
+	return total, err
+}
+
+func (s *sqliteStore) GetPayment(ctx context.Context, id string) (*Payment, error) {
+	return scanPayment(s.db.QueryRowContext(ctx,
+		"SELECT "+paymentColumns+" FROM payments WHERE id = ?",
+		id,
+	))
 }
 
 func (s *sqliteStore) GetPaymentByHash(ctx context.Context, paymentHash string) (*Payment, error) {
-	p := &Payment{}
-	err := s.db.QueryRowContext(ctx,
-		`SELECT id, bolt11, amount_sats, memo, sender_pubkey, receiver_pubkey,
-		        payment_hash, status, created_at, settled_at
-		 FROM payments WHERE payment_hash = ?`,
+	return scanPayment(s.db.QueryRowContext(ctx,
+		"SELECT "+paymentColumns+" FROM payments WHERE payment_hash = ?",
 		paymentHash,
-	).Scan(&p.ID, &p.Bolt11, &p.AmountSats, &p.Memo, &p.SenderPubkey,
-		&p.ReceiverPubkey, &p.PaymentHash, &p.Status, &p.CreatedAt, &p.SettledAt)
+	))
+}
+
+// ListPaymentsByUser returns payments the pubkey received, sent or created
+// as staff on behalf of a merchant.
+func (s *sqliteStore) ListPaymentsByUser(ctx context.Context, pubkey string, limit, offset int) ([]*Payment, error) {
+	return s.queryPayments(ctx,
+		`SELECT `+paymentColumns+`
+		 FROM payments
+		 WHERE receiver_pubkey = ? OR sender_pubkey = ? OR created_by_pubkey = ?
+		 ORDER BY created_at DESC
+		 LIMIT ? OFFSET ?`,
+		pubkey, pubkey, pubkey, limit, offset,
+	)
+}
+
+// ExpirePendingPayments marks pending payments whose expiry is at or before
+// now as expired, records the transitions and returns the payments.
+// Payments settled concurrently keep their status.
+func (s *sqliteStore) ExpirePendingPayments(ctx context.Context, now time.Time) ([]*Payment, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
-	return p, nil
+	defer tx.Rollback()
+
+	const overdue = `status = 'pending'
+		   AND expires_at IS NOT NULL
+		   AND julianday(expires_at) <= julianday(?)`
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO payment_events (payment_id, from_status, to_status, cause, actor, created_at)
+		 SELECT id, 'pending', 'expired', 'expiry', 'system', ? FROM payments WHERE `+overdue,
+		now, now,
+	); err != nil {
+		return nil, err
+	}
+	expired, err := queryPayments(ctx, tx,
+		`UPDATE payments SET status = 'expired' WHERE `+overdue+` RETURNING `+paymentColumns,
+		now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return expired, tx.Commit()
 }
 
-func (s *sqliteStore) UpdatePaymentStatus(ctx context.Context, id string, status string, settledAt *time.Time) error {
-	_, err := s.db.ExecContext(ctx,
-		"UPDATE payments SET status = ?, settled_at = ? WHERE id = ?",
-		status, settledAt, id,
+// ListUnsettledPayments returns incoming pending payments that have not expired by
+// now and pending sent payments, oldest first. With includeExpired, expired
+// payments are included too since they may still have been paid. after,
+// when set, is the last payment of the previous page; only payments after
+// it are returned.
+func (s *sqliteStore) ListUnsettledPayments(ctx context.Context, now time.Time, includeExpired bool, after *Payment, limit int) ([]*Payment, error) {
+	var afterCreated time.Time
+	var afterID string
+	if after != nil {
+		afterCreated, afterID = after.CreatedAt, after.ID
+	}
+	return s.queryPayments(ctx,
+		`SELECT `+paymentColumns+`
+		 FROM payments
+		 WHERE ((direction = 'received'
+		         AND ((status = 'pending'
+		               AND (expires_at IS NULL OR julianday(expires_at) > julianday(?)))
+		              OR (? AND status = 'expired')))
+		        OR (direction = 'sent' AND status = 'pending'))
+		   AND (? = 0 OR julianday(created_at) > julianday(?)
+		        OR (julianday(created_at) = julianday(?) AND id > ?))
+		 ORDER BY julianday(created_at), id
+		 LIMIT ?`,
+		now, includeExpired, after != nil, afterCreated, afterCreated, afterID, limit,
+	)
+}
+
+// TransitionPaymentStatus moves a payment from e.FromStatus to e.ToStatus
+// and appends e to its event log, in one transaction. settledAt, when
+// set, is recorded too. It reports false, changing nothing, if the payment
+// is not in e.FromStatus, so that callers racing on the same payment
+// change it once.
+func (s *sqliteStore) TransitionPaymentStatus(ctx context.Context, e *PaymentEvent, settledAt *time.Time) (bool, error) {
+	return s.transition(ctx, e, `settled_at = COALESCE(?, settled_at)`, settledAt)
+}
+
+// CompleteOutgoingPayment records the outcome of a sent payment like
+// TransitionPaymentStatus, along with its preimage and fee.
+func (s *sqliteStore) CompleteOutgoingPayment(ctx context.Context, e *PaymentEvent, preimage string, feeSats int64, settledAt *time.Time) (bool, error) {
+	return s.transition(ctx, e, `preimage = ?, fee_sats = ?, settled_at = ?`, preimage, feeSats, settledAt)
+}
+
+func (s *sqliteStore) transition(ctx context.Context, e *PaymentEvent, set string, args ...any) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	args = append([]any{e.ToStatus}, args...)
+	args = append(args, e.PaymentID, e.FromStatus)
+	res, err := tx.ExecContext(ctx,
+		`UPDATE payments SET status = ?, `+set+` WHERE id = ? AND status = ?`,
+		args...,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	if err := insertPaymentEvent(ctx, tx, e); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func insertPaymentEvent(ctx context.Context, x execer, e *PaymentEvent) error {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	res, err := x.ExecContext(ctx,
+		`INSERT INTO payment_events (payment_id, from_status, to_status, cause, actor, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		e.PaymentID, e.FromStatus, e.ToStatus, e.Cause, e.Actor, e.CreatedAt,
 	)
+	if err != nil {
+		return err
+	}
+	e.ID, err = res.LastInsertId()
 	return err
 }
 
-func (s *sqliteStore) ListPaymentsByUser(ctx context.Context, pubkey string, limit, offset int) ([]*Payment, error) {
+// ListPaymentEvents returns a payment's event log, oldest first.
+func (s *sqliteStore) ListPaymentEvents(ctx context.Context, paymentID string) ([]*PaymentEvent, error) {
 	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, bolt11, amount_sats, memo, sender_pubkey, receiver_pubkey,
-		        payment_hash, status, created_at, settled_at
-		 FROM payments
-		 WHERE receiver_pubkey = ? OR sender_pubkey = ?
-		 ORDER BY created_at DESC
-		 LIMIT ? OFFSET ?`,
-		pubkey, pubkey, limit, offset,
+		`SELECT id, payment_id, from_status, to_status, cause, actor, created_at
+		 FROM payment_events WHERE payment_id = ? ORDER BY id`,
+		paymentID,
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var payments []*Payment
+	var events []*PaymentEvent
 	for rows.Next() {
-		p := &Payment{}
-		if err := rows.Scan(&p.ID, &p.Bolt11, &p.AmountSats, &p.Memo, &p.SenderPubkey,
-			&p.ReceiverPubkey, &p.PaymentHash, &p.Status, &p.CreatedAt, &p.SettledAt); err != nil {
+		e := &PaymentEvent{}
+		if err := rows.Scan(&e.ID, &e.PaymentID, &e.FromStatus, &e.ToStatus, &e.Cause, &e.Actor, &e.CreatedAt); err != nil {
 			return nil, err
 		}
-		payments = append(payments, p)
+		events = append(events, e)
 	}
-	return payments, rows.Err()
+	return events, rows.Err()
 }
 
 // Merchant
 
+// GetMerchantDailyStats aggregates the merchant's settled payments and
+// refunds for a UTC date in YYYY-MM-DD form. Refunds count on the day they
+// were paid out and are netted out of TotalSats.
 func (s *sqliteStore) GetMerchantDailyStats(ctx context.Context, pubkey string, date string) (*MerchantDailyStats, error) {
-	stats := &MerchantDailyStats{}
+	stats := &MerchantDailyStats{Pubkey: pubkey, Date: date}
 	err := s.db.QueryRowContext(ctx,
-		"SELECT pubkey, date, total_sats, transaction_count FROM merchant_daily_stats WHERE pubkey = ? AND date = ?",
-		pubkey, date,
-	).Scan(&stats.Pubkey, &stats.Date, &stats.TotalSats, &stats.TransactionCount)
+		`SELECT COALESCE(SUM(CASE WHEN refund_of = '' THEN amount_sats END), 0),
+		        COUNT(CASE WHEN refund_of = '' THEN 1 END),
+		        COALESCE(SUM(CASE WHEN refund_of != '' THEN amount_sats END), 0),
+		        COUNT(CASE WHEN refund_of != '' THEN 1 END),
+		        COALESCE(SUM(CASE WHEN refund_of = '' THEN tip_sats END), 0)
+		 FROM payments
+		 WHERE status IN ('paid', 'refunded') AND date(settled_at) = ?
+		   AND (receiver_pubkey = ? OR (sender_pubkey = ? AND refund_of != ''))`,
+		date, pubkey, pubkey,
+	).Scan(&stats.GrossSats, &stats.TransactionCount, &stats.RefundedSats, &stats.RefundCount, &stats.TipSats)
 	if err != nil {
 		return nil, err
 	}
+	stats.TotalSats = stats.GrossSats - stats.RefundedSats
 	return stats, nil
 }
 
+// ListMerchantTransactions returns the merchant's settled payments and the
+// refunds it paid out, newest first.
 func (s *sqliteStore) ListMerchantTransactions(ctx context.Context, pubkey string, limit, offset int) ([]*Payment, error) {
-	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, bolt11, amount_sats, memo, sender_pubkey, receiver_pubkey,
-		        payment_hash, status, created_at, settled_at
+	return s.queryPayments(ctx,
+		`SELECT `+paymentColumns+`
 		 FROM payments
-		 WHERE receiver_pubkey = ? AND status = 'paid'
+		 WHERE (receiver_pubkey = ? OR (sender_pubkey = ? AND refund_of != ''))
+		   AND status IN ('paid', 'refunded')
 		 ORDER BY created_at DESC
 		 LIMIT ? OFFSET ?`,
-		pubkey, limit, offset,
+		pubkey, pubkey, limit, offset,
+	)
+}
+
+// ListMerchantSalesSince returns the merchant's settled incoming payments
+// with settled_at at or after since, newest first. Unlike
+// ListMerchantTransactions it leaves out the refunds the merchant paid.
+func (s *sqliteStore) ListMerchantSalesSince(ctx context.Context, pubkey string, since time.Time, limit int) ([]*Payment, error) {
+	return s.queryPayments(ctx,
+		`SELECT `+paymentColumns+`
+		 FROM payments
+		 WHERE receiver_pubkey = ? AND direction = 'received'
+		   AND status IN ('paid', 'refunded')
+		   AND julianday(settled_at) >= julianday(?)
+		 ORDER BY settled_at DESC
+		 LIMIT ?`,
+		pubkey, since, limit,
+	)
+}
+
+// ListTipSummaries groups the merchant's settled payments by UTC day and by
+// who took them, for days from through to (YYYY-MM-DD, inclusive).
+// Payments without a staff member are attributed to the merchant.
+func (s *sqliteStore) ListTipSummaries(ctx context.Context, pubkey string, from, to string) ([]*TipSummary, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT date(settled_at) AS day,
+		        CASE WHEN created_by_pubkey = '' THEN receiver_pubkey ELSE created_by_pubkey END AS staff,
+		        COUNT(*), SUM(amount_sats - tip_sats), SUM(tip_sats)
+		 FROM payments
+		 WHERE receiver_pubkey = ? AND direction = 'received' AND status IN ('paid', 'refunded')
+		   AND date(settled_at) BETWEEN ? AND ?
+		 GROUP BY day, staff
+		 ORDER BY day, staff`,
+		pubkey, from, to,
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var payments []*Payment
+	var summaries []*TipSummary
 	for rows.Next() {
-		p := &Payment{}
-		if err := rows.Scan(&p.ID, &p.Bolt11, &p.AmountSats, &p.Memo, &p.SenderPubkey,
-			&p.ReceiverPubkey, &p.PaymentHash, &p.Status, &p.CreatedAt, &p.SettledAt); err != nil {
+		t := &TipSummary{}
+		if err := rows.Scan(&t.Date, &t.StaffPubkey, &t.PaymentCount, &t.SubtotalSats, &t.TipSats); err != nil {
 			return nil, err
 		}
-		payments = append(payments, p)
+		summaries = append(summaries, t)
 	}
-	return payments, rows.Err()
+	return summaries, rows.Err()
+}
+
+// Idempotency
+
+// ReserveIdempotencyKey claims rec's key for its pubkey. If the key is
+// already taken, the existing record is returned with false. Expired keys
+// are purged on the way in.
+func (s *sqliteStore) ReserveIdempotencyKey(ctx context.Context, rec *IdempotencyRecord) (*IdempotencyRecord, bool, error) {
+	if _, err := s.db.ExecContext(ctx,
+		"DELETE FROM idempotency_keys WHERE expires_at < ?",
+		time.Now().Unix(),
+	); err != nil {
+		return nil, false, err
+	}
+
+	res, err := s.db.ExecContext(ctx,
+		`INSERT OR IGNORE INTO idempotency_keys (pubkey, key, request_hash, expires_at)
+		 VALUES (?, ?, ?, ?)`,
+		rec.Pubkey, rec.Key, rec.RequestHash, rec.ExpiresAt.Unix(),
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+	if n == 1 {
+		return rec, true, nil
+	}
+
+	existing := &IdempotencyRecord{}
+	var expiresAt int64
+	err = s.db.QueryRowContext(ctx,
+		`SELECT pubkey, key, request_hash, status_code, response, expires_at
+		 FROM idempotency_keys WHERE pubkey = ? AND key = ?`,
+		rec.Pubkey, rec.Key,
+	).Scan(&existing.Pubkey, &existing.Key, &existing.RequestHash,
+		&existing.StatusCode, &existing.Response, &expiresAt)
+	if err != nil {
+		return nil, false, err
+	}
+	existing.ExpiresAt = time.Unix(expiresAt, 0)
+	return existing, false, nil
+}
+
+// CompleteIdempotencyKey stores the response for a reserved key.
+func (s *sqliteStore) CompleteIdempotencyKey(ctx context.Context, pubkey, key string, statusCode int, response []byte) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE idempotency_keys SET status_code = ?, response = ? WHERE pubkey = ? AND key = ?",
+		statusCode, response, pubkey, key,
+	)
+	return err
+}
+
+// ReleaseIdempotencyKey drops a reservation, e.g. after a failed request,
+// so that the key can be retried.
+func (s *sqliteStore) ReleaseIdempotencyKey(ctx context.Context, pubkey, key string) error {
+	_, err := s.db.ExecContext(ctx,
+		"DELETE FROM idempotency_keys WHERE pubkey = ? AND key = ?",
+		pubkey, key,
+	)
+	return err
+}
+
+// Auth
+
+// MarkAuthEventSeen records a NIP-98 event ID and reports whether it was
+// seen for the first time. Expired IDs are purged on the way in.
+func (s *sqliteStore) MarkAuthEventSeen(ctx context.Context, eventID string, expiresAt time.Time) (bool, error) {
+	if _, err := s.db.ExecContext(ctx,
+		"DELETE FROM auth_events WHERE expires_at < ?",
+		time.Now().Unix(),
+	); err != nil {
+		return false, err
+	}
+
+	res, err := s.db.ExecContext(ctx,
+		"INSERT OR IGNORE INTO auth_events (event_id, expires_at) VALUES (?, ?)",
+		eventID, expiresAt.Unix(),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (s *sqliteStore) CreateAuthChallenge(ctx context.Context, challenge string, expiresAt time.Time) error {
+	if _, err := s.db.ExecContext(ctx,
+		"DELETE FROM auth_challenges WHERE expires_at < ?",
+		time.Now().Unix(),
+	); err != nil {
+		return err
+	}
+
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO auth_challenges (challenge, expires_at) VALUES (?, ?)",
+		challenge, expiresAt.Unix(),
+	)
+	return err
+}
+
+// ConsumeAuthChallenge deletes an unexpired challenge and reports whether it
+// existed, so each challenge can be redeemed once.
+func (s *sqliteStore) ConsumeAuthChallenge(ctx context.Context, challenge string) (bool, error) {
+	res, err := s.db.ExecContext(ctx,
+		"DELETE FROM auth_challenges WHERE challenge = ? AND expires_at >= ?",
+		challenge, time.Now().Unix(),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// Sessions
+
+func (s *sqliteStore) CreateSession(ctx context.Context, session *Session) error {
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO sessions (id, pubkey, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		session.ID, session.Pubkey, session.TokenHash, session.CreatedAt, session.ExpiresAt,
+	)
+	return err
+}
+
+func (s *sqliteStore) GetSessionByTokenHash(ctx context.Context, tokenHash string) (*Session, error) {
+	sess := &Session{}
+	err := s.db.QueryRowContext(ctx,
+		`SELECT id, pubkey, token_hash, created_at, expires_at, revoked_at
+		 FROM sessions WHERE token_hash = ?`,
+		tokenHash,
+	).Scan(&sess.ID, &sess.Pubkey, &sess.TokenHash, &sess.CreatedAt, &sess.ExpiresAt, &sess.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// ListSessions returns the pubkey's sessions that have not been revoked,
+// newest first. Expired sessions are included until they are cleaned up.
+func (s *sqliteStore) ListSessions(ctx context.Context, pubkey string) ([]*Session, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, pubkey, token_hash, created_at, expires_at, revoked_at
+		 FROM sessions
+		 WHERE pubkey = ? AND revoked_at IS NULL
+		 ORDER BY created_at DESC`,
+		pubkey,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		sess := &Session{}
+		if err := rows.Scan(&sess.ID, &sess.Pubkey, &sess.TokenHash, &sess.CreatedAt,
+			&sess.ExpiresAt, &sess.RevokedAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession revokes one of the pubkey's sessions. It returns
+// sql.ErrNoRows if no such active session exists.
+func (s *sqliteStore) RevokeSession(ctx context.Context, id, pubkey string) error {
+	res, err := s.db.ExecContext(ctx,
+		"UPDATE sessions SET revoked_at = ? WHERE id = ? AND pubkey = ? AND revoked_at IS NULL",
+		time.Now(), id, pubkey,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// API keys
+
+func (s *sqliteStore) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO api_keys (id, owner_pubkey, label, scopes, key_hash, created_at, expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		key.ID, key.OwnerPubkey, key.Label, strings.Join(key.Scopes, ","),
+		key.KeyHash, key.CreatedAt, key.ExpiresAt,
+	)
+	return err
+}
+
+func (s *sqliteStore) GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error) {
+	return scanAPIKey(s.db.QueryRowContext(ctx,
+		`SELECT id, owner_pubkey, label, scopes, key_hash, created_at, expires_at, revoked_at
+		 FROM api_keys WHERE key_hash = ?`,
+		keyHash,
+	))
+}
+
+// ListAPIKeys returns the owner's keys that have not been revoked, newest
+// first.
+func (s *sqliteStore) ListAPIKeys(ctx context.Context, ownerPubkey string) ([]*APIKey, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, owner_pubkey, label, scopes, key_hash, created_at, expires_at, revoked_at
+		 FROM api_keys
+		 WHERE owner_pubkey = ? AND revoked_at IS NULL
+		 ORDER BY created_at DESC`,
+		ownerPubkey,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey revokes one of the owner's keys. It returns sql.ErrNoRows if
+// no such active key exists.
+func (s *sqliteStore) RevokeAPIKey(ctx context.Context, id, ownerPubkey string) error {
+	res, err := s.db.ExecContext(ctx,
+		"UPDATE api_keys SET revoked_at = ? WHERE id = ? AND owner_pubkey = ? AND revoked_at IS NULL",
+		time.Now(), id, ownerPubkey,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	k := &APIKey{}
+	var scopes string
+	if err := row.Scan(&k.ID, &k.OwnerPubkey, &k.Label, &scopes, &k.KeyHash,
+		&k.CreatedAt, &k.ExpiresAt, &k.RevokedAt); err != nil {
+		return nil, err
+	}
+	if scopes != "" {
+		k.Scopes = strings.Split(scopes, ",")
+	}
+	return k, nil
+}
+
+// Staff
+
+// UpsertStaffGrant creates or replaces the staff member's permissions for a
+// merchant.
+func (s *sqliteStore) UpsertStaffGrant(ctx context.Context, grant *StaffGrant) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO staff_grants (merchant_pubkey, staff_pubkey, permissions)
+		 VALUES (?, ?, ?)
+		 ON CONFLICT (merchant_pubkey, staff_pubkey) DO UPDATE SET permissions = excluded.permissions`,
+		grant.MerchantPubkey, grant.StaffPubkey, strings.Join(grant.Permissions, ","),
+	)
+	return err
+}
+
+func (s *sqliteStore) GetStaffGrant(ctx context.Context, merchantPubkey, staffPubkey string) (*StaffGrant, error) {
+	return scanStaffGrant(s.db.QueryRowContext(ctx,
+		`SELECT merchant_pubkey, staff_pubkey, permissions, created_at
+		 FROM staff_grants WHERE merchant_pubkey = ? AND staff_pubkey = ?`,
+		merchantPubkey, staffPubkey,
+	))
+}
+
+func (s *sqliteStore) ListStaffGrantsByMerchant(ctx context.Context, merchantPubkey string) ([]*StaffGrant, error) {
+	return s.queryStaffGrants(ctx,
+		`SELECT merchant_pubkey, staff_pubkey, permissions, created_at
+		 FROM staff_grants WHERE merchant_pubkey = ? ORDER BY created_at`,
+		merchantPubkey,
+	)
+}
+
+func (s *sqliteStore) ListStaffGrantsByStaff(ctx context.Context, staffPubkey string) ([]*StaffGrant, error) {
+	return s.queryStaffGrants(ctx,
+		`SELECT merchant_pubkey, staff_pubkey, permissions, created_at
+		 FROM staff_grants WHERE staff_pubkey = ? ORDER BY created_at`,
+		staffPubkey,
+	)
+}
+
+func (s *sqliteStore) queryStaffGrants(ctx context.Context, query string, args ...any) ([]*StaffGrant, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []*StaffGrant
+	for rows.Next() {
+		g, err := scanStaffGrant(rows)
+		if err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+// DeleteStaffGrant removes a grant. It returns sql.ErrNoRows if none
+// existed.
+func (s *sqliteStore) DeleteStaffGrant(ctx context.Context, merchantPubkey, staffPubkey string) error {
+	res, err := s.db.ExecContext(ctx,
+		"DELETE FROM staff_grants WHERE merchant_pubkey = ? AND staff_pubkey = ?",
+		merchantPubkey, staffPubkey,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func scanStaffGrant(row rowScanner) (*StaffGrant, error) {
+	g := &StaffGrant{}
+	var permissions string
+	if err := row.Scan(&g.MerchantPubkey, &g.StaffPubkey, &permissions, &g.CreatedAt); err != nil {
+		return nil, err
+	}
+	if permissions != "" {
+		g.Permissions = strings.Split(permissions, ",")
+	}
+	return g, nil
+}
+
+// Splits
+
+func (s *sqliteStore) CreateSplitRule(ctx context.Context, rule *SplitRule) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO split_rules (id, merchant_pubkey, destination, percent, amount_sats, label, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		rule.ID, rule.MerchantPubkey, rule.Destination, rule.Percent, rule.AmountSats, rule.Label, rule.CreatedAt,
+	)
+	return err
+}
+
+func (s *sqliteStore) ListSplitRules(ctx context.Context, merchantPubkey string) ([]*SplitRule, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, merchant_pubkey, destination, percent, amount_sats, label, created_at
+		 FROM split_rules WHERE merchant_pubkey = ? ORDER BY created_at, rowid`,
+		merchantPubkey,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []*SplitRule
+	for rows.Next() {
+		r := &SplitRule{}
+		if err := rows.Scan(&r.ID, &r.MerchantPubkey, &r.Destination, &r.Percent,
+			&r.AmountSats, &r.Label, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// DeleteSplitRule removes one of the merchant's rules. It returns
+// sql.ErrNoRows if the merchant has no such rule. Payouts already created
+// from it are kept.
+func (s *sqliteStore) DeleteSplitRule(ctx context.Context, id, merchantPubkey string) error {
+	res, err := s.db.ExecContext(ctx,
+		"DELETE FROM split_rules WHERE id = ? AND merchant_pubkey = ?", id, merchantPubkey,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CreateSplitPayouts stores payouts in one transaction. A payout for a
+// payment and rule that already has one is skipped, so settling twice
+// does not pay twice.
+func (s *sqliteStore) CreateSplitPayouts(ctx context.Context, payouts []*SplitPayout) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, p := range payouts {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO split_payouts (id, payment_id, rule_id, merchant_pubkey, destination, amount_sats,
+			                            status, next_attempt_at, created_at, updated_at)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			 ON CONFLICT (payment_id, rule_id) DO NOTHING`,
+			p.ID, p.PaymentID, p.RuleID, p.MerchantPubkey, p.Destination, p.AmountSats,
+			p.Status, p.NextAttemptAt, p.CreatedAt, p.UpdatedAt,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const splitPayoutColumns = `id, payment_id, rule_id, merchant_pubkey, destination, amount_sats, status,
+		attempts, last_error, next_attempt_at, payout_payment_id, created_at, updated_at`
+
+func (s *sqliteStore) ListSplitPayouts(ctx context.Context, paymentID string) ([]*SplitPayout, error) {
+	return s.querySplitPayouts(ctx,
+		`SELECT `+splitPayoutColumns+` FROM split_payouts WHERE payment_id = ? ORDER BY created_at, rowid`,
+		paymentID,
+	)
+}
+
+// ListDueSplitPayouts returns pending payouts whose next attempt is due by
+// now, oldest first.
+func (s *sqliteStore) ListDueSplitPayouts(ctx context.Context, now time.Time, limit int) ([]*SplitPayout, error) {
+	return s.querySplitPayouts(ctx,
+		`SELECT `+splitPayoutColumns+` FROM split_payouts
+		 WHERE status = 'pending' AND julianday(next_attempt_at) <= julianday(?)
+		 ORDER BY next_attempt_at
+		 LIMIT ?`,
+		now, limit,
+	)
+}
+
+// ClaimSplitPayout pushes the next attempt of a due payout to until. It
+// reports false if the payout is no longer due, e.g. because another
+// worker claimed it first.
+func (s *sqliteStore) ClaimSplitPayout(ctx context.Context, id string, now, until time.Time) (bool, error) {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE split_payouts SET next_attempt_at = ?
+		 WHERE id = ? AND status = 'pending' AND julianday(next_attempt_at) <= julianday(?)`,
+		until, id, now,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UpdateSplitPayout records the outcome of an attempt.
+func (s *sqliteStore) UpdateSplitPayout(ctx context.Context, payout *SplitPayout) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE split_payouts
+		 SET status = ?, attempts = ?, last_error = ?, next_attempt_at = ?, payout_payment_id = ?, updated_at = ?
+		 WHERE id = ?`,
+		payout.Status, payout.Attempts, payout.LastError, payout.NextAttemptAt,
+		payout.PayoutPaymentID, payout.UpdatedAt, payout.ID,
+	)
+	return err
+}
+
+func (s *sqliteStore) querySplitPayouts(ctx context.Context, query string, args ...any) ([]*SplitPayout, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payouts []*SplitPayout
+	for rows.Next() {
+		p := &SplitPayout{}
+		if err := rows.Scan(&p.ID, &p.PaymentID, &p.RuleID, &p.MerchantPubkey, &p.Destination,
+			&p.AmountSats, &p.Status, &p.Attempts, &p.LastError, &p.NextAttemptAt,
+			&p.PayoutPaymentID, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		payouts = append(payouts, p)
+	}
+	return payouts, rows.Err()
+}
+
+// Webhooks
+
+func (s *sqliteStore) CreateWebhookEndpoint(ctx context.Context, endpoint *WebhookEndpoint) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO webhook_endpoints (id, merchant_pubkey, url, secret, events, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		endpoint.ID, endpoint.MerchantPubkey, endpoint.URL, endpoint.Secret,
+		strings.Join(endpoint.Events, ","), endpoint.CreatedAt,
+	)
+	return err
+}
+
+const webhookEndpointColumns = `id, merchant_pubkey, url, secret, events, created_at`
+
+func (s *sqliteStore) GetWebhookEndpoint(ctx context.Context, id string) (*WebhookEndpoint, error) {
+	return scanWebhookEndpoint(s.db.QueryRowContext(ctx,
+		`SELECT `+webhookEndpointColumns+` FROM webhook_endpoints WHERE id = ?`, id,
+	))
+}
+
+func (s *sqliteStore) ListWebhookEndpoints(ctx context.Context, merchantPubkey string) ([]*WebhookEndpoint, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+webhookEndpointColumns+` FROM webhook_endpoints
+		 WHERE merchant_pubkey = ? ORDER BY created_at, rowid`,
+		merchantPubkey,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var endpoints []*WebhookEndpoint
+	for rows.Next() {
+		e, err := scanWebhookEndpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, rows.Err()
+}
+
+func scanWebhookEndpoint(row rowScanner) (*WebhookEndpoint, error) {
+	e := &WebhookEndpoint{}
+	var events string
+	if err := row.Scan(&e.ID, &e.MerchantPubkey, &e.URL, &e.Secret, &events, &e.CreatedAt); err != nil {
+		return nil, err
+	}
+	if events != "" {
+		e.Events = strings.Split(events, ",")
+	}
+	return e, nil
+}
+
+// DeleteWebhookEndpoint removes one of the merchant's endpoints. It returns
+// sql.ErrNoRows if the merchant has no such endpoint. Its deliveries stay
+// in the log.
+func (s *sqliteStore) DeleteWebhookEndpoint(ctx context.Context, id, merchantPubkey string) error {
+	res, err := s.db.ExecContext(ctx,
+		"DELETE FROM webhook_endpoints WHERE id = ? AND merchant_pubkey = ?", id, merchantPubkey,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CreateWebhookDeliveries stores deliveries in one transaction.
+func (s *sqliteStore) CreateWebhookDeliveries(ctx context.Context, deliveries []*WebhookDelivery) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, d := range deliveries {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO webhook_deliveries (id, endpoint_id, merchant_pubkey, event_id, event_type, payment_id,
+			                                 payload, status, next_attempt_at, created_at, updated_at)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			d.ID, d.EndpointID, d.MerchantPubkey, d.EventID, d.EventType, d.PaymentID,
+			d.Payload, d.Status, d.NextAttemptAt, d.CreatedAt, d.UpdatedAt,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const webhookDeliveryColumns = `id, endpoint_id, merchant_pubkey, event_id, event_type, payment_id, payload,
+		status, attempts, last_error, response_status, next_attempt_at, created_at, updated_at`
+
+func (s *sqliteStore) GetWebhookDelivery(ctx context.Context, id string) (*WebhookDelivery, error) {
+	return scanWebhookDelivery(s.db.QueryRowContext(ctx,
+		`SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries WHERE id = ?`, id,
+	))
+}
+
+func (s *sqliteStore) ListWebhookDeliveries(ctx context.Context, filter *WebhookDeliveryFilter) ([]*WebhookDelivery, error) {
+	return s.queryWebhookDeliveries(ctx,
+		`SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries
+		 WHERE merchant_pubkey = ?
+		   AND (? = '' OR endpoint_id = ?)
+		   AND (? = '' OR payment_id = ?)
+		   AND (? = '' OR status = ?)
+		 ORDER BY created_at DESC, rowid DESC
+		 LIMIT ? OFFSET ?`,
+		filter.MerchantPubkey,
+		filter.EndpointID, filter.EndpointID,
+		filter.PaymentID, filter.PaymentID,
+		filter.Status, filter.Status,
+		filter.Limit, filter.Offset,
+	)
+}
+
+// ListDueWebhookDeliveries returns pending deliveries whose next attempt
+// is due by now, oldest first.
+func (s *sqliteStore) ListDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]*WebhookDelivery, error) {
+	return s.queryWebhookDeliveries(ctx,
+		`SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries
+		 WHERE status = 'pending' AND julianday(next_attempt_at) <= julianday(?)
+		 ORDER BY next_attempt_at
+		 LIMIT ?`,
+		now, limit,
+	)
+}
+
+// ClaimWebhookDelivery pushes the next attempt of a due delivery to until.
+// It reports false if the delivery is no longer due, e.g. because another
+// worker claimed it first.
+func (s *sqliteStore) ClaimWebhookDelivery(ctx context.Context, id string, now, until time.Time) (bool, error) {
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE webhook_deliveries SET next_attempt_at = ?
+		 WHERE id = ? AND status = 'pending' AND julianday(next_attempt_at) <= julianday(?)`,
+		until, id, now,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// UpdateWebhookDelivery records the outcome of an attempt.
+func (s *sqliteStore) UpdateWebhookDelivery(ctx context.Context, d *WebhookDelivery) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE webhook_deliveries
+		 SET status = ?, attempts = ?, last_error = ?, response_status = ?, next_attempt_at = ?, updated_at = ?
+		 WHERE id = ?`,
+		d.Status, d.Attempts, d.LastError, d.ResponseStatus, d.NextAttemptAt, d.UpdatedAt, d.ID,
+	)
+	return err
+}
+
+func (s *sqliteStore) queryWebhookDeliveries(ctx context.Context, query string, args ...any) ([]*WebhookDelivery, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*WebhookDelivery
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func scanWebhookDelivery(row rowScanner) (*WebhookDelivery, error) {
+	d := &WebhookDelivery{}
+	err := row.Scan(&d.ID, &d.EndpointID, &d.MerchantPubkey, &d.EventID, &d.EventType, &d.PaymentID,
+		&d.Payload, &d.Status, &d.Attempts, &d.LastError, &d.ResponseStatus,
+		&d.NextAttemptAt, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Lightning addresses
+
+// ClaimLightningAddress stores address unless another merchant holds its
+// name, and reports whether it did. A merchant claiming a name it already
+// holds updates the description.
+func (s *sqliteStore) ClaimLightningAddress(ctx context.Context, address *LightningAddress) (bool, error) {
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO lightning_addresses (name, merchant_pubkey, description, created_at)
+		 VALUES (?, ?, ?, ?)
+		 ON CONFLICT (name) DO UPDATE SET description = excluded.description
+		 WHERE merchant_pubkey = excluded.merchant_pubkey`,
+		address.Name, address.MerchantPubkey, address.Description, address.CreatedAt,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+const lightningAddressColumns = `name, merchant_pubkey, description, created_at`
+
+func (s *sqliteStore) GetLightningAddress(ctx context.Context, name string) (*LightningAddress, error) {
+	return scanLightningAddress(s.db.QueryRowContext(ctx,
+		`SELECT `+lightningAddressColumns+` FROM lightning_addresses WHERE name = ?`, name,
+	))
+}
+
+func (s *sqliteStore) ListLightningAddresses(ctx context.Context, merchantPubkey string) ([]*LightningAddress, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+lightningAddressColumns+` FROM lightning_addresses
+		 WHERE merchant_pubkey = ? ORDER BY created_at, name`,
+		merchantPubkey,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var addresses []*LightningAddress
+	for rows.Next() {
+		a, err := scanLightningAddress(rows)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, a)
+	}
+	return addresses, rows.Err()
+}
+
+func scanLightningAddress(row rowScanner) (*LightningAddress, error) {
+	a := &LightningAddress{}
+	if err := row.Scan(&a.Name, &a.MerchantPubkey, &a.Description, &a.CreatedAt); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// DeleteLightningAddress releases one of the merchant's names. It returns
+// sql.ErrNoRows if the merchant does not hold it.
+func (s *sqliteStore) DeleteLightningAddress(ctx context.Context, name, merchantPubkey string) error {
+	res, err := s.db.ExecContext(ctx,
+		"DELETE FROM lightning_addresses WHERE name = ? AND merchant_pubkey = ?", name, merchantPubkey,
+	)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Denylist
+
+// DenyPubkey adds a pubkey to the denylist, replacing the reason if it is
+// already listed.
+func (s *sqliteStore) DenyPubkey(ctx context.Context, entry *DeniedPubkey) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO denied_pubkeys (pubkey, reason, denied_by)
+		 VALUES (?, ?, ?)
+		 ON CONFLICT (pubkey) DO UPDATE SET reason = excluded.reason, denied_by = excluded.denied_by`,
+		entry.Pubkey, entry.Reason, entry.DeniedBy,
+	)
+	return err
+}
+
+func (s *sqliteStore) IsPubkeyDenied(ctx context.Context, pubkey string) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM denied_pubkeys WHERE pubkey = ?", pubkey,
+	).Scan(&n)
+	return n > 0, err
+}
+
+func (s *sqliteStore) ListDeniedPubkeys(ctx context.Context) ([]*DeniedPubkey, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT pubkey, reason, denied_by, created_at FROM denied_pubkeys ORDER BY created_at",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*DeniedPubkey
+	for rows.Next() {
+		e := &DeniedPubkey{}
+		if err := rows.Scan(&e.Pubkey, &e.Reason, &e.DeniedBy, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// AllowPubkey removes a pubkey from the denylist. It returns sql.ErrNoRows
+// if it was not listed.
+func (s *sqliteStore) AllowPubkey(ctx context.Context, pubkey string) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM denied_pubkeys WHERE pubkey = ?", pubkey)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
 }
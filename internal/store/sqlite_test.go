@@ -2,6 +2,8 @@ package store_test
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -19,6 +21,21 @@ func setupTestDB(t *testing.T) store.Store {
 	return db
 }
 
+// markPaid settles a pending payment.
+func markPaid(t *testing.T, db store.Store, id string, settledAt *time.Time) {
+	t.Helper()
+	ok, err := db.TransitionPaymentStatus(context.Background(), &store.PaymentEvent{
+		PaymentID:  id,
+		FromStatus: "pending",
+		ToStatus:   "paid",
+		Cause:      "webhook",
+		Actor:      "system",
+	}, settledAt)
+	if err != nil || !ok {
+		t.Fatalf("TransitionPaymentStatus(%s): ok = %v, err = %v", id, ok, err)
+	}
+}
+
 func TestCreateAndGetUser(t *testing.T) {
 	db := setupTestDB(t)
 	ctx := context.Background()
@@ -46,6 +63,57 @@ func TestCreateAndGetUser(t *testing.T) {
 	}
 }
 
+func TestSetUserWallet(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	db.CreateUser(ctx, &store.User{Pubkey: "merchant", IsMerchant: true})
+	wallet := &store.User{
+		Pubkey:           "merchant",
+		LNbitsWalletID:   "wallet_1",
+		LNbitsUserID:     "user_1",
+		LNbitsAdminKey:   "sealed_admin",
+		LNbitsInvoiceKey: "sealed_invoice",
+	}
+	if ok, err := db.SetUserWallet(ctx, wallet); !ok || err != nil {
+		t.Fatalf("SetUserWallet = %v, %v", ok, err)
+	}
+	got, _ := db.GetUser(ctx, "merchant")
+	if got.LNbitsWalletID != "wallet_1" || got.LNbitsUserID != "user_1" ||
+		got.LNbitsAdminKey != "sealed_admin" || got.LNbitsInvoiceKey != "sealed_invoice" || !got.IsMerchant {
+		t.Errorf("user = %+v", got)
+	}
+
+	// A user keeps the first wallet stored for it
+	other := *wallet
+	other.LNbitsWalletID = "wallet_2"
+	if ok, err := db.SetUserWallet(ctx, &other); ok || err != nil {
+		t.Errorf("SetUserWallet again = %v, %v, want false", ok, err)
+	}
+	if got, _ := db.GetUser(ctx, "merchant"); got.LNbitsWalletID != "wallet_1" {
+		t.Errorf("LNbitsWalletID = %q, want wallet_1", got.LNbitsWalletID)
+	}
+
+	// Nor is a wallet stored while the user has a share of the shared
+	// wallet, which it could no longer spend
+	db.CreateUser(ctx, &store.User{Pubkey: "landlord", IsMerchant: true})
+	landlord := *wallet
+	landlord.Pubkey = "landlord"
+	landlord.LNbitsWalletID = "wallet_3"
+	db.CreatePayment(ctx, &store.Payment{ID: "pay_rent", AmountSats: 1000, ReceiverPubkey: "landlord", PaymentHash: "hash_rent", Status: "pending"}, nil)
+	if ok, err := db.SetUserWallet(ctx, &landlord); ok || err != nil {
+		t.Errorf("SetUserWallet with a pending invoice = %v, %v, want false", ok, err)
+	}
+	markPaid(t, db, "pay_rent", nil)
+	if ok, err := db.SetUserWallet(ctx, &landlord); ok || err != nil {
+		t.Errorf("SetUserWallet with a balance = %v, %v, want false", ok, err)
+	}
+	db.CreatePayment(ctx, &store.Payment{ID: "pay_out", AmountSats: 1000, SenderPubkey: "landlord", PaymentHash: "hash_out", Status: "paid", Direction: "sent"}, nil)
+	if ok, err := db.SetUserWallet(ctx, &landlord); !ok || err != nil {
+		t.Errorf("SetUserWallet after withdrawing = %v, %v, want true", ok, err)
+	}
+}
+
 func TestCreateAndGetPayment(t *testing.T) {
 	db := setupTestDB(t)
 	ctx := context.Background()
@@ -58,9 +126,11 @@ func TestCreateAndGetPayment(t *testing.T) {
 		ReceiverPubkey: "npub_receiver",
 		PaymentHash:    "hash_abc",
 		Status:         "pending",
+		WebhookToken:   "token_abc",
+		WalletID:       "wallet_1",
 	}
 
-	if err := db.CreatePayment(ctx, payment); err != nil {
+	if err := db.CreatePayment(ctx, payment, &store.PaymentEvent{Cause: "created", Actor: "npub_receiver"}); err != nil {
 		t.Fatalf("CreatePayment: %v", err)
 	}
 
@@ -75,9 +145,29 @@ func TestCreateAndGetPayment(t *testing.T) {
 	if got.Status != "pending" {
 		t.Errorf("Status = %q, want %q", got.Status, "pending")
 	}
+	if got.WebhookToken != "token_abc" {
+		t.Errorf("WebhookToken = %q, want %q", got.WebhookToken, "token_abc")
+	}
+	if got.WalletID != "wallet_1" {
+		t.Errorf("WalletID = %q, want %q", got.WalletID, "wallet_1")
+	}
+
+	events, _ := db.ListPaymentEvents(ctx, "pay_001")
+	if len(events) != 1 || events[0].FromStatus != "" || events[0].ToStatus != "pending" || events[0].Cause != "created" || events[0].Actor != "npub_receiver" {
+		t.Errorf("events = %+v, want the creation", events)
+	}
+
+	// A payment that is not stored logs no creation
+	payment.ID = "pay_dup"
+	if err := db.CreatePayment(ctx, payment, &store.PaymentEvent{Cause: "created"}); err == nil {
+		t.Fatal("payment with a duplicate hash was stored")
+	}
+	if events, _ := db.ListPaymentEvents(ctx, "pay_dup"); len(events) != 0 {
+		t.Errorf("events = %+v, want none", events)
+	}
 }
 
-func TestUpdatePaymentStatus(t *testing.T) {
+func TestTransitionPaymentStatus(t *testing.T) {
 	db := setupTestDB(t)
 	ctx := context.Background()
 
@@ -89,12 +179,22 @@ func TestUpdatePaymentStatus(t *testing.T) {
 		PaymentHash:    "hash_def",
 		Status:         "pending",
 	}
-	db.CreatePayment(ctx, payment)
+	db.CreatePayment(ctx, payment, nil)
 
+	event := &store.PaymentEvent{
+		PaymentID:  "pay_002",
+		FromStatus: "pending",
+		ToStatus:   "paid",
+		Cause:      "webhook",
+		Actor:      "system",
+	}
 	now := time.Now()
-	err := db.UpdatePaymentStatus(ctx, "pay_002", "paid", &now)
+	ok, err := db.TransitionPaymentStatus(ctx, event, &now)
 	if err != nil {
-		t.Fatalf("UpdatePaymentStatus: %v", err)
+		t.Fatalf("TransitionPaymentStatus: %v", err)
+	}
+	if !ok {
+		t.Error("first transition reported no change")
 	}
 
 	got, _ := db.GetPayment(ctx, "pay_002")
@@ -104,6 +204,39 @@ func TestUpdatePaymentStatus(t *testing.T) {
 	if got.SettledAt == nil {
 		t.Error("SettledAt should not be nil")
 	}
+
+	// The payment is no longer pending, so the same transition is refused
+	ok, _ = db.TransitionPaymentStatus(ctx, event, &now)
+	if ok {
+		t.Error("second transition reported a change")
+	}
+
+	// Without a settle time the existing one is kept
+	ok, _ = db.TransitionPaymentStatus(ctx, &store.PaymentEvent{
+		PaymentID:  "pay_002",
+		FromStatus: "paid",
+		ToStatus:   "refunded",
+		Cause:      "refund",
+		Actor:      "npub_receiver",
+	}, nil)
+	got, _ = db.GetPayment(ctx, "pay_002")
+	if !ok || got.Status != "refunded" || got.SettledAt == nil {
+		t.Errorf("after refund: ok = %v, Status = %q, SettledAt = %v", ok, got.Status, got.SettledAt)
+	}
+
+	events, err := db.ListPaymentEvents(ctx, "pay_002")
+	if err != nil {
+		t.Fatalf("ListPaymentEvents: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	if e := events[0]; e.FromStatus != "pending" || e.ToStatus != "paid" || e.Cause != "webhook" || e.Actor != "system" || e.CreatedAt.IsZero() {
+		t.Errorf("first event = %+v", e)
+	}
+	if e := events[1]; e.FromStatus != "paid" || e.ToStatus != "refunded" || e.Actor != "npub_receiver" {
+		t.Errorf("second event = %+v", e)
+	}
 }
 
 func TestGetPaymentByHash(t *testing.T) {
@@ -118,7 +251,7 @@ func TestGetPaymentByHash(t *testing.T) {
 		PaymentHash:    "unique_hash",
 		Status:         "pending",
 	}
-	db.CreatePayment(ctx, payment)
+	db.CreatePayment(ctx, payment, nil)
 
 	got, err := db.GetPaymentByHash(ctx, "unique_hash")
 	if err != nil {
@@ -141,7 +274,7 @@ func TestListPaymentsByUser(t *testing.T) {
 			ReceiverPubkey: "npub_user",
 			PaymentHash:    fmt.Sprintf("hash_%d", i),
 			Status:         "paid",
-		})
+		}, nil)
 	}
 
 	payments, err := db.ListPaymentsByUser(ctx, "npub_user", 10, 0)
@@ -152,3 +285,878 @@ func TestListPaymentsByUser(t *testing.T) {
 		t.Errorf("got %d payments, want 3", len(payments))
 	}
 }
+
+func TestMarkAuthEventSeen(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	fresh, err := db.MarkAuthEventSeen(ctx, "event_abc", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("MarkAuthEventSeen: %v", err)
+	}
+	if !fresh {
+		t.Error("first use should be fresh")
+	}
+
+	fresh, err = db.MarkAuthEventSeen(ctx, "event_abc", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("MarkAuthEventSeen: %v", err)
+	}
+	if fresh {
+		t.Error("second use should be reported as a replay")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	sess := &store.Session{
+		ID:        "ses_001",
+		Pubkey:    "pubkey_a",
+		TokenHash: "token_hash_001",
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	}
+	if err := db.CreateSession(ctx, sess); err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+
+	got, err := db.GetSessionByTokenHash(ctx, "token_hash_001")
+	if err != nil {
+		t.Fatalf("GetSessionByTokenHash: %v", err)
+	}
+	if got.Pubkey != "pubkey_a" {
+		t.Errorf("Pubkey = %q, want %q", got.Pubkey, "pubkey_a")
+	}
+
+	// Another pubkey cannot revoke the session
+	if err := db.RevokeSession(ctx, "ses_001", "pubkey_b"); err == nil {
+		t.Error("expected error revoking another pubkey's session")
+	}
+	if err := db.RevokeSession(ctx, "ses_001", "pubkey_a"); err != nil {
+		t.Fatalf("RevokeSession: %v", err)
+	}
+
+	sessions, err := db.ListSessions(ctx, "pubkey_a")
+	if err != nil {
+		t.Fatalf("ListSessions: %v", err)
+	}
+	if len(sessions) != 0 {
+		t.Errorf("got %d sessions after revoke, want 0", len(sessions))
+	}
+}
+
+func TestConsumeAuthChallenge(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	if err := db.CreateAuthChallenge(ctx, "nonce", time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("CreateAuthChallenge: %v", err)
+	}
+
+	ok, err := db.ConsumeAuthChallenge(ctx, "nonce")
+	if err != nil || !ok {
+		t.Fatalf("first consume: ok = %v, err = %v", ok, err)
+	}
+	ok, _ = db.ConsumeAuthChallenge(ctx, "nonce")
+	if ok {
+		t.Error("challenge should only be consumable once")
+	}
+}
+
+func TestGetMerchantDailyStats(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	settled := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, status := range []string{"paid", "paid", "pending"} {
+		db.CreatePayment(ctx, &store.Payment{
+			ID:             fmt.Sprintf("pay_%d", i),
+			Bolt11:         "lnbc...",
+			AmountSats:     100,
+			ReceiverPubkey: "merchant",
+			PaymentHash:    fmt.Sprintf("hash_%d", i),
+			Status:         "pending",
+		}, nil)
+		if status == "paid" {
+			markPaid(t, db, fmt.Sprintf("pay_%d", i), &settled)
+		}
+	}
+
+	stats, err := db.GetMerchantDailyStats(ctx, "merchant", "2026-03-01")
+	if err != nil {
+		t.Fatalf("GetMerchantDailyStats: %v", err)
+	}
+	if stats.TotalSats != 200 {
+		t.Errorf("TotalSats = %d, want 200", stats.TotalSats)
+	}
+	if stats.TransactionCount != 2 {
+		t.Errorf("TransactionCount = %d, want 2", stats.TransactionCount)
+	}
+
+	other, _ := db.GetMerchantDailyStats(ctx, "merchant", "2026-03-02")
+	if other.TransactionCount != 0 {
+		t.Errorf("other day TransactionCount = %d, want 0", other.TransactionCount)
+	}
+}
+
+func TestListTipSummaries(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	day1 := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	payments := []struct {
+		createdBy string
+		subtotal  int64
+		tip       int64
+		settled   *time.Time
+	}{
+		{"staff_a", 1000, 100, &day1},
+		{"staff_a", 500, 50, &day1},
+		{"", 2000, 0, &day1},
+		{"staff_b", 300, 30, &day2},
+		{"staff_b", 300, 30, nil}, // unpaid
+	}
+	for i, p := range payments {
+		db.CreatePayment(ctx, &store.Payment{
+			ID:              fmt.Sprintf("pay_%d", i),
+			Bolt11:          "lnbc...",
+			AmountSats:      p.subtotal + p.tip,
+			SubtotalSats:    p.subtotal,
+			TipSats:         p.tip,
+			ReceiverPubkey:  "merchant",
+			CreatedByPubkey: p.createdBy,
+			PaymentHash:     fmt.Sprintf("hash_%d", i),
+			Status:          "pending",
+		}, nil)
+		if p.settled != nil {
+			markPaid(t, db, fmt.Sprintf("pay_%d", i), p.settled)
+		}
+	}
+
+	summaries, err := db.ListTipSummaries(ctx, "merchant", "2026-03-01", "2026-03-02")
+	if err != nil {
+		t.Fatalf("ListTipSummaries: %v", err)
+	}
+	want := []store.TipSummary{
+		{Date: "2026-03-01", StaffPubkey: "merchant", PaymentCount: 1, SubtotalSats: 2000},
+		{Date: "2026-03-01", StaffPubkey: "staff_a", PaymentCount: 2, SubtotalSats: 1500, TipSats: 150},
+		{Date: "2026-03-02", StaffPubkey: "staff_b", PaymentCount: 1, SubtotalSats: 300, TipSats: 30},
+	}
+	if len(summaries) != len(want) {
+		t.Fatalf("got %d summaries, want %d", len(summaries), len(want))
+	}
+	for i, s := range summaries {
+		if *s != want[i] {
+			t.Errorf("summary %d = %+v, want %+v", i, *s, want[i])
+		}
+	}
+
+	stats, _ := db.GetMerchantDailyStats(ctx, "merchant", "2026-03-01")
+	if stats.TipSats != 150 || stats.GrossSats != 3650 {
+		t.Errorf("stats tips %d gross %d, want 150 and 3650", stats.TipSats, stats.GrossSats)
+	}
+}
+
+func TestCreateRefund(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	settled := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	db.CreatePayment(ctx, &store.Payment{
+		ID:             "pay_sale",
+		Bolt11:         "lnbc...",
+		AmountSats:     1000,
+		ReceiverPubkey: "merchant",
+		PaymentHash:    "hash_sale",
+		Status:         "pending",
+	}, nil)
+	markPaid(t, db, "pay_sale", &settled)
+
+	refund := func(id string, amount int64) bool {
+		t.Helper()
+		ok, err := db.CreateRefund(ctx, &store.Payment{
+			ID:           id,
+			Bolt11:       "lnbc...",
+			AmountSats:   amount,
+			SenderPubkey: "merchant",
+			PaymentHash:  "hash_" + id,
+			Status:       "pending",
+			Direction:    "sent",
+			RefundOf:     "pay_sale",
+		}, 1000, store.SpendLimit{}, nil)
+		if err != nil {
+			t.Fatalf("CreateRefund: %v", err)
+		}
+		return ok
+	}
+
+	if !refund("ref_1", 600) {
+		t.Fatal("first refund rejected")
+	}
+	if refund("ref_2", 500) {
+		t.Error("refund above the remaining amount was stored")
+	}
+	// A failed refund frees its amount again
+	db.CompleteOutgoingPayment(ctx, &store.PaymentEvent{PaymentID: "ref_1", FromStatus: "pending", ToStatus: "failed"}, "", 0, nil)
+	if !refund("ref_3", 1000) {
+		t.Fatal("full refund rejected after the partial one failed")
+	}
+	db.CompleteOutgoingPayment(ctx, &store.PaymentEvent{PaymentID: "ref_3", FromStatus: "pending", ToStatus: "paid"}, "preimage", 1, &settled)
+
+	sale, _ := db.GetPayment(ctx, "pay_sale")
+	if sale.RefundedSats != 1000 {
+		t.Errorf("RefundedSats = %d, want 1000", sale.RefundedSats)
+	}
+	r, _ := db.GetPayment(ctx, "ref_3")
+	if r.RefundOf != "pay_sale" || r.Direction != "sent" {
+		t.Errorf("refund = %+v, want a sent refund of pay_sale", r)
+	}
+
+	stats, _ := db.GetMerchantDailyStats(ctx, "merchant", "2026-03-01")
+	if stats.GrossSats != 1000 || stats.RefundedSats != 1000 || stats.TotalSats != 0 || stats.RefundCount != 1 {
+		t.Errorf("stats = %+v, want 1000 gross, 1000 refunded, 0 net", stats)
+	}
+	txs, _ := db.ListMerchantTransactions(ctx, "merchant", 10, 0)
+	if len(txs) != 2 {
+		t.Errorf("got %d transactions, want the sale and its refund", len(txs))
+	}
+	if sales, _ := db.ListMerchantSalesSince(ctx, "merchant", settled, 10); len(sales) != 1 || sales[0].ID != "pay_sale" {
+		t.Errorf("sales = %v, want only the sale", sales)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	key := &store.APIKey{
+		ID:          "apk_001",
+		OwnerPubkey: "merchant",
+		Label:       "webshop",
+		Scopes:      []string{"invoices:create", "payments:read"},
+		KeyHash:     "key_hash_001",
+		CreatedAt:   time.Now(),
+	}
+	if err := db.CreateAPIKey(ctx, key); err != nil {
+		t.Fatalf("CreateAPIKey: %v", err)
+	}
+
+	got, err := db.GetAPIKeyByHash(ctx, "key_hash_001")
+	if err != nil {
+		t.Fatalf("GetAPIKeyByHash: %v", err)
+	}
+	if len(got.Scopes) != 2 || got.Scopes[1] != "payments:read" {
+		t.Errorf("Scopes = %v, want [invoices:create payments:read]", got.Scopes)
+	}
+	if got.ExpiresAt != nil {
+		t.Errorf("ExpiresAt = %v, want nil", got.ExpiresAt)
+	}
+
+	if err := db.RevokeAPIKey(ctx, "apk_001", "merchant"); err != nil {
+		t.Fatalf("RevokeAPIKey: %v", err)
+	}
+	keys, _ := db.ListAPIKeys(ctx, "merchant")
+	if len(keys) != 0 {
+		t.Errorf("got %d keys after revoke, want 0", len(keys))
+	}
+}
+
+func TestStaffGrants(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	grant := &store.StaffGrant{
+		MerchantPubkey: "merchant",
+		StaffPubkey:    "cashier",
+		Permissions:    []string{"invoices:create"},
+	}
+	if err := db.UpsertStaffGrant(ctx, grant); err != nil {
+		t.Fatalf("UpsertStaffGrant: %v", err)
+	}
+	grant.Permissions = []string{"invoices:create", "transactions:today"}
+	if err := db.UpsertStaffGrant(ctx, grant); err != nil {
+		t.Fatalf("UpsertStaffGrant (replace): %v", err)
+	}
+
+	got, err := db.GetStaffGrant(ctx, "merchant", "cashier")
+	if err != nil {
+		t.Fatalf("GetStaffGrant: %v", err)
+	}
+	if len(got.Permissions) != 2 {
+		t.Errorf("Permissions = %v, want 2 entries", got.Permissions)
+	}
+
+	employers, _ := db.ListStaffGrantsByStaff(ctx, "cashier")
+	if len(employers) != 1 || employers[0].MerchantPubkey != "merchant" {
+		t.Errorf("ListStaffGrantsByStaff = %v, want one grant from merchant", employers)
+	}
+
+	if err := db.DeleteStaffGrant(ctx, "merchant", "cashier"); err != nil {
+		t.Fatalf("DeleteStaffGrant: %v", err)
+	}
+	if err := db.DeleteStaffGrant(ctx, "merchant", "cashier"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("second delete: err = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestListPaymentsByUser_CreatedBy(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	db.CreatePayment(ctx, &store.Payment{
+		ID:              "pay_staff",
+		Bolt11:          "lnbc1",
+		AmountSats:      100,
+		ReceiverPubkey:  "merchant",
+		CreatedByPubkey: "cashier",
+		PaymentHash:     "hash_staff",
+		Status:          "pending",
+	}, nil)
+
+	payments, err := db.ListPaymentsByUser(ctx, "cashier", 10, 0)
+	if err != nil {
+		t.Fatalf("ListPaymentsByUser: %v", err)
+	}
+	if len(payments) != 1 || payments[0].CreatedByPubkey != "cashier" {
+		t.Errorf("got %v, want the payment created by cashier", payments)
+	}
+}
+
+func TestDenylist(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	if denied, _ := db.IsPubkeyDenied(ctx, "spammer"); denied {
+		t.Fatal("pubkey denied before being listed")
+	}
+
+	if err := db.DenyPubkey(ctx, &store.DeniedPubkey{Pubkey: "spammer", Reason: "invoice spam", DeniedBy: "operator"}); err != nil {
+		t.Fatalf("DenyPubkey: %v", err)
+	}
+	denied, err := db.IsPubkeyDenied(ctx, "spammer")
+	if err != nil {
+		t.Fatalf("IsPubkeyDenied: %v", err)
+	}
+	if !denied {
+		t.Error("pubkey not denied after DenyPubkey")
+	}
+
+	entries, _ := db.ListDeniedPubkeys(ctx)
+	if len(entries) != 1 || entries[0].Reason != "invoice spam" {
+		t.Errorf("ListDeniedPubkeys = %v, want one entry with reason", entries)
+	}
+
+	if err := db.AllowPubkey(ctx, "spammer"); err != nil {
+		t.Fatalf("AllowPubkey: %v", err)
+	}
+	if err := db.AllowPubkey(ctx, "spammer"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("second AllowPubkey: err = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestExpirePendingPayments(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Hour)
+	for _, p := range []*store.Payment{
+		{ID: "pay_overdue", PaymentHash: "hash_overdue", Status: "pending", ExpiresAt: &past},
+		{ID: "pay_open", PaymentHash: "hash_open", Status: "pending", ExpiresAt: &future},
+		{ID: "pay_paid", PaymentHash: "hash_paid", Status: "paid", ExpiresAt: &past},
+		{ID: "pay_legacy", PaymentHash: "hash_legacy", Status: "pending"},
+	} {
+		p.Bolt11 = "lnbc1"
+		p.AmountSats = 100
+		p.ReceiverPubkey = "merchant"
+		if err := db.CreatePayment(ctx, p, nil); err != nil {
+			t.Fatalf("CreatePayment: %v", err)
+		}
+	}
+
+	expired, err := db.ExpirePendingPayments(ctx, now)
+	if err != nil {
+		t.Fatalf("ExpirePendingPayments: %v", err)
+	}
+	if len(expired) != 1 || expired[0].ID != "pay_overdue" || expired[0].Status != "expired" {
+		t.Fatalf("expired = %v, want only pay_overdue", expired)
+	}
+
+	p, _ := db.GetPayment(ctx, "pay_open")
+	if p.Status != "pending" {
+		t.Errorf("pay_open status = %q, want pending", p.Status)
+	}
+
+	events, _ := db.ListPaymentEvents(ctx, "pay_overdue")
+	if len(events) != 1 || events[0].FromStatus != "pending" || events[0].ToStatus != "expired" || events[0].Cause != "expiry" {
+		t.Errorf("events = %v, want one expiry", events)
+	}
+
+	// A second sweep finds nothing new
+	expired, _ = db.ExpirePendingPayments(ctx, now)
+	if len(expired) != 0 {
+		t.Errorf("second sweep expired %d payments, want 0", len(expired))
+	}
+	if events, _ := db.ListPaymentEvents(ctx, "pay_overdue"); len(events) != 1 {
+		t.Errorf("got %d events after the second sweep, want 1", len(events))
+	}
+}
+
+func TestListUnsettledPayments(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Hour)
+	for _, p := range []*store.Payment{
+		{ID: "pay_pending", PaymentHash: "hash_pending", Status: "pending", ExpiresAt: &future},
+		{ID: "pay_overdue", PaymentHash: "hash_overdue", Status: "pending", ExpiresAt: &past},
+		{ID: "pay_expired", PaymentHash: "hash_expired", Status: "expired", ExpiresAt: &past},
+		{ID: "pay_paid", PaymentHash: "hash_paid", Status: "paid"},
+		{ID: "pay_sending", PaymentHash: "hash_sending", Status: "pending", Direction: "sent"},
+		{ID: "pay_sent", PaymentHash: "hash_sent", Status: "paid", Direction: "sent"},
+	} {
+		p.Bolt11 = "lnbc1"
+		p.AmountSats = 100
+		p.ReceiverPubkey = "merchant"
+		if err := db.CreatePayment(ctx, p, nil); err != nil {
+			t.Fatalf("CreatePayment: %v", err)
+		}
+	}
+
+	payments, err := db.ListUnsettledPayments(ctx, now, false, nil, 10)
+	if err != nil {
+		t.Fatalf("ListUnsettledPayments: %v", err)
+	}
+	if len(payments) != 2 || payments[0].ID != "pay_pending" || payments[1].ID != "pay_sending" {
+		t.Errorf("got %v, want pay_pending and pay_sending", payments)
+	}
+
+	payments, _ = db.ListUnsettledPayments(ctx, now, true, nil, 10)
+	if len(payments) != 3 {
+		t.Errorf("with expired: got %d payments, want 3", len(payments))
+	}
+
+	// Pages follow each other even when payments share a creation time
+	var ids []string
+	var after *store.Payment
+	for range 5 {
+		page, err := db.ListUnsettledPayments(ctx, now, true, after, 2)
+		if err != nil {
+			t.Fatalf("ListUnsettledPayments: %v", err)
+		}
+		for _, p := range page {
+			ids = append(ids, p.ID)
+		}
+		if len(page) < 2 {
+			break
+		}
+		after = page[len(page)-1]
+	}
+	if len(ids) != 3 || ids[0] == ids[1] || ids[1] == ids[2] || ids[0] == ids[2] {
+		t.Errorf("paged through %v, want the 3 payments once each", ids)
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	rec := &store.IdempotencyRecord{
+		Pubkey:      "merchant",
+		Key:         "retry-1",
+		RequestHash: "hash_a",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}
+	if _, created, err := db.ReserveIdempotencyKey(ctx, rec); err != nil || !created {
+		t.Fatalf("ReserveIdempotencyKey: created = %v, err = %v", created, err)
+	}
+
+	// In flight: the second caller sees the reservation without a response
+	existing, created, _ := db.ReserveIdempotencyKey(ctx, rec)
+	if created || existing.StatusCode != 0 {
+		t.Fatalf("second reserve: created = %v, status = %d", created, existing.StatusCode)
+	}
+
+	if err := db.CompleteIdempotencyKey(ctx, "merchant", "retry-1", 201, []byte(`{"ok":true}`)); err != nil {
+		t.Fatalf("CompleteIdempotencyKey: %v", err)
+	}
+	existing, _, _ = db.ReserveIdempotencyKey(ctx, rec)
+	if existing.StatusCode != 201 || string(existing.Response) != `{"ok":true}` || existing.RequestHash != "hash_a" {
+		t.Errorf("stored record = %+v", existing)
+	}
+
+	// Keys are scoped per pubkey
+	other := *rec
+	other.Pubkey = "someone-else"
+	if _, created, _ := db.ReserveIdempotencyKey(ctx, &other); !created {
+		t.Error("same key for another pubkey was not reserved")
+	}
+
+	// Expired keys can be reused
+	if err := db.ReleaseIdempotencyKey(ctx, "merchant", "retry-1"); err != nil {
+		t.Fatalf("ReleaseIdempotencyKey: %v", err)
+	}
+	expired := *rec
+	expired.ExpiresAt = time.Now().Add(-time.Hour)
+	db.ReserveIdempotencyKey(ctx, &expired)
+	if _, created, _ := db.ReserveIdempotencyKey(ctx, rec); !created {
+		t.Error("expired key was not purged")
+	}
+}
+
+func TestCompleteOutgoingPayment(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	db.CreatePayment(ctx, &store.Payment{
+		ID:           "pay_out",
+		Bolt11:       "lnbc1",
+		AmountSats:   100,
+		SenderPubkey: "merchant",
+		PaymentHash:  "hash_out",
+		Status:       "pending",
+		Direction:    "sent",
+	}, nil)
+	db.CreatePayment(ctx, &store.Payment{
+		ID:             "pay_in",
+		Bolt11:         "lnbc2",
+		AmountSats:     200,
+		ReceiverPubkey: "merchant",
+		PaymentHash:    "hash_in",
+		Status:         "pending",
+	}, nil)
+
+	now := time.Now()
+	event := &store.PaymentEvent{
+		PaymentID:  "pay_out",
+		FromStatus: "pending",
+		ToStatus:   "paid",
+		Cause:      "payment",
+		Actor:      "merchant",
+	}
+	ok, err := db.CompleteOutgoingPayment(ctx, event, "preimage_abc", 2, &now)
+	if err != nil {
+		t.Fatalf("CompleteOutgoingPayment: %v", err)
+	}
+	if !ok {
+		t.Error("CompleteOutgoingPayment reported no change")
+	}
+	if ok, _ := db.CompleteOutgoingPayment(ctx, event, "preimage_abc", 2, &now); ok {
+		t.Error("completed the payment twice")
+	}
+	p, _ := db.GetPayment(ctx, "pay_out")
+	if p.Status != "paid" || p.Preimage != "preimage_abc" || p.FeeSats != 2 || p.Direction != "sent" {
+		t.Errorf("outgoing payment = %+v", p)
+	}
+
+	in, _ := db.GetPayment(ctx, "pay_in")
+	if in.Direction != "received" {
+		t.Errorf("Direction = %q, want received by default", in.Direction)
+	}
+
+	// Both directions show up in the user's history
+	payments, _ := db.ListPaymentsByUser(ctx, "merchant", 10, 0)
+	if len(payments) != 2 {
+		t.Errorf("history has %d payments, want 2", len(payments))
+	}
+
+	// Outgoing payments are not reconciled as incoming ones
+	unsettled, _ := db.ListUnsettledPayments(ctx, now, true, nil, 10)
+	if len(unsettled) != 1 || unsettled[0].ID != "pay_in" {
+		t.Errorf("unsettled = %v, want only pay_in", unsettled)
+	}
+}
+
+func TestSplitPayouts(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	db.CreateSplitRule(ctx, &store.SplitRule{ID: "spr_1", MerchantPubkey: "merchant", Destination: "a@example.com", Percent: 10, CreatedAt: now})
+	if err := db.DeleteSplitRule(ctx, "spr_1", "other"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("delete another merchant's rule: err = %v, want sql.ErrNoRows", err)
+	}
+
+	payout := &store.SplitPayout{
+		ID:             "spl_1",
+		PaymentID:      "pay_1",
+		RuleID:         "spr_1",
+		MerchantPubkey: "merchant",
+		Destination:    "a@example.com",
+		AmountSats:     100,
+		Status:         "pending",
+		NextAttemptAt:  now,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	if err := db.CreateSplitPayouts(ctx, []*store.SplitPayout{payout}); err != nil {
+		t.Fatalf("CreateSplitPayouts: %v", err)
+	}
+	// The same payment and rule again is ignored
+	dup := *payout
+	dup.ID = "spl_2"
+	if err := db.CreateSplitPayouts(ctx, []*store.SplitPayout{&dup}); err != nil {
+		t.Fatalf("CreateSplitPayouts again: %v", err)
+	}
+	payouts, _ := db.ListSplitPayouts(ctx, "pay_1")
+	if len(payouts) != 1 || payouts[0].ID != "spl_1" {
+		t.Fatalf("payouts = %+v, want only spl_1", payouts)
+	}
+
+	due, _ := db.ListDueSplitPayouts(ctx, now, 10)
+	if len(due) != 1 {
+		t.Fatalf("%d payouts due, want 1", len(due))
+	}
+
+	// Only one claim succeeds, and a claimed payout is not due
+	if ok, err := db.ClaimSplitPayout(ctx, "spl_1", now, now.Add(time.Minute)); !ok || err != nil {
+		t.Fatalf("ClaimSplitPayout = %v, %v", ok, err)
+	}
+	if ok, _ := db.ClaimSplitPayout(ctx, "spl_1", now, now.Add(time.Minute)); ok {
+		t.Error("claimed twice")
+	}
+	if due, _ := db.ListDueSplitPayouts(ctx, now, 10); len(due) != 0 {
+		t.Errorf("%d payouts due while claimed, want 0", len(due))
+	}
+
+	payout.Status = "paid"
+	payout.Attempts = 1
+	payout.PayoutPaymentID = "pay_out"
+	if err := db.UpdateSplitPayout(ctx, payout); err != nil {
+		t.Fatalf("UpdateSplitPayout: %v", err)
+	}
+	payouts, _ = db.ListSplitPayouts(ctx, "pay_1")
+	if payouts[0].Status != "paid" || payouts[0].Attempts != 1 || payouts[0].PayoutPaymentID != "pay_out" {
+		t.Errorf("payout = %+v", payouts[0])
+	}
+	if due, _ := db.ListDueSplitPayouts(ctx, now.Add(time.Hour), 10); len(due) != 0 {
+		t.Errorf("%d paid payouts due, want 0", len(due))
+	}
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	endpoint := &store.WebhookEndpoint{
+		ID:             "whe_1",
+		MerchantPubkey: "merchant",
+		URL:            "https://shop.example.com/hooks",
+		Secret:         "whsec_1",
+		Events:         []string{"payment.paid", "payment.expired"},
+		CreatedAt:      now,
+	}
+	if err := db.CreateWebhookEndpoint(ctx, endpoint); err != nil {
+		t.Fatalf("CreateWebhookEndpoint: %v", err)
+	}
+	got, err := db.GetWebhookEndpoint(ctx, "whe_1")
+	if err != nil {
+		t.Fatalf("GetWebhookEndpoint: %v", err)
+	}
+	if got.Secret != "whsec_1" || len(got.Events) != 2 || got.Events[1] != "payment.expired" {
+		t.Errorf("endpoint = %+v", got)
+	}
+	if err := db.DeleteWebhookEndpoint(ctx, "whe_1", "other"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("delete another merchant's endpoint: err = %v, want sql.ErrNoRows", err)
+	}
+
+	var deliveries []*store.WebhookDelivery
+	for i, payment := range []string{"pay_1", "pay_2", "pay_2"} {
+		deliveries = append(deliveries, &store.WebhookDelivery{
+			ID:             fmt.Sprintf("whd_%d", i),
+			EndpointID:     "whe_1",
+			MerchantPubkey: "merchant",
+			EventID:        fmt.Sprintf("evt_%d", i),
+			EventType:      "payment.paid",
+			PaymentID:      payment,
+			Payload:        []byte(`{"id":"evt"}`),
+			Status:         "pending",
+			NextAttemptAt:  now,
+			CreatedAt:      now.Add(time.Duration(i) * time.Second),
+			UpdatedAt:      now,
+		})
+	}
+	if err := db.CreateWebhookDeliveries(ctx, deliveries); err != nil {
+		t.Fatalf("CreateWebhookDeliveries: %v", err)
+	}
+
+	list, _ := db.ListWebhookDeliveries(ctx, &store.WebhookDeliveryFilter{MerchantPubkey: "merchant", Limit: 10})
+	if len(list) != 3 || list[0].ID != "whd_2" {
+		t.Fatalf("got %d deliveries starting with %v, want 3 newest first", len(list), list)
+	}
+	list, _ = db.ListWebhookDeliveries(ctx, &store.WebhookDeliveryFilter{MerchantPubkey: "merchant", PaymentID: "pay_2", Limit: 10})
+	if len(list) != 2 {
+		t.Errorf("got %d deliveries for pay_2, want 2", len(list))
+	}
+	if list, _ := db.ListWebhookDeliveries(ctx, &store.WebhookDeliveryFilter{MerchantPubkey: "other", Limit: 10}); len(list) != 0 {
+		t.Errorf("another merchant sees %d deliveries", len(list))
+	}
+
+	if ok, err := db.ClaimWebhookDelivery(ctx, "whd_0", now, now.Add(time.Minute)); !ok || err != nil {
+		t.Fatalf("ClaimWebhookDelivery = %v, %v", ok, err)
+	}
+	if ok, _ := db.ClaimWebhookDelivery(ctx, "whd_0", now, now.Add(time.Minute)); ok {
+		t.Error("claimed twice")
+	}
+	if due, _ := db.ListDueWebhookDeliveries(ctx, now, 10); len(due) != 2 {
+		t.Errorf("%d deliveries due, want 2", len(due))
+	}
+
+	d := deliveries[0]
+	d.Status = "delivered"
+	d.Attempts = 1
+	d.ResponseStatus = 204
+	if err := db.UpdateWebhookDelivery(ctx, d); err != nil {
+		t.Fatalf("UpdateWebhookDelivery: %v", err)
+	}
+	d, _ = db.GetWebhookDelivery(ctx, "whd_0")
+	if d.Status != "delivered" || d.ResponseStatus != 204 || string(d.Payload) != `{"id":"evt"}` {
+		t.Errorf("delivery = %+v", d)
+	}
+	list, _ = db.ListWebhookDeliveries(ctx, &store.WebhookDeliveryFilter{MerchantPubkey: "merchant", Status: "delivered", Limit: 10})
+	if len(list) != 1 {
+		t.Errorf("got %d delivered, want 1", len(list))
+	}
+}
+
+func TestSpendLimits(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+
+	db.CreatePayment(ctx, &store.Payment{ID: "pay_sale", AmountSats: 10_000, ReceiverPubkey: "merchant", PaymentHash: "hash_sale", Status: "pending"}, nil)
+	markPaid(t, db, "pay_sale", nil)
+	// Neither pending invoices nor other wallets count
+	db.CreatePayment(ctx, &store.Payment{ID: "pay_open", AmountSats: 5000, ReceiverPubkey: "merchant", PaymentHash: "hash_open", Status: "pending"}, nil)
+	db.CreatePayment(ctx, &store.Payment{ID: "pay_own", AmountSats: 5000, ReceiverPubkey: "merchant", PaymentHash: "hash_own", Status: "paid", WalletID: "wallet_1"}, nil)
+	// A credit transferred to another user
+	db.CreatePayment(ctx, &store.Payment{ID: "pay_split", AmountSats: 1000, SenderPubkey: "merchant", ReceiverPubkey: "landlord", PaymentHash: "spl_1", Status: "paid"}, nil)
+
+	if balance, err := db.GetLedgerBalance(ctx, "merchant"); err != nil || balance != 9000 {
+		t.Fatalf("GetLedgerBalance = %d, %v, want 9000", balance, err)
+	}
+	if balance, _ := db.GetLedgerBalance(ctx, "landlord"); balance != 1000 {
+		t.Errorf("landlord balance = %d, want 1000", balance)
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	withdraw := func(id string, amount int64, limit store.SpendLimit) bool {
+		t.Helper()
+		ok, err := db.CreateSpend(ctx, &store.Payment{
+			ID:           id,
+			AmountSats:   amount,
+			SenderPubkey: "merchant",
+			PaymentHash:  "hash_" + id,
+			Status:       "pending",
+			Direction:    "sent",
+			Withdrawal:   true,
+		}, limit, nil)
+		if err != nil {
+			t.Fatalf("CreateSpend: %v", err)
+		}
+		return ok
+	}
+
+	if !withdraw("wd_1", 4000, store.SpendLimit{Since: today, DailySats: 6000, MinLedgerSats: 4100}) {
+		t.Fatal("first withdrawal rejected")
+	}
+	if withdraw("wd_2", 3000, store.SpendLimit{Since: today, DailySats: 6000}) {
+		t.Error("withdrawal above the daily limit was stored")
+	}
+	if withdraw("wd_3", 2000, store.SpendLimit{Since: today, DailySats: 6000, MinLedgerSats: 5100}) {
+		t.Error("withdrawal above the ledger balance was stored")
+	}
+	// Without limits, e.g. from the merchant's own wallet
+	if !withdraw("wd_4", 2000, store.SpendLimit{}) {
+		t.Fatal("unlimited withdrawal rejected")
+	}
+
+	if total, err := db.SumWithdrawals(ctx, "merchant", today); err != nil || total != 6000 {
+		t.Errorf("SumWithdrawals = %d, %v, want 6000", total, err)
+	}
+	if total, _ := db.SumWithdrawals(ctx, "merchant", today.Add(24*time.Hour)); total != 0 {
+		t.Errorf("withdrawals since tomorrow = %d, want 0", total)
+	}
+	// A failed withdrawal frees its amount again
+	db.CompleteOutgoingPayment(ctx, &store.PaymentEvent{PaymentID: "wd_1", FromStatus: "pending", ToStatus: "failed"}, "", 0, nil)
+	db.CompleteOutgoingPayment(ctx, &store.PaymentEvent{PaymentID: "wd_4", FromStatus: "pending", ToStatus: "paid"}, "preimage", 10, nil)
+	if balance, _ := db.GetLedgerBalance(ctx, "merchant"); balance != 6990 {
+		t.Errorf("balance after withdrawals = %d, want 6990", balance)
+	}
+	if p, _ := db.GetPayment(ctx, "wd_4"); !p.Withdrawal {
+		t.Error("Withdrawal not stored")
+	}
+
+	// Other payments need the ledger balance but ignore the daily limit
+	spend := func(p *store.Payment, minLedger int64) bool {
+		t.Helper()
+		ok, err := db.CreateSpend(ctx, p, store.SpendLimit{Since: today, DailySats: 1, MinLedgerSats: minLedger}, nil)
+		if err != nil {
+			t.Fatalf("CreateSpend: %v", err)
+		}
+		return ok
+	}
+	if !spend(&store.Payment{ID: "pay_out", AmountSats: 3000, SenderPubkey: "merchant", PaymentHash: "hash_out", Status: "pending", Direction: "sent"}, 3100) {
+		t.Fatal("payment within the ledger balance rejected")
+	}
+	if spend(&store.Payment{ID: "pay_credit", AmountSats: 4000, SenderPubkey: "merchant", ReceiverPubkey: "landlord", PaymentHash: "spl_2", Status: "paid"}, 4000) {
+		t.Error("credit above the ledger balance was stored")
+	}
+	// Transfers to other wallets count while their invoice is open
+	db.CreatePayment(ctx, &store.Payment{ID: "pay_transfer", AmountSats: 990, SenderPubkey: "merchant", ReceiverPubkey: "landlord", PaymentHash: "hash_transfer", Status: "pending", WalletID: "wallet_2"}, nil)
+	if balance, _ := db.GetLedgerBalance(ctx, "merchant"); balance != 3000 {
+		t.Errorf("balance after payment and transfer = %d, want 3000", balance)
+	}
+	if ok, _ := db.CreateRefund(ctx, &store.Payment{ID: "ref_1", AmountSats: 3500, SenderPubkey: "merchant", PaymentHash: "hash_ref_1", Status: "pending", Direction: "sent", RefundOf: "pay_sale"}, 10_000, store.SpendLimit{MinLedgerSats: 3500}, nil); ok {
+		t.Error("refund above the ledger balance was stored")
+	}
+}
+
+func TestLightningAddresses(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	claimed, err := db.ClaimLightningAddress(ctx, &store.LightningAddress{Name: "shop", MerchantPubkey: "merchant", Description: "The shop", CreatedAt: now})
+	if err != nil || !claimed {
+		t.Fatalf("ClaimLightningAddress = %v, %v", claimed, err)
+	}
+	if claimed, _ := db.ClaimLightningAddress(ctx, &store.LightningAddress{Name: "shop", MerchantPubkey: "other", CreatedAt: now}); claimed {
+		t.Error("claimed a name another merchant holds")
+	}
+	// Claiming again updates the description
+	if claimed, _ := db.ClaimLightningAddress(ctx, &store.LightningAddress{Name: "shop", MerchantPubkey: "merchant", Description: "Corner shop", CreatedAt: now}); !claimed {
+		t.Error("merchant could not claim its own name again")
+	}
+
+	a, err := db.GetLightningAddress(ctx, "shop")
+	if err != nil {
+		t.Fatalf("GetLightningAddress: %v", err)
+	}
+	if a.MerchantPubkey != "merchant" || a.Description != "Corner shop" {
+		t.Errorf("address = %+v", a)
+	}
+	if _, err := db.GetLightningAddress(ctx, "nobody"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("unknown name: err = %v, want sql.ErrNoRows", err)
+	}
+
+	db.ClaimLightningAddress(ctx, &store.LightningAddress{Name: "tips", MerchantPubkey: "merchant", CreatedAt: now.Add(time.Second)})
+	if list, _ := db.ListLightningAddresses(ctx, "merchant"); len(list) != 2 || list[0].Name != "shop" || list[1].Name != "tips" {
+		t.Errorf("ListLightningAddresses = %v, want shop and tips", list)
+	}
+
+	if err := db.DeleteLightningAddress(ctx, "shop", "other"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("deleting another merchant's name: err = %v, want sql.ErrNoRows", err)
+	}
+	if err := db.DeleteLightningAddress(ctx, "shop", "merchant"); err != nil {
+		t.Fatalf("DeleteLightningAddress: %v", err)
+	}
+	if claimed, _ := db.ClaimLightningAddress(ctx, &store.LightningAddress{Name: "shop", MerchantPubkey: "other", CreatedAt: now}); !claimed {
+		t.Error("released name could not be claimed")
+	}
+}
@@ -9,27 +9,233 @@ type User struct {
 	Pubkey         string
 	IsMerchant     bool
 	LNbitsWalletID string
-	CreatedAt      time.Time
+	// LNbitsUserID owns the user's own wallet, and the keys of that
+	// wallet are stored encrypted. All three are empty for users whose
+	// payments go through the shared wallet.
+	LNbitsUserID     string
+	LNbitsAdminKey   string
+	LNbitsInvoiceKey string
+	CreatedAt        time.Time
 }
 
 type Payment struct {
-	ID             string
-	Bolt11         string
-	AmountSats     int64
-	Memo           string
-	SenderPubkey   string
-	ReceiverPubkey string
-	PaymentHash    string
-	Status         string // pending, paid, expired
-	CreatedAt      time.Time
-	SettledAt      *time.Time
+	ID              string
+	Bolt11          string
+	AmountSats      int64
+	Memo            string
+	SenderPubkey    string
+	ReceiverPubkey  string
+	PaymentHash     string
+	Status          string // pending, paid, expired, refunded, failed
+	CreatedAt       time.Time
+	SettledAt       *time.Time
+	CreatedByPubkey string // staff member who created it for the receiver, if any
+	ExpiresAt       *time.Time
+	// Fiat quote the amount was converted from, if it was requested in a
+	// fiat currency. FiatAmount is in the currency's minor unit.
+	FiatAmount   int64
+	FiatCurrency string
+	ExchangeRate float64 // price of one BTC in FiatCurrency
+	RateSource   string
+	Direction    string // received, sent
+	Preimage     string
+	FeeSats      int64  // routing fee paid, for sent payments
+	RefundOf     string // ID of the payment this refunds, for refunds
+	// RefundedSats is the total of the payment's paid and in-flight
+	// refunds. It is computed, not stored.
+	RefundedSats int64
+	// SubtotalSats and TipSats split AmountSats for invoices with a tip.
+	SubtotalSats int64
+	TipSats      int64
+	// WebhookToken authenticates LNbits webhooks for the invoice. It is
+	// never sent to clients.
+	WebhookToken string `json:"-"`
+	// WalletID is the LNbits wallet the payment was made in: the
+	// merchant's own, or empty for the shared wallet.
+	WalletID string
+	// Withdrawal marks sent payments a merchant makes out of their
+	// balance, as a withdrawal or by paying an invoice. They count toward
+	// the daily limit.
+	Withdrawal bool
+}
+
+// SpendLimit bounds a payment out of the sender's balance as it is stored.
+type SpendLimit struct {
+	// DailySats caps the sender's paid and in-flight withdrawals since
+	// Since, this one included; zero means no cap.
+	Since     time.Time
+	DailySats int64
+	// MinLedgerSats, if positive, is the ledger balance the sender must
+	// have before the payment.
+	MinLedgerSats int64
 }
 
 type MerchantDailyStats struct {
 	Pubkey           string
 	Date             string
-	TotalSats        int64
+	TotalSats        int64 // GrossSats minus RefundedSats
 	TransactionCount int
+	GrossSats        int64
+	RefundedSats     int64
+	RefundCount      int
+	TipSats          int64 // included in GrossSats
+}
+
+// PaymentEvent is one entry of a payment's append-only status history.
+// FromStatus is empty for the event that records its creation.
+type PaymentEvent struct {
+	ID         int64
+	PaymentID  string
+	FromStatus string
+	ToStatus   string
+	// Cause is what triggered the change, e.g. "webhook" or "expiry", and
+	// Actor the pubkey that did, or "system".
+	Cause     string
+	Actor     string
+	CreatedAt time.Time
+}
+
+// TipSummary totals one day of a merchant's settled payments taken by one
+// person: a staff member, or the merchant itself.
+type TipSummary struct {
+	Date         string
+	StaffPubkey  string
+	PaymentCount int
+	SubtotalSats int64
+	TipSats      int64
+}
+
+type Session struct {
+	ID        string
+	Pubkey    string
+	TokenHash string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	RevokedAt *time.Time
+}
+
+type APIKey struct {
+	ID          string
+	OwnerPubkey string
+	Label       string
+	Scopes      []string
+	KeyHash     string
+	CreatedAt   time.Time
+	ExpiresAt   *time.Time
+	RevokedAt   *time.Time
+}
+
+type StaffGrant struct {
+	MerchantPubkey string
+	StaffPubkey    string
+	Permissions    []string
+	CreatedAt      time.Time
+}
+
+// SplitRule sends part of each settled payment a merchant receives to
+// someone else. Exactly one of Percent and AmountSats is set.
+type SplitRule struct {
+	ID             string
+	MerchantPubkey string
+	// Destination is a Lightning address or the hex pubkey of a user on
+	// this instance.
+	Destination string
+	Percent     float64
+	AmountSats  int64
+	Label       string
+	CreatedAt   time.Time
+}
+
+// SplitPayout is one rule applied to one settled payment. It stays pending
+// while attempts remain and ends up paid or failed.
+type SplitPayout struct {
+	ID             string
+	PaymentID      string
+	RuleID         string
+	MerchantPubkey string
+	Destination    string
+	AmountSats     int64
+	Status         string
+	Attempts       int
+	LastError      string
+	NextAttemptAt  time.Time
+	// PayoutPaymentID is the payment that carries the payout once one
+	// has been made.
+	PayoutPaymentID string
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// WebhookEndpoint is a URL a merchant has told about its payments. Events
+// lists the event types it receives; empty means all of them.
+type WebhookEndpoint struct {
+	ID             string
+	MerchantPubkey string
+	URL            string
+	// Secret signs the deliveries so the receiver can check them.
+	Secret    string
+	Events    []string
+	CreatedAt time.Time
+}
+
+// WebhookDelivery is one event sent to one endpoint. It stays pending
+// while attempts remain and ends up delivered or dead. Payload is the
+// request body, fixed when the event happened.
+type WebhookDelivery struct {
+	ID             string
+	EndpointID     string
+	MerchantPubkey string
+	EventID        string
+	EventType      string
+	PaymentID      string
+	Payload        []byte
+	Status         string
+	Attempts       int
+	LastError      string
+	ResponseStatus int // of the last attempt, 0 if there was no response
+	NextAttemptAt  time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// WebhookDeliveryFilter selects a merchant's deliveries, newest first.
+// Empty fields match everything.
+type WebhookDeliveryFilter struct {
+	MerchantPubkey string
+	EndpointID     string
+	PaymentID      string
+	Status         string
+	Limit          int
+	Offset         int
+}
+
+// LightningAddress is a name a merchant has claimed to be paid at over
+// LNURL-pay, as name@domain or through a static QR code.
+type LightningAddress struct {
+	Name           string
+	MerchantPubkey string
+	// Description is shown to payers; the address itself when empty.
+	Description string
+	CreatedAt   time.Time
+}
+
+type DeniedPubkey struct {
+	Pubkey    string
+	Reason    string
+	DeniedBy  string
+	CreatedAt time.Time
+}
+
+// IdempotencyRecord remembers the response to a request made with an
+// Idempotency-Key. StatusCode is zero while the first request is still
+// being processed.
+type IdempotencyRecord struct {
+	Pubkey      string
+	Key         string
+	RequestHash string
+	StatusCode  int
+	Response    []byte
+	ExpiresAt   time.Time
 }
 
 type Store interface {
@@ -37,17 +243,91 @@ type Store interface {
 	CreateUser(ctx context.Context, user *User) error
 	GetUser(ctx context.Context, pubkey string) (*User, error)
 	UpdateUserMerchant(ctx context.Context, pubkey string, isMerchant bool) error
+	SetUserWallet(ctx context.Context, user *User) (bool, error)
 
 	// Payments
-	CreatePayment(ctx context.Context, payment *Payment) error
+	CreatePayment(ctx context.Context, payment *Payment, e *PaymentEvent) error
 	GetPayment(ctx context.Context, id string) (*Payment, error)
 	GetPaymentByHash(ctx context.Context, paymentHash string) (*Payment, error)
-	UpdatePaymentStatus(ctx context.Context, id string, status string, settledAt *time.Time) error
 	ListPaymentsByUser(ctx context.Context, pubkey string, limit, offset int) ([]*Payment, error)
+	ExpirePendingPayments(ctx context.Context, now time.Time) ([]*Payment, error)
+	ListUnsettledPayments(ctx context.Context, now time.Time, includeExpired bool, after *Payment, limit int) ([]*Payment, error)
+	TransitionPaymentStatus(ctx context.Context, e *PaymentEvent, settledAt *time.Time) (bool, error)
+	CompleteOutgoingPayment(ctx context.Context, e *PaymentEvent, preimage string, feeSats int64, settledAt *time.Time) (bool, error)
+	ListPaymentEvents(ctx context.Context, paymentID string) ([]*PaymentEvent, error)
+	CreateRefund(ctx context.Context, payment *Payment, maxSats int64, limit SpendLimit, e *PaymentEvent) (bool, error)
+	CreateSpend(ctx context.Context, payment *Payment, limit SpendLimit, e *PaymentEvent) (bool, error)
+	GetLedgerBalance(ctx context.Context, pubkey string) (int64, error)
+	SumWithdrawals(ctx context.Context, pubkey string, since time.Time) (int64, error)
 
 	// Merchant
 	GetMerchantDailyStats(ctx context.Context, pubkey string, date string) (*MerchantDailyStats, error)
 	ListMerchantTransactions(ctx context.Context, pubkey string, limit, offset int) ([]*Payment, error)
+	ListMerchantSalesSince(ctx context.Context, pubkey string, since time.Time, limit int) ([]*Payment, error)
+	ListTipSummaries(ctx context.Context, pubkey string, from, to string) ([]*TipSummary, error)
+
+	// Staff
+	UpsertStaffGrant(ctx context.Context, grant *StaffGrant) error
+	GetStaffGrant(ctx context.Context, merchantPubkey, staffPubkey string) (*StaffGrant, error)
+	ListStaffGrantsByMerchant(ctx context.Context, merchantPubkey string) ([]*StaffGrant, error)
+	ListStaffGrantsByStaff(ctx context.Context, staffPubkey string) ([]*StaffGrant, error)
+	DeleteStaffGrant(ctx context.Context, merchantPubkey, staffPubkey string) error
+
+	// Splits
+	CreateSplitRule(ctx context.Context, rule *SplitRule) error
+	ListSplitRules(ctx context.Context, merchantPubkey string) ([]*SplitRule, error)
+	DeleteSplitRule(ctx context.Context, id, merchantPubkey string) error
+	CreateSplitPayouts(ctx context.Context, payouts []*SplitPayout) error
+	ListSplitPayouts(ctx context.Context, paymentID string) ([]*SplitPayout, error)
+	ListDueSplitPayouts(ctx context.Context, now time.Time, limit int) ([]*SplitPayout, error)
+	ClaimSplitPayout(ctx context.Context, id string, now, until time.Time) (bool, error)
+	UpdateSplitPayout(ctx context.Context, payout *SplitPayout) error
+
+	// Webhooks
+	CreateWebhookEndpoint(ctx context.Context, endpoint *WebhookEndpoint) error
+	GetWebhookEndpoint(ctx context.Context, id string) (*WebhookEndpoint, error)
+	ListWebhookEndpoints(ctx context.Context, merchantPubkey string) ([]*WebhookEndpoint, error)
+	DeleteWebhookEndpoint(ctx context.Context, id, merchantPubkey string) error
+	CreateWebhookDeliveries(ctx context.Context, deliveries []*WebhookDelivery) error
+	GetWebhookDelivery(ctx context.Context, id string) (*WebhookDelivery, error)
+	ListWebhookDeliveries(ctx context.Context, filter *WebhookDeliveryFilter) ([]*WebhookDelivery, error)
+	ListDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]*WebhookDelivery, error)
+	ClaimWebhookDelivery(ctx context.Context, id string, now, until time.Time) (bool, error)
+	UpdateWebhookDelivery(ctx context.Context, delivery *WebhookDelivery) error
+
+	// Lightning addresses
+	ClaimLightningAddress(ctx context.Context, address *LightningAddress) (bool, error)
+	GetLightningAddress(ctx context.Context, name string) (*LightningAddress, error)
+	ListLightningAddresses(ctx context.Context, merchantPubkey string) ([]*LightningAddress, error)
+	DeleteLightningAddress(ctx context.Context, name, merchantPubkey string) error
+
+	// Denylist
+	DenyPubkey(ctx context.Context, entry *DeniedPubkey) error
+	IsPubkeyDenied(ctx context.Context, pubkey string) (bool, error)
+	ListDeniedPubkeys(ctx context.Context) ([]*DeniedPubkey, error)
+	AllowPubkey(ctx context.Context, pubkey string) error
+
+	// Auth
+	MarkAuthEventSeen(ctx context.Context, eventID string, expiresAt time.Time) (bool, error)
+	CreateAuthChallenge(ctx context.Context, challenge string, expiresAt time.Time) error
+	ConsumeAuthChallenge(ctx context.Context, challenge string) (bool, error)
+
+	// Idempotency
+	ReserveIdempotencyKey(ctx context.Context, rec *IdempotencyRecord) (*IdempotencyRecord, bool, error)
+	CompleteIdempotencyKey(ctx context.Context, pubkey, key string, statusCode int, response []byte) error
+	ReleaseIdempotencyKey(ctx context.Context, pubkey, key string) error
+
+	// Sessions
+	CreateSession(ctx context.Context, session *Session) error
+	GetSessionByTokenHash(ctx context.Context, tokenHash string) (*Session, error)
+	ListSessions(ctx context.Context, pubkey string) ([]*Session, error)
+	RevokeSession(ctx context.Context, id, pubkey string) error
+
+	// API keys
+	CreateAPIKey(ctx context.Context, key *APIKey) error
+	GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error)
+	ListAPIKeys(ctx context.Context, ownerPubkey string) ([]*APIKey, error)
+	RevokeAPIKey(ctx context.Context, id, ownerPubkey string) error
 
 	Close() error
 }
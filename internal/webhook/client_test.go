@@ -0,0 +1,38 @@
+package webhook_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/webhook"
+)
+
+func TestNewClient_RefusesPrivateAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached a loopback server")
+	}))
+	defer srv.Close()
+
+	client := webhook.NewClient(5 * time.Second)
+	for _, url := range []string{
+		srv.URL,
+		"http://localhost:1/",
+		"http://10.0.0.1:1/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[::1]:1/",
+		"http://100.64.0.1:1/",
+	} {
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, url, nil)
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if !errors.Is(err, webhook.ErrForbiddenAddress) {
+			t.Errorf("%s: err = %v, want ErrForbiddenAddress", url, err)
+		}
+	}
+}
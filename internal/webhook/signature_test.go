@@ -0,0 +1,45 @@
+package webhook_test
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/webhook"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	body := []byte(`{"type":"payment.paid"}`)
+	now := time.Unix(1_800_000_000, 0)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	sig := webhook.Sign("whsec_test", now.Unix(), body)
+
+	if err := webhook.Verify("whsec_test", ts, sig, body, now, webhook.DefaultTolerance); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		signature string
+		body      string
+		now       time.Time
+		want      error
+	}{
+		{"wrong secret", "whsec_other", ts, sig, string(body), now, webhook.ErrInvalidSignature},
+		{"tampered body", "whsec_test", ts, sig, `{"type":"payment.expired"}`, now, webhook.ErrInvalidSignature},
+		{"changed timestamp", "whsec_test", strconv.FormatInt(now.Unix()+1, 10), sig, string(body), now, webhook.ErrInvalidSignature},
+		{"bad timestamp", "whsec_test", "yesterday", sig, string(body), now, webhook.ErrInvalidSignature},
+		{"replayed later", "whsec_test", ts, sig, string(body), now.Add(10 * time.Minute), webhook.ErrStaleTimestamp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := webhook.Verify(tt.secret, tt.timestamp, tt.signature, []byte(tt.body), tt.now, webhook.DefaultTolerance)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,436 @@
+// Package webhook tells merchants' own servers about their payments. Events
+// are stored as deliveries when they happen and sent by a background
+// worker, which signs each request and retries failed ones with backoff.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/store"
+)
+
+// Event types, one per final payment status.
+const (
+	EventPaymentPaid     = "payment.paid"
+	EventPaymentExpired  = "payment.expired"
+	EventPaymentRefunded = "payment.refunded"
+	EventPaymentFailed   = "payment.failed"
+)
+
+// EventTypes lists every event type an endpoint can subscribe to.
+var EventTypes = []string{EventPaymentPaid, EventPaymentExpired, EventPaymentRefunded, EventPaymentFailed}
+
+// Delivery statuses.
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusDead      = "dead"
+)
+
+// MaxEndpoints bounds how many endpoints a merchant can register.
+const MaxEndpoints = 5
+
+// MaxAttempts is how often a delivery is tried before it is marked dead.
+// Attempts back off exponentially from retryBase.
+const MaxAttempts = 10
+
+const (
+	retryBase = 30 * time.Second
+	// claimLease keeps other workers off a delivery while an attempt
+	// runs. It is longer than any request may take.
+	claimLease = 2 * time.Minute
+	batchSize  = 100
+)
+
+var (
+	ErrInvalidEndpoint  = errors.New("invalid webhook endpoint")
+	ErrEndpointNotFound = errors.New("webhook endpoint not found")
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+)
+
+type Service struct {
+	store  store.Store
+	client *http.Client
+	wake   chan struct{}
+}
+
+// NewService returns a service that sends deliveries with client, which
+// should have a timeout and, like NewClient's, refuse private addresses.
+func NewService(store store.Store, client *http.Client) *Service {
+	return &Service{
+		store:  store,
+		client: client,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// CreateEndpoint registers url to receive the merchant's events of the
+// given types, or all of them if events is empty. The returned endpoint
+// carries the signing secret.
+func (s *Service) CreateEndpoint(ctx context.Context, merchantPubkey, rawURL string, events []string) (*store.WebhookEndpoint, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.User != nil {
+		return nil, fmt.Errorf("%w: url must be an http or https URL", ErrInvalidEndpoint)
+	}
+	var types []string
+	for _, e := range events {
+		if !slices.Contains(EventTypes, e) {
+			return nil, fmt.Errorf("%w: unknown event %q", ErrInvalidEndpoint, e)
+		}
+		if !slices.Contains(types, e) {
+			types = append(types, e)
+		}
+	}
+
+	existing, err := s.store.ListWebhookEndpoints(ctx, merchantPubkey)
+	if err != nil {
+		return nil, fmt.Errorf("list webhook endpoints: %w", err)
+	}
+	if len(existing) >= MaxEndpoints {
+		return nil, fmt.Errorf("%w: at most %d endpoints", ErrInvalidEndpoint, MaxEndpoints)
+	}
+
+	id, err := newID("whe_", 16)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := newID("whsec_", 32)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := &store.WebhookEndpoint{
+		ID:             id,
+		MerchantPubkey: merchantPubkey,
+		URL:            u.String(),
+		Secret:         secret,
+		Events:         types,
+		CreatedAt:      time.Now().UTC(),
+	}
+	if err := s.store.CreateWebhookEndpoint(ctx, endpoint); err != nil {
+		return nil, fmt.Errorf("store webhook endpoint: %w", err)
+	}
+	return endpoint, nil
+}
+
+func (s *Service) ListEndpoints(ctx context.Context, merchantPubkey string) ([]*store.WebhookEndpoint, error) {
+	return s.store.ListWebhookEndpoints(ctx, merchantPubkey)
+}
+
+// DeleteEndpoint removes one of the merchant's endpoints. Its pending
+// deliveries are marked dead when they come up.
+func (s *Service) DeleteEndpoint(ctx context.Context, id, merchantPubkey string) error {
+	err := s.store.DeleteWebhookEndpoint(ctx, id, merchantPubkey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrEndpointNotFound
+	}
+	return err
+}
+
+// ListDeliveries returns the merchant's deliveries matching filter, newest
+// first. filter.MerchantPubkey is set to merchantPubkey.
+func (s *Service) ListDeliveries(ctx context.Context, merchantPubkey string, filter store.WebhookDeliveryFilter) ([]*store.WebhookDelivery, error) {
+	filter.MerchantPubkey = merchantPubkey
+	return s.store.ListWebhookDeliveries(ctx, &filter)
+}
+
+// GetDelivery returns one of the merchant's deliveries.
+func (s *Service) GetDelivery(ctx context.Context, id, merchantPubkey string) (*store.WebhookDelivery, error) {
+	d, err := s.store.GetWebhookDelivery(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && d.MerchantPubkey != merchantPubkey) {
+		return nil, ErrDeliveryNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get webhook delivery: %w", err)
+	}
+	return d, nil
+}
+
+// Redeliver sends a delivery's event to its endpoint again, as a new
+// delivery with the same payload and event ID so receivers can tell it
+// is a repeat.
+func (s *Service) Redeliver(ctx context.Context, id, merchantPubkey string) (*store.WebhookDelivery, error) {
+	orig, err := s.GetDelivery(ctx, id, merchantPubkey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.store.GetWebhookEndpoint(ctx, orig.EndpointID); errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrEndpointNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("get webhook endpoint: %w", err)
+	}
+
+	d, err := newDelivery(orig.EndpointID, merchantPubkey, orig.EventID, orig.EventType, orig.PaymentID, orig.Payload, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.CreateWebhookDeliveries(ctx, []*store.WebhookDelivery{d}); err != nil {
+		return nil, fmt.Errorf("store webhook delivery: %w", err)
+	}
+	s.kick()
+	return d, nil
+}
+
+// Event is the body of a delivery.
+type Event struct {
+	ID        string       `json:"id"`
+	Type      string       `json:"type"`
+	CreatedAt time.Time    `json:"created_at"`
+	Data      EventPayment `json:"data"`
+}
+
+// EventPayment is the payment an event is about.
+type EventPayment struct {
+	ID             string     `json:"id"`
+	PaymentHash    string     `json:"payment_hash"`
+	Status         string     `json:"status"`
+	Direction      string     `json:"direction"`
+	AmountSats     int64      `json:"amount_sats"`
+	SubtotalSats   int64      `json:"subtotal_sats,omitempty"`
+	TipSats        int64      `json:"tip_sats,omitempty"`
+	FeeSats        int64      `json:"fee_sats,omitempty"`
+	RefundedSats   int64      `json:"refunded_sats,omitempty"`
+	RefundOf       string     `json:"refund_of,omitempty"`
+	Memo           string     `json:"memo"`
+	FiatAmount     int64      `json:"fiat_amount,omitempty"`
+	FiatCurrency   string     `json:"fiat_currency,omitempty"`
+	ReceiverPubkey string     `json:"receiver_pubkey,omitempty"`
+	SenderPubkey   string     `json:"sender_pubkey,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	SettledAt      *time.Time `json:"settled_at,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+}
+
+// PaymentChanged queues the event for p's new status to the endpoints of
+// the merchant it belongs to: the receiver of an incoming payment, the
+// sender of an outgoing one. Errors are logged only, so that the payment
+// change itself stands.
+func (s *Service) PaymentChanged(ctx context.Context, p *store.Payment) {
+	eventType := "payment." + p.Status
+	if !slices.Contains(EventTypes, eventType) {
+		return
+	}
+	merchant := p.ReceiverPubkey
+	if p.Direction == "sent" {
+		merchant = p.SenderPubkey
+	}
+
+	endpoints, err := s.store.ListWebhookEndpoints(ctx, merchant)
+	if err != nil {
+		slog.Error("failed to load webhook endpoints", "payment_id", p.ID, "error", err)
+		return
+	}
+	endpoints = slices.DeleteFunc(endpoints, func(e *store.WebhookEndpoint) bool {
+		return len(e.Events) > 0 && !slices.Contains(e.Events, eventType)
+	})
+	if len(endpoints) == 0 {
+		return
+	}
+
+	if err := s.queue(ctx, merchant, eventType, p, endpoints); err != nil {
+		slog.Error("failed to queue webhooks", "payment_id", p.ID, "event", eventType, "error", err)
+		return
+	}
+	s.kick()
+}
+
+func (s *Service) queue(ctx context.Context, merchant, eventType string, p *store.Payment, endpoints []*store.WebhookEndpoint) error {
+	now := time.Now().UTC()
+	eventID, err := newID("evt_", 16)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(&Event{
+		ID:        eventID,
+		Type:      eventType,
+		CreatedAt: now,
+		Data: EventPayment{
+			ID:             p.ID,
+			PaymentHash:    p.PaymentHash,
+			Status:         p.Status,
+			Direction:      p.Direction,
+			AmountSats:     p.AmountSats,
+			SubtotalSats:   p.SubtotalSats,
+			TipSats:        p.TipSats,
+			FeeSats:        p.FeeSats,
+			RefundedSats:   p.RefundedSats,
+			RefundOf:       p.RefundOf,
+			Memo:           p.Memo,
+			FiatAmount:     p.FiatAmount,
+			FiatCurrency:   p.FiatCurrency,
+			ReceiverPubkey: p.ReceiverPubkey,
+			SenderPubkey:   p.SenderPubkey,
+			CreatedAt:      p.CreatedAt,
+			SettledAt:      p.SettledAt,
+			ExpiresAt:      p.ExpiresAt,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("encode event: %w", err)
+	}
+
+	deliveries := make([]*store.WebhookDelivery, 0, len(endpoints))
+	for _, e := range endpoints {
+		d, err := newDelivery(e.ID, merchant, eventID, eventType, p.ID, payload, now)
+		if err != nil {
+			return err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return s.store.CreateWebhookDeliveries(ctx, deliveries)
+}
+
+func newDelivery(endpointID, merchant, eventID, eventType, paymentID string, payload []byte, now time.Time) (*store.WebhookDelivery, error) {
+	id, err := newID("whd_", 16)
+	if err != nil {
+		return nil, err
+	}
+	return &store.WebhookDelivery{
+		ID:             id,
+		EndpointID:     endpointID,
+		MerchantPubkey: merchant,
+		EventID:        eventID,
+		EventType:      eventType,
+		PaymentID:      paymentID,
+		Payload:        payload,
+		Status:         StatusPending,
+		NextAttemptAt:  now,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}, nil
+}
+
+// kick wakes the worker without waiting for its next tick.
+func (s *Service) kick() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// ProcessDeliveries sends the deliveries that are due and returns how many
+// were delivered. A failed attempt is retried later with backoff until
+// MaxAttempts, after which the delivery is dead.
+func (s *Service) ProcessDeliveries(ctx context.Context) (int, error) {
+	now := time.Now().UTC()
+	due, err := s.store.ListDueWebhookDeliveries(ctx, now, batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("list due webhook deliveries: %w", err)
+	}
+
+	delivered := 0
+	for _, d := range due {
+		if ctx.Err() != nil {
+			return delivered, ctx.Err()
+		}
+		claimed, err := s.store.ClaimWebhookDelivery(ctx, d.ID, now, now.Add(claimLease))
+		if err != nil {
+			slog.Error("failed to claim webhook delivery", "delivery_id", d.ID, "error", err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		final, err := s.attempt(ctx, d)
+		d.Attempts++
+		d.UpdatedAt = time.Now().UTC()
+		switch {
+		case err == nil:
+			d.Status = StatusDelivered
+			d.LastError = ""
+			delivered++
+		case final || d.Attempts >= MaxAttempts:
+			d.Status = StatusDead
+			d.LastError = err.Error()
+			slog.Warn("webhook delivery dead", "delivery_id", d.ID, "endpoint_id", d.EndpointID, "error", err)
+		default:
+			d.LastError = err.Error()
+			d.NextAttemptAt = d.UpdatedAt.Add(retryBase << (d.Attempts - 1))
+		}
+		if err := s.store.UpdateWebhookDelivery(ctx, d); err != nil {
+			slog.Error("failed to record webhook delivery", "delivery_id", d.ID, "error", err)
+		}
+	}
+	return delivered, nil
+}
+
+// attempt posts d to its endpoint once. final is set for errors that
+// retrying cannot fix.
+func (s *Service) attempt(ctx context.Context, d *store.WebhookDelivery) (final bool, err error) {
+	d.ResponseStatus = 0
+	endpoint, err := s.store.GetWebhookEndpoint(ctx, d.EndpointID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true, errors.New("endpoint was deleted")
+	}
+	if err != nil {
+		return false, fmt.Errorf("get webhook endpoint: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return true, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nostr-pay-webhooks")
+	req.Header.Set(HeaderEvent, d.EventType)
+	req.Header.Set(HeaderDelivery, d.ID)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(endpoint.Secret, timestamp, d.Payload))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	d.ResponseStatus = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	// Only the status is kept; the body is the endpoint's, which need not
+	// be a merchant's own server
+	return false, fmt.Errorf("endpoint returned %d", resp.StatusCode)
+}
+
+// RunWorker calls ProcessDeliveries every interval, and whenever an event
+// is queued, until ctx is done. Deliveries left pending by a restart are
+// picked up on the first run.
+func (s *Service) RunWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.ProcessDeliveries(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("webhook delivery failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+func newID(prefix string, n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate id: %w", err)
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,213 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nostr-pay/nostr-pay/internal/store"
+	"github.com/nostr-pay/nostr-pay/internal/webhook"
+)
+
+// receiver records the deliveries it gets and answers with status.
+type receiver struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	w.WriteHeader(rc.status)
+}
+
+func setup(t *testing.T) (store.Store, *webhook.Service, *receiver, *httptest.Server) {
+	t.Helper()
+	db, err := store.NewSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("NewSQLite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	rc := &receiver{status: http.StatusOK}
+	srv := httptest.NewServer(rc)
+	t.Cleanup(srv.Close)
+	return db, webhook.NewService(db, srv.Client()), rc, srv
+}
+
+func paidPayment() *store.Payment {
+	settled := time.Now().UTC()
+	return &store.Payment{
+		ID:             "pay_001",
+		AmountSats:     1000,
+		ReceiverPubkey: "merchant",
+		PaymentHash:    "hash_001",
+		Status:         "paid",
+		Direction:      "received",
+		SettledAt:      &settled,
+	}
+}
+
+func TestCreateEndpoint(t *testing.T) {
+	_, svc, _, _ := setup(t)
+	ctx := context.Background()
+
+	e, err := svc.CreateEndpoint(ctx, "merchant", "https://shop.example.com/hooks", []string{webhook.EventPaymentPaid, webhook.EventPaymentPaid})
+	if err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+	if !strings.HasPrefix(e.ID, "whe_") || !strings.HasPrefix(e.Secret, "whsec_") || len(e.Events) != 1 {
+		t.Errorf("endpoint = %+v", e)
+	}
+
+	for _, tt := range []struct {
+		name, url string
+		events    []string
+	}{
+		{"bad scheme", "ftp://shop.example.com", nil},
+		{"no host", "https://", nil},
+		{"credentials", "https://user:pw@shop.example.com", nil},
+		{"unknown event", "https://shop.example.com", []string{"payment.created"}},
+	} {
+		if _, err := svc.CreateEndpoint(ctx, "merchant", tt.url, tt.events); !errors.Is(err, webhook.ErrInvalidEndpoint) {
+			t.Errorf("%s: err = %v, want ErrInvalidEndpoint", tt.name, err)
+		}
+	}
+
+	if err := svc.DeleteEndpoint(ctx, e.ID, "someone-else"); !errors.Is(err, webhook.ErrEndpointNotFound) {
+		t.Errorf("delete another merchant's endpoint: err = %v", err)
+	}
+	if err := svc.DeleteEndpoint(ctx, e.ID, "merchant"); err != nil {
+		t.Errorf("DeleteEndpoint: %v", err)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	_, svc, rc, srv := setup(t)
+	ctx := context.Background()
+
+	all, _ := svc.CreateEndpoint(ctx, "merchant", srv.URL+"/all", nil)
+	svc.CreateEndpoint(ctx, "merchant", srv.URL+"/expired", []string{webhook.EventPaymentExpired})
+	svc.CreateEndpoint(ctx, "other", srv.URL+"/other", nil)
+
+	svc.PaymentChanged(ctx, paidPayment())
+	// Pending payments have no event
+	svc.PaymentChanged(ctx, &store.Payment{ID: "pay_002", ReceiverPubkey: "merchant", Status: "pending"})
+
+	n, err := svc.ProcessDeliveries(ctx)
+	if err != nil {
+		t.Fatalf("ProcessDeliveries: %v", err)
+	}
+	if n != 1 || len(rc.requests) != 1 {
+		t.Fatalf("delivered %d, received %d, want 1", n, len(rc.requests))
+	}
+
+	req, body := rc.requests[0], rc.bodies[0]
+	if req.URL.Path != "/all" || req.Header.Get(webhook.HeaderEvent) != webhook.EventPaymentPaid {
+		t.Errorf("request to %s for %s", req.URL.Path, req.Header.Get(webhook.HeaderEvent))
+	}
+	err = webhook.Verify(all.Secret, req.Header.Get(webhook.HeaderTimestamp), req.Header.Get(webhook.HeaderSignature), body, time.Now(), webhook.DefaultTolerance)
+	if err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	var event webhook.Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatalf("decode event: %v", err)
+	}
+	if event.Type != webhook.EventPaymentPaid || event.Data.ID != "pay_001" || event.Data.AmountSats != 1000 || event.Data.SettledAt == nil {
+		t.Errorf("event = %+v", event)
+	}
+
+	deliveries, _ := svc.ListDeliveries(ctx, "merchant", store.WebhookDeliveryFilter{Limit: 10})
+	if len(deliveries) != 1 || deliveries[0].Status != webhook.StatusDelivered || deliveries[0].ResponseStatus != 200 || deliveries[0].Attempts != 1 {
+		t.Errorf("deliveries = %+v", deliveries)
+	}
+	if deliveries[0].ID != req.Header.Get(webhook.HeaderDelivery) || deliveries[0].EventID != event.ID {
+		t.Errorf("delivery %s of event %s, request says %s of %s", deliveries[0].ID, deliveries[0].EventID, req.Header.Get(webhook.HeaderDelivery), event.ID)
+	}
+}
+
+func TestDeliver_RetryAndRedeliver(t *testing.T) {
+	db, svc, rc, srv := setup(t)
+	ctx := context.Background()
+
+	svc.CreateEndpoint(ctx, "merchant", srv.URL, nil)
+	svc.PaymentChanged(ctx, paidPayment())
+
+	rc.status = http.StatusInternalServerError
+	if n, _ := svc.ProcessDeliveries(ctx); n != 0 {
+		t.Fatalf("delivered %d, want 0", n)
+	}
+	deliveries, _ := svc.ListDeliveries(ctx, "merchant", store.WebhookDeliveryFilter{Limit: 10})
+	d := deliveries[0]
+	if d.Status != webhook.StatusPending || d.Attempts != 1 || d.ResponseStatus != 500 || !d.NextAttemptAt.After(time.Now()) {
+		t.Fatalf("delivery after failure = %+v, want pending and retried later", d)
+	}
+
+	// Not due yet
+	svc.ProcessDeliveries(ctx)
+	if len(rc.requests) != 1 {
+		t.Fatalf("retried before the delivery was due")
+	}
+
+	for range webhook.MaxAttempts - 1 {
+		d.NextAttemptAt = time.Now().Add(-time.Second)
+		db.UpdateWebhookDelivery(ctx, d)
+		svc.ProcessDeliveries(ctx)
+		d, _ = db.GetWebhookDelivery(ctx, d.ID)
+	}
+	if d.Status != webhook.StatusDead || d.Attempts != webhook.MaxAttempts {
+		t.Fatalf("delivery = %+v, want dead after %d attempts", d, webhook.MaxAttempts)
+	}
+
+	if _, err := svc.Redeliver(ctx, d.ID, "someone-else"); !errors.Is(err, webhook.ErrDeliveryNotFound) {
+		t.Errorf("redeliver another merchant's delivery: err = %v", err)
+	}
+	rc.status = http.StatusNoContent
+	again, err := svc.Redeliver(ctx, d.ID, "merchant")
+	if err != nil {
+		t.Fatalf("Redeliver: %v", err)
+	}
+	if n, _ := svc.ProcessDeliveries(ctx); n != 1 {
+		t.Fatalf("delivered %d on redelivery, want 1", n)
+	}
+	again, _ = db.GetWebhookDelivery(ctx, again.ID)
+	if again.Status != webhook.StatusDelivered || again.EventID != d.EventID || string(again.Payload) != string(d.Payload) {
+		t.Errorf("redelivery = %+v, want the same event delivered", again)
+	}
+
+	dead, _ := svc.ListDeliveries(ctx, "merchant", store.WebhookDeliveryFilter{Status: webhook.StatusDead, Limit: 10})
+	if len(dead) != 1 || dead[0].ID != d.ID {
+		t.Errorf("dead deliveries = %v, want the original", dead)
+	}
+}
+
+func TestDeliver_DeletedEndpoint(t *testing.T) {
+	_, svc, rc, srv := setup(t)
+	ctx := context.Background()
+
+	e, _ := svc.CreateEndpoint(ctx, "merchant", srv.URL, nil)
+	svc.PaymentChanged(ctx, paidPayment())
+	svc.DeleteEndpoint(ctx, e.ID, "merchant")
+
+	svc.ProcessDeliveries(ctx)
+	deliveries, _ := svc.ListDeliveries(ctx, "merchant", store.WebhookDeliveryFilter{Limit: 10})
+	if len(rc.requests) != 0 || deliveries[0].Status != webhook.StatusDead {
+		t.Errorf("sent %d requests, delivery = %+v, want dead without a request", len(rc.requests), deliveries[0])
+	}
+	if _, err := svc.Redeliver(ctx, deliveries[0].ID, "merchant"); !errors.Is(err, webhook.ErrEndpointNotFound) {
+		t.Errorf("redeliver to a deleted endpoint: err = %v", err)
+	}
+}
@@ -31,6 +31,22 @@ export interface CreateInvoiceResponse {
   payment_id: string
   bolt11: string
   payment_hash: string
+  expires_at: string
+  amount_sats: number
+  subtotal_sats: number
+  tip_sats: number
+  fiat_amount?: number
+  currency?: string
+  exchange_rate?: number
+}
+
+export interface PayInvoiceResponse {
+  payment_id: string
+  payment_hash: string
+  status: string
+  amount_sats: number
+  fee_sats: number
+  preimage?: string
 }
 
 export interface Payment {
@@ -44,17 +60,39 @@ export interface Payment {
   Status: string
   CreatedAt: string
   SettledAt: string | null
+  ExpiresAt: string | null
+  FiatAmount: number
+  FiatCurrency: string
+  ExchangeRate: number
+  RateSource: string
+  Direction: 'received' | 'sent'
+  Preimage: string
+  FeeSats: number
+  RefundOf: string
+  RefundedSats: number
+  SubtotalSats: number
+  TipSats: number
 }
 
 export const api = {
   health: () => apiFetch<{ status: string }>('/health'),
 
-  createInvoice: (amountSats: number, memo: string, token: string) =>
+  createInvoice: (amountSats: number, memo: string, token: string, tipPercent = 0) =>
     apiFetch<CreateInvoiceResponse>(
       '/payments/invoice',
       {
         method: 'POST',
-        body: JSON.stringify({ amount_sats: amountSats, memo }),
+        body: JSON.stringify({ amount_sats: amountSats, memo, tip_percent: tipPercent }),
+      },
+      token
+    ),
+
+  payInvoice: (bolt11: string, amountSats: number | undefined, token: string) =>
+    apiFetch<PayInvoiceResponse>(
+      '/payments/pay',
+      {
+        method: 'POST',
+        body: JSON.stringify({ bolt11, amount_sats: amountSats }),
       },
       token
     ),
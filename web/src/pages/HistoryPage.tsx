@@ -47,16 +47,26 @@ export function HistoryPage() {
               <div className="flex justify-between items-center">
                 <div>
                   <p className="font-bold">
-                    {p.Status === 'paid' ? '+' : ''}{p.AmountSats} sats
+                    {p.Status === 'paid' ? (p.Direction === 'sent' ? '-' : '+') : ''}
+                    {p.AmountSats} sats
                   </p>
+                  {p.RefundOf && <p className="text-xs text-gray-500">refund</p>}
+                  {p.RefundedSats > 0 && (
+                    <p className="text-xs text-gray-500">refunded {p.RefundedSats} sats</p>
+                  )}
+                  {p.Direction === 'sent' && p.FeeSats > 0 && (
+                    <p className="text-xs text-gray-500">fee {p.FeeSats} sats</p>
+                  )}
                   {p.Memo && <p className="text-sm text-gray-400">{p.Memo}</p>}
                 </div>
                 <span
                   className={`text-xs px-2 py-1 rounded ${
                     p.Status === 'paid'
                       ? 'bg-green-900 text-green-400'
-                      : p.Status === 'expired'
+                      : p.Status === 'expired' || p.Status === 'failed'
                       ? 'bg-red-900 text-red-400'
+                      : p.Status === 'refunded'
+                      ? 'bg-gray-800 text-gray-400'
                       : 'bg-yellow-900 text-yellow-400'
                   }`}
                 >
@@ -3,12 +3,16 @@ import { QRGenerator } from '../components/QRGenerator'
 import { api } from '../lib/api'
 import { useAuth } from '../stores/auth'
 
-type POSState = 'input' | 'waiting' | 'paid'
+type POSState = 'input' | 'tip' | 'waiting' | 'paid'
+
+// Tip percentages offered to the customer before the invoice is created
+const TIP_PRESETS = [10, 15, 20]
 
 export function MerchantPOS() {
   const [amount, setAmount] = useState('0')
   const [state, setState] = useState<POSState>('input')
   const [invoice, setInvoice] = useState<string | null>(null)
+  const [total, setTotal] = useState(0)
   const [error, setError] = useState<string | null>(null)
   const { createAuthToken, isLoggedIn } = useAuth()
 
@@ -29,17 +33,21 @@ export function MerchantPOS() {
     })
   }, [])
 
-  const handleCharge = async () => {
-    const sats = parseInt(amount)
-    if (sats <= 0) return
-
+  const handleCharge = () => {
+    if (parseInt(amount) <= 0) return
     setError(null)
+    setState('tip')
+  }
+
+  const handleTip = async (tipPercent: number) => {
+    const sats = parseInt(amount)
     setState('waiting')
 
     try {
       const url = `${window.location.origin}/api/payments/invoice`
       const token = createAuthToken(url, 'POST')
-      const result = await api.createInvoice(sats, `POS Payment`, token)
+      const result = await api.createInvoice(sats, `POS Payment`, token, tipPercent)
+      setTotal(result.amount_sats)
       setInvoice(result.bolt11)
 
       // Poll for payment status
@@ -51,6 +59,11 @@ export function MerchantPOS() {
           if (payment.Status === 'paid') {
             clearInterval(pollInterval)
             setState('paid')
+          } else if (payment.Status === 'expired') {
+            clearInterval(pollInterval)
+            setInvoice(null)
+            setError('Invoice expired')
+            setState('input')
           }
         } catch {
           // Ignore poll errors
@@ -71,6 +84,7 @@ export function MerchantPOS() {
     setAmount('0')
     setState('input')
     setInvoice(null)
+    setTotal(0)
     setError(null)
   }
 
@@ -80,7 +94,7 @@ export function MerchantPOS() {
       <div className="fixed inset-0 bg-green-950 flex flex-col items-center justify-center gap-6 z-50">
         <div className="text-6xl">&#10003;</div>
         <h2 className="text-4xl font-bold text-green-400">Paid!</h2>
-        <p className="text-2xl text-green-300">{parseInt(amount).toLocaleString()} sats</p>
+        <p className="text-2xl text-green-300">{total.toLocaleString()} sats</p>
         <button
           onClick={handleReset}
           className="mt-8 bg-green-800 hover:bg-green-700 text-white font-bold py-4 px-12 rounded-xl text-xl"
@@ -95,7 +109,12 @@ export function MerchantPOS() {
   if (state === 'waiting' && invoice) {
     return (
       <div className="fixed inset-0 bg-gray-950 flex flex-col items-center justify-center gap-6 z-50">
-        <h2 className="text-3xl font-bold">{parseInt(amount).toLocaleString()} sats</h2>
+        <h2 className="text-3xl font-bold">{total.toLocaleString()} sats</h2>
+        {total > parseInt(amount) && (
+          <p className="text-gray-400">
+            incl. {(total - parseInt(amount)).toLocaleString()} sats tip
+          </p>
+        )}
         <QRGenerator value={`lightning:${invoice}`} size={300} />
         <p className="text-gray-400 animate-pulse">Waiting for payment...</p>
         <button
@@ -108,6 +127,44 @@ export function MerchantPOS() {
     )
   }
 
+  // Tip selection state, shown to the customer
+  if (state === 'tip') {
+    const sats = parseInt(amount)
+    return (
+      <div className="fixed inset-0 bg-gray-950 flex flex-col items-center justify-center gap-6 z-50 p-4">
+        <p className="text-gray-500 text-sm">Subtotal</p>
+        <h2 className="text-4xl font-bold tabular-nums">{sats.toLocaleString()} sats</h2>
+        <p className="text-xl text-gray-300">Add a tip?</p>
+        <div className="grid grid-cols-3 gap-2 max-w-sm w-full">
+          {TIP_PRESETS.map((pct) => (
+            <button
+              key={pct}
+              onClick={() => handleTip(pct)}
+              className="bg-gray-900 hover:bg-gray-800 text-white font-bold py-5 rounded-xl active:bg-gray-700"
+            >
+              <span className="block text-2xl">{pct}%</span>
+              <span className="block text-sm text-gray-400">
+                +{Math.round((sats * pct) / 100).toLocaleString()}
+              </span>
+            </button>
+          ))}
+        </div>
+        <button
+          onClick={() => handleTip(0)}
+          className="w-full max-w-sm bg-gray-800 hover:bg-gray-700 text-white font-bold py-4 rounded-xl"
+        >
+          No tip
+        </button>
+        <button
+          onClick={() => setState('input')}
+          className="text-gray-600 hover:text-gray-400 text-sm mt-4"
+        >
+          Back
+        </button>
+      </div>
+    )
+  }
+
   // Numpad input state
   const numpadKeys = ['1', '2', '3', '4', '5', '6', '7', '8', '9', 'C', '0', '←']
 